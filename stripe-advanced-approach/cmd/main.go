@@ -8,7 +8,6 @@ import (
 	"github.com/darkphotonKN/stripe-advanced-approach/config"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/redis"
 	"github.com/joho/godotenv"
-	"github.com/stripe/stripe-go/v82"
 )
 
 func main() {
@@ -40,11 +39,22 @@ func main() {
 		log.Fatal("Failed to ping Redis:", err)
 	}
 
+	// cache in front of (or instead of) redis
+	cacheClient, invalidations := config.InitCache(ctx, redisClient)
+
 	// setup stripe
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	stripeClient := config.InitStripe()
+
+	// subcommands
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(ctx, db, cacheClient, invalidations, stripeClient, os.Args[2:]); err != nil {
+			log.Fatal("Failed to replay webhook events:", err)
+		}
+		return
+	}
 
 	// setup routes
-	router := config.SetupRoutes(db, redisClient)
+	router := config.SetupRoutes(ctx, db, cacheClient, invalidations, redisClient, stripeClient)
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8000"
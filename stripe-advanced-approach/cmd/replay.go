@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/database"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/invalidation"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/user"
+	"github.com/jmoiron/sqlx"
+	"github.com/stripe/stripe-go/v82"
+)
+
+/**
+* replay subcommand, re-runs stored webhook events through the payment service:
+*
+*	go run ./cmd replay --type payment_intent.succeeded --customer cus_123 --from 2025-01-01T00:00:00Z --state failed --dry-run
+*
+* Prints the replay result as JSON.
+**/
+func runReplay(ctx context.Context, db *sqlx.DB, cacheClient interfaces.Cache, invalidations *invalidation.Bus, stripeClient *stripe.Client, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+
+	eventType := flags.String("type", "", "only replay events of this type")
+	customerID := flags.String("customer", "", "only replay events of this stripe customer")
+	from := flags.String("from", "", "only replay events received at or after this time (RFC3339)")
+	to := flags.String("to", "", "only replay events received before this time (RFC3339)")
+	state := flags.String("state", "", "only replay events in this state: processed, failed or pending")
+	limit := flags.Int("limit", 100, "maximum number of events to replay")
+	dryRun := flags.Bool("dry-run", false, "report the rows and cache keys that would change without writing")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	request := &payment.WebhookReplayRequest{
+		EventType:  *eventType,
+		CustomerID: *customerID,
+		State:      *state,
+		Limit:      *limit,
+		DryRun:     *dryRun,
+	}
+
+	var err error
+	if request.From, err = parseReplayTime(*from); err != nil {
+		return fmt.Errorf("invalid --from: %w", err)
+	}
+
+	if request.To, err = parseReplayTime(*to); err != nil {
+		return fmt.Errorf("invalid --to: %w", err)
+	}
+
+	// same wiring as the http server, webhooks are replayed inline
+	unitOfWork := database.NewUnitOfWork(db)
+	userRepo := user.NewRepository(db)
+	userService := user.NewService(userRepo, unitOfWork)
+	paymentService := payment.NewService(payment.NewRepository(db), unitOfWork, userService, payment.NewStripeProcessor(stripeClient), cacheClient)
+	paymentService.SetInvalidationBus(invalidations)
+	userService.SetPaymentService(paymentService)
+
+	res, err := paymentService.ReplayWebhookEvents(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(res)
+}
+
+func parseReplayTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parsed, nil
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cache"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cachekey"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/invalidation"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/redis"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
+)
+
+/**
+* Cache backend selected by CACHE_BACKEND:
+*
+* - "redis" (default) shares the cache between every instance
+* - "memory" keeps it in process, for single-node deploys
+* - "tiered" keeps the userId ↔ customerId mappings in process in front of redis
+*
+* Along with the invalidation bus announcing rewritten keys to every instance, whose in-process copies listen on it.
+**/
+func InitCache(ctx context.Context, redisClient *redis.Client) (interfaces.Cache, *invalidation.Bus) {
+	keys := cachekey.FromEnv()
+
+	var cacheClient interfaces.Cache = redisClient
+	var pubsub interfaces.PubSub = redisClient
+	var listeners []invalidation.Listener
+
+	switch util.GetEnv("CACHE_BACKEND", "redis") {
+	case "memory":
+		memory := cache.NewMemory(util.GetEnvAsInt("CACHE_MEMORY_MAX_ENTRIES", 0))
+		cacheClient, pubsub = memory, memory
+
+	case "tiered":
+		tiered := cache.NewTiered(redisClient, cache.TieredConfig{
+			MaxEntries:   util.GetEnvAsInt("CACHE_LOCAL_MAX_ENTRIES", 10000),
+			LocalTTL:     time.Duration(util.GetEnvAsInt("CACHE_LOCAL_TTL_SECONDS", 60)) * time.Second,
+			CacheLocally: keys.IsMapping,
+		})
+		cacheClient = tiered
+		listeners = append(listeners, tiered)
+	}
+
+	invalidations := invalidation.NewBus(pubsub, keys.InvalidationChannel())
+
+	for _, listener := range listeners {
+		invalidations.AddListener(listener)
+	}
+
+	go func() {
+		if err := invalidations.Run(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("\nError when listening for cache invalidations: %+v\n\n", err)
+		}
+	}()
+
+	return cacheClient, invalidations
+}
@@ -11,16 +11,22 @@ import (
 	_ "github.com/lib/pq"
 )
 
-func InitDB() (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+// connections of the application, the customer_changed triggers leave their writes alone (migration 000015)
+const DatabaseApplicationName = "stripe-advanced-approach"
+
+func DatabaseDSN() string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable application_name=%s",
 		os.Getenv("DB_HOST"),
 		os.Getenv("DB_PORT"),
 		os.Getenv("DB_USER"),
 		os.Getenv("DB_PASSWORD"),
 		os.Getenv("DB_NAME"),
+		DatabaseApplicationName,
 	)
+}
 
-	db, err := sqlx.Connect("postgres", dsn)
+func InitDB() (*sqlx.DB, error) {
+	db, err := sqlx.Connect("postgres", DatabaseDSN())
 	if err != nil {
 		return nil, err
 	}
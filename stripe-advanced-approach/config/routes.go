@@ -1,19 +1,26 @@
 package config
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
+	"github.com/stripe/stripe-go/v82"
 
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/database"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/invalidation"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/middleware"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/pgnotify"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/user"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
 )
 
-func SetupRoutes(db *sqlx.DB, cacheClient interfaces.Cache) *gin.Engine {
+func SetupRoutes(ctx context.Context, db *sqlx.DB, cacheClient interfaces.Cache, invalidations *invalidation.Bus, queue interfaces.Queue, stripeClient *stripe.Client) *gin.Engine {
 	router := gin.Default()
 
 	// NOTE: debugging middleware
@@ -38,9 +45,12 @@ func SetupRoutes(db *sqlx.DB, cacheClient interfaces.Cache) *gin.Engine {
 
 	api := router.Group("/api")
 
+	// transactions shared by the user and payment repositories
+	unitOfWork := database.NewUnitOfWork(db)
+
 	// user setup
 	userRepo := user.NewRepository(db)
-	userService := user.NewService(userRepo)
+	userService := user.NewService(userRepo, unitOfWork)
 	userHandler := user.NewHandler(userService)
 	api.POST("/signup", userHandler.SignUp)
 	api.POST("/signin", userHandler.SignIn)
@@ -55,18 +65,63 @@ func SetupRoutes(db *sqlx.DB, cacheClient interfaces.Cache) *gin.Engine {
 	protected.DELETE("/users/:id", userHandler.Delete)
 
 	// payment setup
-	stripeProcessor := payment.NewStripeProcessor()
+	stripeProcessor := payment.NewStripeProcessor(stripeClient)
 	paymentRepository := payment.NewRepository(db)
-	paymentService := payment.NewService(paymentRepository, userService, stripeProcessor, cacheClient)
+	paymentService := payment.NewService(paymentRepository, unitOfWork, userService, stripeProcessor, cacheClient)
+
+	paymentService.SetInvalidationBus(invalidations)
 
 	// injecting proper payment service after completing payment service initialization
 	userService.SetPaymentService(paymentService)
 
+	// webhooks are processed by background workers unless explicitly disabled
+	if util.GetEnv("WEBHOOK_QUEUE_ENABLED", "true") == "true" {
+		webhookQueue := payment.NewWebhookQueue(queue, paymentService, payment.DefaultWebhookQueueConfig())
+		paymentService.SetWebhookQueue(webhookQueue)
+
+		go func() {
+			if err := webhookQueue.Run(ctx); err != nil && ctx.Err() == nil {
+				fmt.Printf("\nError when running webhook queue: %+v\n\n", err)
+			}
+		}()
+	}
+
+	// rebuilds the cache after a flush and checks it against postgres and stripe
+	if util.GetEnv("CACHE_WARMER_ENABLED", "true") == "true" {
+		go func() {
+			if err := paymentService.RunCacheWarmer(ctx, payment.DefaultCacheWarmerConfig()); err != nil && ctx.Err() == nil {
+				fmt.Printf("\nError when running cache warmer: %+v\n\n", err)
+			}
+		}()
+	}
+
+	go func() {
+		if err := paymentService.RunConsistencyChecks(ctx, payment.DefaultConsistencyCheckConfig()); err != nil && ctx.Err() == nil {
+			fmt.Printf("\nError when running cache consistency checks: %+v\n\n", err)
+		}
+	}()
+
+	// rows fixed by hand in SQL drop their customer's cached copies
+	if util.GetEnv("CUSTOMER_CHANGE_LISTENER_ENABLED", "true") == "true" {
+		rebuild := util.GetEnv("CUSTOMER_CHANGE_REBUILD", "false") == "true"
+
+		customerChanges := pgnotify.NewListener(DatabaseDSN(), pgnotify.DefaultListenerConfig(), func(ctx context.Context, customerId string) error {
+			return paymentService.InvalidateCustomer(ctx, customerId, rebuild)
+		})
+
+		go func() {
+			if err := customerChanges.Run(ctx); err != nil && ctx.Err() == nil {
+				fmt.Printf("\nError when running customer change listener: %+v\n\n", err)
+			}
+		}()
+	}
+
 	paymentHandler := payment.NewHandler(paymentService)
 
 	// for stripe webhooks
 	stripeWebhookAPI := router.Group("/")
 	stripeWebhookAPI.POST("/webhook/stripe", paymentHandler.HandleStripeWebhook)
+	stripeWebhookAPI.POST("/webhook/stripe/connect", paymentHandler.HandleStripeConnectWebhook)
 
 	// payment service endpoints
 	paymentRoutes := protected.Group("/payment")
@@ -82,6 +137,23 @@ func SetupRoutes(db *sqlx.DB, cacheClient interfaces.Cache) *gin.Engine {
 	// subscription endpoints (part of payment service)
 	paymentRoutes.POST("/subscription/subscribe", paymentHandler.Subscribe)
 	paymentRoutes.GET("/subscription/status", paymentHandler.GetSubscriptionStatus)
+	paymentRoutes.GET("/subscription", paymentHandler.GetActiveSubscription)
+	paymentRoutes.POST("/subscription/cancel", paymentHandler.CancelSubscription)
+	paymentRoutes.POST("/subscription/resume", paymentHandler.ResumeSubscription)
+	paymentRoutes.POST("/subscription/pause", paymentHandler.PauseSubscription)
+	paymentRoutes.POST("/subscription/unpause", paymentHandler.UnpauseSubscription)
+	paymentRoutes.POST("/subscription/change-plan", paymentHandler.ChangePlan)
+	paymentRoutes.POST("/subscription/change-plan/preview", paymentHandler.PreviewPlanChange)
+
+	// admin endpoints
+	adminRoutes := router.Group("/admin")
+	adminRoutes.Use(middleware.AdminMiddleware())
+	adminRoutes.GET("/metrics", gin.WrapH(expvar.Handler()))
+	adminRoutes.GET("/webhooks/dead-letters", paymentHandler.ListWebhookDeadLetters)
+	adminRoutes.POST("/webhooks/dead-letters/:id/redrive", paymentHandler.RedriveWebhookDeadLetter)
+	adminRoutes.POST("/webhooks/replay", paymentHandler.ReplayWebhookEvents)
+	adminRoutes.POST("/cache/warm", paymentHandler.WarmCache)
+	adminRoutes.POST("/cache/check", paymentHandler.CheckCacheConsistency)
 
 	return router
 }
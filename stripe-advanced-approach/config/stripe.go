@@ -0,0 +1,18 @@
+package config
+
+import (
+	"os"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/stripe/stripe-go/v82"
+)
+
+/**
+* Builds the stripe client for the platform account from the environment.
+*
+* STRIPE_API_BASE_URL is optional and only needed to point the app at something other than
+* api.stripe.com, such as a local stripe-mock container.
+**/
+func InitStripe() *stripe.Client {
+	return payment.NewStripeClient(os.Getenv("STRIPE_SECRET_KEY"), os.Getenv("STRIPE_API_BASE_URL"))
+}
@@ -0,0 +1,461 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/codec"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+)
+
+/**
+* In-process interfaces.Cache for tests and single-node deploys, and the local tier of Tiered.
+*
+* Values are stored as strings like redis does. Expired entries are dropped when read and swept every so often on
+* writes, and with maxEntries set the least recently used entries are evicted beyond it. It also implements
+* interfaces.PubSub between subscribers of the same process.
+**/
+type Memory struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	recent     *list.List // most recently used first
+	writes     int
+
+	subscribers map[string][]chan string
+}
+
+type memoryEntry struct {
+	key       string
+	value     string
+	hash      map[string]*memoryField // nil unless the key holds a hash
+	floors    map[string]int64        // version of the last replacement of each pattern of the hash
+	expiresAt time.Time               // zero for no expiration
+}
+
+// deleted fields keep their version until their pattern is replaced, like in the redis implementation
+type memoryField struct {
+	value   string
+	version int64
+	deleted bool
+}
+
+// what redis answers when a key is read as the wrong type
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+var _ interfaces.Cache = (*Memory)(nil)
+var _ interfaces.PubSub = (*Memory)(nil)
+
+// writes between sweeps of expired entries
+const memorySweepInterval = 1024
+
+// maxEntries of 0 keeps every entry until it expires or is deleted
+func NewMemory(maxEntries int) *Memory {
+	return &Memory{
+		maxEntries:  maxEntries,
+		entries:     map[string]*list.Element{},
+		recent:      list.New(),
+		subscribers: map[string][]chan string{},
+	}
+}
+
+func (m *Memory) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	stored, err := stringValue(value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.set(key, stored, expiration)
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		return "", interfaces.ErrCacheMiss
+	}
+
+	if entry.hash != nil {
+		return "", errWrongType
+	}
+
+	return entry.value, nil
+}
+
+func (m *Memory) Del(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		m.remove(key)
+	}
+
+	return nil
+}
+
+func (m *Memory) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error) {
+	stored, err := stringValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.get(key) != nil {
+		return false, nil
+	}
+
+	m.set(key, stored, expiration)
+	return true, nil
+}
+
+// same rule as the redis script, values without a version are replaced
+func (m *Memory) SetIfNewer(ctx context.Context, key string, value []byte, version int64, expiration time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry := m.get(key); entry != nil {
+		if current, versioned := codec.Version([]byte(entry.value)); versioned && current > version {
+			return false, nil
+		}
+	}
+
+	m.set(key, string(value), expiration)
+	return true, nil
+}
+
+func (m *Memory) ExpireIfEqual(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil || entry.value != value {
+		return false, nil
+	}
+
+	entry.expiresAt = expiresAt(expiration)
+	return true, nil
+}
+
+func (m *Memory) DelIfEqual(ctx context.Context, key string, value string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil || entry.value != value {
+		return false, nil
+	}
+
+	m.remove(key)
+	return true, nil
+}
+
+func (m *Memory) HGet(ctx context.Context, key string, fields ...string) (map[string]interfaces.HashField, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		return nil, interfaces.ErrCacheMiss
+	}
+
+	if entry.hash == nil {
+		return nil, errWrongType
+	}
+
+	hash := map[string]interfaces.HashField{}
+
+	for name, field := range entry.hash {
+		if !field.deleted && FieldSelected(name, fields) {
+			hash[name] = interfaces.HashField{Value: field.value, Version: field.version}
+		}
+	}
+
+	return hash, nil
+}
+
+func (m *Memory) HSetIfNewer(ctx context.Context, key string, fields map[string][]byte, version int64, expiration time.Duration) ([]string, error) {
+	return m.HReplaceIfNewer(ctx, key, fields, nil, version, expiration)
+}
+
+func (m *Memory) HReplaceIfNewer(ctx context.Context, key string, fields map[string][]byte, replace []string, version int64, expiration time.Duration) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+
+	if entry != nil && entry.hash == nil {
+		return nil, errWrongType
+	}
+
+	if entry == nil {
+		entry = &memoryEntry{hash: map[string]*memoryField{}}
+	}
+
+	var written []string
+
+	for name, value := range fields {
+		if current, known := entry.fieldVersion(name); known && current > version {
+			continue
+		}
+
+		entry.hash[name] = &memoryField{value: string(value), version: version, deleted: value == nil}
+		written = append(written, name)
+	}
+
+	if len(replace) > 0 {
+		for name, field := range entry.hash {
+			if field.version > version || !FieldSelected(name, replace) {
+				continue
+			}
+
+			if _, listed := fields[name]; !listed && !field.deleted {
+				written = append(written, name)
+			}
+
+			// the floor keeps older writes out
+			if _, listed := fields[name]; !listed || field.deleted {
+				delete(entry.hash, name)
+			}
+		}
+
+		if entry.floors == nil {
+			entry.floors = map[string]int64{}
+		}
+
+		for _, pattern := range replace {
+			entry.floors[pattern] = max(entry.floors[pattern], version)
+		}
+	}
+
+	if len(written) == 0 && len(replace) == 0 {
+		return nil, nil
+	}
+
+	if m.get(key) == nil {
+		m.set(key, "", expiration)
+		stored := m.entries[key].Value.(*memoryEntry)
+		stored.hash, stored.floors = entry.hash, entry.floors
+	} else if expiration > 0 {
+		entry.expiresAt = expiresAt(expiration)
+	}
+
+	return written, nil
+}
+
+// the version a field was written with, or the newest replacement of a pattern selecting it
+func (e *memoryEntry) fieldVersion(name string) (int64, bool) {
+	if field, exists := e.hash[name]; exists {
+		return field.version, true
+	}
+
+	var floor int64
+	known := false
+
+	for pattern, version := range e.floors {
+		if FieldSelected(name, []string{pattern}) && (!known || version > floor) {
+			floor, known = version, true
+		}
+	}
+
+	return floor, known
+}
+
+/**
+* Whether a hash field is selected by fields as passed to interfaces.Cache HGet: named in it, starting with a
+* name ending with *, or fields is empty.
+**/
+func FieldSelected(field string, fields []string) bool {
+	if len(fields) == 0 {
+		return true
+	}
+
+	for _, wanted := range fields {
+		if prefix, isPrefix := strings.CutSuffix(wanted, "*"); isPrefix && strings.HasPrefix(field, prefix) {
+			return true
+		}
+
+		if field == wanted {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Len returns the number of entries held, including expired ones not swept yet
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.entries)
+}
+
+// Clear drops every entry
+func (m *Memory) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = map[string]*list.Element{}
+	m.recent.Init()
+}
+
+// --- pub/sub ---
+
+// Broadcast delivers message to every current subscriber of channel, dropping it for subscribers that are behind
+func (m *Memory) Broadcast(ctx context.Context, channel string, message string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, subscriber := range m.subscribers[channel] {
+		select {
+		case subscriber <- message:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	messages := make(chan string, 64)
+
+	m.mu.Lock()
+	m.subscribers[channel] = append(m.subscribers[channel], messages)
+	m.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		subscribers := m.subscribers[channel]
+		for index, subscriber := range subscribers {
+			if subscriber == messages {
+				m.subscribers[channel] = append(subscribers[:index], subscribers[index+1:]...)
+				break
+			}
+		}
+
+		close(messages)
+	}()
+
+	return messages, nil
+}
+
+// --- entries, callers hold mu ---
+
+func (m *Memory) get(key string) *memoryEntry {
+	element, exists := m.entries[key]
+	if !exists {
+		return nil
+	}
+
+	entry := element.Value.(*memoryEntry)
+
+	if entry.expired(time.Now()) {
+		m.remove(key)
+		return nil
+	}
+
+	m.recent.MoveToFront(element)
+	return entry
+}
+
+func (m *Memory) set(key string, value string, expiration time.Duration) {
+	if element, exists := m.entries[key]; exists {
+		entry := element.Value.(*memoryEntry)
+		entry.value = value
+		entry.hash = nil
+		entry.expiresAt = expiresAt(expiration)
+
+		m.recent.MoveToFront(element)
+	} else {
+		m.entries[key] = m.recent.PushFront(&memoryEntry{key: key, value: value, expiresAt: expiresAt(expiration)})
+	}
+
+	m.writes++
+	if m.writes%memorySweepInterval == 0 {
+		m.sweep()
+	}
+
+	for m.maxEntries > 0 && len(m.entries) > m.maxEntries {
+		m.remove(m.recent.Back().Value.(*memoryEntry).key)
+	}
+}
+
+func (m *Memory) remove(key string) {
+	if element, exists := m.entries[key]; exists {
+		m.recent.Remove(element)
+		delete(m.entries, key)
+	}
+}
+
+func (m *Memory) sweep() {
+	now := time.Now()
+
+	for key, element := range m.entries {
+		if element.Value.(*memoryEntry).expired(now) {
+			m.remove(key)
+		}
+	}
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+func expiresAt(expiration time.Duration) time.Time {
+	if expiration <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(expiration)
+}
+
+// the string redis would store for value
+func stringValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case fmt.Stringer:
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported cache value type %T", value)
+	}
+}
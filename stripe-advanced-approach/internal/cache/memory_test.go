@@ -0,0 +1,172 @@
+package cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cache"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMemoryExpiresEntries checks entries disappear after their expiration and live forever without one
+func TestMemoryExpiresEntries(t *testing.T) {
+	memory := cache.NewMemory(0)
+	ctx := t.Context()
+
+	require.NoError(t, memory.Set(ctx, "short", "value", 50*time.Millisecond))
+	require.NoError(t, memory.Set(ctx, "forever", []byte("value"), 0))
+
+	value, err := memory.Get(ctx, "short")
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = memory.Get(ctx, "short")
+	assert.ErrorIs(t, err, interfaces.ErrCacheMiss)
+
+	value, err = memory.Get(ctx, "forever")
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	// expired keys can be taken again
+	require.NoError(t, memory.Set(ctx, "lock", "a", 50*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+
+	acquired, err := memory.SetNX(ctx, "lock", "b", time.Second)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+}
+
+// TestMemoryEvictsLeastRecentlyUsed checks the oldest untouched entry makes room for new ones
+func TestMemoryEvictsLeastRecentlyUsed(t *testing.T) {
+	memory := cache.NewMemory(2)
+	ctx := t.Context()
+
+	require.NoError(t, memory.Set(ctx, "a", "1", 0))
+	require.NoError(t, memory.Set(ctx, "b", "2", 0))
+
+	_, err := memory.Get(ctx, "a")
+	require.NoError(t, err)
+
+	require.NoError(t, memory.Set(ctx, "c", "3", 0))
+
+	_, err = memory.Get(ctx, "b")
+	assert.ErrorIs(t, err, interfaces.ErrCacheMiss, "least recently used entry is evicted")
+
+	_, err = memory.Get(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, memory.Len())
+}
+
+// TestMemorySetIfNewerKeepsNewerVersions checks the ordering guard matches the redis implementation
+func TestMemorySetIfNewerKeepsNewerVersions(t *testing.T) {
+	memory := cache.NewMemory(0)
+	ctx := t.Context()
+
+	stored, err := memory.SetIfNewer(ctx, "data", []byte(`{"version":20,"status":"active"}`), 20, 0)
+	require.NoError(t, err)
+	assert.True(t, stored)
+
+	stored, err = memory.SetIfNewer(ctx, "data", []byte(`{"version":10,"status":"incomplete"}`), 10, 0)
+	require.NoError(t, err)
+	assert.False(t, stored)
+
+	stored, err = memory.SetIfNewer(ctx, "data", []byte(`{"version":20,"status":"canceled"}`), 20, 0)
+	require.NoError(t, err)
+	assert.True(t, stored, "equal versions are replaced")
+
+	value, err := memory.Get(ctx, "data")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version":20,"status":"canceled"}`, value)
+}
+
+// TestMemoryHashFieldsKeepNewerVersions checks hash fields are guarded one by one, deleted ones included
+func TestMemoryHashFieldsKeepNewerVersions(t *testing.T) {
+	memory := cache.NewMemory(0)
+	ctx := t.Context()
+
+	_, err := memory.HGet(ctx, "customer")
+	assert.ErrorIs(t, err, interfaces.ErrCacheMiss)
+
+	written, err := memory.HSetIfNewer(ctx, "customer", map[string][]byte{
+		"profile":   []byte("v10"),
+		"sub:sub_1": []byte("active"),
+		"sub:sub_2": []byte("trialing"),
+	}, 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, written, 3)
+
+	// a webhook newer than the next sync
+	written, err = memory.HSetIfNewer(ctx, "customer", map[string][]byte{"sub:sub_1": []byte("past_due")}, 30, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sub:sub_1"}, written)
+
+	written, err = memory.HSetIfNewer(ctx, "customer", map[string][]byte{
+		"profile":   []byte("v20"),
+		"sub:sub_1": []byte("active"),
+		"sub:sub_2": nil,
+	}, 20, 0)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"profile", "sub:sub_2"}, written)
+
+	// older than the deletion
+	written, err = memory.HSetIfNewer(ctx, "customer", map[string][]byte{"sub:sub_2": []byte("trialing")}, 15, 0)
+	require.NoError(t, err)
+	assert.Empty(t, written)
+
+	subs, err := memory.HGet(ctx, "customer", "sub:*")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interfaces.HashField{"sub:sub_1": {Value: "past_due", Version: 30}}, subs)
+
+	hash, err := memory.HGet(ctx, "customer")
+	require.NoError(t, err)
+	assert.Equal(t, interfaces.HashField{Value: "v20", Version: 20}, hash["profile"])
+	assert.Len(t, hash, 2)
+}
+
+// TestMemoryReplaceDropsUnlistedFields checks a replacement prunes unlisted and deleted fields yet keeps older writes out
+func TestMemoryReplaceDropsUnlistedFields(t *testing.T) {
+	memory := cache.NewMemory(0)
+	ctx := t.Context()
+
+	_, err := memory.HSetIfNewer(ctx, "customer", map[string][]byte{
+		"sub:sub_1":    []byte("active"),
+		"sub:sub_2":    []byte("active"),
+		"payment:pi_1": []byte("succeeded"),
+	}, 10, 0)
+	require.NoError(t, err)
+
+	_, err = memory.HSetIfNewer(ctx, "customer", map[string][]byte{"sub:sub_2": nil}, 15, 0)
+	require.NoError(t, err)
+
+	// a webhook newer than the replacement
+	_, err = memory.HSetIfNewer(ctx, "customer", map[string][]byte{"sub:sub_3": []byte("trialing")}, 30, 0)
+	require.NoError(t, err)
+
+	written, err := memory.HReplaceIfNewer(ctx, "customer", map[string][]byte{"synced": []byte("20")}, []string{"sub:*"}, 20, 0)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"synced", "sub:sub_1"}, written, "the tombstone of sub_2 is dropped silently")
+
+	hash, err := memory.HGet(ctx, "customer")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interfaces.HashField{
+		"synced":       {Value: "20", Version: 20},
+		"sub:sub_3":    {Value: "trialing", Version: 30},
+		"payment:pi_1": {Value: "succeeded", Version: 10},
+	}, hash)
+
+	// older than the replacement, for fields it dropped and ones it never saw
+	written, err = memory.HSetIfNewer(ctx, "customer", map[string][]byte{
+		"sub:sub_1": []byte("active"),
+		"sub:sub_4": []byte("active"),
+	}, 18, 0)
+	require.NoError(t, err)
+	assert.Empty(t, written)
+
+	written, err = memory.HSetIfNewer(ctx, "customer", map[string][]byte{"sub:sub_4": []byte("active")}, 25, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sub:sub_4"}, written)
+}
@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+)
+
+/**
+* Two-tier interfaces.Cache: a bounded in-process LRU in front of a shared cache (redis).
+*
+* Only keys selected by CacheLocally are kept locally, every other key and every write goes to the shared cache.
+* Writes drop the local copy of the key, copies on other instances are dropped through the invalidation bus the
+* writers publish to (Tiered is an invalidation.Listener). Local copies also expire after LocalTTL, which bounds
+* how long an invalidation lost on the way can serve stale data.
+**/
+type Tiered struct {
+	remote interfaces.Cache
+	local  *Memory
+	config TieredConfig
+
+	// bumped by every eviction, reads only fill the local tier when nothing was evicted since they started
+	evictions atomic.Int64
+}
+
+type TieredConfig struct {
+	MaxEntries   int
+	LocalTTL     time.Duration
+	CacheLocally func(key string) bool
+}
+
+var _ interfaces.Cache = (*Tiered)(nil)
+
+func NewTiered(remote interfaces.Cache, config TieredConfig) *Tiered {
+	return &Tiered{
+		remote: remote,
+		local:  NewMemory(config.MaxEntries),
+		config: config,
+	}
+}
+
+func (t *Tiered) Get(ctx context.Context, key string) (string, error) {
+	if !t.config.CacheLocally(key) {
+		return t.remote.Get(ctx, key)
+	}
+
+	if value, err := t.local.Get(ctx, key); err == nil {
+		return value, nil
+	}
+
+	evictions := t.evictions.Load()
+
+	value, err := t.remote.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	// an invalidation may have passed while reading, the value read could be the old one
+	if t.evictions.Load() == evictions {
+		t.local.Set(ctx, key, value, t.config.LocalTTL)
+	}
+
+	return value, nil
+}
+
+func (t *Tiered) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	if err := t.remote.Set(ctx, key, value, expiration); err != nil {
+		return err
+	}
+
+	t.Evict(key)
+	return nil
+}
+
+func (t *Tiered) Del(ctx context.Context, keys ...string) error {
+	if err := t.remote.Del(ctx, keys...); err != nil {
+		return err
+	}
+
+	t.Evict(keys...)
+	return nil
+}
+
+func (t *Tiered) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error) {
+	stored, err := t.remote.SetNX(ctx, key, value, expiration)
+	if err != nil || !stored {
+		return stored, err
+	}
+
+	t.Evict(key)
+	return true, nil
+}
+
+func (t *Tiered) SetIfNewer(ctx context.Context, key string, value []byte, version int64, expiration time.Duration) (bool, error) {
+	stored, err := t.remote.SetIfNewer(ctx, key, value, version, expiration)
+	if err != nil || !stored {
+		return stored, err
+	}
+
+	t.Evict(key)
+	return true, nil
+}
+
+// the value doesn't change, local copies stay valid
+func (t *Tiered) ExpireIfEqual(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	return t.remote.ExpireIfEqual(ctx, key, value, expiration)
+}
+
+func (t *Tiered) DelIfEqual(ctx context.Context, key string, value string) (bool, error) {
+	deleted, err := t.remote.DelIfEqual(ctx, key, value)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+
+	t.Evict(key)
+	return true, nil
+}
+
+// hashes are only kept in the shared cache
+func (t *Tiered) HGet(ctx context.Context, key string, fields ...string) (map[string]interfaces.HashField, error) {
+	return t.remote.HGet(ctx, key, fields...)
+}
+
+func (t *Tiered) HSetIfNewer(ctx context.Context, key string, fields map[string][]byte, version int64, expiration time.Duration) ([]string, error) {
+	written, err := t.remote.HSetIfNewer(ctx, key, fields, version, expiration)
+	if err != nil || len(written) == 0 {
+		return written, err
+	}
+
+	t.Evict(key)
+	return written, nil
+}
+
+func (t *Tiered) HReplaceIfNewer(ctx context.Context, key string, fields map[string][]byte, replace []string, version int64, expiration time.Duration) ([]string, error) {
+	written, err := t.remote.HReplaceIfNewer(ctx, key, fields, replace, version, expiration)
+	if err != nil || len(written) == 0 {
+		return written, err
+	}
+
+	t.Evict(key)
+	return written, nil
+}
+
+func (t *Tiered) Close() error {
+	return t.remote.Close()
+}
+
+func (t *Tiered) Ping(ctx context.Context) error {
+	return t.remote.Ping(ctx)
+}
+
+// --- invalidation.Listener ---
+
+func (t *Tiered) Evict(keys ...string) {
+	t.evictions.Add(1)
+	t.local.Del(context.Background(), keys...)
+}
+
+func (t *Tiered) EvictAll() {
+	t.evictions.Add(1)
+	t.local.Clear()
+}
@@ -0,0 +1,50 @@
+package cache_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTieredServesLocalCopies checks repeated reads of local keys don't reach the shared cache
+func TestTieredServesLocalCopies(t *testing.T) {
+	remote := cache.NewMemory(0)
+	tiered := cache.NewTiered(remote, cache.TieredConfig{
+		MaxEntries:   100,
+		LocalTTL:     time.Minute,
+		CacheLocally: func(key string) bool { return strings.HasPrefix(key, "mapping:") },
+	})
+	ctx := t.Context()
+
+	require.NoError(t, tiered.Set(ctx, "mapping:user", "cus_1", 0))
+
+	value, err := tiered.Get(ctx, "mapping:user")
+	require.NoError(t, err)
+	assert.Equal(t, "cus_1", value)
+
+	// changed behind the tier's back, the local copy is still served
+	require.NoError(t, remote.Set(ctx, "mapping:user", "cus_changed", 0))
+
+	value, err = tiered.Get(ctx, "mapping:user")
+	require.NoError(t, err)
+	assert.Equal(t, "cus_1", value)
+
+	// until it is evicted
+	tiered.Evict("mapping:user")
+
+	value, err = tiered.Get(ctx, "mapping:user")
+	require.NoError(t, err)
+	assert.Equal(t, "cus_changed", value)
+
+	// other keys always read through
+	require.NoError(t, tiered.Set(ctx, "data:user", "v1", 0))
+	require.NoError(t, remote.Set(ctx, "data:user", "v2", 0))
+
+	value, err = tiered.Get(ctx, "data:user")
+	require.NoError(t, err)
+	assert.Equal(t, "v2", value)
+}
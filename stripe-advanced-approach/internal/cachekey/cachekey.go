@@ -0,0 +1,181 @@
+package cachekey
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
+)
+
+/**
+* Key schema of the cache.
+*
+* Every key is prefixed with the environment and tenant ({env}:{tenant}:) so deployments sharing one redis never
+* read each other's data:
+*
+* -- Data --
+* - 1. stripe:customer:v{CustomerDataVersion}:{customerId} → hash of the customer's stripe data, one field per part
+*   (payment.StripeCacheData, see the payment package's customer_cache.go)
+* - 2. stripe:products → active products with their prices (invalidated by product / price webhooks)
+*
+* -- Key Mappings --
+* - 3. stripe:customer:{customerId}:userid → userId (customerId → userId lookup)
+* - 4. stripe:customer:userid:{userId} → customerId (userId → customerId lookup)
+*
+* -- Sync coordination between instances --
+* - 5. stripe:sync:lock:{customerId} → token of the instance currently syncing the customer
+* - 6. stripe:sync:pending:{customerId} → set when a sync was requested while one was running
+*
+* -- Maintenance --
+* - 7. cache:warmed → set by the cache warmer, gone after a flush or failover that lost the data
+* - 8. cache:warm:lock → token of the instance warming the cache
+* - 9. cache:check:lock → claims a consistency check interval for one instance
+*
+* -- Webhook queue --
+* - 10. stripe:webhooks:stream → stream of stored webhook events to process, read by the consumer group
+*   stripe-webhook-workers (prefixed like the keys)
+* - 11. stripe:webhooks:retry → sorted set of failed events by the time of their next attempt
+* - 12. stripe:webhooks:dead → stream of events that failed too often
+**/
+
+/**
+* Version of the cached customer data's shape, bump it with every change to payment.StripeCacheData or its hash
+* layout that old entries can't be read as. Entries of older versions are no longer looked up, their customers are rebuilt by a
+* full sync on the next read and the old entries expire with their ttl.
+**/
+const CustomerDataVersion = 3
+
+const (
+	keyCustomerData       = "stripe:customer:v%d:%s"
+	keyCustomerIdToUserId = "stripe:customer:%s:userid"
+	keyUserIdToCustomerId = "stripe:customer:userid:%s"
+	keyProducts           = "stripe:products"
+	keySyncLock           = "stripe:sync:lock:%s"
+	keySyncPending        = "stripe:sync:pending:%s"
+	keySyncFullPending    = "stripe:sync:pending-full:%s"
+	keyCacheWarmed        = "cache:warmed"
+	keyCacheWarmLock      = "cache:warm:lock"
+	keyCacheCheckLock     = "cache:check:lock"
+	keyWebhookStream      = "stripe:webhooks:stream"
+	keyWebhookRetry       = "stripe:webhooks:retry"
+	keyWebhookDeadLetter  = "stripe:webhooks:dead"
+	groupWebhookWorkers   = "stripe-webhook-workers"
+
+	channelInvalidation = "cache:invalidate"
+)
+
+type Schema struct {
+	prefix string
+}
+
+func New(env string, tenant string) *Schema {
+	return &Schema{
+		prefix: fmt.Sprintf("%s:%s:", env, tenant),
+	}
+}
+
+// schema of the deployment, from CACHE_ENV and CACHE_TENANT
+func FromEnv() *Schema {
+	return New(util.GetEnv("CACHE_ENV", "local"), util.GetEnv("CACHE_TENANT", "default"))
+}
+
+func (s *Schema) CustomerData(customerId string) string {
+	return s.prefix + fmt.Sprintf(keyCustomerData, CustomerDataVersion, customerId)
+}
+
+// customer to userId
+func (s *Schema) CustomerIdToUserId(customerId string) string {
+	return s.prefix + fmt.Sprintf(keyCustomerIdToUserId, customerId)
+}
+
+// userId to customerId
+func (s *Schema) UserIdToCustomerId(userId string) string {
+	return s.prefix + fmt.Sprintf(keyUserIdToCustomerId, userId)
+}
+
+func (s *Schema) Products() string {
+	return s.prefix + keyProducts
+}
+
+func (s *Schema) SyncLock(customerId string) string {
+	return s.prefix + fmt.Sprintf(keySyncLock, customerId)
+}
+
+func (s *Schema) SyncPending(customerId string) string {
+	return s.prefix + fmt.Sprintf(keySyncPending, customerId)
+}
+
+func (s *Schema) SyncFullPending(customerId string) string {
+	return s.prefix + fmt.Sprintf(keySyncFullPending, customerId)
+}
+
+func (s *Schema) CacheWarmed() string {
+	return s.prefix + keyCacheWarmed
+}
+
+func (s *Schema) CacheWarmLock() string {
+	return s.prefix + keyCacheWarmLock
+}
+
+func (s *Schema) CacheCheckLock() string {
+	return s.prefix + keyCacheCheckLock
+}
+
+func (s *Schema) WebhookStream() string {
+	return s.prefix + keyWebhookStream
+}
+
+// consumer group of the webhook workers on WebhookStream
+func (s *Schema) WebhookGroup() string {
+	return s.prefix + groupWebhookWorkers
+}
+
+func (s *Schema) WebhookRetry() string {
+	return s.prefix + keyWebhookRetry
+}
+
+func (s *Schema) WebhookDeadLetter() string {
+	return s.prefix + keyWebhookDeadLetter
+}
+
+/**
+* Whether key is one of the userId ↔ customerId mappings, which never change once written and are read on most
+* requests, making them the keys worth keeping in process (see cache.Tiered).
+**/
+func (s *Schema) IsMapping(key string) bool {
+	key, found := strings.CutPrefix(key, s.prefix)
+
+	if !found {
+		return false
+	}
+
+	return strings.HasPrefix(key, fmt.Sprintf(keyUserIdToCustomerId, "")) ||
+		(strings.HasPrefix(key, "stripe:customer:") && strings.HasSuffix(key, ":userid"))
+}
+
+// pub/sub channel announcing keys that changed, so instances drop their local copies
+func (s *Schema) InvalidationChannel() string {
+	return s.prefix + channelInvalidation
+}
+
+/**
+* Expiration of each key class. Everything cached can be rebuilt from stripe or the database, so ttls only bound
+* how long a missed invalidation can serve stale data and how long unused entries take up memory. Lock and pending
+* keys carry their own lease durations.
+**/
+
+// customer data is kept current by syncs and webhooks
+func CustomerDataTTL() time.Duration {
+	return time.Duration(util.GetEnvAsInt("CACHE_CUSTOMER_DATA_TTL_HOURS", 24)) * time.Hour
+}
+
+// mappings never change once a customer is created
+func MappingTTL() time.Duration {
+	return time.Duration(util.GetEnvAsInt("CACHE_MAPPING_TTL_HOURS", 24*7)) * time.Hour
+}
+
+// products are dropped on product / price webhooks
+func ProductsTTL() time.Duration {
+	return time.Duration(util.GetEnvAsInt("CACHE_PRODUCTS_TTL_MINUTES", 10)) * time.Minute
+}
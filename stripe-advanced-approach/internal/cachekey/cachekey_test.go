@@ -0,0 +1,57 @@
+package cachekey_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cachekey"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestKeysAreUniquePerCustomer checks no two customers, deployments or key classes share a key
+func TestKeysAreUniquePerCustomer(t *testing.T) {
+	schemas := []*cachekey.Schema{
+		cachekey.New("prod", "acme"),
+		cachekey.New("prod", "globex"),
+		cachekey.New("staging", "acme"),
+	}
+	customers := []string{"cus_123", "cus_456", "cus_1234"}
+
+	seen := map[string]string{}
+	add := func(key string, owner string) {
+		t.Helper()
+
+		previous, exists := seen[key]
+		assert.False(t, exists, "key %s of %s is also used by %s", key, owner, previous)
+		seen[key] = owner
+	}
+
+	for _, schema := range schemas {
+		for _, customerId := range customers {
+			owner := fmt.Sprintf("%p/%s", schema, customerId)
+
+			add(schema.CustomerData(customerId), owner+"/data")
+			add(schema.CustomerIdToUserId(customerId), owner+"/userid")
+			add(schema.UserIdToCustomerId(customerId), owner+"/customerid")
+			add(schema.SyncLock(customerId), owner+"/lock")
+			add(schema.SyncPending(customerId), owner+"/pending")
+			add(schema.SyncFullPending(customerId), owner+"/full-pending")
+		}
+
+		add(schema.Products(), fmt.Sprintf("%p/products", schema))
+		add(schema.CacheWarmed(), fmt.Sprintf("%p/warmed", schema))
+		add(schema.CacheWarmLock(), fmt.Sprintf("%p/warm-lock", schema))
+		add(schema.CacheCheckLock(), fmt.Sprintf("%p/check-lock", schema))
+		add(schema.WebhookStream(), fmt.Sprintf("%p/webhook-stream", schema))
+		add(schema.WebhookGroup(), fmt.Sprintf("%p/webhook-group", schema))
+		add(schema.WebhookRetry(), fmt.Sprintf("%p/webhook-retry", schema))
+		add(schema.WebhookDeadLetter(), fmt.Sprintf("%p/webhook-dead", schema))
+	}
+}
+
+// TestCustomerDataKeyCarriesSchemaVersion checks entries of another shape are never looked up
+func TestCustomerDataKeyCarriesSchemaVersion(t *testing.T) {
+	key := cachekey.New("prod", "acme").CustomerData("cus_123")
+
+	assert.Equal(t, fmt.Sprintf("prod:acme:stripe:customer:v%d:cus_123", cachekey.CustomerDataVersion), key)
+}
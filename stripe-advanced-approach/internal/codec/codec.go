@@ -0,0 +1,242 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/**
+* Encoding of cache values.
+*
+* JSON values are stored as they are, which keeps them readable by instances and tools that predate the codecs.
+* Every other format is framed so readers and the cache's ordering guard (SetIfNewer) can tell the formats apart
+* without knowing which one wrote the value:
+*
+*	[format byte][version, 16 hex digits][payload]
+*
+* The format bytes never start a JSON document, so unframed values are JSON. The version is the one SetIfNewer
+* compares (0 for unversioned values), JSON values carry theirs in a top-level "version" field instead.
+*
+* CACHE_CODEC selects the codec values are written with: "json" (default), "msgpack" or "msgpack+zstd". Values in
+* any format are read regardless, so the codec can be switched at any time.
+**/
+
+type Format byte
+
+const (
+	FormatJSON        Format = '{'
+	FormatMsgpack     Format = 0x01
+	FormatZstdMsgpack Format = 0x02
+)
+
+const versionDigits = 16
+
+type Codec interface {
+	Format() Format
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, value interface{}) error
+}
+
+var codecs = map[Format]Codec{
+	FormatJSON:        jsonCodec{},
+	FormatMsgpack:     msgpackCodec{},
+	FormatZstdMsgpack: zstdMsgpackCodec{},
+}
+
+var codecNames = map[string]Format{
+	"json":         FormatJSON,
+	"msgpack":      FormatMsgpack,
+	"msgpack+zstd": FormatZstdMsgpack,
+}
+
+// the codec selected by CACHE_CODEC
+func FromEnv() Codec {
+	name := util.GetEnv("CACHE_CODEC", "json")
+
+	format, exists := codecNames[name]
+	if !exists {
+		fmt.Printf("\nUnknown CACHE_CODEC %q, using json\n\n", name)
+		format = FormatJSON
+	}
+
+	return codecs[format]
+}
+
+/**
+* Encodes value with codec, framed with version unless it is JSON.
+**/
+func Encode(codec Codec, version int64, value interface{}) ([]byte, error) {
+	payload, err := codec.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode cache value as %s: %w", codec.Format(), err)
+	}
+
+	if codec.Format() == FormatJSON {
+		return payload, nil
+	}
+
+	framed := make([]byte, 0, 1+versionDigits+len(payload))
+	framed = append(framed, byte(codec.Format()))
+	framed = fmt.Appendf(framed, "%0*x", versionDigits, version)
+
+	return append(framed, payload...), nil
+}
+
+/**
+* Decodes a value written by Encode with any codec.
+**/
+func Decode(data []byte, value interface{}) error {
+	codec, payload, _, err := unframe(data)
+	if err != nil {
+		return err
+	}
+
+	if err := codec.Unmarshal(payload, value); err != nil {
+		return fmt.Errorf("failed to decode cache value as %s: %w", codec.Format(), err)
+	}
+
+	return nil
+}
+
+/**
+* The version data was written with, false when it has none (a JSON value without a "version" field, or data that
+* isn't an encoded value).
+**/
+func Version(data []byte) (int64, bool) {
+	codec, _, version, err := unframe(data)
+	if err != nil {
+		return 0, false
+	}
+
+	if codec.Format() != FormatJSON {
+		return version, true
+	}
+
+	var versioned struct {
+		Version *int64 `json:"version"`
+	}
+
+	if json.Unmarshal(data, &versioned) != nil || versioned.Version == nil {
+		return 0, false
+	}
+
+	return *versioned.Version, true
+}
+
+func unframe(data []byte) (codec Codec, payload []byte, version int64, err error) {
+	data = bytes.TrimLeft(data, " \t\r\n")
+
+	if len(data) == 0 {
+		return nil, nil, 0, fmt.Errorf("empty cache value")
+	}
+
+	codec, exists := codecs[Format(data[0])]
+	if !exists {
+		// legacy JSON that isn't an object
+		return codecs[FormatJSON], data, 0, nil
+	}
+
+	if codec.Format() == FormatJSON {
+		return codec, data, 0, nil
+	}
+
+	if len(data) < 1+versionDigits {
+		return nil, nil, 0, fmt.Errorf("truncated %s cache value", codec.Format())
+	}
+
+	version, err = strconv.ParseInt(string(data[1:1+versionDigits]), 16, 64)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("invalid version in %s cache value: %w", codec.Format(), err)
+	}
+
+	return codec, data[1+versionDigits:], version, nil
+}
+
+func (f Format) String() string {
+	for name, format := range codecNames {
+		if format == f {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("format(%#x)", byte(f))
+}
+
+// --- codecs ---
+
+type jsonCodec struct{}
+
+func (jsonCodec) Format() Format {
+	return FormatJSON
+}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+// msgpack with the json field names, values keep their shape when switching codecs
+type msgpackCodec struct{}
+
+func (msgpackCodec) Format() Format {
+	return FormatMsgpack
+}
+
+func (msgpackCodec) Marshal(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, value interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+
+	return decoder.Decode(value)
+}
+
+// shared, EncodeAll and DecodeAll are safe for concurrent use
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+type zstdMsgpackCodec struct{}
+
+func (zstdMsgpackCodec) Format() Format {
+	return FormatZstdMsgpack
+}
+
+func (zstdMsgpackCodec) Marshal(value interface{}) ([]byte, error) {
+	packed, err := msgpackCodec{}.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return zstdEncoder.EncodeAll(packed, nil), nil
+}
+
+func (zstdMsgpackCodec) Unmarshal(data []byte, value interface{}) error {
+	packed, err := zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return err
+	}
+
+	return msgpackCodec{}.Unmarshal(packed, value)
+}
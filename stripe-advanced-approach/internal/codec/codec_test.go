@@ -0,0 +1,151 @@
+package codec_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/codec"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var formats = []codec.Format{codec.FormatJSON, codec.FormatMsgpack, codec.FormatZstdMsgpack}
+
+func codecFor(t testing.TB, format codec.Format) codec.Codec {
+	t.Helper()
+	t.Setenv("CACHE_CODEC", format.String())
+
+	return codec.FromEnv()
+}
+
+// customer with a long history, the shape the sync caches
+func largeCustomer(payments int) *payment.StripeCacheData {
+	defaultPaymentMethod := "pm_1Q2w3E4r5T6y7U8i"
+
+	data := &payment.StripeCacheData{
+		Version: 1735689600000000,
+		CustomerData: payment.StripeCustomerDataRes{
+			ID:       "cus_Q2w3E4r5T6y7U8",
+			Address:  &payment.CustomerAddress{City: "Berlin", Country: "DE", Line1: "Unter den Linden 1", PostalCode: "10117"},
+			Created:  1704067200,
+			Currency: "eur",
+			Email:    "customer@example.com",
+			InvoiceSettings: &payment.CustomerInvoiceSettings{
+				DefaultPaymentMethod: &defaultPaymentMethod,
+				Footer:               "Thank you for your business",
+			},
+			Metadata:         map[string]string{"user_id": "6f1c2b4e-8a3d-4f5e-9b7c-1d2e3f4a5b6c"},
+			Name:             "Example Customer",
+			Object:           "customer",
+			PreferredLocales: []string{"de", "en"},
+			Tax:              &payment.CustomerTax{AutomaticTax: "supported", Location: &payment.CustomerTaxLocation{Country: "DE", Source: "billing_address"}},
+			Subscriptions: &payment.SubscriptionList{
+				Data: []interface{}{
+					map[string]interface{}{"id": "sub_1", "status": "active", "items": map[string]interface{}{"data": []interface{}{map[string]interface{}{"price": "price_pro", "quantity": 1}}}},
+				},
+				Url: "/v1/customers/cus_Q2w3E4r5T6y7U8/subscriptions",
+			},
+		},
+	}
+
+	for index := range 5 {
+		data.Subscriptions = append(data.Subscriptions, &payment.StripeSubscriptionCache{
+			SubscriptionID: fmt.Sprintf("sub_%024d", index),
+			Status:         "canceled",
+			PriceID:        "price_1Q2w3E4r5T6y7U8iPro",
+			PaymentMethod:  &payment.PaymentMethodInfo{Brand: "visa", Last4: "4242"},
+		})
+	}
+
+	for index := range payments {
+		data.Payments = append(data.Payments, &payment.StripePaymentsCache{
+			ID:     fmt.Sprintf("pi_%024d", index),
+			Status: "succeeded",
+		})
+	}
+
+	return data
+}
+
+func jsonOf(t *testing.T, value interface{}) string {
+	t.Helper()
+
+	encoded, err := json.Marshal(value)
+	require.NoError(t, err)
+
+	return string(encoded)
+}
+
+// TestCodecsRoundTrip checks every codec reads back what it wrote, whichever codec is configured for reading
+func TestCodecsRoundTrip(t *testing.T) {
+	original := largeCustomer(20)
+
+	for _, format := range formats {
+		t.Run(format.String(), func(t *testing.T) {
+			encoded, err := codec.Encode(codecFor(t, format), original.Version, original)
+			require.NoError(t, err)
+
+			var decoded payment.StripeCacheData
+			require.NoError(t, codec.Decode(encoded, &decoded))
+			assert.JSONEq(t, jsonOf(t, original), jsonOf(t, &decoded))
+
+			version, versioned := codec.Version(encoded)
+			assert.True(t, versioned)
+			assert.Equal(t, original.Version, version)
+		})
+	}
+}
+
+// TestDecodeReadsLegacyJSON checks values written before the codecs existed are still read
+func TestDecodeReadsLegacyJSON(t *testing.T) {
+	legacy := []byte(`{"version":42,"customer_data":{"id":"cus_legacy"},"subscriptions":[],"payments":[{"id":"pi_1","status":"succeeded"}]}`)
+
+	var decoded payment.StripeCacheData
+	require.NoError(t, codec.Decode(legacy, &decoded))
+	assert.Equal(t, "cus_legacy", decoded.CustomerData.ID)
+	assert.Len(t, decoded.Payments, 1)
+
+	version, versioned := codec.Version(legacy)
+	assert.True(t, versioned)
+	assert.Equal(t, int64(42), version)
+
+	_, versioned = codec.Version([]byte(`[1, 2]`))
+	assert.False(t, versioned)
+}
+
+// BenchmarkCodecs compares encoded size and encode / decode time, json being today's json.Marshal
+func BenchmarkCodecs(b *testing.B) {
+	for _, payments := range []int{10, 1000} {
+		original := largeCustomer(payments)
+
+		for _, format := range formats {
+			selected := codecFor(b, format)
+
+			encoded, err := codec.Encode(selected, original.Version, original)
+			require.NoError(b, err)
+
+			name := fmt.Sprintf("%s/payments=%d", format, payments)
+
+			b.Run(name+"/encode", func(b *testing.B) {
+				for b.Loop() {
+					if _, err := codec.Encode(selected, original.Version, original); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.ReportMetric(float64(len(encoded)), "bytes")
+			})
+
+			b.Run(name+"/decode", func(b *testing.B) {
+				for b.Loop() {
+					var decoded payment.StripeCacheData
+					if err := codec.Decode(encoded, &decoded); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
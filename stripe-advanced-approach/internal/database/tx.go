@@ -0,0 +1,134 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/**
+* Unit of work.
+*
+* A transaction is carried in the context instead of being passed to every repository method. Repositories run
+* their queries through Conn, which picks up the transaction of the context when there is one and the plain
+* connection pool otherwise, so the same repository methods work inside and outside of a transaction and several
+* repositories can share one.
+*
+* Side effects that must only happen once the writes are visible (cache syncs, background goroutines) are
+* registered with AfterCommit and run after a successful commit. Side effects outside of the database that were
+* already made in the transaction (e.g. a customer created at the payment processor) are undone by hooks
+* registered with AfterRollback.
+**/
+
+// the query methods repositories need, implemented by both *sqlx.DB and *sqlx.Tx
+type Executor interface {
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type txContextKey struct{}
+
+type txState struct {
+	tx            *sqlx.Tx // nil for transactions of other units of work
+	afterCommit   []func(ctx context.Context)
+	afterRollback []func(ctx context.Context)
+}
+
+type unitOfWork struct {
+	db *sqlx.DB
+}
+
+func NewUnitOfWork(db *sqlx.DB) *unitOfWork {
+	return &unitOfWork{db: db}
+}
+
+/**
+* Runs fn in a transaction which is committed when fn returns nil and rolled back otherwise. Calls nested in an
+* already running transaction join it, only the outermost call commits.
+**/
+func (u *unitOfWork) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txContextKey{}).(*txState); ok {
+		return fn(ctx)
+	}
+
+	tx, err := u.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	state := &txState{tx: tx}
+
+	if err := fn(context.WithValue(ctx, txContextKey{}, state)); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			fmt.Printf("\nError when rolling back transaction: %+v\n\n", rollbackErr)
+		}
+
+		state.rolledBack(ctx)
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		state.rolledBack(ctx)
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	state.committed(ctx)
+	return nil
+}
+
+// hooks get the context without the finished transaction
+func (state *txState) committed(ctx context.Context) {
+	for _, hook := range state.afterCommit {
+		hook(ctx)
+	}
+}
+
+// undone in reverse order, also when the transaction failed because ctx was canceled
+func (state *txState) rolledBack(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+
+	for i := len(state.afterRollback) - 1; i >= 0; i-- {
+		state.afterRollback[i](ctx)
+	}
+}
+
+// the transaction of the context if there is one, the connection pool otherwise
+func Conn(ctx context.Context, db *sqlx.DB) Executor {
+	if state, ok := ctx.Value(txContextKey{}).(*txState); ok && state.tx != nil {
+		return state.tx
+	}
+
+	return db
+}
+
+// runs hook once the transaction of the context has committed, or right away outside of a transaction
+func AfterCommit(ctx context.Context, hook func(ctx context.Context)) {
+	if state, ok := ctx.Value(txContextKey{}).(*txState); ok {
+		state.afterCommit = append(state.afterCommit, hook)
+		return
+	}
+
+	hook(ctx)
+}
+
+// runs hook when the transaction of the context is rolled back, never outside of a transaction
+func AfterRollback(ctx context.Context, hook func(ctx context.Context)) {
+	if state, ok := ctx.Value(txContextKey{}).(*txState); ok {
+		state.afterRollback = append(state.afterRollback, hook)
+	}
+}
+
+/**
+* For other interfaces.UnitOfWork implementations (e.g. the in-memory one of the tests): marks the returned context
+* as running in a transaction so AfterCommit and AfterRollback defer their hooks, which are run by calling commit or
+* rollback once the transaction finished.
+**/
+func BeginHooks(ctx context.Context) (txCtx context.Context, commit func(ctx context.Context), rollback func(ctx context.Context)) {
+	state := &txState{}
+
+	return context.WithValue(ctx, txContextKey{}, state), state.committed, state.rolledBack
+}
@@ -0,0 +1,86 @@
+package database_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/database"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/testutil"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func countUsers(t *testing.T, suite *testutil.FullSuite, email string) int {
+	t.Helper()
+
+	var count int
+	err := suite.DB.GetContext(suite.Ctx, &count, `SELECT COUNT(*) FROM users WHERE email = $1`, email)
+	require.NoError(t, err)
+
+	return count
+}
+
+// TestWithinTxRollsBackAcrossRepositories checks a failure after several repository calls leaves nothing behind
+func TestWithinTxRollsBackAcrossRepositories(t *testing.T) {
+	suite := testutil.SetupFake(t, testutil.WithPostgres())
+	defer suite.CleanupFunc()
+
+	unitOfWork := database.NewUnitOfWork(suite.DB)
+	failure := errors.New("stripe unavailable")
+	hookRan := false
+	undone := false
+
+	err := unitOfWork.WithinTx(suite.Ctx, func(ctx context.Context) error {
+		created, err := suite.UserRepo.Create(ctx, &user.User{Email: suite.TestUser.Email, Password: "hashed", Name: "Rollback"})
+		require.NoError(t, err)
+
+		// visible inside the transaction
+		_, err = suite.UserRepo.GetByEmail(ctx, suite.TestUser.Email)
+		require.NoError(t, err)
+
+		require.NoError(t, suite.UserRepo.UpdateStripeCustomer(ctx, created.ID, "cus_rolled_back"))
+
+		database.AfterCommit(ctx, func(ctx context.Context) { hookRan = true })
+		database.AfterRollback(ctx, func(ctx context.Context) { undone = true })
+
+		return failure
+	})
+
+	assert.ErrorIs(t, err, failure)
+	assert.True(t, undone, "rollback hooks undo side effects outside of the transaction")
+	assert.Equal(t, 0, countUsers(t, suite, suite.TestUser.Email))
+	assert.False(t, hookRan, "hooks must not run after a rollback")
+}
+
+// TestWithinTxNestedCallsJoin checks nested units of work commit once with the outermost one
+func TestWithinTxNestedCallsJoin(t *testing.T) {
+	suite := testutil.SetupFake(t, testutil.WithPostgres())
+	defer suite.CleanupFunc()
+
+	unitOfWork := database.NewUnitOfWork(suite.DB)
+	var hookSawUser int
+
+	err := unitOfWork.WithinTx(suite.Ctx, func(ctx context.Context) error {
+		return unitOfWork.WithinTx(ctx, func(ctx context.Context) error {
+			_, err := suite.UserRepo.Create(ctx, &user.User{Email: suite.TestUser.Email, Password: "hashed", Name: "Nested"})
+			if err != nil {
+				return err
+			}
+
+			database.AfterCommit(ctx, func(ctx context.Context) {
+				hookSawUser = countUsers(t, suite, suite.TestUser.Email)
+			})
+
+			return nil
+		})
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, countUsers(t, suite, suite.TestUser.Email))
+	assert.Equal(t, 1, hookSawUser, "hooks run once the writes are committed")
+
+	_, err = suite.DB.ExecContext(suite.Ctx, `DELETE FROM users WHERE email = $1`, suite.TestUser.Email)
+	require.NoError(t, err)
+}
@@ -2,21 +2,47 @@ package interfaces
 
 import (
 	"context"
+	"errors"
 	"time"
-
-	"github.com/redis/go-redis/v9"
 )
 
-// client for interfacing with the implemented cache
+// returned by Cache.Get and Cache.HGet for keys that don't exist or expired
+var ErrCacheMiss = errors.New("cache miss")
+
+// a field of a hash with the version it was written with
+type HashField struct {
+	Value   string
+	Version int64
+}
+
+// client for interfacing with the implemented cache, keys are built by the cachekey package
 type Cache interface {
 	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error
 	Get(ctx context.Context, key string) (string, error)
 	Del(ctx context.Context, keys ...string) error
 	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error)
-	Pipeline() redis.Pipeliner
+	// stores a value encoded by the codec package with version unless the stored one has a higher version
+	SetIfNewer(ctx context.Context, key string, value []byte, version int64, expiration time.Duration) (bool, error)
+	// compare-and-set variants for keys owned by one holder at a time (locks)
+	ExpireIfEqual(ctx context.Context, key string, value string, expiration time.Duration) (bool, error)
+	DelIfEqual(ctx context.Context, key string, value string) (bool, error)
+	// hashes whose fields are read and written on their own, fields ending with * select every field starting
+	// with the rest and no fields selects all of them
+	HGet(ctx context.Context, key string, fields ...string) (map[string]HashField, error)
+	// writes each field (nil values delete it) unless it was written with a higher version, returns the fields
+	// written. versions outlive deleted fields so older writes can't bring them back
+	HSetIfNewer(ctx context.Context, key string, fields map[string][]byte, version int64, expiration time.Duration) ([]string, error)
+	// HSetIfNewer that also deletes the fields selected by replace (as for HGet) that fields doesn't name and drops
+	// the versions of deleted ones, unless they are newer. Fields of replace without a version of their own then
+	// count as written with version, returns the fields written and deleted
+	HReplaceIfNewer(ctx context.Context, key string, fields map[string][]byte, replace []string, version int64, expiration time.Duration) ([]string, error)
 	Close() error
 	Ping(ctx context.Context) error
-	GetUserIdFromCustomerIdKey(customerId string) string
-	GetCustomerIdFromUserIdKey(userId string) string
-	GetCustomerDataFromCustomerIdKey(customerId string) string
+}
+
+// fire-and-forget messages to every instance listening on a channel
+type PubSub interface {
+	Broadcast(ctx context.Context, channel string, message string) error
+	// messages arrive on the returned channel until ctx is done or the subscription drops, which closes it
+	Subscribe(ctx context.Context, channel string) (<-chan string, error)
 }
@@ -0,0 +1,26 @@
+package interfaces
+
+import (
+	"context"
+	"time"
+)
+
+// single entry read from a queue stream
+type QueueMessage struct {
+	ID     string
+	Values map[string]string
+}
+
+// client for interfacing with the implemented stream based queue (consumer groups, delayed retries)
+type Queue interface {
+	EnsureGroup(ctx context.Context, stream string, group string) error
+	Publish(ctx context.Context, stream string, values map[string]string) (string, error)
+	Consume(ctx context.Context, stream string, group string, consumer string, count int64, block time.Duration) ([]QueueMessage, error)
+	ClaimStale(ctx context.Context, stream string, group string, consumer string, minIdle time.Duration, count int64) ([]QueueMessage, error)
+	Ack(ctx context.Context, stream string, group string, ids ...string) error
+	Range(ctx context.Context, stream string, count int64) ([]QueueMessage, error)
+	GetMessage(ctx context.Context, stream string, id string) (*QueueMessage, error)
+	Remove(ctx context.Context, stream string, ids ...string) error
+	ScheduleAt(ctx context.Context, key string, member string, at time.Time) error
+	PopDue(ctx context.Context, key string, now time.Time, count int64) ([]string, error)
+}
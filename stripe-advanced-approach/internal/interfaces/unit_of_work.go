@@ -0,0 +1,8 @@
+package interfaces
+
+import "context"
+
+// runs repository calls across repositories in one database transaction carried by the context
+type UnitOfWork interface {
+	WithinTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
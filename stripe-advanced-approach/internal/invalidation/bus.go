@@ -0,0 +1,160 @@
+package invalidation
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+)
+
+/**
+* Cross-instance invalidation of in-process copies of cached data.
+*
+* Whenever an instance rewrites a customer's cached keys it publishes a Message on a pub/sub channel, and every
+* instance (itself included) hands it to its listeners, which evict their local copies. Pub/sub is fire-and-forget,
+* so a subscription that drops loses the messages published until it is back: the bus resubscribes with backoff
+* and has every listener evict everything, as it can't tell what it missed.
+*
+* Counted in expvar "cache_invalidations": published, publish_failed, received, dropped (undecodable messages),
+* disconnects and resubscribes.
+**/
+
+var metrics = expvar.NewMap("cache_invalidations")
+
+// keys of one customer that were rewritten
+type Message struct {
+	CustomerID string   `json:"customer_id"`
+	Keys       []string `json:"keys"`
+}
+
+// in-process copies of cached data
+type Listener interface {
+	Evict(keys ...string)
+	EvictAll()
+}
+
+const (
+	minResubscribeBackoff = 100 * time.Millisecond
+	maxResubscribeBackoff = 30 * time.Second
+)
+
+type Bus struct {
+	pubsub  interfaces.PubSub
+	channel string
+
+	mu        sync.RWMutex
+	listeners []Listener
+}
+
+func NewBus(pubsub interfaces.PubSub, channel string) *Bus {
+	return &Bus{
+		pubsub:  pubsub,
+		channel: channel,
+	}
+}
+
+func (b *Bus) AddListener(listener Listener) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.listeners = append(b.listeners, listener)
+}
+
+/**
+* Announces that keys of the customer were rewritten. A lost announcement leaves other instances with stale local
+* copies until they expire, so failures are counted and returned but shouldn't fail the write itself.
+**/
+func (b *Bus) Publish(ctx context.Context, customerId string, keys ...string) error {
+	payload, err := json.Marshal(Message{CustomerID: customerId, Keys: keys})
+	if err != nil {
+		return fmt.Errorf("failed to marshal invalidation: %w", err)
+	}
+
+	if err := b.pubsub.Broadcast(ctx, b.channel, string(payload)); err != nil {
+		metrics.Add("publish_failed", 1)
+		return fmt.Errorf("failed to publish invalidation of customer %s: %w", customerId, err)
+	}
+
+	metrics.Add("published", 1)
+	return nil
+}
+
+/**
+* Delivers invalidations to the listeners until ctx is done, resubscribing whenever the subscription drops.
+**/
+func (b *Bus) Run(ctx context.Context) error {
+	backoff := minResubscribeBackoff
+	subscribedBefore := false
+
+	for {
+		messages, err := b.pubsub.Subscribe(ctx, b.channel)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			fmt.Printf("\nError when subscribing to cache invalidations, retrying in %s: %+v\n\n", backoff, err)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+
+			backoff = min(backoff*2, maxResubscribeBackoff)
+			continue
+		}
+
+		// anything published while the subscription was down is lost
+		if subscribedBefore {
+			metrics.Add("resubscribes", 1)
+			b.evictAll()
+		}
+
+		subscribedBefore = true
+		backoff = minResubscribeBackoff
+
+		for payload := range messages {
+			b.deliver(payload)
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		metrics.Add("disconnects", 1)
+		fmt.Printf("\nCache invalidation subscription dropped, resubscribing\n\n")
+	}
+}
+
+func (b *Bus) deliver(payload string) {
+	metrics.Add("received", 1)
+
+	var message Message
+	if err := json.Unmarshal([]byte(payload), &message); err != nil {
+		metrics.Add("dropped", 1)
+		fmt.Printf("\nError when decoding cache invalidation, dropping it: %+v\n\n", err)
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, listener := range b.listeners {
+		listener.Evict(message.Keys...)
+	}
+}
+
+func (b *Bus) evictAll() {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, listener := range b.listeners {
+		listener.EvictAll()
+	}
+}
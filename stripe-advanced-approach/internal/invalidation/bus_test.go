@@ -0,0 +1,131 @@
+package invalidation_test
+
+import (
+	"context"
+	"expvar"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cache"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/invalidation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const channel = "test:cache:invalidate"
+
+// pub/sub whose current subscription can be dropped like a lost connection
+type droppingPubSub struct {
+	*cache.Memory
+
+	mu   sync.Mutex
+	drop context.CancelFunc
+}
+
+func (p *droppingPubSub) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	subscriptionCtx, drop := context.WithCancel(ctx)
+
+	p.mu.Lock()
+	p.drop = drop
+	p.mu.Unlock()
+
+	return p.Memory.Subscribe(subscriptionCtx, channel)
+}
+
+func (p *droppingPubSub) dropSubscription() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.drop != nil {
+		p.drop()
+	}
+}
+
+func newInstance(t *testing.T, remote *cache.Memory, pubsub *droppingPubSub) (*cache.Tiered, *invalidation.Bus) {
+	t.Helper()
+
+	tiered := cache.NewTiered(remote, cache.TieredConfig{
+		MaxEntries:   100,
+		LocalTTL:     time.Minute,
+		CacheLocally: func(key string) bool { return strings.HasPrefix(key, "mapping:") },
+	})
+
+	bus := invalidation.NewBus(pubsub, channel)
+	bus.AddListener(tiered)
+
+	go bus.Run(t.Context())
+
+	return tiered, bus
+}
+
+func metric(name string) int64 {
+	value := expvar.Get("cache_invalidations").(*expvar.Map).Get(name)
+	if value == nil {
+		return 0
+	}
+
+	return value.(*expvar.Int).Value()
+}
+
+// TestBusInvalidatesOtherInstances checks a published rewrite evicts the local copy of another instance
+func TestBusInvalidatesOtherInstances(t *testing.T) {
+	remote := cache.NewMemory(0)
+	ctx := t.Context()
+
+	first, firstBus := newInstance(t, remote, &droppingPubSub{Memory: remote})
+	second, _ := newInstance(t, remote, &droppingPubSub{Memory: remote})
+
+	require.NoError(t, first.Set(ctx, "mapping:user", "cus_1", 0))
+
+	value, err := second.Get(ctx, "mapping:user")
+	require.NoError(t, err)
+	assert.Equal(t, "cus_1", value)
+
+	require.NoError(t, first.Set(ctx, "mapping:user", "cus_2", 0))
+
+	// published until the second instance's subscription is up
+	assert.Eventually(t, func() bool {
+		require.NoError(t, firstBus.Publish(ctx, "cus_1", "mapping:user"))
+
+		value, err := second.Get(ctx, "mapping:user")
+		return err == nil && value == "cus_2"
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestBusResubscribesAndEvictsEverything checks a dropped subscription is restored and local copies are dropped
+func TestBusResubscribesAndEvictsEverything(t *testing.T) {
+	remote := cache.NewMemory(0)
+	pubsub := &droppingPubSub{Memory: remote}
+	ctx := t.Context()
+
+	tiered, _ := newInstance(t, remote, pubsub)
+
+	require.NoError(t, remote.Set(ctx, "mapping:user", "cus_1", 0))
+
+	_, err := tiered.Get(ctx, "mapping:user")
+	require.NoError(t, err)
+
+	// messages published while disconnected are lost
+	require.NoError(t, remote.Set(ctx, "mapping:user", "cus_2", 0))
+	resubscribes := metric("resubscribes")
+
+	require.Eventually(t, func() bool {
+		pubsub.dropSubscription()
+		return metric("resubscribes") > resubscribes
+	}, 2*time.Second, 50*time.Millisecond)
+
+	value, err := tiered.Get(ctx, "mapping:user")
+	require.NoError(t, err)
+	assert.Equal(t, "cus_2", value, "local copies are dropped after reconnecting")
+
+	// undecodable messages are counted as dropped
+	dropped := metric("dropped")
+
+	assert.Eventually(t, func() bool {
+		require.NoError(t, remote.Broadcast(ctx, channel, "not json"))
+		return metric("dropped") > dropped
+	}, time.Second, 10*time.Millisecond)
+
+}
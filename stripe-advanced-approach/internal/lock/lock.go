@@ -0,0 +1,90 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+	"github.com/google/uuid"
+)
+
+/**
+* Distributed lock on a cache key.
+*
+* The key is taken with SetNX and holds a random token, so only the holder can renew or release it. Locks are
+* leases: they expire after their ttl unless renewed, which frees them when the holder crashes. Work running
+* under a lock should use the context from KeepAlive, which is canceled once the lease is lost.
+**/
+type Lock struct {
+	cache interfaces.Cache
+	key   string
+	token string
+	ttl   time.Duration
+}
+
+/**
+* Takes the lock if nobody holds it, acquired is false otherwise.
+**/
+func TryAcquire(ctx context.Context, cache interfaces.Cache, key string, ttl time.Duration) (lock *Lock, acquired bool, err error) {
+	token := uuid.NewString()
+
+	acquired, err = cache.SetNX(ctx, key, token, ttl)
+
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to acquire lock %s: %w", key, err)
+	}
+
+	if !acquired {
+		return nil, false, nil
+	}
+
+	return &Lock{cache: cache, key: key, token: token, ttl: ttl}, true, nil
+}
+
+/**
+* Renews the lease every third of its ttl until stop is called. The returned context is canceled when the lease
+* can't be renewed, as another holder may take the lock after it expires.
+**/
+func (l *Lock) KeepAlive(ctx context.Context) (leaseCtx context.Context, stop func()) {
+	leaseCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-leaseCtx.Done():
+				return
+			case <-ticker.C:
+				renewed, err := l.cache.ExpireIfEqual(leaseCtx, l.key, l.token, l.ttl)
+
+				if err != nil || !renewed {
+					fmt.Printf("\nLost lock %s, renewed: %t, err: %+v\n\n", l.key, renewed, err)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return leaseCtx, func() {
+		close(done)
+		cancel()
+	}
+}
+
+/**
+* Releases the lock, unless the lease expired and it is held by someone else by now.
+**/
+func (l *Lock) Release(ctx context.Context) error {
+	if _, err := l.cache.DelIfEqual(ctx, l.key, l.token); err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", l.key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package lock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cache"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/lock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLockIsExclusiveUntilReleased checks only the holder can release the lock
+func TestLockIsExclusiveUntilReleased(t *testing.T) {
+	client := cache.NewMemory(0)
+	ctx := t.Context()
+	key := "test:lock"
+
+	held, acquired, err := lock.TryAcquire(ctx, client, key, time.Second)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	_, acquired, err = lock.TryAcquire(ctx, client, key, time.Second)
+	require.NoError(t, err)
+	assert.False(t, acquired, "lock is held")
+
+	require.NoError(t, held.Release(ctx))
+
+	_, acquired, err = lock.TryAcquire(ctx, client, key, time.Second)
+	require.NoError(t, err)
+	assert.True(t, acquired, "released lock can be taken")
+
+	// the previous holder can't release someone else's lock
+	require.NoError(t, held.Release(ctx))
+	_, acquired, err = lock.TryAcquire(ctx, client, key, time.Second)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+}
+
+// TestLockKeepAliveRenewsLease checks a kept alive lock outlives its ttl
+func TestLockKeepAliveRenewsLease(t *testing.T) {
+	client := cache.NewMemory(0)
+	ctx := t.Context()
+	key := "test:lock"
+
+	held, acquired, err := lock.TryAcquire(ctx, client, key, 300*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	leaseCtx, stop := held.KeepAlive(ctx)
+
+	time.Sleep(time.Second)
+	assert.NoError(t, leaseCtx.Err(), "lease is still held")
+
+	_, acquired, err = lock.TryAcquire(ctx, client, key, time.Second)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	stop()
+	require.NoError(t, held.Release(ctx))
+}
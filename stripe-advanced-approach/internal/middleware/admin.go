@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+* Guards operational endpoints (webhook dead letters, replays). Requests must send the shared ADMIN_API_KEY
+* in the X-Admin-Key header, and the endpoints are disabled entirely when no key is configured.
+**/
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminKey := os.Getenv("ADMIN_API_KEY")
+		if adminKey == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "admin endpoints are disabled"})
+			c.Abort()
+			return
+		}
+
+		providedKey := c.GetHeader("X-Admin-Key")
+		if subtle.ConstantTimeCompare([]byte(providedKey), []byte(adminKey)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid admin key"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
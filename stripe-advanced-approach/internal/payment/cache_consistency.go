@@ -0,0 +1,373 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/codec"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
+)
+
+/**
+* Consistency check of the copies of customers' stripe state.
+*
+* Samples customers and compares their subscriptions in the cache and in the database to stripe, and their cached
+* mappings to the users table. Customers without cached data have nothing to drift. Objects written after the check
+* read stripe reflect a newer state than the one compared to, so they are skipped.
+*
+* With repair, wrong mappings are rewritten and customers with mismatched subscriptions are resynced: their cached
+* data is dropped first so the sync is a full pass, rewriting every row and field.
+*
+* Runs every CACHE_CHECK_INTERVAL_MINUTES (0 disables it) on one instance per interval, sampling CACHE_CHECK_SAMPLE
+* customers and repairing with CACHE_CHECK_AUTO_REPAIR. Counted in expvar "cache_consistency": checks, sampled,
+* consistent, mismatched, mismatches, repaired and failed.
+**/
+
+var consistencyMetrics = expvar.NewMap("cache_consistency")
+
+const (
+	defaultConsistencySample = 20
+	maxConsistencySample     = 500
+)
+
+// mismatch sources and objects besides subscriptions ("sub:{id}")
+const (
+	consistencySourceCache    = "cache"
+	consistencySourceDatabase = "database"
+
+	consistencyObjectUserIdToCustomerId = "mapping:userid_to_customerid"
+	consistencyObjectCustomerIdToUserId = "mapping:customerid_to_userid"
+
+	consistencyMissing = "missing"
+)
+
+type ConsistencyCheckConfig struct {
+	Interval time.Duration
+	Sample   int
+	Repair   bool
+}
+
+func DefaultConsistencyCheckConfig() ConsistencyCheckConfig {
+	return ConsistencyCheckConfig{
+		Interval: time.Duration(util.GetEnvAsInt("CACHE_CHECK_INTERVAL_MINUTES", 60)) * time.Minute,
+		Sample:   util.GetEnvAsInt("CACHE_CHECK_SAMPLE", defaultConsistencySample),
+		Repair:   util.GetEnv("CACHE_CHECK_AUTO_REPAIR", "false") == "true",
+	}
+}
+
+/**
+* Checks a sample of customers every interval until ctx is canceled.
+**/
+func (s *service) RunConsistencyChecks(ctx context.Context, config ConsistencyCheckConfig) error {
+	if config.Interval <= 0 {
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		// the first instance to claim the interval checks, the claim expires with it
+		claimed, err := s.cacheClient.SetNX(ctx, s.keys.CacheCheckLock(), owner, config.Interval)
+
+		if err != nil {
+			fmt.Printf("\nError when claiming the consistency check: %+v\n\n", err)
+			continue
+		}
+
+		if !claimed {
+			continue
+		}
+
+		report, err := s.CheckCacheConsistency(ctx, &ConsistencyCheckRequest{Sample: config.Sample, Repair: config.Repair})
+
+		if err != nil {
+			fmt.Printf("\nError when checking cache consistency: %+v\n\n", err)
+			continue
+		}
+
+		fmt.Printf("\nCache consistency: %d sampled, %d consistent, %d mismatched, %d repaired, %d failed\n\n", report.Sampled, report.Consistent, report.Mismatched, report.Repaired, report.Failed)
+	}
+}
+
+/**
+* Compares a random sample of customers across redis, postgres and stripe, repairing mismatches when requested.
+**/
+func (s *service) CheckCacheConsistency(ctx context.Context, request *ConsistencyCheckRequest) (*ConsistencyReport, error) {
+	if request.Sample <= 0 {
+		request.Sample = defaultConsistencySample
+	}
+
+	if request.Sample > maxConsistencySample {
+		request.Sample = maxConsistencySample
+	}
+
+	customers, err := s.repo.SampleCacheCustomers(ctx, request.Sample)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ConsistencyReport{
+		Repair:     request.Repair,
+		Sampled:    len(customers),
+		Mismatches: []*ConsistencyMismatch{},
+	}
+
+	for _, customer := range customers {
+		mismatches, err := s.checkCustomerConsistency(ctx, customer)
+
+		if err != nil {
+			fmt.Printf("\nError when checking consistency of customer %s: %+v\n\n", customer.StripeCustomerID, err)
+			report.Failed++
+			continue
+		}
+
+		if len(mismatches) == 0 {
+			report.Consistent++
+			continue
+		}
+
+		report.Mismatched++
+		report.Mismatches = append(report.Mismatches, mismatches...)
+
+		if !request.Repair {
+			continue
+		}
+
+		if err := s.repairCustomerConsistency(ctx, customer, mismatches); err != nil {
+			fmt.Printf("\nError when repairing customer %s: %+v\n\n", customer.StripeCustomerID, err)
+			report.Failed++
+			continue
+		}
+
+		report.Repaired++
+	}
+
+	consistencyMetrics.Add("checks", 1)
+	consistencyMetrics.Add("sampled", int64(report.Sampled))
+	consistencyMetrics.Add("consistent", int64(report.Consistent))
+	consistencyMetrics.Add("mismatched", int64(report.Mismatched))
+	consistencyMetrics.Add("mismatches", int64(len(report.Mismatches)))
+	consistencyMetrics.Add("repaired", int64(report.Repaired))
+	consistencyMetrics.Add("failed", int64(report.Failed))
+
+	return report, nil
+}
+
+func (s *service) checkCustomerConsistency(ctx context.Context, customer *CacheCustomer) ([]*ConsistencyMismatch, error) {
+	customerId := customer.StripeCustomerID
+	var mismatches []*ConsistencyMismatch
+
+	mismatch := func(source string, object string, expected string, actual string) {
+		mismatches = append(mismatches, &ConsistencyMismatch{
+			CustomerID: customerId,
+			Source:     source,
+			Object:     object,
+			Expected:   expected,
+			Actual:     actual,
+		})
+	}
+
+	// -- mappings, missing ones are rebuilt on demand --
+
+	mappings := []struct {
+		object   string
+		key      string
+		expected string
+	}{
+		{consistencyObjectUserIdToCustomerId, s.keys.UserIdToCustomerId(customer.UserID.String()), customerId},
+		{consistencyObjectCustomerIdToUserId, s.keys.CustomerIdToUserId(customerId), customer.UserID.String()},
+	}
+
+	for _, mapping := range mappings {
+		cached, err := s.cacheClient.Get(ctx, mapping.key)
+
+		if errors.Is(err, interfaces.ErrCacheMiss) {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cached mapping: %w", err)
+		}
+
+		if cached != mapping.expected {
+			mismatch(consistencySourceCache, mapping.object, mapping.expected, cached)
+		}
+	}
+
+	// -- subscriptions --
+
+	readAt := stripeReadVersion(time.Now())
+
+	subscriptions, err := s.paymentProcessor.ListSubscriptions(ctx, customerId, &ListOptions{PageSize: syncPageSize()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscriptions from stripe: %w", stripeCallErr(err))
+	}
+
+	expected := map[string]string{}
+	for _, sub := range subscriptions {
+		expected[sub.ID] = subscriptionState(string(sub.Status), sub.CancelAtPeriodEnd, sub.PauseCollection != nil)
+	}
+
+	cached, err := s.cachedSubscriptionStates(ctx, customerId, readAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.repo.ListSubscriptionsByCustomer(ctx, customerId)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := map[string]string{}
+	for _, row := range rows {
+		if row.LastEventAt != nil && row.LastEventAt.After(readAt) {
+			stored[row.StripeSubscriptionID] = ""
+			continue
+		}
+
+		stored[row.StripeSubscriptionID] = subscriptionState(row.Status, row.CancelAtPeriodEnd, row.PauseBehavior != "")
+	}
+
+	replicas := []struct {
+		source string
+		states map[string]string
+	}{
+		{consistencySourceCache, cached},
+		{consistencySourceDatabase, stored},
+	}
+
+	for _, replica := range replicas {
+		// not cached
+		if replica.states == nil {
+			continue
+		}
+
+		for subscriptionId, state := range expected {
+			actual, exists := replica.states[subscriptionId]
+
+			if !exists {
+				mismatch(replica.source, subscriptionField(subscriptionId), state, consistencyMissing)
+			} else if actual != "" && actual != state {
+				mismatch(replica.source, subscriptionField(subscriptionId), state, actual)
+			}
+		}
+
+		for subscriptionId, actual := range replica.states {
+			if _, exists := expected[subscriptionId]; !exists && actual != "" {
+				mismatch(replica.source, subscriptionField(subscriptionId), consistencyMissing, actual)
+			}
+		}
+	}
+
+	return mismatches, nil
+}
+
+/**
+* States of the customer's cached subscriptions by id, nil when the customer isn't cached. Subscriptions written
+* after readAt map to "", they can't be compared.
+**/
+func (s *service) cachedSubscriptionStates(ctx context.Context, customerId string, readAt time.Time) (map[string]string, error) {
+	hash, err := s.cacheClient.HGet(ctx, s.keys.CustomerData(customerId), subscriptionFields...)
+
+	if errors.Is(err, interfaces.ErrCacheMiss) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached subscriptions: %w", err)
+	}
+
+	if _, complete := hash[fieldSynced]; !complete {
+		return nil, nil
+	}
+
+	states := map[string]string{}
+
+	for name, field := range hash {
+		subscriptionId, isSubscription := strings.CutPrefix(name, fieldSubscriptionPrefix)
+		if !isSubscription {
+			continue
+		}
+
+		if field.Version > readAt.UnixMicro() {
+			states[subscriptionId] = ""
+			continue
+		}
+
+		var sub StripeSubscriptionCache
+		if err := codec.Decode([]byte(field.Value), &sub); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal cached subscription %s: %w", subscriptionId, err)
+		}
+
+		states[subscriptionId] = subscriptionState(sub.Status, sub.CancelAtPeriodEnd, sub.PauseBehavior != "")
+	}
+
+	return states, nil
+}
+
+// what is compared of a subscription
+func subscriptionState(status string, cancelAtPeriodEnd bool, paused bool) string {
+	state := status
+
+	if cancelAtPeriodEnd {
+		state += ", cancel_at_period_end"
+	}
+
+	if paused {
+		state += ", paused"
+	}
+
+	return state
+}
+
+func (s *service) repairCustomerConsistency(ctx context.Context, customer *CacheCustomer, mismatches []*ConsistencyMismatch) error {
+	resync := false
+
+	for _, mismatch := range mismatches {
+		var err error
+
+		switch mismatch.Object {
+		case consistencyObjectUserIdToCustomerId:
+			err = s.AddCacheCusIdToUserId(ctx, customer.StripeCustomerID, customer.UserID)
+		case consistencyObjectCustomerIdToUserId:
+			err = s.AddCacheUserIdToCusId(ctx, customer.UserID, customer.StripeCustomerID)
+		default:
+			resync = true
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if !resync {
+		return nil
+	}
+
+	// without cached data the sync is a full pass
+	key := s.keys.CustomerData(customer.StripeCustomerID)
+
+	if err := s.cacheClient.Del(ctx, key); err != nil {
+		return fmt.Errorf("failed to drop cached stripe data: %w", err)
+	}
+
+	s.announceInvalidation(ctx, customer.StripeCustomerID, key)
+
+	return s.SyncStripeDataToStorage(ctx, customer.StripeCustomerID)
+}
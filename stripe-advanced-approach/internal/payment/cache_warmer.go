@@ -0,0 +1,257 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/lock"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
+	"github.com/google/uuid"
+)
+
+/**
+* Cache warming.
+*
+* After a redis flush or failover every user's first request takes the slow path, rebuilding the mappings from the
+* database and the customer data from stripe. The warmer rebuilds them ahead of the requests, walking the users
+* with a stripe customer in batches:
+*
+* - the userId ↔ customerId mappings of every customer
+* - the cached data of customers with subscriptions, through a regular sync so it coordinates with the others
+*
+* Entries that are still cached are left alone. The cache:warmed key marks a warmed cache: every instance checks it
+* every CACHE_WARM_CHECK_SECONDS and the one taking the warm lock warms the cache when it's gone, which also covers
+* the first start. Batches are paused between so warming doesn't eat up the stripe rate limit.
+*
+* Counted in expvar "cache_warmer": runs, customers, mappings_warmed, data_rebuilt and failed.
+**/
+
+var cacheWarmerMetrics = expvar.NewMap("cache_warmer")
+
+type CacheWarmerConfig struct {
+	BatchSize     int
+	Concurrency   int // customers warmed at once
+	BatchPause    time.Duration
+	CheckInterval time.Duration
+	LockTTL       time.Duration
+}
+
+func DefaultCacheWarmerConfig() CacheWarmerConfig {
+	return CacheWarmerConfig{
+		BatchSize:     util.GetEnvAsInt("CACHE_WARM_BATCH_SIZE", 100),
+		Concurrency:   max(util.GetEnvAsInt("CACHE_WARM_CONCURRENCY", 4), 1),
+		BatchPause:    time.Duration(util.GetEnvAsInt("CACHE_WARM_BATCH_PAUSE_MS", 1000)) * time.Millisecond,
+		CheckInterval: time.Duration(util.GetEnvAsInt("CACHE_WARM_CHECK_SECONDS", 60)) * time.Second,
+		LockTTL:       30 * time.Second,
+	}
+}
+
+/**
+* Warms the cache whenever it lost its data, until ctx is canceled.
+**/
+func (s *service) RunCacheWarmer(ctx context.Context, config CacheWarmerConfig) error {
+	ticker := time.NewTicker(config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.warmIfFlushed(ctx, config); err != nil && ctx.Err() == nil {
+			fmt.Printf("\nError when warming the cache: %+v\n\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *service) warmIfFlushed(ctx context.Context, config CacheWarmerConfig) error {
+	_, err := s.cacheClient.Get(ctx, s.keys.CacheWarmed())
+
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, interfaces.ErrCacheMiss) {
+		return fmt.Errorf("failed to check whether the cache is warm: %w", err)
+	}
+
+	warmLock, acquired, err := lock.TryAcquire(ctx, s.cacheClient, s.keys.CacheWarmLock(), config.LockTTL)
+
+	// another instance is warming it
+	if err != nil || !acquired {
+		return err
+	}
+
+	leaseCtx, stop := warmLock.KeepAlive(ctx)
+	defer stop()
+
+	defer func() {
+		if err := warmLock.Release(context.WithoutCancel(ctx)); err != nil {
+			fmt.Printf("\nError when releasing the cache warm lock: %+v\n\n", err)
+		}
+	}()
+
+	// marked before warming, a flush while warming removes it again and the cache is warmed once more
+	if err := s.cacheClient.Set(leaseCtx, s.keys.CacheWarmed(), time.Now().UTC().Format(time.RFC3339), 0); err != nil {
+		return fmt.Errorf("failed to mark the cache as warmed: %w", err)
+	}
+
+	result, err := s.warmCache(leaseCtx, config)
+	if err != nil {
+		// retried on the next check
+		if err := s.cacheClient.Del(context.WithoutCancel(ctx), s.keys.CacheWarmed()); err != nil {
+			fmt.Printf("\nError when unmarking the cache as warmed: %+v\n\n", err)
+		}
+
+		return err
+	}
+
+	fmt.Printf("\nCache warmed: %+v\n\n", *result)
+	return nil
+}
+
+/**
+* Rebuilds the mappings and customer data that aren't cached, for every user with a stripe customer. Customers that
+* fail are counted and skipped.
+**/
+func (s *service) WarmCache(ctx context.Context) (*CacheWarmResult, error) {
+	return s.warmCache(ctx, DefaultCacheWarmerConfig())
+}
+
+func (s *service) warmCache(ctx context.Context, config CacheWarmerConfig) (*CacheWarmResult, error) {
+	startedAt := time.Now()
+	result := &CacheWarmResult{}
+
+	cacheWarmerMetrics.Add("runs", 1)
+
+	var mu sync.Mutex
+	after := uuid.Nil
+
+	for {
+		customers, err := s.repo.ListCacheCustomers(ctx, after, config.BatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, config.Concurrency)
+
+		for _, customer := range customers {
+			slots <- struct{}{}
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				mappings, rebuilt, err := s.warmCustomer(ctx, customer)
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				result.Customers++
+				result.MappingsWarmed += mappings
+
+				if rebuilt {
+					result.DataRebuilt++
+				}
+
+				if err != nil {
+					fmt.Printf("\nError when warming the cache of customer %s: %+v\n\n", customer.StripeCustomerID, err)
+					result.Failed++
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		if len(customers) < config.BatchSize || ctx.Err() != nil {
+			break
+		}
+
+		after = customers[len(customers)-1].UserID
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(config.BatchPause):
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	result.Duration = time.Since(startedAt).Round(time.Millisecond).String()
+
+	cacheWarmerMetrics.Add("customers", int64(result.Customers))
+	cacheWarmerMetrics.Add("mappings_warmed", int64(result.MappingsWarmed))
+	cacheWarmerMetrics.Add("data_rebuilt", int64(result.DataRebuilt))
+	cacheWarmerMetrics.Add("failed", int64(result.Failed))
+
+	return result, nil
+}
+
+// rebuilds what isn't cached of one customer
+func (s *service) warmCustomer(ctx context.Context, customer *CacheCustomer) (mappings int, rebuilt bool, err error) {
+	customerId := customer.StripeCustomerID
+
+	// -- mappings --
+
+	cached, err := s.isCached(ctx, s.keys.UserIdToCustomerId(customer.UserID.String()))
+	if err != nil {
+		return mappings, false, err
+	}
+
+	if !cached {
+		if err := s.AddCacheCusIdToUserId(ctx, customerId, customer.UserID); err != nil {
+			return mappings, false, err
+		}
+		mappings++
+	}
+
+	cached, err = s.isCached(ctx, s.keys.CustomerIdToUserId(customerId))
+	if err != nil {
+		return mappings, false, err
+	}
+
+	if !cached {
+		if err := s.AddCacheUserIdToCusId(ctx, customer.UserID, customerId); err != nil {
+			return mappings, false, err
+		}
+		mappings++
+	}
+
+	// -- customer data --
+
+	if !customer.HasSubscriptions {
+		return mappings, false, nil
+	}
+
+	data, err := s.getCachedStripeData(ctx, s.keys.CustomerData(customerId), fieldSynced)
+	if err != nil || data != nil {
+		return mappings, false, err
+	}
+
+	if err := s.SyncStripeDataToStorage(ctx, customerId); err != nil {
+		return mappings, false, err
+	}
+
+	return mappings, true, nil
+}
+
+func (s *service) isCached(ctx context.Context, key string) (bool, error) {
+	_, err := s.cacheClient.Get(ctx, key)
+
+	if errors.Is(err, interfaces.ErrCacheMiss) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
@@ -0,0 +1,254 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cachekey"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/codec"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+)
+
+/**
+* Layout of the customer's cached stripe data, a hash with one field per part so reads only decode the parts they
+* need and webhooks only rewrite what their event changed:
+*
+* - synced → time of the last sync, entries without it are incomplete and read as missing
+* - profile → the stripe customer (StripeCustomerDataRes)
+* - sub:{subscriptionId} → one subscription (StripeSubscriptionCache)
+* - payment:{paymentIntentId} → one payment (StripePaymentsCache)
+*
+* Every field is written with the version of the stripe state it reflects and is never replaced by an older one
+* (see interfaces.Cache HSetIfNewer), so syncs and webhooks touching different parts of a customer don't undo each
+* other. The data's Version is the one of its synced field.
+**/
+
+const (
+	fieldSynced             = "synced"
+	fieldProfile            = "profile"
+	fieldSubscriptionPrefix = "sub:"
+	fieldPaymentPrefix      = "payment:"
+)
+
+// the parts read to check a customer's subscriptions, e.g. for the subscription status
+var subscriptionFields = []string{fieldSynced, fieldSubscriptionPrefix + "*"}
+
+func subscriptionField(subscriptionId string) string {
+	return fieldSubscriptionPrefix + subscriptionId
+}
+
+func paymentField(paymentIntentId string) string {
+	return fieldPaymentPrefix + paymentIntentId
+}
+
+/**
+* The cached stripe data under key, limited to fields (see interfaces.Cache HGet, all of them without any). nil
+* without an error when there is none.
+**/
+func (s *service) getCachedStripeData(ctx context.Context, key string, fields ...string) (*StripeCacheData, error) {
+	hash, err := s.cacheClient.HGet(ctx, key, fields...)
+
+	if errors.Is(err, interfaces.ErrCacheMiss) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached stripe data: %w", err)
+	}
+
+	synced, complete := hash[fieldSynced]
+	if !complete {
+		return nil, nil
+	}
+
+	data := &StripeCacheData{Version: synced.Version}
+
+	for name, field := range hash {
+		var err error
+
+		switch {
+		case name == fieldProfile:
+			err = codec.Decode([]byte(field.Value), &data.CustomerData)
+
+		case strings.HasPrefix(name, fieldSubscriptionPrefix):
+			var sub StripeSubscriptionCache
+			err = codec.Decode([]byte(field.Value), &sub)
+			data.Subscriptions = append(data.Subscriptions, &sub)
+
+		case strings.HasPrefix(name, fieldPaymentPrefix):
+			var payment StripePaymentsCache
+			err = codec.Decode([]byte(field.Value), &payment)
+			data.Payments = append(data.Payments, &payment)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal cached stripe data field %s: %w", name, err)
+		}
+	}
+
+	// hash fields come in no particular order
+	slices.SortFunc(data.Subscriptions, func(a, b *StripeSubscriptionCache) int {
+		return strings.Compare(a.SubscriptionID, b.SubscriptionID)
+	})
+	slices.SortFunc(data.Payments, func(a, b *StripePaymentsCache) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return data, nil
+}
+
+/**
+* Writes the cache state of a sync. Incremental passes only carry the objects they listed, the other fields stay as
+* cached, full passes also drop the subscriptions stripe no longer lists.
+**/
+func (s *service) cacheStripeSync(ctx context.Context, plan *stripeSyncPlan) error {
+	state := plan.cacheState
+	fields := map[string][]byte{}
+
+	add := func(field string, value interface{}) error {
+		encoded, err := codec.Encode(s.codec, state.Version, value)
+		if err != nil {
+			return fmt.Errorf("failed to marshal cached stripe data field %s: %w", field, err)
+		}
+
+		fields[field] = encoded
+		return nil
+	}
+
+	if err := add(fieldProfile, state.CustomerData); err != nil {
+		return err
+	}
+
+	for _, sub := range state.Subscriptions {
+		if err := add(subscriptionField(sub.SubscriptionID), sub); err != nil {
+			return err
+		}
+	}
+
+	for _, payment := range state.Payments {
+		if err := add(paymentField(payment.ID), payment); err != nil {
+			return err
+		}
+	}
+
+	fields[fieldSynced] = []byte(time.UnixMicro(state.Version).UTC().Format(time.RFC3339Nano))
+
+	// full passes replace the subscriptions, dropping the ones stripe no longer lists along with the versions kept
+	// for deleted ones
+	var replace []string
+	if plan.listedAllSubscriptions {
+		replace = []string{fieldSubscriptionPrefix + "*"}
+	}
+
+	// fields written since this sync read stripe keep their newer state
+	written, err := s.cacheClient.HReplaceIfNewer(ctx, plan.cacheKey, fields, replace, state.Version, cachekey.CustomerDataTTL())
+
+	if err != nil {
+		fmt.Printf("\nFailed to sync and store stripe data into cache: %+v\n\n", err)
+		return fmt.Errorf("failed to sync and store stripe data into cache: %w", err)
+	}
+
+	// written also holds the fields the replacement dropped
+	skipped := 0
+	for field := range fields {
+		if !slices.Contains(written, field) {
+			skipped++
+		}
+	}
+
+	if skipped > 0 {
+		fmt.Printf("\nSkipped %d stale cache fields for customer %s\n\n", skipped, plan.customerId)
+	}
+
+	if len(written) > 0 {
+		s.announceInvalidation(ctx, plan.customerId, plan.cacheKey)
+	}
+
+	return nil
+}
+
+/**
+* Replaces one field of the customer's cached stripe data with the value patch returns, reflecting stripe's state
+* as of seenAt. patch gets the cached field (and the data's Version) to carry over what the change doesn't know
+* about. Changes older than the field are dropped. Customers without cached data get a full sync instead, which
+* builds the entry from stripe.
+**/
+func (s *service) patchCachedStripeData(ctx context.Context, customerId string, seenAt time.Time, field string, patch func(current *StripeCacheData) interface{}) error {
+	key := s.keys.CustomerData(customerId)
+
+	current, err := s.getCachedStripeData(ctx, key, fieldSynced, field)
+
+	if err != nil {
+		return err
+	}
+
+	if current == nil {
+		return s.SyncStripeDataToStorage(ctx, customerId)
+	}
+
+	version := seenAt.UnixMicro()
+
+	patched, err := codec.Encode(s.codec, version, patch(current))
+	if err != nil {
+		return fmt.Errorf("failed to marshal cached stripe data field %s: %w", field, err)
+	}
+
+	written, err := s.cacheClient.HSetIfNewer(ctx, key, map[string][]byte{field: patched}, version, cachekey.CustomerDataTTL())
+	if err != nil {
+		return err
+	}
+
+	if len(written) == 0 {
+		fmt.Printf("\nSkipping stale cache update of %s for customer %s\n\n", field, customerId)
+		return nil
+	}
+
+	s.announceInvalidation(ctx, customerId, key)
+	return nil
+}
+
+/**
+* Drops the customer's cached data and mappings after its rows were changed outside the application (see the
+* pgnotify package), they are rebuilt on the next read. With rebuild the customer data is synced right away
+* instead, which also brings the rows back in line with stripe.
+**/
+func (s *service) InvalidateCustomer(ctx context.Context, customerId string, rebuild bool) error {
+	keys := []string{s.keys.CustomerData(customerId), s.keys.CustomerIdToUserId(customerId)}
+
+	// the mappings of the user the customer was cached for and of the user owning it now, they differ after the
+	// customer was moved to another user
+	cachedUserId, err := s.cacheClient.Get(ctx, s.keys.CustomerIdToUserId(customerId))
+
+	if err == nil {
+		keys = append(keys, s.keys.UserIdToCustomerId(cachedUserId))
+	} else if !errors.Is(err, interfaces.ErrCacheMiss) {
+		return fmt.Errorf("failed to read cached user of customer %s: %w", customerId, err)
+	}
+
+	owner, err := s.userService.GetByStripeCustomerID(ctx, customerId)
+	owned := err == nil
+
+	if owned {
+		keys = append(keys, s.keys.UserIdToCustomerId(owner.ID.String()))
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to get user of customer %s: %w", customerId, err)
+	}
+
+	if err := s.cacheClient.Del(ctx, keys...); err != nil {
+		return fmt.Errorf("failed to drop cached keys of customer %s: %w", customerId, err)
+	}
+
+	s.announceInvalidation(ctx, customerId, keys...)
+
+	// customers without a user aren't synced
+	if !rebuild || !owned {
+		return nil
+	}
+
+	return s.SyncStripeDataToStorage(ctx, customerId)
+}
@@ -0,0 +1,533 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cache"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/codec"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+	"github.com/google/uuid"
+)
+
+/**
+* Dry runs.
+*
+* A dry run executes the exact same service code against a repository and cache that only record what would have
+* been written, compared to what is currently stored, so previews can't drift from real processing. Reads go to
+* the real storage, writes stay in the recorders (the cache keeps them in an overlay so later reads in the same
+* run see them).
+**/
+
+// copy of the service whose writes are recorded into the returned changes instead of being applied
+func (s *service) dryRun() (*service, *SyncChanges) {
+	changes := &SyncChanges{
+		Rows:      []SyncRowChange{},
+		CacheKeys: []string{},
+	}
+
+	// dry runs don't coordinate with real syncs, nothing is written
+	shadow := &service{
+		userService:      &dryRunUserService{PaymentUserService: s.userService, changes: changes},
+		paymentProcessor: s.paymentProcessor,
+		cacheClient:      &dryRunCache{Cache: s.cacheClient, changes: changes, overlay: map[string]*string{}, hashes: map[string]map[string]*dryRunField{}},
+		keys:             s.keys,
+		codec:            s.codec,
+		repo:             &dryRunRepository{Repository: s.repo, changes: changes},
+		unitOfWork:       dryRunUnitOfWork{},
+	}
+	shadow.webhookHandlers = shadow.newWebhookHandlers()
+
+	return shadow, changes
+}
+
+func (c *SyncChanges) addRow(table string, key string, action string, fields []string) {
+	for index, row := range c.Rows {
+		if row.Table != table || row.Key != key {
+			continue
+		}
+
+		// merge repeated writes to the same row
+		for _, field := range fields {
+			if !slices.Contains(row.Fields, field) {
+				c.Rows[index].Fields = append(c.Rows[index].Fields, field)
+			}
+		}
+
+		return
+	}
+
+	c.Rows = append(c.Rows, SyncRowChange{Table: table, Key: key, Action: action, Fields: fields})
+}
+
+func (c *SyncChanges) addCacheKey(key string) {
+	if !slices.Contains(c.CacheKeys, key) {
+		c.CacheKeys = append(c.CacheKeys, key)
+	}
+}
+
+// --- repository ---
+
+type dryRunRepository struct {
+	Repository
+	changes *SyncChanges
+}
+
+func (r *dryRunRepository) Create(ctx context.Context, userId uuid.UUID, paymentIntent *PaymentIntentRequest) error {
+	r.changes.addRow("payments", paymentIntent.IntentID, "insert", nil)
+	return nil
+}
+
+func (r *dryRunRepository) UpdateStatus(ctx context.Context, intentID string, status string, eventAt time.Time) error {
+	existing, err := r.GetPaymentByIntentID(ctx, intentID)
+
+	// an update without a row is a no-op
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if existing.Status != status && !isStale(existing.LastEventAt, &eventAt) {
+		r.changes.addRow("payments", intentID, "update", []string{"status"})
+	}
+
+	return nil
+}
+
+func (r *dryRunRepository) UpsertPayment(ctx context.Context, paymentIntentID string, payment *Payment) error {
+	existing, err := r.GetPaymentByIntentID(ctx, paymentIntentID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		r.changes.addRow("payments", paymentIntentID, "insert", nil)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if isStale(existing.LastEventAt, payment.LastEventAt) {
+		return nil
+	}
+
+	var fields []string
+	if existing.Status != payment.Status {
+		fields = append(fields, "status")
+	}
+	if existing.Amount != payment.Amount {
+		fields = append(fields, "amount")
+	}
+	if existing.Currency != payment.Currency {
+		fields = append(fields, "currency")
+	}
+
+	if len(fields) > 0 {
+		r.changes.addRow("payments", paymentIntentID, "update", fields)
+	}
+
+	return nil
+}
+
+func (r *dryRunRepository) UpsertSubscriptionRecord(ctx context.Context, sub *Subscription) error {
+	existing, err := r.GetSubscriptionByStripeID(ctx, sub.StripeSubscriptionID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		r.changes.addRow("subscriptions", sub.StripeSubscriptionID, "insert", nil)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if isStale(existing.LastEventAt, sub.LastEventAt) {
+		return nil
+	}
+
+	var fields []string
+	if existing.Status != sub.Status {
+		fields = append(fields, "status")
+	}
+	if existing.StripePriceID != sub.StripePriceID {
+		fields = append(fields, "stripe_price_id")
+	}
+	if !sameTimestamp(existing.CurrentPeriodStart, sub.CurrentPeriodStart) {
+		fields = append(fields, "current_period_start")
+	}
+	if !sameTimestamp(existing.CurrentPeriodEnd, sub.CurrentPeriodEnd) {
+		fields = append(fields, "current_period_end")
+	}
+	if existing.CancelAtPeriodEnd != sub.CancelAtPeriodEnd {
+		fields = append(fields, "cancel_at_period_end")
+	}
+	if !sameOptionalTimestamp(existing.CanceledAt, sub.CanceledAt) {
+		fields = append(fields, "canceled_at")
+	}
+	if !sameOptionalTimestamp(existing.EndedAt, sub.EndedAt) {
+		fields = append(fields, "ended_at")
+	}
+	if !sameOptionalTimestamp(existing.TrialStart, sub.TrialStart) {
+		fields = append(fields, "trial_start")
+	}
+	if !sameOptionalTimestamp(existing.TrialEnd, sub.TrialEnd) {
+		fields = append(fields, "trial_end")
+	}
+	if existing.LatestInvoiceID != sub.LatestInvoiceID {
+		fields = append(fields, "latest_invoice_id")
+	}
+	if !slices.Equal(existing.DiscountIDs, sub.DiscountIDs) {
+		fields = append(fields, "discount_ids")
+	}
+	if existing.CancellationReason != sub.CancellationReason {
+		fields = append(fields, "cancellation_reason")
+	}
+	if existing.CancellationFeedback != sub.CancellationFeedback {
+		fields = append(fields, "cancellation_feedback")
+	}
+	if existing.CancellationComment != sub.CancellationComment {
+		fields = append(fields, "cancellation_comment")
+	}
+	if existing.PauseBehavior != sub.PauseBehavior {
+		fields = append(fields, "pause_behavior")
+	}
+	if !sameOptionalTimestamp(existing.PauseResumesAt, sub.PauseResumesAt) {
+		fields = append(fields, "pause_resumes_at")
+	}
+
+	if sub.Items != nil {
+		r.recordItemChanges(existing.Items, sub.Items)
+	}
+
+	if len(fields) > 0 {
+		r.changes.addRow("subscriptions", sub.StripeSubscriptionID, "update", fields)
+	}
+
+	return nil
+}
+
+func (r *dryRunRepository) recordItemChanges(existing []*SubscriptionItem, items []*SubscriptionItem) {
+	stored := make(map[string]*SubscriptionItem, len(existing))
+	for _, item := range existing {
+		stored[item.StripeSubscriptionItemID] = item
+	}
+
+	for _, item := range items {
+		current, ok := stored[item.StripeSubscriptionItemID]
+		delete(stored, item.StripeSubscriptionItemID)
+
+		if !ok {
+			r.changes.addRow("subscription_items", item.StripeSubscriptionItemID, "insert", nil)
+			continue
+		}
+
+		var fields []string
+		if current.StripePriceID != item.StripePriceID {
+			fields = append(fields, "stripe_price_id")
+		}
+		if current.Quantity != item.Quantity {
+			fields = append(fields, "quantity")
+		}
+		if !sameTimestamp(current.CurrentPeriodEnd, item.CurrentPeriodEnd) {
+			fields = append(fields, "current_period_end")
+		}
+
+		if len(fields) > 0 {
+			r.changes.addRow("subscription_items", item.StripeSubscriptionItemID, "update", fields)
+		}
+	}
+
+	for _, itemID := range slices.Sorted(maps.Keys(stored)) {
+		r.changes.addRow("subscription_items", itemID, "delete", nil)
+	}
+}
+
+func (r *dryRunRepository) UpdateSubscriptionStatus(ctx context.Context, subID string, status string, eventAt time.Time) error {
+	existing, err := r.GetSubscriptionByStripeID(ctx, subID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if existing.Status != status && !isStale(existing.LastEventAt, &eventAt) {
+		r.changes.addRow("subscriptions", subID, "update", []string{"status"})
+	}
+
+	return nil
+}
+
+func (r *dryRunRepository) SetTrialEndingNotice(ctx context.Context, subID string, noticeAt *time.Time) error {
+	existing, err := r.GetSubscriptionByStripeID(ctx, subID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if (existing.TrialEndingNoticeAt == nil) != (noticeAt == nil) {
+		r.changes.addRow("subscriptions", subID, "update", []string{"trial_ending_notice_at"})
+	}
+
+	return nil
+}
+
+// sync progress is bookkeeping, not mirrored state
+func (r *dryRunRepository) SaveCustomerSyncState(ctx context.Context, state *CustomerSyncState) error {
+	return nil
+}
+
+func (r *dryRunRepository) MarkWebhookEventProcessed(ctx context.Context, stripeEventID string) error {
+	return nil
+}
+
+func (r *dryRunRepository) MarkWebhookEventFailed(ctx context.Context, stripeEventID string, processingErr string) error {
+	return nil
+}
+
+func (r *dryRunRepository) SaveWebhookEvent(ctx context.Context, event *WebhookEvent) (*WebhookEvent, bool, error) {
+	return nil, false, fmt.Errorf("webhook events can't be stored in a dry run")
+}
+
+// --- users ---
+
+type dryRunUserService struct {
+	PaymentUserService
+	changes *SyncChanges
+}
+
+func (u *dryRunUserService) UpdateSubscribed(ctx context.Context, userID uuid.UUID, subscribed bool) error {
+	u.changes.addRow("users", userID.String(), "update", []string{"subscribed"})
+	return nil
+}
+
+// --- transactions ---
+
+// nothing is written, so there is nothing to commit or roll back
+type dryRunUnitOfWork struct{}
+
+func (dryRunUnitOfWork) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// --- cache ---
+
+type dryRunCache struct {
+	interfaces.Cache
+	changes *SyncChanges
+
+	// values written during the run, nil for deleted keys
+	overlay map[string]*string
+	// hash fields written during the run
+	hashes map[string]map[string]*dryRunField
+}
+
+type dryRunField struct {
+	interfaces.HashField
+	deleted bool
+}
+
+func (c *dryRunCache) Get(ctx context.Context, key string) (string, error) {
+	if value, ok := c.overlay[key]; ok {
+		if value == nil {
+			return "", interfaces.ErrCacheMiss
+		}
+
+		return *value, nil
+	}
+
+	return c.Cache.Get(ctx, key)
+}
+
+func (c *dryRunCache) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	var newValue string
+
+	switch v := value.(type) {
+	case []byte:
+		newValue = string(v)
+	case string:
+		newValue = v
+	default:
+		newValue = fmt.Sprint(v)
+	}
+
+	current, err := c.Get(ctx, key)
+
+	if err != nil && !errors.Is(err, interfaces.ErrCacheMiss) {
+		return err
+	}
+
+	if errors.Is(err, interfaces.ErrCacheMiss) || current != newValue {
+		c.changes.addCacheKey(key)
+	}
+
+	c.overlay[key] = &newValue
+	return nil
+}
+
+func (c *dryRunCache) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error) {
+	_, err := c.Get(ctx, key)
+
+	if errors.Is(err, interfaces.ErrCacheMiss) {
+		return true, c.Set(ctx, key, value, expiration)
+	}
+
+	return false, err
+}
+
+func (c *dryRunCache) SetIfNewer(ctx context.Context, key string, value []byte, version int64, expiration time.Duration) (bool, error) {
+	current, err := c.Get(ctx, key)
+
+	if err != nil && !errors.Is(err, interfaces.ErrCacheMiss) {
+		return false, err
+	}
+
+	if err == nil {
+		if cachedVersion, versioned := codec.Version([]byte(current)); versioned && cachedVersion > version {
+			return false, nil
+		}
+	}
+
+	return true, c.Set(ctx, key, value, expiration)
+}
+
+func (c *dryRunCache) Del(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		_, err := c.Get(ctx, key)
+
+		if errors.Is(err, interfaces.ErrCacheMiss) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		c.changes.addCacheKey(key)
+		c.overlay[key] = nil
+	}
+
+	return nil
+}
+
+func (c *dryRunCache) HGet(ctx context.Context, key string, fields ...string) (map[string]interfaces.HashField, error) {
+	stored, err := c.Cache.HGet(ctx, key, fields...)
+
+	if errors.Is(err, interfaces.ErrCacheMiss) {
+		if _, written := c.hashes[key]; !written {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	hash := map[string]interfaces.HashField{}
+	maps.Copy(hash, stored)
+
+	for name, field := range c.hashes[key] {
+		if !cache.FieldSelected(name, fields) {
+			continue
+		}
+
+		if field.deleted {
+			delete(hash, name)
+		} else {
+			hash[name] = field.HashField
+		}
+	}
+
+	return hash, nil
+}
+
+func (c *dryRunCache) HSetIfNewer(ctx context.Context, key string, fields map[string][]byte, version int64, expiration time.Duration) ([]string, error) {
+	current, err := c.HGet(ctx, key, slices.Collect(maps.Keys(fields))...)
+
+	if err != nil && !errors.Is(err, interfaces.ErrCacheMiss) {
+		return nil, err
+	}
+
+	if c.hashes[key] == nil {
+		c.hashes[key] = map[string]*dryRunField{}
+	}
+
+	var written []string
+
+	for name, value := range fields {
+		cached, exists := current[name]
+
+		if exists && cached.Version > version {
+			continue
+		}
+
+		if changed := exists && (value == nil || cached.Value != string(value)) || !exists && value != nil; changed {
+			c.changes.addCacheKey(key)
+		}
+
+		c.hashes[key][name] = &dryRunField{
+			HashField: interfaces.HashField{Value: string(value), Version: version},
+			deleted:   value == nil,
+		}
+		written = append(written, name)
+	}
+
+	return written, nil
+}
+
+func (c *dryRunCache) HReplaceIfNewer(ctx context.Context, key string, fields map[string][]byte, replace []string, version int64, expiration time.Duration) ([]string, error) {
+	written, err := c.HSetIfNewer(ctx, key, fields, version, expiration)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := c.HGet(ctx, key, replace...)
+
+	if err != nil && !errors.Is(err, interfaces.ErrCacheMiss) {
+		return nil, err
+	}
+
+	for name, cached := range current {
+		if _, listed := fields[name]; listed || cached.Version > version {
+			continue
+		}
+
+		c.changes.addCacheKey(key)
+		c.hashes[key][name] = &dryRunField{HashField: interfaces.HashField{Version: version}, deleted: true}
+		written = append(written, name)
+	}
+
+	return written, nil
+}
+
+// mirrors the ordering guard of the repository upserts
+func isStale(stored *time.Time, incoming *time.Time) bool {
+	if stored == nil {
+		return false
+	}
+
+	return incoming == nil || incoming.Before(*stored)
+}
+
+func sameTimestamp(a time.Time, b time.Time) bool {
+	return a.Truncate(time.Second).Equal(b.Truncate(time.Second))
+}
+
+func sameOptionalTimestamp(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return sameTimestamp(*a, *b)
+}
@@ -0,0 +1,1553 @@
+package payment_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cachekey"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/codec"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/lock"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/testutil"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/user"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// createFakeUser signs up a user through the user service so the fake processor creates its customer
+func createFakeUser(t *testing.T, suite *testutil.FullSuite) *user.User {
+	t.Helper()
+
+	err := suite.UserService.Create(suite.Ctx, &user.User{
+		Email:    suite.TestUser.Email,
+		Password: suite.TestUser.Password,
+		Name:     "Fake Flow User",
+	})
+	require.NoError(t, err, "Failed to create test user")
+
+	created, err := suite.UserService.GetByEmail(suite.Ctx, suite.TestUser.Email)
+	require.NoError(t, err)
+	require.NotNil(t, created.StripeCustomerID, "Stripe customer should be created")
+
+	return created
+}
+
+// waitForSignupSync waits for the mappings and the sync the signup started in the background
+func waitForSignupSync(t *testing.T, suite *testutil.FullSuite, customerId string) {
+	t.Helper()
+
+	key := cachekey.FromEnv().CustomerData(customerId)
+
+	require.Eventually(t, func() bool {
+		hash, err := suite.Cache.HGet(suite.Ctx, key, "synced")
+		return err == nil && len(hash) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func paymentStatus(t *testing.T, suite *testutil.FullSuite, intentId string) string {
+	t.Helper()
+
+	stored, err := suite.PaymentRepo.GetPaymentByIntentID(suite.Ctx, intentId)
+	require.NoError(t, err)
+
+	return stored.Status
+}
+
+// TestPurchaseFlowWithFakeProcessor runs purchase → payment confirmation → webhook sync without stripe
+func TestPurchaseFlowWithFakeProcessor(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	_, err := suite.PaymentService.SetupProducts(suite.Ctx, &payment.SetupProductsReq{
+		Name:        "T-Shirt",
+		Description: "A fake t-shirt",
+		Price:       2000,
+	})
+	require.NoError(t, err)
+
+	products, err := suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+	require.Len(t, products.Products, 1)
+
+	purchase, err := suite.PaymentService.PurchaseProduct(suite.Ctx, testUser.ID, &payment.PurchaseProductRequest{
+		ProductID:  products.Products[0].ID,
+		CustomerID: customerId,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "pending", paymentStatus(t, suite, purchase.PaymentIntentID))
+
+	event, err := suite.FakeProcessor.SucceedPaymentIntent(purchase.PaymentIntentID)
+	require.NoError(t, err)
+
+	err = suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event)
+	require.NoError(t, err)
+
+	assert.Equal(t, string(stripe.PaymentIntentStatusSucceeded), paymentStatus(t, suite, purchase.PaymentIntentID))
+}
+
+// TestSubscribeFlowWithFakeProcessor runs subscribe → first invoice payment → webhook sync without stripe
+func TestSubscribeFlowWithFakeProcessor(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	_, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{
+		Name:        "Pro",
+		Description: "Fake pro plan",
+		Price:       999,
+	})
+	require.NoError(t, err)
+
+	products, err := suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+	require.Len(t, products.Products, 1)
+	assert.Equal(t, "subscription", products.Products[0].Type)
+
+	sub, err := suite.PaymentService.SubscribeToProduct(suite.Ctx, testUser.ID, &payment.SubscribeRequest{
+		ProductID:  products.Products[0].ID,
+		CustomerID: customerId,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, string(stripe.SubscriptionStatusIncomplete), sub.Status)
+
+	// confirm the payment intent behind the subscription's first invoice
+	intents, _, err := suite.FakeProcessor.ListPaymentIntents(suite.Ctx, customerId, nil)
+	require.NoError(t, err)
+	require.Len(t, intents, 1)
+
+	event, err := suite.FakeProcessor.SucceedPaymentIntent(intents[0].ID)
+	require.NoError(t, err)
+
+	err = suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event)
+	require.NoError(t, err)
+
+	// the paid first invoice activates the subscription
+	err = suite.PaymentService.ProcessWebhookEvent(suite.Ctx, suite.FakeProcessor.LatestEvent(stripe.EventTypeInvoicePaid))
+	require.NoError(t, err)
+
+	record, err := suite.PaymentRepo.GetSubscriptionByStripeID(suite.Ctx, sub.SubscriptionID)
+	require.NoError(t, err)
+	assert.Equal(t, string(stripe.SubscriptionStatusActive), record.Status)
+}
+
+// TestSubscriptionMirrorIncludesItems checks subscription webhooks mirror the items and billing period
+func TestSubscriptionMirrorIncludesItems(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	_, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{
+		Name:        "Pro",
+		Description: "Fake pro plan",
+		Price:       1500,
+	})
+	require.NoError(t, err)
+
+	products, err := suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+	require.Len(t, products.Products, 1)
+
+	sub, err := suite.PaymentService.SubscribeToProduct(suite.Ctx, testUser.ID, &payment.SubscribeRequest{
+		ProductID:  products.Products[0].ID,
+		CustomerID: customerId,
+	})
+	require.NoError(t, err)
+
+	_, err = suite.PaymentService.GetActiveSubscription(suite.Ctx, testUser.ID)
+	assert.ErrorIs(t, err, payment.ErrNoActiveSubscription, "incomplete subscriptions grant no access")
+
+	intents, _, err := suite.FakeProcessor.ListPaymentIntents(suite.Ctx, customerId, nil)
+	require.NoError(t, err)
+	require.Len(t, intents, 1)
+
+	_, err = suite.FakeProcessor.SucceedPaymentIntent(intents[0].ID)
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, suite.FakeProcessor.LatestEvent(stripe.EventTypeInvoicePaid)))
+
+	active, err := suite.PaymentService.GetActiveSubscription(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.Equal(t, sub.SubscriptionID, active.StripeSubscriptionID)
+	assert.Equal(t, string(stripe.SubscriptionStatusActive), active.Status)
+	assert.True(t, active.CurrentPeriodEnd.After(time.Now()), "renewal date is mirrored")
+	assert.NotEmpty(t, active.LatestInvoiceID)
+
+	require.Len(t, active.Items, 1)
+	assert.Equal(t, products.Products[0].ID, active.Items[0].StripeProductID)
+	assert.Equal(t, active.StripePriceID, active.Items[0].StripePriceID)
+	assert.Equal(t, int64(1), active.Items[0].Quantity)
+	assert.Equal(t, int64(1500), active.Items[0].UnitAmount)
+	assert.Equal(t, "month", active.Items[0].RecurringInterval)
+}
+
+// TestWebhookHandlerWithFakeProcessor posts a signed synthetic event through the webhook endpoint
+func TestWebhookHandlerWithFakeProcessor(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	const webhookSecret = "whsec_fake_test"
+	t.Setenv("STRIPE_WEBHOOK_SECRET", webhookSecret)
+
+	testUser := createFakeUser(t, suite)
+
+	intent, err := suite.PaymentService.CreatePaymentIntent(suite.Ctx, 1500, *testUser.StripeCustomerID)
+	require.NoError(t, err)
+
+	event, err := suite.FakeProcessor.SucceedPaymentIntent(intent.PaymentIntentID)
+	require.NoError(t, err)
+
+	rec := postWebhook(t, suite, event, webhookSecret)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, string(stripe.PaymentIntentStatusSucceeded), paymentStatus(t, suite, intent.PaymentIntentID))
+}
+
+// TestWebhookRedeliveryIsIdempotent delivers the same event twice, the second delivery must not be processed again
+func TestWebhookRedeliveryIsIdempotent(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	const webhookSecret = "whsec_fake_test"
+	t.Setenv("STRIPE_WEBHOOK_SECRET", webhookSecret)
+
+	testUser := createFakeUser(t, suite)
+
+	intent, err := suite.PaymentService.CreatePaymentIntent(suite.Ctx, 700, *testUser.StripeCustomerID)
+	require.NoError(t, err)
+
+	event, err := suite.FakeProcessor.SucceedPaymentIntent(intent.PaymentIntentID)
+	require.NoError(t, err)
+
+	first := postWebhook(t, suite, event, webhookSecret)
+	require.Equal(t, http.StatusOK, first.Code)
+
+	second := postWebhook(t, suite, event, webhookSecret)
+	require.Equal(t, http.StatusOK, second.Code)
+	assert.Contains(t, second.Body.String(), `"duplicate":true`)
+
+	stored, err := suite.PaymentRepo.GetWebhookEventByStripeID(suite.Ctx, event.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.Processed)
+	assert.Equal(t, 1, stored.Attempts)
+	assert.Nil(t, stored.LastError)
+	assert.NotNil(t, stored.ProcessedAt)
+}
+
+// TestConnectWebhookIsStoredWithoutApplying checks events of connected accounts are acknowledged and recorded as
+// handled without touching the platform's mirror
+func TestConnectWebhookIsStoredWithoutApplying(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	const connectSecret = "whsec_fake_connect"
+	t.Setenv("STRIPE_CONNECT_WEBHOOK_SECRETS", connectSecret)
+
+	// a payment of the connected account's own customer
+	event, err := suite.FakeProcessor.NewEvent(stripe.EventTypePaymentIntentSucceeded, &stripe.PaymentIntent{
+		ID:       "pi_connected",
+		Object:   "payment_intent",
+		Amount:   900,
+		Currency: stripe.CurrencyUSD,
+		Customer: &stripe.Customer{ID: "cus_connected"},
+		Status:   stripe.PaymentIntentStatusSucceeded,
+	})
+	require.NoError(t, err)
+	event.Account = "acct_connected"
+
+	rec := postWebhookTo(t, "/webhook/stripe/connect", suite.PaymentHandler.HandleStripeConnectWebhook, suite, event, connectSecret)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	stored, err := suite.PaymentRepo.GetWebhookEventByStripeID(suite.Ctx, event.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.Processed)
+	assert.Nil(t, stored.LastError)
+
+	_, err = suite.PaymentRepo.GetPaymentByIntentID(suite.Ctx, "pi_connected")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+// TestWebhookQueueProcessesDelivery checks a delivery acknowledged by the webhook endpoint is processed by the
+// queue workers
+func TestWebhookQueueProcessesDelivery(t *testing.T) {
+	suite := testutil.SetupFake(t, testutil.WithWebhookQueue())
+	defer suite.CleanupFunc()
+
+	const webhookSecret = "whsec_fake_test"
+	t.Setenv("STRIPE_WEBHOOK_SECRET", webhookSecret)
+
+	testUser := createFakeUser(t, suite)
+
+	intent, err := suite.PaymentService.CreatePaymentIntent(suite.Ctx, 1100, *testUser.StripeCustomerID)
+	require.NoError(t, err)
+
+	event, err := suite.FakeProcessor.SucceedPaymentIntent(intent.PaymentIntentID)
+	require.NoError(t, err)
+
+	rec := postWebhook(t, suite, event, webhookSecret)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	require.Eventually(t, func() bool {
+		stored, err := suite.PaymentRepo.GetWebhookEventByStripeID(suite.Ctx, event.ID)
+		return err == nil && stored.Processed
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.Equal(t, string(stripe.PaymentIntentStatusSucceeded), paymentStatus(t, suite, intent.PaymentIntentID))
+}
+
+// postWebhook signs the event like stripe would and sends it through the webhook handler
+func postWebhook(t *testing.T, suite *testutil.FullSuite, event *stripe.Event, secret string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return postWebhookTo(t, "/webhook/stripe", suite.PaymentHandler.HandleStripeWebhook, suite, event, secret)
+}
+
+// postWebhookTo signs the event like stripe would and sends it through the handler of the given endpoint
+func postWebhookTo(t *testing.T, path string, handler gin.HandlerFunc, suite *testutil.FullSuite, event *stripe.Event, secret string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	payload, signature, err := suite.FakeProcessor.SignEvent(event, secret)
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST(path, handler)
+
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+	req.Header.Set("Stripe-Signature", signature)
+	rec := httptest.NewRecorder()
+
+	router.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// TestWebhookReplayDryRun replays a stored event, first as a dry run reporting the pending changes then for real
+func TestWebhookReplayDryRun(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	intent, err := suite.PaymentService.CreatePaymentIntent(suite.Ctx, 1200, customerId)
+	require.NoError(t, err)
+
+	event, err := suite.FakeProcessor.SucceedPaymentIntent(intent.PaymentIntentID)
+	require.NoError(t, err)
+
+	payload, _, err := suite.FakeProcessor.SignEvent(event, "whsec_fake_test")
+	require.NoError(t, err)
+
+	require.NoError(t, suite.PaymentService.HandleWebhookEvent(suite.Ctx, event, payload))
+
+	request := &payment.WebhookReplayRequest{
+		EventType:  string(stripe.EventTypePaymentIntentSucceeded),
+		CustomerID: customerId,
+		DryRun:     true,
+	}
+
+	// storage already reflects the event, nothing to change
+	res, err := suite.PaymentService.ReplayWebhookEvents(suite.Ctx, request)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Matched)
+	require.NotNil(t, res.Events[0].Changes)
+	assert.Empty(t, res.Events[0].Changes.Rows)
+	assert.Empty(t, res.Events[0].Changes.CacheKeys)
+
+	// a buggy release reverted the payment
+	reverted, err := suite.PaymentRepo.GetPaymentByIntentID(suite.Ctx, intent.PaymentIntentID)
+	require.NoError(t, err)
+	reverted.Status = "pending"
+	require.NoError(t, suite.PaymentRepo.UpsertPayment(suite.Ctx, intent.PaymentIntentID, reverted))
+
+	res, err = suite.PaymentService.ReplayWebhookEvents(suite.Ctx, request)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Matched)
+	assert.Equal(t, 0, res.Replayed)
+	assert.Equal(t, []payment.SyncRowChange{
+		{Table: "payments", Key: intent.PaymentIntentID, Action: "update", Fields: []string{"status"}},
+	}, res.Events[0].Changes.Rows)
+	assert.Equal(t, "pending", paymentStatus(t, suite, intent.PaymentIntentID), "dry run must not write rows")
+
+	// replay for real repairs it
+	request.DryRun = false
+	res, err = suite.PaymentService.ReplayWebhookEvents(suite.Ctx, request)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Replayed)
+	assert.Equal(t, string(stripe.PaymentIntentStatusSucceeded), paymentStatus(t, suite, intent.PaymentIntentID))
+}
+
+// TestWebhookReplayRejectsUnknownState checks the replay endpoint answers bad filters with 400
+func TestWebhookReplayRejectsUnknownState(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	_, err := suite.PaymentService.ReplayWebhookEvents(suite.Ctx, &payment.WebhookReplayRequest{State: "stuck"})
+	assert.ErrorIs(t, err, payment.ErrInvalidReplayFilter)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/admin/webhooks/replay", suite.PaymentHandler.ReplayWebhookEvents)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/webhooks/replay", bytes.NewReader([]byte(`{"state": "stuck"}`)))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// TestRefundWebhookUpdatesPayment checks charge.refunded is applied to the payment of the refunded intent
+func TestRefundWebhookUpdatesPayment(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+
+	intent, err := suite.PaymentService.CreatePaymentIntent(suite.Ctx, 2500, *testUser.StripeCustomerID)
+	require.NoError(t, err)
+
+	event, err := suite.FakeProcessor.SucceedPaymentIntent(intent.PaymentIntentID)
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+
+	event, err = suite.FakeProcessor.RefundPaymentIntent(intent.PaymentIntentID, 1000)
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+	assert.Equal(t, "partially_refunded", paymentStatus(t, suite, intent.PaymentIntentID))
+
+	event, err = suite.FakeProcessor.RefundPaymentIntent(intent.PaymentIntentID, 0)
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+	assert.Equal(t, "refunded", paymentStatus(t, suite, intent.PaymentIntentID))
+}
+
+// TestFullSyncKeepsRefundedPayment checks a full sync after the refund reads the refund from the intent's latest
+// charge rather than reverting the payment to succeeded
+func TestFullSyncKeepsRefundedPayment(t *testing.T) {
+	t.Setenv("STRIPE_FULL_RESYNC_INTERVAL_HOURS", "0")
+
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	intent, err := suite.PaymentService.CreatePaymentIntent(suite.Ctx, 2500, customerId)
+	require.NoError(t, err)
+
+	// paid and refunded a while before the sync, so the sync's newer read wins
+	event, err := suite.FakeProcessor.SucceedPaymentIntent(intent.PaymentIntentID)
+	require.NoError(t, err)
+	event.Created = time.Now().Add(-3 * time.Second).Unix()
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+
+	event, err = suite.FakeProcessor.RefundPaymentIntent(intent.PaymentIntentID, 0)
+	require.NoError(t, err)
+	event.Created = time.Now().Add(-2 * time.Second).Unix()
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+
+	syncer, ok := suite.PaymentService.(user.UserPaymentService)
+	require.True(t, ok)
+	require.NoError(t, syncer.SyncStripeDataToStorage(suite.Ctx, customerId))
+
+	assert.Equal(t, "refunded", paymentStatus(t, suite, intent.PaymentIntentID))
+
+	field := "payment:" + intent.PaymentIntentID
+	hash, err := suite.Cache.HGet(suite.Ctx, cachekey.FromEnv().CustomerData(customerId), field)
+	require.NoError(t, err)
+	require.Contains(t, hash, field)
+
+	var cached payment.StripePaymentsCache
+	require.NoError(t, codec.Decode([]byte(hash[field].Value), &cached))
+	assert.Equal(t, "refunded", cached.Status)
+}
+
+// TestCatalogWebhookInvalidatesProducts checks product events drop the cached product list
+func TestCatalogWebhookInvalidatesProducts(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	_, err := suite.PaymentService.SetupProducts(suite.Ctx, &payment.SetupProductsReq{Name: "Mug", Price: 1500})
+	require.NoError(t, err)
+
+	products, err := suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+	require.Len(t, products.Products, 1)
+
+	_, err = suite.PaymentService.SetupProducts(suite.Ctx, &payment.SetupProductsReq{Name: "Poster", Price: 900})
+	require.NoError(t, err)
+
+	// still served from cache
+	products, err = suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+	require.Len(t, products.Products, 1)
+
+	event, err := suite.FakeProcessor.NewEvent(stripe.EventTypeProductCreated, &stripe.Product{ID: "prod_poster", Object: "product"})
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+
+	products, err = suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+	assert.Len(t, products.Products, 2)
+}
+
+// TestSetupProductWithSeveralPrices checks every price of a product is listed with the default one first
+func TestSetupProductWithSeveralPrices(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	_, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{
+		Name:   "Pro",
+		Prices: []*payment.SetupPriceReq{{Amount: 999, Interval: "month", IntervalCount: 40}},
+	})
+	assert.ErrorIs(t, err, payment.ErrInvalidPrice)
+
+	setup, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{
+		Name: "Pro",
+		Prices: []*payment.SetupPriceReq{
+			{Amount: 49900, LookupKey: "pro_lifetime"},
+			{Amount: 999, Interval: "month", LookupKey: "pro_monthly"},
+			{Amount: 9900, Interval: "year", LookupKey: "pro_yearly"},
+		},
+	})
+	require.NoError(t, err)
+
+	products, err := suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+	require.Len(t, products.Products, 1)
+
+	product := products.Products[0]
+	assert.Equal(t, setup.PriceID, product.PriceID)
+	assert.Equal(t, "subscription", product.Type)
+	require.Len(t, product.Prices, 3)
+	assert.Equal(t, "pro_monthly", product.Prices[0].LookupKey)
+	assert.True(t, product.Prices[0].Default)
+	assert.Equal(t, "pro_lifetime", product.Prices[1].LookupKey)
+	assert.Equal(t, "one-time", product.Prices[1].Type)
+	assert.Equal(t, "year", product.Prices[2].Interval)
+
+	// the monthly default is what subscriptions are charged
+	testUser := createFakeUser(t, suite)
+
+	sub, err := suite.PaymentService.SubscribeToProduct(suite.Ctx, testUser.ID, &payment.SubscribeRequest{
+		ProductID:  product.ID,
+		CustomerID: *testUser.StripeCustomerID,
+	})
+	require.NoError(t, err)
+
+	subscription, err := suite.FakeProcessor.GetSubscription(suite.Ctx, sub.SubscriptionID)
+	require.NoError(t, err)
+	assert.Equal(t, setup.PriceID, subscription.Items.Data[0].Price.ID)
+}
+
+// TestSubscribeToNonDefaultPrice checks purchases and subscriptions can select another active price of the product
+func TestSubscribeToNonDefaultPrice(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	setup, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{
+		Name: "Pro",
+		Prices: []*payment.SetupPriceReq{
+			{Amount: 999, Interval: "month", LookupKey: "pro_monthly"},
+			{Amount: 9900, Interval: "year", LookupKey: "pro_yearly"},
+			{Amount: 49900, LookupKey: "pro_lifetime"},
+			{Amount: 2900, Interval: "week", LookupKey: "pro_weekly"},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, setup.Prices, 4)
+
+	team := setupFakePlan(t, suite, "Team", 5000)
+
+	_, err = suite.FakeProcessor.DeactivatePrice(setup.Prices[3].ID)
+	require.NoError(t, err)
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	rejected := []payment.PriceSelector{
+		{PriceID: team.PriceID},                                 // another product's
+		{LookupKey: "pro_weekly"},                               // inactive
+		{LookupKey: "pro_lifetime"},                             // one-time
+		{LookupKey: "pro_daily"},                                // unknown
+		{PriceID: setup.Prices[1].ID, LookupKey: "pro_monthly"}, // two different prices
+	}
+
+	for _, selector := range rejected {
+		_, err = suite.PaymentService.SubscribeToProduct(suite.Ctx, testUser.ID, &payment.SubscribeRequest{
+			ProductID:     setup.ProductID,
+			CustomerID:    customerId,
+			PriceSelector: selector,
+		})
+		assert.ErrorIs(t, err, payment.ErrInvalidPrice, "%+v", selector)
+	}
+
+	sub, err := suite.PaymentService.SubscribeToProduct(suite.Ctx, testUser.ID, &payment.SubscribeRequest{
+		ProductID:     setup.ProductID,
+		CustomerID:    customerId,
+		PriceSelector: payment.PriceSelector{LookupKey: "pro_yearly"},
+	})
+	require.NoError(t, err)
+
+	subscription, err := suite.FakeProcessor.GetSubscription(suite.Ctx, sub.SubscriptionID)
+	require.NoError(t, err)
+	assert.Equal(t, setup.Prices[1].ID, subscription.Items.Data[0].Price.ID)
+	assert.Equal(t, int64(9900), subscription.Items.Data[0].Price.UnitAmount)
+
+	// recurring prices are subscribed to, not purchased
+	_, err = suite.PaymentService.PurchaseProduct(suite.Ctx, testUser.ID, &payment.PurchaseProductRequest{
+		ProductID:     setup.ProductID,
+		CustomerID:    customerId,
+		PriceSelector: payment.PriceSelector{PriceID: setup.Prices[1].ID},
+	})
+	assert.ErrorIs(t, err, payment.ErrInvalidPrice)
+
+	purchase, err := suite.PaymentService.PurchaseProduct(suite.Ctx, testUser.ID, &payment.PurchaseProductRequest{
+		ProductID:     setup.ProductID,
+		CustomerID:    customerId,
+		PriceSelector: payment.PriceSelector{LookupKey: "pro_lifetime"},
+	})
+	require.NoError(t, err)
+
+	stored, err := suite.PaymentRepo.GetPaymentByIntentID(suite.Ctx, purchase.PaymentIntentID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(49900), stored.Amount)
+}
+
+// TestUnsupportedWebhookIsAcknowledged checks events without a handler are accepted so stripe stops retrying them
+func TestUnsupportedWebhookIsAcknowledged(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	const webhookSecret = "whsec_fake_test"
+	t.Setenv("STRIPE_WEBHOOK_SECRET", webhookSecret)
+
+	event, err := suite.FakeProcessor.NewEvent(stripe.EventTypeCustomerDiscountCreated, &stripe.Discount{ID: "di_fake", Object: "discount"})
+	require.NoError(t, err)
+
+	rec := postWebhook(t, suite, event, webhookSecret)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// TestStaleWebhookDoesNotRegressPayment delivers an older event after a newer one and checks it is ignored
+func TestStaleWebhookDoesNotRegressPayment(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	intent, err := suite.PaymentService.CreatePaymentIntent(suite.Ctx, 900, customerId)
+	require.NoError(t, err)
+
+	succeeded, err := suite.FakeProcessor.SucceedPaymentIntent(intent.PaymentIntentID)
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, succeeded))
+
+	// a failed attempt from before the successful one, delivered late
+	stale, err := suite.FakeProcessor.NewEvent(stripe.EventTypePaymentIntentPaymentFailed, &stripe.PaymentIntent{
+		ID:       intent.PaymentIntentID,
+		Object:   "payment_intent",
+		Amount:   900,
+		Currency: stripe.CurrencyUSD,
+		Customer: &stripe.Customer{ID: customerId},
+		Status:   stripe.PaymentIntentStatusRequiresPaymentMethod,
+	})
+	require.NoError(t, err)
+	stale.Created = succeeded.Created - 60
+
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, stale))
+	assert.Equal(t, string(stripe.PaymentIntentStatusSucceeded), paymentStatus(t, suite, intent.PaymentIntentID))
+
+	field := "payment:" + intent.PaymentIntentID
+	hash, err := suite.Cache.HGet(suite.Ctx, cachekey.FromEnv().CustomerData(customerId), field)
+	require.NoError(t, err)
+	require.Contains(t, hash, field)
+
+	var cached payment.StripePaymentsCache
+	require.NoError(t, codec.Decode([]byte(hash[field].Value), &cached))
+	assert.Equal(t, string(stripe.PaymentIntentStatusSucceeded), cached.Status)
+}
+
+// TestWebhookInSameSecondAsSyncIsApplied checks an event created in the second a sync read stripe in wins over the
+// sync, the change it carries may have been made after the read
+func TestWebhookInSameSecondAsSyncIsApplied(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	// wait for the sync started by the signup
+	require.Eventually(t, func() bool {
+		_, err := suite.PaymentRepo.GetCustomerSyncState(suite.Ctx, customerId)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	intent, err := suite.PaymentService.CreatePaymentIntent(suite.Ctx, 800, customerId)
+	require.NoError(t, err)
+
+	syncer, ok := suite.PaymentService.(user.UserPaymentService)
+	require.True(t, ok)
+
+	syncedAt := time.Now()
+	require.NoError(t, syncer.SyncStripeDataToStorage(suite.Ctx, customerId))
+	require.NotEqual(t, string(stripe.PaymentIntentStatusSucceeded), paymentStatus(t, suite, intent.PaymentIntentID))
+
+	// paid right after the sync read the intent, stripe stamps the event with the same second
+	succeeded, err := suite.FakeProcessor.SucceedPaymentIntent(intent.PaymentIntentID)
+	require.NoError(t, err)
+	succeeded.Created = syncedAt.Unix()
+
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, succeeded))
+	assert.Equal(t, string(stripe.PaymentIntentStatusSucceeded), paymentStatus(t, suite, intent.PaymentIntentID))
+
+	field := "payment:" + intent.PaymentIntentID
+	hash, err := suite.Cache.HGet(suite.Ctx, cachekey.FromEnv().CustomerData(customerId), field)
+	require.NoError(t, err)
+	require.Contains(t, hash, field)
+
+	var cached payment.StripePaymentsCache
+	require.NoError(t, codec.Decode([]byte(hash[field].Value), &cached))
+	assert.Equal(t, string(stripe.PaymentIntentStatusSucceeded), cached.Status)
+}
+
+// TestSyncCachesEachSubscriptionsPaymentMethod checks every cached subscription shows its own card, not the first
+// subscription's
+func TestSyncCachesEachSubscriptionsPaymentMethod(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	var subscriptionIds []string
+
+	for _, name := range []string{"Basic", "Pro"} {
+		setup, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{Name: name, Price: 1000, TrialDays: 14})
+		require.NoError(t, err)
+
+		sub, err := suite.PaymentService.SubscribeToProduct(suite.Ctx, testUser.ID, &payment.SubscribeRequest{
+			ProductID:  setup.ProductID,
+			CustomerID: customerId,
+		})
+		require.NoError(t, err)
+
+		subscriptionIds = append(subscriptionIds, sub.SubscriptionID)
+	}
+
+	// only the second subscription gets a card
+	subs, err := suite.FakeProcessor.ListSubscriptions(suite.Ctx, customerId, nil)
+	require.NoError(t, err)
+
+	for _, sub := range subs {
+		if sub.ID == subscriptionIds[1] {
+			require.NotNil(t, sub.PendingSetupIntent)
+			_, err := suite.FakeProcessor.SucceedSetupIntent(sub.PendingSetupIntent.ID)
+			require.NoError(t, err)
+		}
+	}
+
+	syncer, ok := suite.PaymentService.(user.UserPaymentService)
+	require.True(t, ok)
+	require.NoError(t, syncer.SyncStripeDataToStorage(suite.Ctx, customerId))
+
+	reader, ok := suite.PaymentService.(interface {
+		GetStripeData(ctx context.Context, customerId string) (*payment.StripeCacheData, error)
+	})
+	require.True(t, ok)
+
+	data, err := reader.GetStripeData(suite.Ctx, customerId)
+	require.NoError(t, err)
+	require.Len(t, data.Subscriptions, 2)
+
+	for _, cached := range data.Subscriptions {
+		if cached.SubscriptionID == subscriptionIds[1] {
+			require.NotNil(t, cached.PaymentMethod)
+			assert.Equal(t, "4242", cached.PaymentMethod.Last4)
+		} else {
+			assert.Nil(t, cached.PaymentMethod, "subscription %s has no card of its own", cached.SubscriptionID)
+		}
+	}
+}
+
+// TestSyncPaginatesAndResumes checks a sync cut short by the page limit is continued by the next syncs
+func TestSyncPaginatesAndResumes(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	syncState := func() *payment.CustomerSyncState {
+		state, err := suite.PaymentRepo.GetCustomerSyncState(suite.Ctx, customerId)
+		if err != nil {
+			return nil
+		}
+		return state
+	}
+
+	// wait for the sync started by the signup
+	require.Eventually(t, func() bool { return syncState() != nil }, 5*time.Second, 50*time.Millisecond)
+
+	for range 5 {
+		_, err := suite.PaymentService.CreatePaymentIntent(suite.Ctx, 300, customerId)
+		require.NoError(t, err)
+	}
+
+	// the sync is part of the service the user package depends on
+	syncer, ok := suite.PaymentService.(user.UserPaymentService)
+	require.True(t, ok)
+
+	t.Setenv("STRIPE_SYNC_PAGE_SIZE", "2")
+	t.Setenv("STRIPE_SYNC_MAX_PAGES", "1")
+
+	countPayments := func() int {
+		intents, _, err := suite.FakeProcessor.ListPaymentIntents(suite.Ctx, customerId, nil)
+		require.NoError(t, err)
+
+		var count int
+		for _, intent := range intents {
+			if _, err := suite.PaymentRepo.GetPaymentByIntentID(suite.Ctx, intent.ID); err == nil {
+				count++
+			}
+		}
+		return count
+	}
+
+	require.NoError(t, syncer.SyncStripeDataToStorage(suite.Ctx, customerId))
+	assert.Equal(t, 2, countPayments())
+	require.NotNil(t, syncState().PassCursor, "unfinished pass keeps its cursor")
+
+	require.NoError(t, syncer.SyncStripeDataToStorage(suite.Ctx, customerId))
+	require.NoError(t, syncer.SyncStripeDataToStorage(suite.Ctx, customerId))
+	assert.Equal(t, 5, countPayments())
+
+	state := syncState()
+	assert.Nil(t, state.PassCursor, "pass finished")
+	assert.NotZero(t, state.PaymentsCreatedGte)
+}
+
+// TestFailedWebhookFallsBackToFullSync checks a webhook whose targeted update fails syncs objects an incremental
+// pass doesn't list
+func TestFailedWebhookFallsBackToFullSync(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	waitForSignupSync(t, suite, customerId)
+
+	intent, err := suite.PaymentService.CreatePaymentIntent(suite.Ctx, 1200, customerId)
+	require.NoError(t, err)
+	_, err = suite.FakeProcessor.SucceedPaymentIntent(intent.PaymentIntentID)
+	require.NoError(t, err)
+
+	// the intent is older than the high-water mark and a full pass isn't due
+	state, err := suite.PaymentRepo.GetCustomerSyncState(suite.Ctx, customerId)
+	require.NoError(t, err)
+
+	now := time.Now()
+	state.PaymentsCreatedGte = now.Add(time.Hour).Unix()
+	state.LastFullSyncAt = &now
+	require.NoError(t, suite.PaymentRepo.SaveCustomerSyncState(suite.Ctx, state))
+
+	syncer, ok := suite.PaymentService.(user.UserPaymentService)
+	require.True(t, ok)
+	require.NoError(t, syncer.SyncStripeDataToStorage(suite.Ctx, customerId))
+
+	_, err = suite.PaymentRepo.GetPaymentByIntentID(suite.Ctx, intent.PaymentIntentID)
+	require.ErrorIs(t, err, sql.ErrNoRows, "incremental passes don't list the intent")
+
+	// names the customer but doesn't decode as a payment intent
+	event := &stripe.Event{
+		ID:   "evt_undecodable",
+		Type: stripe.EventTypePaymentIntentSucceeded,
+		Data: &stripe.EventData{
+			Raw: json.RawMessage(fmt.Sprintf(`{"id": %q, "object": "payment_intent", "customer": %q, "amount": "twelve"}`, intent.PaymentIntentID, customerId)),
+		},
+	}
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+
+	assert.Equal(t, string(stripe.PaymentIntentStatusSucceeded), paymentStatus(t, suite, intent.PaymentIntentID))
+}
+
+// TestStripeDataReadThroughIsStampedeSafe checks concurrent misses share one sync and outages serve the stale copy
+func TestStripeDataReadThroughIsStampedeSafe(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+	key := cachekey.FromEnv().CustomerData(customerId)
+
+	reader, ok := suite.PaymentService.(interface {
+		GetStripeData(ctx context.Context, customerId string) (*payment.StripeCacheData, error)
+	})
+	require.True(t, ok)
+
+	waitForSignupSync(t, suite, customerId)
+
+	require.NoError(t, suite.Cache.Del(suite.Ctx, key))
+	readsBefore := suite.FakeProcessor.CustomerReads()
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			data, err := reader.GetStripeData(suite.Ctx, customerId)
+			assert.NoError(t, err)
+			assert.NotNil(t, data)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, suite.FakeProcessor.CustomerReads()-readsBefore, "concurrent misses share one sync")
+
+	// stale copies are served while stripe is down
+	t.Setenv("STRIPE_DATA_FRESH_SECONDS", "0")
+	t.Setenv("STRIPE_DATA_STALE_WHILE_REVALIDATE", "false")
+	suite.FakeProcessor.SetUnavailable(true)
+
+	data, err := reader.GetStripeData(suite.Ctx, customerId)
+	require.NoError(t, err)
+	assert.Equal(t, customerId, data.CustomerData.ID)
+
+	// without a copy the outage surfaces
+	require.NoError(t, suite.Cache.Del(suite.Ctx, key))
+
+	_, err = reader.GetStripeData(suite.Ctx, customerId)
+	assert.ErrorIs(t, err, payment.ErrStripeUnavailable)
+
+	suite.FakeProcessor.SetUnavailable(false)
+}
+
+// TestCoalescedSyncWaitsForItsFollowUp checks a sync requested while another one runs returns the result of the
+// follow-up covering it, not before
+func TestCoalescedSyncWaitsForItsFollowUp(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+	keys := cachekey.FromEnv()
+
+	waitForSignupSync(t, suite, customerId)
+
+	// another instance is syncing the customer
+	running, acquired, err := lock.TryAcquire(suite.Ctx, suite.Cache, keys.SyncLock(customerId), time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	syncer, ok := suite.PaymentService.(user.UserPaymentService)
+	require.True(t, ok)
+
+	suite.FakeProcessor.SetUnavailable(true)
+	defer suite.FakeProcessor.SetUnavailable(false)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- syncer.SyncStripeDataToStorage(suite.Ctx, customerId)
+	}()
+
+	select {
+	case err := <-result:
+		t.Fatalf("coalesced sync returned while the running one held the lock: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	_, err = suite.Cache.Get(suite.Ctx, keys.SyncPending(customerId))
+	require.NoError(t, err, "the follow-up is requested")
+
+	require.NoError(t, running.Release(suite.Ctx))
+
+	select {
+	case err := <-result:
+		assert.ErrorIs(t, err, payment.ErrStripeUnavailable, "the follow-up's failure is reported to the coalesced caller")
+	case <-time.After(5 * time.Second):
+		t.Fatal("coalesced sync didn't finish after the lock was released")
+	}
+}
+
+// TestCacheWarmerRebuildsFlushedMappings checks a warm pass restores mappings lost by a flush
+func TestCacheWarmerRebuildsFlushedMappings(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+	keys := cachekey.FromEnv()
+
+	waitForSignupSync(t, suite, customerId)
+	require.NoError(t, suite.Cache.Del(suite.Ctx, keys.UserIdToCustomerId(testUser.ID.String()), keys.CustomerIdToUserId(customerId)))
+
+	result, err := suite.PaymentService.WarmCache(suite.Ctx)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, result.MappingsWarmed, 2)
+
+	cached, err := suite.Cache.Get(suite.Ctx, keys.UserIdToCustomerId(testUser.ID.String()))
+	require.NoError(t, err)
+	assert.Equal(t, customerId, cached)
+
+	cached, err = suite.Cache.Get(suite.Ctx, keys.CustomerIdToUserId(customerId))
+	require.NoError(t, err)
+	assert.Equal(t, testUser.ID.String(), cached)
+}
+
+// TestConsistencyCheckRepairsDrift checks a drifted mapping is reported and rewritten
+func TestConsistencyCheckRepairsDrift(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+	key := cachekey.FromEnv().UserIdToCustomerId(testUser.ID.String())
+
+	require.NoError(t, suite.Cache.Set(suite.Ctx, key, "cus_drifted", 0))
+
+	report, err := suite.PaymentService.CheckCacheConsistency(suite.Ctx, &payment.ConsistencyCheckRequest{Sample: 500, Repair: true})
+	require.NoError(t, err)
+
+	var found bool
+	for _, mismatch := range report.Mismatches {
+		if mismatch.CustomerID == customerId && mismatch.Actual == "cus_drifted" {
+			found = true
+			assert.Equal(t, "cache", mismatch.Source)
+			assert.Equal(t, customerId, mismatch.Expected)
+		}
+	}
+	assert.True(t, found, "drifted mapping is reported")
+	assert.GreaterOrEqual(t, report.Repaired, 1)
+
+	cached, err := suite.Cache.Get(suite.Ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, customerId, cached)
+}
+
+// subscribeFakeUser creates a user with an active, paid subscription and returns the user and the subscription id
+func subscribeFakeUser(t *testing.T, suite *testutil.FullSuite) (*user.User, string) {
+	t.Helper()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	_, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{Name: "Pro", Price: 3000})
+	require.NoError(t, err)
+
+	products, err := suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, products.Products)
+
+	sub, err := suite.PaymentService.SubscribeToProduct(suite.Ctx, testUser.ID, &payment.SubscribeRequest{
+		ProductID:  products.Products[0].ID,
+		CustomerID: customerId,
+	})
+	require.NoError(t, err)
+
+	// what SubscribeToSite records along with the subscription
+	require.NoError(t, suite.UserRepo.UpdateSubscribed(suite.Ctx, testUser.ID, true))
+
+	intents, _, err := suite.FakeProcessor.ListPaymentIntents(suite.Ctx, customerId, nil)
+	require.NoError(t, err)
+	require.Len(t, intents, 1)
+
+	_, err = suite.FakeProcessor.SucceedPaymentIntent(intents[0].ID)
+	require.NoError(t, err)
+
+	// mirrors the paid subscription, items and latest invoice included
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, suite.FakeProcessor.LatestEvent(stripe.EventTypeCustomerSubscriptionUpdated)))
+
+	return testUser, sub.SubscriptionID
+}
+
+// TestCancelSubscriptionAtPeriodEndAndResume checks a scheduled cancellation keeps access and can be taken back
+func TestCancelSubscriptionAtPeriodEndAndResume(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser, subscriptionId := subscribeFakeUser(t, suite)
+
+	canceled, err := suite.PaymentService.CancelSubscription(suite.Ctx, testUser.ID, &payment.CancelSubscriptionRequest{
+		SubscriptionID: subscriptionId,
+		AtPeriodEnd:    true,
+		Reason:         "too_expensive",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, string(stripe.SubscriptionStatusActive), canceled.Status)
+	assert.True(t, canceled.CancelAtPeriodEnd)
+	assert.NotNil(t, canceled.AccessEndsAt)
+
+	record, err := suite.PaymentService.GetActiveSubscription(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.True(t, record.CancelAtPeriodEnd)
+	assert.Equal(t, "too_expensive", record.CancellationFeedback)
+
+	status, err := suite.PaymentService.GetSubscriptionStatus(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.True(t, status.HasAccess)
+	assert.True(t, status.CancelAtPeriodEnd)
+
+	resumed, err := suite.PaymentService.ResumeSubscription(suite.Ctx, testUser.ID, &payment.ResumeSubscriptionRequest{SubscriptionID: subscriptionId})
+	require.NoError(t, err)
+	assert.False(t, resumed.CancelAtPeriodEnd)
+	assert.Nil(t, resumed.AccessEndsAt)
+
+	status, err = suite.PaymentService.GetSubscriptionStatus(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.False(t, status.CancelAtPeriodEnd)
+
+	_, err = suite.PaymentService.ResumeSubscription(suite.Ctx, testUser.ID, &payment.ResumeSubscriptionRequest{SubscriptionID: subscriptionId})
+	assert.ErrorIs(t, err, payment.ErrCancellationNotScheduled)
+}
+
+// TestCancelSubscriptionImmediatelyWithRefund checks an immediate cancellation ends access and refunds the rest
+func TestCancelSubscriptionImmediatelyWithRefund(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser, subscriptionId := subscribeFakeUser(t, suite)
+
+	// other users can't cancel it
+	_, err := suite.PaymentService.CancelSubscription(suite.Ctx, uuid.New(), &payment.CancelSubscriptionRequest{SubscriptionID: subscriptionId})
+	assert.ErrorIs(t, err, payment.ErrSubscriptionNotFound)
+
+	canceled, err := suite.PaymentService.CancelSubscription(suite.Ctx, testUser.ID, &payment.CancelSubscriptionRequest{
+		SubscriptionID: subscriptionId,
+		Refund:         true,
+		Reason:         "unused",
+		Comment:        "not using it anymore",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, string(stripe.SubscriptionStatusCanceled), canceled.Status)
+	assert.Greater(t, canceled.RefundedAmount, int64(0))
+	assert.LessOrEqual(t, canceled.RefundedAmount, int64(3000))
+	assert.NotNil(t, suite.FakeProcessor.LatestEvent(stripe.EventTypeChargeRefunded))
+
+	updatedUser, err := suite.UserService.GetByID(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.False(t, updatedUser.Subscribed)
+
+	record, err := suite.PaymentRepo.GetSubscriptionByStripeID(suite.Ctx, subscriptionId)
+	require.NoError(t, err)
+	assert.Equal(t, "not using it anymore", record.CancellationComment)
+
+	status, err := suite.PaymentService.GetSubscriptionStatus(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.False(t, status.HasAccess)
+
+	_, err = suite.PaymentService.CancelSubscription(suite.Ctx, testUser.ID, &payment.CancelSubscriptionRequest{SubscriptionID: subscriptionId})
+	assert.ErrorIs(t, err, payment.ErrSubscriptionEnded)
+}
+
+// TestCancelSubscriptionWhenRefundFails checks a failed refund reports what is left to refund without undoing the
+// cancellation
+func TestCancelSubscriptionWhenRefundFails(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser, subscriptionId := subscribeFakeUser(t, suite)
+
+	suite.FakeProcessor.SetRefundsFailing(true)
+
+	canceled, err := suite.PaymentService.CancelSubscription(suite.Ctx, testUser.ID, &payment.CancelSubscriptionRequest{
+		SubscriptionID: subscriptionId,
+		Refund:         true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, string(stripe.SubscriptionStatusCanceled), canceled.Status)
+	assert.Zero(t, canceled.RefundedAmount)
+	assert.Greater(t, canceled.RefundDue, int64(0))
+	assert.LessOrEqual(t, canceled.RefundDue, int64(3000))
+	assert.NotEmpty(t, canceled.RefundError)
+	assert.Nil(t, suite.FakeProcessor.LatestEvent(stripe.EventTypeChargeRefunded))
+
+	record, err := suite.PaymentRepo.GetSubscriptionByStripeID(suite.Ctx, subscriptionId)
+	require.NoError(t, err)
+	assert.Equal(t, string(stripe.SubscriptionStatusCanceled), record.Status)
+}
+
+// TestCancelSubscriptionWhenMirroringFails checks the refund is made after stripe canceled even when storing the
+// canceled subscription fails
+func TestCancelSubscriptionWhenMirroringFails(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser, subscriptionId := subscribeFakeUser(t, suite)
+
+	// the customer's user can't be resolved while mirroring
+	key := cachekey.FromEnv().CustomerIdToUserId(*testUser.StripeCustomerID)
+	require.NoError(t, suite.Cache.Set(suite.Ctx, key, "not-a-user-id", time.Minute))
+
+	canceled, err := suite.PaymentService.CancelSubscription(suite.Ctx, testUser.ID, &payment.CancelSubscriptionRequest{
+		SubscriptionID: subscriptionId,
+		Refund:         true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, string(stripe.SubscriptionStatusCanceled), canceled.Status)
+	assert.NotEmpty(t, canceled.MirrorError)
+	assert.Greater(t, canceled.RefundedAmount, int64(0))
+	assert.Zero(t, canceled.RefundDue)
+	assert.NotNil(t, suite.FakeProcessor.LatestEvent(stripe.EventTypeChargeRefunded))
+}
+
+// TestCancelTrialWithRefund checks nothing is refunded for a trial, which wasn't paid for
+func TestCancelTrialWithRefund(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+
+	_, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{Name: "Pro", Price: 3000, TrialDays: 14})
+	require.NoError(t, err)
+
+	products, err := suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+
+	sub, err := suite.PaymentService.SubscribeToProduct(suite.Ctx, testUser.ID, &payment.SubscribeRequest{
+		ProductID:  products.Products[0].ID,
+		CustomerID: *testUser.StripeCustomerID,
+	})
+	require.NoError(t, err)
+
+	canceled, err := suite.PaymentService.CancelSubscription(suite.Ctx, testUser.ID, &payment.CancelSubscriptionRequest{
+		SubscriptionID: sub.SubscriptionID,
+		Refund:         true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, string(stripe.SubscriptionStatusCanceled), canceled.Status)
+	assert.Zero(t, canceled.RefundedAmount)
+	assert.Zero(t, canceled.RefundDue)
+	assert.Nil(t, suite.FakeProcessor.LatestEvent(stripe.EventTypeChargeRefunded))
+}
+
+// TestPauseSubscriptionDeniesAccess checks a paused subscription reports paused without access until unpaused
+func TestPauseSubscriptionDeniesAccess(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser, subscriptionId := subscribeFakeUser(t, suite)
+
+	_, err := suite.PaymentService.PauseSubscription(suite.Ctx, testUser.ID, &payment.PauseSubscriptionRequest{SubscriptionID: subscriptionId, Behavior: "skip"})
+	assert.ErrorIs(t, err, payment.ErrInvalidPause)
+
+	past := time.Now().Add(-time.Hour)
+	_, err = suite.PaymentService.PauseSubscription(suite.Ctx, testUser.ID, &payment.PauseSubscriptionRequest{SubscriptionID: subscriptionId, Behavior: "void", ResumesAt: &past})
+	assert.ErrorIs(t, err, payment.ErrInvalidPause)
+
+	resumesAt := time.Now().AddDate(0, 3, 0).Truncate(time.Second)
+
+	paused, err := suite.PaymentService.PauseSubscription(suite.Ctx, testUser.ID, &payment.PauseSubscriptionRequest{
+		SubscriptionID: subscriptionId,
+		Behavior:       "void",
+		ResumesAt:      &resumesAt,
+	})
+	require.NoError(t, err)
+	assert.True(t, paused.Paused)
+	assert.Equal(t, string(stripe.SubscriptionStatusActive), paused.Status, "stripe keeps the subscription active")
+	require.NotNil(t, paused.ResumesAt)
+	assert.True(t, resumesAt.Equal(*paused.ResumesAt))
+
+	status, err := suite.PaymentService.GetSubscriptionStatus(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.False(t, status.HasAccess)
+	assert.Equal(t, "paused", status.Status)
+	assert.NotNil(t, status.ResumesAt)
+
+	record, err := suite.PaymentService.GetActiveSubscription(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "void", record.PauseBehavior)
+
+	unpaused, err := suite.PaymentService.UnpauseSubscription(suite.Ctx, testUser.ID, &payment.UnpauseSubscriptionRequest{SubscriptionID: subscriptionId})
+	require.NoError(t, err)
+	assert.False(t, unpaused.Paused)
+
+	status, err = suite.PaymentService.GetSubscriptionStatus(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.True(t, status.HasAccess)
+	assert.Equal(t, string(stripe.SubscriptionStatusActive), status.Status)
+
+	_, err = suite.PaymentService.UnpauseSubscription(suite.Ctx, testUser.ID, &payment.UnpauseSubscriptionRequest{SubscriptionID: subscriptionId})
+	assert.ErrorIs(t, err, payment.ErrSubscriptionNotPaused)
+}
+
+// TestTrialSubscriptionWithoutCard checks a trial grants access without paying and is canceled when it ends
+// without a card
+func TestTrialSubscriptionWithoutCard(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	_, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{Name: "Pro", Price: 3000, TrialDays: 14})
+	require.NoError(t, err)
+
+	products, err := suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+	require.Len(t, products.Products, 1)
+	assert.Equal(t, int64(14), products.Products[0].TrialDays)
+
+	tooLong := int64(1000)
+	_, err = suite.PaymentService.SubscribeToProduct(suite.Ctx, testUser.ID, &payment.SubscribeRequest{ProductID: products.Products[0].ID, CustomerID: customerId, TrialDays: &tooLong})
+	assert.ErrorIs(t, err, payment.ErrInvalidTrial)
+
+	sub, err := suite.PaymentService.SubscribeToProduct(suite.Ctx, testUser.ID, &payment.SubscribeRequest{
+		ProductID:  products.Products[0].ID,
+		CustomerID: customerId,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, string(stripe.SubscriptionStatusTrialing), sub.Status)
+	assert.Equal(t, "setup_intent", sub.ClientSecretType)
+	require.NotNil(t, sub.TrialEnd)
+
+	// nothing was charged up front
+	intents, _, err := suite.FakeProcessor.ListPaymentIntents(suite.Ctx, customerId, nil)
+	require.NoError(t, err)
+	assert.Empty(t, intents)
+
+	status, err := suite.PaymentService.GetSubscriptionStatus(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.True(t, status.HasAccess)
+	assert.Equal(t, string(stripe.SubscriptionStatusTrialing), status.Status)
+	require.NotNil(t, status.TrialEnd)
+	assert.True(t, sub.TrialEnd.Equal(*status.TrialEnd))
+
+	event, err := suite.FakeProcessor.TrialWillEnd(sub.SubscriptionID)
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+
+	// the user can be asked for a card before the trial ends
+	current, err := suite.PaymentService.GetActiveSubscription(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	require.NotNil(t, current.TrialEndingNoticeAt)
+
+	event, err = suite.FakeProcessor.EndTrial(sub.SubscriptionID)
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+
+	status, err = suite.PaymentService.GetSubscriptionStatus(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.False(t, status.HasAccess)
+	assert.Equal(t, string(stripe.SubscriptionStatusCanceled), status.Status)
+	assert.Nil(t, status.TrialEnd)
+}
+
+// TestTrialWithCustomersDefaultCard checks a card saved as the customer's default for invoices counts for the trial
+func TestTrialWithCustomersDefaultCard(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser := createFakeUser(t, suite)
+	customerId := *testUser.StripeCustomerID
+
+	_, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{Name: "Pro", Price: 3000, TrialDays: 14})
+	require.NoError(t, err)
+
+	products, err := suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+
+	sub, err := suite.PaymentService.SubscribeToProduct(suite.Ctx, testUser.ID, &payment.SubscribeRequest{
+		ProductID:  products.Products[0].ID,
+		CustomerID: customerId,
+	})
+	require.NoError(t, err)
+
+	_, err = suite.FakeProcessor.SetDefaultCard(customerId)
+	require.NoError(t, err)
+
+	event, err := suite.FakeProcessor.TrialWillEnd(sub.SubscriptionID)
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+
+	current, err := suite.PaymentService.GetActiveSubscription(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.Nil(t, current.TrialEndingNoticeAt)
+
+	event, err = suite.FakeProcessor.EndTrial(sub.SubscriptionID)
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+
+	status, err := suite.PaymentService.GetSubscriptionStatus(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.True(t, status.HasAccess)
+	assert.Equal(t, string(stripe.SubscriptionStatusActive), status.Status)
+}
+
+// setupFakePlan adds another subscription product and returns it
+func setupFakePlan(t *testing.T, suite *testutil.FullSuite, name string, price int64) payment.ProductInfo {
+	t.Helper()
+
+	setup, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{Name: name, Price: price})
+	require.NoError(t, err)
+
+	// the products listed before are cached until stripe announces the new one
+	event, err := suite.FakeProcessor.NewEvent(stripe.EventTypeProductCreated, &stripe.Product{ID: setup.ProductID, Object: "product"})
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+
+	products, err := suite.PaymentService.GetProducts(suite.Ctx)
+	require.NoError(t, err)
+
+	for _, product := range products.Products {
+		if product.Name == name {
+			return product
+		}
+	}
+
+	t.Fatalf("product %s was not set up", name)
+	return payment.ProductInfo{}
+}
+
+// TestChangePlanUpgradeAsPreviewed checks an upgrade is prorated as previewed and mirrored right away
+func TestChangePlanUpgradeAsPreviewed(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser, subscriptionId := subscribeFakeUser(t, suite)
+	premium := setupFakePlan(t, suite, "Premium", 6000)
+
+	request := &payment.ChangePlanRequest{SubscriptionID: subscriptionId, ProductID: premium.ID}
+
+	preview, err := suite.PaymentService.PreviewPlanChange(suite.Ctx, testUser.ID, request)
+	require.NoError(t, err)
+	assert.False(t, preview.Downgrade)
+	assert.Equal(t, premium.PriceID, preview.NewPriceID)
+	assert.Equal(t, "create_prorations", preview.ProrationBehavior)
+	assert.Greater(t, preview.ProrationAmount, int64(0), "the rest of the period costs more")
+	assert.Equal(t, int64(6000)+preview.ProrationAmount, preview.AmountDue, "prorations are added to the renewal")
+	assert.NotNil(t, preview.InvoiceAt)
+	assert.Len(t, preview.Lines, 3)
+
+	// deferring is for downgrades
+	_, err = suite.PaymentService.ChangePlan(suite.Ctx, testUser.ID, &payment.ChangePlanRequest{SubscriptionID: subscriptionId, ProductID: premium.ID, AtPeriodEnd: true})
+	assert.ErrorIs(t, err, payment.ErrInvalidPlanChange)
+
+	_, err = suite.PaymentService.ChangePlan(suite.Ctx, testUser.ID, &payment.ChangePlanRequest{SubscriptionID: subscriptionId, ProductID: premium.ID, ProrationBehavior: "sometimes"})
+	assert.ErrorIs(t, err, payment.ErrInvalidPlanChange)
+
+	request.ProrationDate = preview.ProrationDate
+
+	changed, err := suite.PaymentService.ChangePlan(suite.Ctx, testUser.ID, request)
+	require.NoError(t, err)
+	assert.Equal(t, premium.PriceID, changed.PriceID)
+	assert.Empty(t, changed.ScheduleID)
+
+	record, err := suite.PaymentService.GetActiveSubscription(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.Equal(t, premium.PriceID, record.StripePriceID)
+	require.Len(t, record.Items, 1)
+	assert.Equal(t, int64(6000), record.Items[0].UnitAmount)
+
+	_, err = suite.PaymentService.ChangePlan(suite.Ctx, testUser.ID, request)
+	assert.ErrorIs(t, err, payment.ErrInvalidPlanChange, "already on the plan")
+}
+
+// TestChangePlanToNonDefaultPrice checks a plan change can move to another price than the product's default
+func TestChangePlanToNonDefaultPrice(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser, subscriptionId := subscribeFakeUser(t, suite)
+
+	premium, err := suite.PaymentService.SetupSubscription(suite.Ctx, &payment.SetupProductsReq{
+		Name: "Premium",
+		Prices: []*payment.SetupPriceReq{
+			{Amount: 6000, Interval: "month", LookupKey: "premium_monthly"},
+			{Amount: 60000, Interval: "year", LookupKey: "premium_yearly"},
+		},
+	})
+	require.NoError(t, err)
+
+	current, err := suite.PaymentService.GetActiveSubscription(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+
+	// the current price belongs to another product
+	_, err = suite.PaymentService.PreviewPlanChange(suite.Ctx, testUser.ID, &payment.ChangePlanRequest{
+		SubscriptionID: subscriptionId,
+		ProductID:      premium.ProductID,
+		PriceSelector:  payment.PriceSelector{PriceID: current.StripePriceID},
+	})
+	assert.ErrorIs(t, err, payment.ErrInvalidPlanChange)
+	assert.ErrorIs(t, err, payment.ErrInvalidPrice)
+
+	request := &payment.ChangePlanRequest{
+		SubscriptionID: subscriptionId,
+		ProductID:      premium.ProductID,
+		PriceSelector:  payment.PriceSelector{LookupKey: "premium_yearly"},
+	}
+
+	preview, err := suite.PaymentService.PreviewPlanChange(suite.Ctx, testUser.ID, request)
+	require.NoError(t, err)
+	assert.Equal(t, premium.Prices[1].ID, preview.NewPriceID)
+	assert.False(t, preview.Downgrade)
+
+	request.ProrationDate = preview.ProrationDate
+
+	changed, err := suite.PaymentService.ChangePlan(suite.Ctx, testUser.ID, request)
+	require.NoError(t, err)
+	assert.Equal(t, premium.Prices[1].ID, changed.PriceID)
+
+	record, err := suite.PaymentService.GetActiveSubscription(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.Equal(t, premium.Prices[1].ID, record.StripePriceID)
+	require.Len(t, record.Items, 1)
+	assert.Equal(t, int64(60000), record.Items[0].UnitAmount)
+	assert.Equal(t, "year", record.Items[0].RecurringInterval)
+}
+
+// TestChangePlanDeferredDowngrade checks a downgrade deferred to the period end switches once the schedule runs
+func TestChangePlanDeferredDowngrade(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	testUser, subscriptionId := subscribeFakeUser(t, suite)
+	basic := setupFakePlan(t, suite, "Basic", 1000)
+
+	request := &payment.ChangePlanRequest{SubscriptionID: subscriptionId, ProductID: basic.ID, AtPeriodEnd: true}
+
+	preview, err := suite.PaymentService.PreviewPlanChange(suite.Ctx, testUser.ID, request)
+	require.NoError(t, err)
+	assert.True(t, preview.Downgrade)
+	assert.Zero(t, preview.ProrationAmount, "nothing is prorated at the period end")
+	assert.Equal(t, int64(1000), preview.AmountDue)
+
+	changed, err := suite.PaymentService.ChangePlan(suite.Ctx, testUser.ID, request)
+	require.NoError(t, err)
+	assert.NotEmpty(t, changed.ScheduleID)
+	assert.Equal(t, string(stripe.SubscriptionStatusActive), changed.Status, "the status is the subscription's")
+	assert.Equal(t, string(stripe.SubscriptionScheduleStatusActive), changed.ScheduleStatus)
+	assert.Equal(t, basic.PriceID, changed.ScheduledPriceID)
+	assert.NotEqual(t, basic.PriceID, changed.PriceID, "the current plan runs until the period ends")
+
+	record, err := suite.PaymentService.GetActiveSubscription(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.NotEqual(t, basic.PriceID, record.StripePriceID)
+
+	event, err := suite.FakeProcessor.AdvanceSubscriptionSchedule(changed.ScheduleID)
+	require.NoError(t, err)
+	require.NoError(t, suite.PaymentService.ProcessWebhookEvent(suite.Ctx, event))
+
+	record, err = suite.PaymentService.GetActiveSubscription(suite.Ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.Equal(t, basic.PriceID, record.StripePriceID)
+}
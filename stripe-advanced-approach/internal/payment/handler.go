@@ -2,15 +2,15 @@ package payment
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/webhook"
 )
 
 type Handler struct {
@@ -28,9 +28,24 @@ type Service interface {
 	SubscribeToProduct(ctx context.Context, userId uuid.UUID, req *SubscribeRequest) (*SubscribeResponse, error)
 	SubscribeToSite(ctx context.Context, userId uuid.UUID) (*SubscribeToSiteResponse, error)
 	GetSubscriptionStatus(ctx context.Context, userId uuid.UUID) (*SubscriptionStatusResponse, error)
+	GetActiveSubscription(ctx context.Context, userId uuid.UUID) (*Subscription, error)
+	CancelSubscription(ctx context.Context, userId uuid.UUID, request *CancelSubscriptionRequest) (*SubscriptionCancellationResponse, error)
+	ResumeSubscription(ctx context.Context, userId uuid.UUID, request *ResumeSubscriptionRequest) (*SubscriptionCancellationResponse, error)
+	PauseSubscription(ctx context.Context, userId uuid.UUID, request *PauseSubscriptionRequest) (*SubscriptionPauseResponse, error)
+	UnpauseSubscription(ctx context.Context, userId uuid.UUID, request *UnpauseSubscriptionRequest) (*SubscriptionPauseResponse, error)
+	PreviewPlanChange(ctx context.Context, userId uuid.UUID, request *ChangePlanRequest) (*PlanChangePreview, error)
+	ChangePlan(ctx context.Context, userId uuid.UUID, request *ChangePlanRequest) (*PlanChangeResponse, error)
 
 	// flow based methods
 	ProcessWebhookEvent(ctx context.Context, event *stripe.Event) error
+	HandleWebhookEvent(ctx context.Context, event *stripe.Event, payload []byte) error
+
+	// admin
+	ListWebhookDeadLetters(ctx context.Context, count int64) ([]WebhookDeadLetter, error)
+	RedriveWebhookDeadLetter(ctx context.Context, deadLetterID string) error
+	ReplayWebhookEvents(ctx context.Context, request *WebhookReplayRequest) (*WebhookReplayResponse, error)
+	WarmCache(ctx context.Context) (*CacheWarmResult, error)
+	CheckCacheConsistency(ctx context.Context, request *ConsistencyCheckRequest) (*ConsistencyReport, error)
 }
 
 func NewHandler(service Service) *Handler {
@@ -47,7 +62,7 @@ func (h *Handler) SetupProducts(c *gin.Context) {
 
 	resp, err := h.service.SetupProducts(c.Request.Context(), &request)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(setupProductStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -127,13 +142,21 @@ func (h *Handler) SetupSubscription(c *gin.Context) {
 
 	resp, err := h.service.SetupSubscription(c.Request.Context(), &request)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(setupProductStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, resp)
 }
 
+func setupProductStatus(err error) int {
+	if errors.Is(err, ErrInvalidPrice) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
 func (h *Handler) GetProducts(c *gin.Context) {
 	resp, err := h.service.GetProducts(c.Request.Context())
 	if err != nil {
@@ -159,7 +182,12 @@ func (h *Handler) PurchaseProduct(c *gin.Context) {
 
 	resp, err := h.service.PurchaseProduct(c.Request.Context(), userId, &req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInvalidPrice) {
+			status = http.StatusBadRequest
+		}
+
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -181,7 +209,12 @@ func (h *Handler) SubscribeToProduct(c *gin.Context) {
 
 	resp, err := h.service.SubscribeToProduct(c.Request.Context(), userId, &req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInvalidTrial) || errors.Is(err, ErrInvalidPrice) {
+			status = http.StatusBadRequest
+		}
+
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -232,7 +265,256 @@ func (h *Handler) GetSubscriptionStatus(c *gin.Context) {
 	c.JSON(http.StatusOK, status)
 }
 
+// current subscription with its items and renewal date, served from the database mirror
+func (h *Handler) GetActiveSubscription(c *gin.Context) {
+	userIdStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	userId, err := uuid.Parse(userIdStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	subscription, err := h.service.GetActiveSubscription(c.Request.Context(), userId)
+	if errors.Is(err, ErrNoActiveSubscription) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, subscription)
+}
+
+// cancels now (optionally refunding the rest of the period) or at the end of the period
+func (h *Handler) CancelSubscription(c *gin.Context) {
+	userIdStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	userId, err := uuid.Parse(userIdStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var request CancelSubscriptionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := h.service.CancelSubscription(c.Request.Context(), userId, &request)
+	if err != nil {
+		c.JSON(subscriptionCancellationStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// takes back a cancellation scheduled for the end of the period
+func (h *Handler) ResumeSubscription(c *gin.Context) {
+	userIdStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	userId, err := uuid.Parse(userIdStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var request ResumeSubscriptionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := h.service.ResumeSubscription(c.Request.Context(), userId, &request)
+	if err != nil {
+		c.JSON(subscriptionCancellationStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func subscriptionCancellationStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSubscriptionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidCancellation):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrSubscriptionEnded), errors.Is(err, ErrCancellationNotScheduled):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// pauses collecting payments, the subscription grants no access until it resumes
+func (h *Handler) PauseSubscription(c *gin.Context) {
+	userIdStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	userId, err := uuid.Parse(userIdStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var request PauseSubscriptionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := h.service.PauseSubscription(c.Request.Context(), userId, &request)
+	if err != nil {
+		c.JSON(subscriptionPauseStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) UnpauseSubscription(c *gin.Context) {
+	userIdStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	userId, err := uuid.Parse(userIdStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var request UnpauseSubscriptionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := h.service.UnpauseSubscription(c.Request.Context(), userId, &request)
+	if err != nil {
+		c.JSON(subscriptionPauseStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func subscriptionPauseStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSubscriptionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidPause):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrSubscriptionEnded), errors.Is(err, ErrSubscriptionNotPaused):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// the invoice a plan change leads to, shown before the user confirms it
+func (h *Handler) PreviewPlanChange(c *gin.Context) {
+	userIdStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	userId, err := uuid.Parse(userIdStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var request ChangePlanRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := h.service.PreviewPlanChange(c.Request.Context(), userId, &request)
+	if err != nil {
+		c.JSON(planChangeStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) ChangePlan(c *gin.Context) {
+	userIdStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	userId, err := uuid.Parse(userIdStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var request ChangePlanRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := h.service.ChangePlan(c.Request.Context(), userId, &request)
+	if err != nil {
+		c.JSON(planChangeStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func planChangeStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSubscriptionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidPlanChange):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrSubscriptionEnded):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func (h *Handler) HandleStripeWebhook(c *gin.Context) {
+	h.handleStripeWebhook(c, WebhookEndpointPlatform)
+}
+
+// webhooks of connected accounts, delivered to a separate stripe endpoint with its own secrets. they are stored and
+// acknowledged but not applied, see ProcessWebhookEvent
+func (h *Handler) HandleStripeConnectWebhook(c *gin.Context) {
+	h.handleStripeWebhook(c, WebhookEndpointConnect)
+}
+
+func (h *Handler) handleStripeWebhook(c *gin.Context, endpoint WebhookEndpoint) {
 	// Read raw bytes instead of using gin's ShouldBindJSON because:
 	// 1. Stripe's webhook signature is calculated from the exact bytes sent
 	// 2. ShouldBindJSON would parse/reformat the JSON, breaking signature verification
@@ -253,20 +535,114 @@ func (h *Handler) HandleStripeWebhook(c *gin.Context) {
 		return
 	}
 
-	webhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
-
-	event, err := webhook.ConstructEvent(body, signature, webhookSecret)
+	event, err := VerifyWebhookEvent(endpoint, body, signature)
 	if err != nil {
 		fmt.Printf("\nError invalid signature: %+v\n\n", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
 		return
 	}
 
-	// validate signature in service method
-	err = h.service.ProcessWebhookEvent(c.Request.Context(), &event)
+	// store and process the verified event
+	err = h.service.HandleWebhookEvent(c.Request.Context(), &event, body)
+
+	// redelivery of an event we already handled, acknowledge so stripe stops retrying
+	if errors.Is(err, ErrWebhookEventAlreadyProcessed) {
+		c.JSON(http.StatusOK, gin.H{"received": true, "duplicate": true})
+		return
+	}
 
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to process stripe event.", "error": err})
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to process stripe event.", "error": err.Error()})
 		return
 	}
+
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+func (h *Handler) ListWebhookDeadLetters(c *gin.Context) {
+	count, err := strconv.ParseInt(c.DefaultQuery("count", "100"), 10, 64)
+	if err != nil || count <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid count"})
+		return
+	}
+
+	deadLetters, err := h.service.ListWebhookDeadLetters(c.Request.Context(), count)
+	if errors.Is(err, ErrWebhookQueueDisabled) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dead_letters": deadLetters})
+}
+
+func (h *Handler) RedriveWebhookDeadLetter(c *gin.Context) {
+	err := h.service.RedriveWebhookDeadLetter(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, ErrWebhookQueueDisabled) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"redriven": c.Param("id")})
+}
+
+func (h *Handler) ReplayWebhookEvents(c *gin.Context) {
+	var request WebhookReplayRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		fmt.Printf("\nError when parsing json: %+v\n\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := h.service.ReplayWebhookEvents(c.Request.Context(), &request)
+
+	if errors.Is(err, ErrInvalidReplayFilter) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) WarmCache(c *gin.Context) {
+	res, err := h.service.WarmCache(c.Request.Context())
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) CheckCacheConsistency(c *gin.Context) {
+	var request ConsistencyCheckRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		fmt.Printf("\nError when parsing json: %+v\n\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := h.service.CheckCacheConsistency(c.Request.Context(), &request)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
 }
@@ -1,9 +1,11 @@
 package payment
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 // General Payments Entity
@@ -17,36 +19,186 @@ type Payment struct {
 	Currency           string     `db:"currency" json:"currency"`
 	Status             string     `db:"status" json:"status"` // synced from stripe
 	PaymentMethodTypes string     `db:"payment_method_types" json:"payment_method_types"`
+	LastEventAt        *time.Time `db:"last_event_at" json:"last_event_at"` // time of the stripe state this row reflects
 	CreatedAt          time.Time  `db:"created_at" json:"created_at"`
 	UpdatedAt          time.Time  `db:"updated_at" json:"updated_at"`
 	CompletedAt        *time.Time `db:"completed_at" json:"completed_at"`
 }
 
-// Subscription Entity
+// Subscription Entity, a full mirror of the stripe subscription
 type Subscription struct {
-	ID                   uuid.UUID  `db:"id" json:"id"`
-	UserID               uuid.UUID  `db:"user_id" json:"user_id"`
-	StripeCustomerID     string     `db:"stripe_customer_id" json:"stripe_customer_id"`
-	StripeSubscriptionID string     `db:"stripe_subscription_id" json:"stripe_subscription_id"`
-	StripePriceID        string     `db:"stripe_price_id" json:"stripe_price_id"`
-	Status               string     `db:"status" json:"status"`
-	CurrentPeriodStart   time.Time  `db:"current_period_start" json:"current_period_start"`
-	CurrentPeriodEnd     time.Time  `db:"current_period_end" json:"current_period_end"`
-	CancelAtPeriodEnd    bool       `db:"cancel_at_period_end" json:"cancel_at_period_end"`
-	CanceledAt           *time.Time `db:"canceled_at" json:"canceled_at"`
-	CreatedAt            time.Time  `db:"created_at" json:"created_at"`
-	UpdatedAt            time.Time  `db:"updated_at" json:"updated_at"`
+	ID                   uuid.UUID           `db:"id" json:"id"`
+	UserID               uuid.UUID           `db:"user_id" json:"user_id"`
+	StripeCustomerID     string              `db:"stripe_customer_id" json:"stripe_customer_id"`
+	StripeSubscriptionID string              `db:"stripe_subscription_id" json:"stripe_subscription_id"`
+	StripePriceID        string              `db:"stripe_price_id" json:"stripe_price_id"` // price of the first item
+	Status               string              `db:"status" json:"status"`
+	CurrentPeriodStart   time.Time           `db:"current_period_start" json:"current_period_start"`
+	CurrentPeriodEnd     time.Time           `db:"current_period_end" json:"current_period_end"` // renewal date
+	CancelAtPeriodEnd    bool                `db:"cancel_at_period_end" json:"cancel_at_period_end"`
+	CanceledAt           *time.Time          `db:"canceled_at" json:"canceled_at"`
+	EndedAt              *time.Time          `db:"ended_at" json:"ended_at"`
+	TrialStart           *time.Time          `db:"trial_start" json:"trial_start"`
+	TrialEnd             *time.Time          `db:"trial_end" json:"trial_end"`
+	LatestInvoiceID      string              `db:"latest_invoice_id" json:"latest_invoice_id"`
+	DiscountIDs          pq.StringArray      `db:"discount_ids" json:"discount_ids"`
+	CancellationReason   string              `db:"cancellation_reason" json:"cancellation_reason"`     // e.g. "cancellation_requested", "payment_failed"
+	CancellationFeedback string              `db:"cancellation_feedback" json:"cancellation_feedback"` // the customer's, e.g. "too_expensive"
+	CancellationComment  string              `db:"cancellation_comment" json:"cancellation_comment"`
+	PauseBehavior        string              `db:"pause_behavior" json:"pause_behavior"` // set while collection is paused, e.g. "void"
+	PauseResumesAt       *time.Time          `db:"pause_resumes_at" json:"pause_resumes_at"`
+	TrialEndingNoticeAt  *time.Time          `db:"trial_ending_notice_at" json:"trial_ending_notice_at"` // trial ends without a payment method, see handleTrialWillEnd
+	LastEventAt          *time.Time          `db:"last_event_at" json:"last_event_at"`                   // time of the stripe state this row reflects
+	CreatedAt            time.Time           `db:"created_at" json:"created_at"`
+	UpdatedAt            time.Time           `db:"updated_at" json:"updated_at"`
+	Items                []*SubscriptionItem `db:"-" json:"items"`
+}
+
+// Subscription Item Entity, one per price billed by a subscription
+type SubscriptionItem struct {
+	ID                       uuid.UUID `db:"id" json:"id"`
+	StripeSubscriptionItemID string    `db:"stripe_subscription_item_id" json:"stripe_subscription_item_id"`
+	StripeSubscriptionID     string    `db:"stripe_subscription_id" json:"stripe_subscription_id"`
+	StripePriceID            string    `db:"stripe_price_id" json:"stripe_price_id"`
+	StripeProductID          string    `db:"stripe_product_id" json:"stripe_product_id"`
+	Quantity                 int64     `db:"quantity" json:"quantity"`
+	UnitAmount               int64     `db:"unit_amount" json:"unit_amount"`
+	Currency                 string    `db:"currency" json:"currency"`
+	RecurringInterval        string    `db:"recurring_interval" json:"recurring_interval"`
+	CurrentPeriodStart       time.Time `db:"current_period_start" json:"current_period_start"`
+	CurrentPeriodEnd         time.Time `db:"current_period_end" json:"current_period_end"`
+	CreatedAt                time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt                time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// Progress of the incremental stripe sync of a customer
+type CustomerSyncState struct {
+	StripeCustomerID   string     `db:"stripe_customer_id" json:"stripe_customer_id"`
+	PaymentsCreatedGte int64      `db:"payments_created_gte" json:"payments_created_gte"` // unix time
+	PassCreatedGte     *int64     `db:"pass_created_gte" json:"pass_created_gte"`
+	PassCursor         *string    `db:"pass_cursor" json:"pass_cursor"`
+	PassNewestCreated  int64      `db:"pass_newest_created" json:"pass_newest_created"`
+	LastFullSyncAt     *time.Time `db:"last_full_sync_at" json:"last_full_sync_at"`
+	UpdatedAt          time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// a user with a stripe customer, as walked by the cache warmer and sampled by the consistency check
+type CacheCustomer struct {
+	UserID           uuid.UUID `db:"id"`
+	StripeCustomerID string    `db:"stripe_customer_id"`
+	HasSubscriptions bool      `db:"has_subscriptions"`
+}
+
+// Webhook Event Entity, every verified stripe event is stored before processing
+type WebhookEvent struct {
+	ID            uuid.UUID       `db:"id" json:"id"`
+	StripeEventID string          `db:"stripe_event_id" json:"stripe_event_id"`
+	EventType     string          `db:"event_type" json:"event_type"`
+	CustomerID    *string         `db:"stripe_customer_id" json:"stripe_customer_id"`
+	Processed     bool            `db:"processed" json:"processed"`
+	Payload       json.RawMessage `db:"payload" json:"payload"`
+	Attempts      int             `db:"attempts" json:"attempts"`
+	LastError     *string         `db:"last_error" json:"last_error"`
+	ProcessedAt   *time.Time      `db:"processed_at" json:"processed_at"`
+	FailedAt      *time.Time      `db:"failed_at" json:"failed_at"`
+	CreatedAt     time.Time       `db:"created_at" json:"created_at"`
+	UpdatedAt     time.Time       `db:"updated_at" json:"updated_at"`
+}
+
+// Webhook Replay
+type WebhookReplayRequest struct {
+	EventType  string     `json:"event_type"`
+	CustomerID string     `json:"customer_id"`
+	From       *time.Time `json:"from"`
+	To         *time.Time `json:"to"`
+	State      string     `json:"state"` // "processed", "failed", "pending" or empty for all
+	Limit      int        `json:"limit"`
+	DryRun     bool       `json:"dry_run"`
+}
+
+type WebhookReplayResponse struct {
+	DryRun   bool                  `json:"dry_run"`
+	Matched  int                   `json:"matched"`
+	Replayed int                   `json:"replayed"`
+	Failed   int                   `json:"failed"`
+	Events   []*WebhookReplayEvent `json:"events"`
+}
+
+type WebhookReplayEvent struct {
+	StripeEventID string       `json:"stripe_event_id"`
+	EventType     string       `json:"event_type"`
+	CustomerID    string       `json:"customer_id,omitempty"`
+	Error         string       `json:"error,omitempty"`
+	Changes       *SyncChanges `json:"changes,omitempty"` // dry run only
+}
+
+// rows and cache keys a sync would change
+type SyncChanges struct {
+	Rows      []SyncRowChange `json:"rows"`
+	CacheKeys []string        `json:"cache_keys"`
+}
+
+type SyncRowChange struct {
+	Table  string   `json:"table"`
+	Key    string   `json:"key"`
+	Action string   `json:"action"` // "insert" or "update"
+	Fields []string `json:"fields,omitempty"`
+}
+
+type CacheWarmResult struct {
+	Customers      int    `json:"customers"`
+	MappingsWarmed int    `json:"mappings_warmed"`
+	DataRebuilt    int    `json:"data_rebuilt"`
+	Failed         int    `json:"failed"`
+	Duration       string `json:"duration"`
+}
+
+type ConsistencyCheckRequest struct {
+	Sample int  `json:"sample"`
+	Repair bool `json:"repair"`
+}
+
+type ConsistencyReport struct {
+	Repair     bool                   `json:"repair"`
+	Sampled    int                    `json:"sampled"`
+	Consistent int                    `json:"consistent"`
+	Mismatched int                    `json:"mismatched"` // customers with at least one mismatch
+	Repaired   int                    `json:"repaired"`
+	Failed     int                    `json:"failed"` // customers that couldn't be checked or repaired
+	Mismatches []*ConsistencyMismatch `json:"mismatches"`
+}
+
+// a difference between a copy (cache or database) and the source of truth (stripe, or the users table for mappings)
+type ConsistencyMismatch struct {
+	CustomerID string `json:"customer_id"`
+	Source     string `json:"source"` // "cache" or "database"
+	Object     string `json:"object"` // e.g. "sub:sub_123" or "mapping:userid_to_customerid"
+	Expected   string `json:"expected"`
+	Actual     string `json:"actual"`
 }
 
 // Setup Products
 type SetupProductsReq struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Price       int64  `json:"price"`
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	Price       int64            `json:"price"`      // a single usd price, when no prices are given
+	TrialDays   int64            `json:"trial_days"` // subscriptions only, the free trial new subscribers get by default
+	Prices      []*SetupPriceReq `json:"prices"`     // every price of the product, see SetupPrices for which is the default
+}
+
+// one price of a product being set up
+type SetupPriceReq struct {
+	LookupKey     string `json:"lookup_key"`     // derived from the product and interval when left out
+	Amount        int64  `json:"amount"`         // in the currency's smallest unit, e.g. cents
+	Currency      string `json:"currency"`       // defaults to usd
+	Interval      string `json:"interval"`       // "day", "week", "month" or "year", left out for one-time prices
+	IntervalCount int64  `json:"interval_count"` // billed every interval_count intervals, defaults to 1
 }
 
 type SetupProductsResp struct {
-	PriceID string `json:"price_id"`
+	ProductID string      `json:"product_id"`
+	PriceID   string      `json:"price_id"` // the default price
+	Prices    []PriceInfo `json:"prices"`
 }
 
 // Create Customer
@@ -85,12 +237,25 @@ type SubscriptionResp struct {
 
 // Products List
 type ProductInfo struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Price       int64  `json:"price"`
-	PriceID     string `json:"price_id"`
-	Type        string `json:"type"` // "one-time" or "subscription"
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Price       int64       `json:"price"`
+	PriceID     string      `json:"price_id"`
+	Type        string      `json:"type"`                 // "one-time" or "subscription"
+	TrialDays   int64       `json:"trial_days,omitempty"` // default free trial of subscriptions
+	Prices      []PriceInfo `json:"prices"`               // every active price, the default one first
+}
+
+type PriceInfo struct {
+	ID            string `json:"id"`
+	LookupKey     string `json:"lookup_key"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	Type          string `json:"type"`                     // "one-time" or "subscription"
+	Interval      string `json:"interval,omitempty"`       // "day", "week", "month" or "year"
+	IntervalCount int64  `json:"interval_count,omitempty"` // billed every interval_count intervals
+	Default       bool   `json:"default"`
 }
 
 type ProductListResponse struct {
@@ -101,6 +266,8 @@ type ProductListResponse struct {
 type PurchaseProductRequest struct {
 	ProductID  string `json:"product_id" binding:"required"`
 	CustomerID string `json:"customer_id" binding:"required"`
+	// the price to pay, the product's default one unless another is selected
+	PriceSelector
 }
 
 type PurchaseProductResponse struct {
@@ -119,12 +286,17 @@ type StripePurchaseResponse struct {
 type SubscribeRequest struct {
 	ProductID  string `json:"product_id"`  // Product to subscribe to
 	CustomerID string `json:"customer_id"` // Stripe customer ID
+	TrialDays  *int64 `json:"trial_days"`  // overrides the product's free trial, 0 for none
+	// the price to subscribe to, the product's default one unless another is selected
+	PriceSelector
 }
 
 type SubscribeResponse struct {
-	SubscriptionID string `json:"subscription_id"` // sub_xxx ID for management
-	ClientSecret   string `json:"client_secret"`   // For frontend to confirm payment
-	Status         string `json:"status"`          // "incomplete" until payment confirmed
+	SubscriptionID   string     `json:"subscription_id"`    // sub_xxx ID for management
+	ClientSecret     string     `json:"client_secret"`      // For frontend to confirm payment
+	ClientSecretType string     `json:"client_secret_type"` // "payment_intent", or "setup_intent" to optionally save a card for after the trial
+	Status           string     `json:"status"`             // "incomplete" until payment confirmed, "trialing" during a free trial
+	TrialEnd         *time.Time `json:"trial_end,omitempty"`
 }
 
 // Subscribe To Site
@@ -134,9 +306,117 @@ type SubscribeToSiteResponse struct {
 
 // Minimal response for frontend UI decisions
 type SubscriptionStatusResponse struct {
-	HasAccess         bool   `json:"has_access"`           // Simple boolean for "can see premium page?"
-	Status            string `json:"status"`               // "active", "canceled", "past_due", "none"
-	CancelAtPeriodEnd bool   `json:"cancel_at_period_end"` // Show "Renews on" vs "Expires on"
+	HasAccess         bool       `json:"has_access"`           // Simple boolean for "can see premium page?"
+	Status            string     `json:"status"`               // "active", "trialing", "paused", "canceled", "past_due", "none"
+	CancelAtPeriodEnd bool       `json:"cancel_at_period_end"` // Show "Renews on" vs "Expires on"
+	ResumesAt         *time.Time `json:"resumes_at,omitempty"` // paused subscriptions resuming on their own
+	TrialEnd          *time.Time `json:"trial_end,omitempty"`  // while trialing
+}
+
+// Cancel / Resume Subscription
+type CancelSubscriptionRequest struct {
+	SubscriptionID string `json:"subscription_id" binding:"required"`
+	AtPeriodEnd    bool   `json:"at_period_end"` // keep access until the renewal date instead of ending it now
+	Refund         bool   `json:"refund"`        // immediate cancellations only, refunds the unused part of the period
+	Reason         string `json:"reason"`        // stripe's cancellation feedback, e.g. "too_expensive", "unused"
+	Comment        string `json:"comment"`
+}
+
+type ResumeSubscriptionRequest struct {
+	SubscriptionID string `json:"subscription_id" binding:"required"`
+}
+
+type SubscriptionCancellationResponse struct {
+	SubscriptionID    string     `json:"subscription_id"`
+	Status            string     `json:"status"`
+	CancelAtPeriodEnd bool       `json:"cancel_at_period_end"`
+	AccessEndsAt      *time.Time `json:"access_ends_at"` // nil while the subscription renews
+	RefundedAmount    int64      `json:"refunded_amount"`
+	RefundDue         int64      `json:"refund_due,omitempty"`   // left to refund from the latest invoice when refunding failed
+	RefundError       string     `json:"refund_error,omitempty"` // why refunding failed, the subscription is canceled regardless
+	MirrorError       string     `json:"mirror_error,omitempty"` // why storing the change failed, its webhook stores it later
+}
+
+// why a subscription is canceled, stored on stripe's cancellation_details
+type CancellationDetails struct {
+	Feedback string
+	Comment  string
+}
+
+// Pause / Unpause Subscription
+type PauseSubscriptionRequest struct {
+	SubscriptionID string     `json:"subscription_id" binding:"required"`
+	Behavior       string     `json:"behavior" binding:"required"` // what happens to invoices meanwhile: "void", "keep_as_draft" or "mark_uncollectible"
+	ResumesAt      *time.Time `json:"resumes_at"`                  // resume on its own at this time, otherwise until unpaused
+}
+
+type UnpauseSubscriptionRequest struct {
+	SubscriptionID string `json:"subscription_id" binding:"required"`
+}
+
+type SubscriptionPauseResponse struct {
+	SubscriptionID string     `json:"subscription_id"`
+	Status         string     `json:"status"`
+	Paused         bool       `json:"paused"`
+	Behavior       string     `json:"behavior,omitempty"`
+	ResumesAt      *time.Time `json:"resumes_at,omitempty"`
+}
+
+// stripe's pause_collection of a subscription
+type PauseCollection struct {
+	Behavior  string
+	ResumesAt int64 // unix time, 0 to stay paused until unpaused
+}
+
+// Change Plan, the preview takes the same request
+type ChangePlanRequest struct {
+	SubscriptionID    string `json:"subscription_id" binding:"required"`
+	ProductID         string `json:"product_id" binding:"required"` // the subscription product to move to
+	ProrationBehavior string `json:"proration_behavior"`            // "create_prorations" (default), "always_invoice" or "none"
+	ProrationDate     int64  `json:"proration_date"`                // from the preview, so the change is prorated as previewed
+	AtPeriodEnd       bool   `json:"at_period_end"`                 // downgrades only, switch at the renewal date instead of now
+	// the price to move to, the product's default one unless another is selected
+	PriceSelector
+}
+
+type PlanChangePreview struct {
+	SubscriptionID    string            `json:"subscription_id"`
+	CurrentPriceID    string            `json:"current_price_id"`
+	NewPriceID        string            `json:"new_price_id"`
+	Downgrade         bool              `json:"downgrade"`
+	ProrationBehavior string            `json:"proration_behavior"`
+	ProrationDate     int64             `json:"proration_date"`   // pass back when confirming the change
+	ProrationAmount   int64             `json:"proration_amount"` // net of the proration lines, negative for a credit
+	AmountDue         int64             `json:"amount_due"`       // of the invoice the change leads to
+	Currency          string            `json:"currency"`
+	InvoiceAt         *time.Time        `json:"invoice_at"` // nil when invoiced right away
+	Lines             []*PlanChangeLine `json:"lines"`
+}
+
+type PlanChangeLine struct {
+	Description string `json:"description"`
+	Amount      int64  `json:"amount"`
+	Proration   bool   `json:"proration"`
+}
+
+type PlanChangeResponse struct {
+	SubscriptionID   string     `json:"subscription_id"`
+	Status           string     `json:"status"`
+	PriceID          string     `json:"price_id"`                     // the current price, the old one until a deferred change takes effect
+	ScheduledPriceID string     `json:"scheduled_price_id,omitempty"` // deferred changes only
+	ScheduleID       string     `json:"schedule_id,omitempty"`
+	ScheduleStatus   string     `json:"schedule_status,omitempty"`
+	EffectiveAt      *time.Time `json:"effective_at"`
+}
+
+// a price swap of one subscription item, as the processor previews or makes it
+type PlanChange struct {
+	SubscriptionID    string
+	ScheduleID        string // the schedule managing the subscription, if any
+	ItemID            string
+	PriceID           string
+	ProrationBehavior string
+	ProrationDate     int64 // unix time the proration is calculated for
 }
 
 // Payment Intent Request for internal use
@@ -151,8 +431,9 @@ type CheckoutSessionResponse struct {
 	CheckoutURL string `json:"checkout_url"`
 }
 
-// stripe customer cached data
+// stripe customer cached data, stored as a hash (see customer_cache.go), bump cachekey.CustomerDataVersion when changing its shape
 type StripeCacheData struct {
+	Version       int64                      `json:"version"` // unix micros of the stripe state as of the last sync
 	CustomerData  StripeCustomerDataRes      `json:"customer_data"`
 	Subscriptions []*StripeSubscriptionCache `json:"subscriptions"`
 	Payments      []*StripePaymentsCache     `json:"payments"`
@@ -168,6 +449,9 @@ type StripeSubscriptionCache struct {
 	Status            string             `json:"status"`
 	PriceID           string             `json:"price_id"`
 	CancelAtPeriodEnd bool               `json:"cancel_at_period_end"`
+	PauseBehavior     string             `json:"pause_behavior,omitempty"` // set while collection is paused
+	PauseResumesAt    *time.Time         `json:"pause_resumes_at,omitempty"`
+	TrialEnd          *time.Time         `json:"trial_end,omitempty"`
 	PaymentMethod     *PaymentMethodInfo `json:"payment_method,omitempty"`
 }
 
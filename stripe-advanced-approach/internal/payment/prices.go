@@ -0,0 +1,212 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+/**
+* Product prices.
+*
+* A product carries any number of prices: recurring ones billed every day, week, month or year (or every
+* interval_count of them) and one-time ones, each in its own currency and with a lookup key to find it by instead
+* of its id. One of them is the product's default price, what purchases and subscriptions are charged by default:
+* the first one-time price of products and the first recurring price of subscription products.
+*
+* Requests without prices set up a single usd price from SetupProductsReq.Price: one-time for products, monthly for
+* subscriptions.
+*
+* Purchases, subscriptions and plan changes are for the product's default price unless they select another of its
+* prices (PriceSelector).
+**/
+
+// returned for prices stripe wouldn't accept
+var ErrInvalidPrice = errors.New("invalid price")
+
+const defaultCurrency = "usd"
+
+// most intervals a recurring price may span, stripe bills at least every 3 years
+var maxIntervalCounts = map[stripe.PriceRecurringInterval]int64{
+	stripe.PriceRecurringIntervalDay:   1095,
+	stripe.PriceRecurringIntervalWeek:  156,
+	stripe.PriceRecurringIntervalMonth: 36,
+	stripe.PriceRecurringIntervalYear:  3,
+}
+
+/**
+* The prices to set up for the product, validated and completed with their defaults. The default price comes
+* first, recurring tells whether it is looked for among the recurring prices (subscriptions) or the one-time ones.
+**/
+func (r *SetupProductsReq) SetupPrices(recurring bool) ([]*SetupPriceReq, error) {
+	if len(r.Prices) == 0 {
+		price := &SetupPriceReq{Amount: r.Price}
+
+		if recurring {
+			price.Interval = string(stripe.PriceRecurringIntervalMonth)
+		}
+
+		r = &SetupProductsReq{Prices: []*SetupPriceReq{price}}
+	}
+
+	prices := make([]*SetupPriceReq, 0, len(r.Prices))
+	lookupKeys := map[string]bool{}
+	defaultIndex := -1
+
+	for _, requested := range r.Prices {
+		price := *requested
+
+		if price.Amount < 0 {
+			return nil, fmt.Errorf("%w: amount %d is negative", ErrInvalidPrice, price.Amount)
+		}
+
+		if price.Currency == "" {
+			price.Currency = defaultCurrency
+		}
+		price.Currency = strings.ToLower(price.Currency)
+
+		if price.Interval == "" {
+			if price.IntervalCount != 0 {
+				return nil, fmt.Errorf("%w: one-time prices have no interval count", ErrInvalidPrice)
+			}
+		} else {
+			maxCount, ok := maxIntervalCounts[stripe.PriceRecurringInterval(price.Interval)]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown interval %s", ErrInvalidPrice, price.Interval)
+			}
+
+			price.IntervalCount = max(price.IntervalCount, 1)
+			if price.IntervalCount > maxCount {
+				return nil, fmt.Errorf("%w: prices are billed at least every 3 years, not every %d %ss", ErrInvalidPrice, price.IntervalCount, price.Interval)
+			}
+		}
+
+		// derived keys only differ by what the price bills
+		lookupKey := price.LookupKeyFor("")
+		if lookupKeys[lookupKey] {
+			return nil, fmt.Errorf("%w: two prices share the lookup key %s, give them their own", ErrInvalidPrice, strings.TrimPrefix(lookupKey, "_"))
+		}
+		lookupKeys[lookupKey] = true
+
+		if defaultIndex < 0 && price.Recurring() == recurring {
+			defaultIndex = len(prices)
+		}
+
+		prices = append(prices, &price)
+	}
+
+	if defaultIndex < 0 {
+		kind := "one-time"
+		if recurring {
+			kind = "recurring"
+		}
+
+		return nil, fmt.Errorf("%w: the product needs a %s price", ErrInvalidPrice, kind)
+	}
+
+	// the default price first, the others in the requested order
+	defaultPrice := prices[defaultIndex]
+	copy(prices[1:defaultIndex+1], prices[:defaultIndex])
+	prices[0] = defaultPrice
+
+	return prices, nil
+}
+
+func (p *SetupPriceReq) Recurring() bool {
+	return p.Interval != ""
+}
+
+/**
+* The requested lookup key of the price, otherwise one derived from the product and what the price bills, e.g.
+* prod_123_usd_month, prod_123_usd_3_month or prod_123_eur_one_time.
+**/
+func (p *SetupPriceReq) LookupKeyFor(productId string) string {
+	if p.LookupKey != "" {
+		return p.LookupKey
+	}
+
+	switch {
+	case !p.Recurring():
+		return fmt.Sprintf("%s_%s_one_time", productId, p.Currency)
+	case p.IntervalCount > 1:
+		return fmt.Sprintf("%s_%s_%d_%s", productId, p.Currency, p.IntervalCount, p.Interval)
+	default:
+		return fmt.Sprintf("%s_%s_%s", productId, p.Currency, p.Interval)
+	}
+}
+
+func convertPriceInfo(price *stripe.Price, defaultPriceId string) PriceInfo {
+	info := PriceInfo{
+		ID:        price.ID,
+		LookupKey: price.LookupKey,
+		Amount:    price.UnitAmount,
+		Currency:  string(price.Currency),
+		Type:      "one-time",
+		Default:   price.ID == defaultPriceId,
+	}
+
+	if price.Recurring != nil {
+		info.Type = "subscription"
+		info.Interval = string(price.Recurring.Interval)
+		info.IntervalCount = price.Recurring.IntervalCount
+	}
+
+	return info
+}
+
+/**
+* Which price of a product a request is for: one of the product's active prices by id or lookup key (both have to
+* match when both are given), the product's default price when neither is.
+**/
+type PriceSelector struct {
+	PriceID   string `json:"price_id"`
+	LookupKey string `json:"lookup_key"`
+}
+
+func (p PriceSelector) IsDefault() bool {
+	return p.PriceID == "" && p.LookupKey == ""
+}
+
+/**
+* The selected price of the product among prices, the candidates looked up for the selector. Prices of other
+* products and inactive ones are rejected with ErrInvalidPrice.
+**/
+func (p PriceSelector) Select(productId string, defaultPrice *stripe.Price, prices []*stripe.Price) (*stripe.Price, error) {
+	if p.IsDefault() {
+		if defaultPrice == nil {
+			return nil, fmt.Errorf("product has no default price")
+		}
+
+		return defaultPrice, nil
+	}
+
+	// why the matching prices were rejected, lookup keys of inactive prices may have moved to active ones
+	var rejected error
+
+	for _, price := range prices {
+		if (p.PriceID != "" && price.ID != p.PriceID) || (p.LookupKey != "" && price.LookupKey != p.LookupKey) {
+			continue
+		}
+
+		switch {
+		case price.Product == nil || price.Product.ID != productId:
+			rejected = fmt.Errorf("%w: price %s doesn't belong to product %s", ErrInvalidPrice, price.ID, productId)
+		case !price.Active:
+			rejected = fmt.Errorf("%w: price %s is no longer active", ErrInvalidPrice, price.ID)
+		default:
+			return price, nil
+		}
+	}
+
+	if rejected != nil {
+		return nil, rejected
+	}
+
+	if p.PriceID != "" {
+		return nil, fmt.Errorf("%w: no price %s of product %s", ErrInvalidPrice, p.PriceID, productId)
+	}
+
+	return nil, fmt.Errorf("%w: no price with lookup key %s of product %s", ErrInvalidPrice, p.LookupKey, productId)
+}
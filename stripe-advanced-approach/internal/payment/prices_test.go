@@ -0,0 +1,81 @@
+package payment_test
+
+import (
+	"testing"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSetupPricesPutsTheDefaultFirst checks the first price of the product's kind becomes the default
+func TestSetupPricesPutsTheDefaultFirst(t *testing.T) {
+	request := &payment.SetupProductsReq{
+		Name: "Pro",
+		Prices: []*payment.SetupPriceReq{
+			{Amount: 19900, LookupKey: "pro_lifetime"},
+			{Amount: 999, Interval: "month"},
+			{Amount: 9900, Interval: "year", Currency: "EUR"},
+			{Amount: 2999, Interval: "month", IntervalCount: 3},
+		},
+	}
+
+	prices, err := request.SetupPrices(true)
+	require.NoError(t, err)
+	require.Len(t, prices, 4)
+
+	assert.Equal(t, int64(999), prices[0].Amount, "the first recurring price is the default")
+	assert.Equal(t, "usd", prices[0].Currency)
+	assert.Equal(t, int64(1), prices[0].IntervalCount)
+	assert.Equal(t, "prod_1_usd_month", prices[0].LookupKeyFor("prod_1"))
+
+	assert.Equal(t, "pro_lifetime", prices[1].LookupKeyFor("prod_1"))
+	assert.False(t, prices[1].Recurring())
+	assert.Equal(t, "prod_1_eur_year", prices[2].LookupKeyFor("prod_1"))
+	assert.Equal(t, "prod_1_usd_3_month", prices[3].LookupKeyFor("prod_1"))
+
+	prices, err = request.SetupPrices(false)
+	require.NoError(t, err)
+	assert.Equal(t, "pro_lifetime", prices[0].LookupKey, "the first one-time price is the default")
+
+	// the request itself is left as it was
+	assert.Empty(t, request.Prices[1].Currency)
+}
+
+// TestSetupPricesFromSinglePrice checks requests without prices keep setting up one usd price
+func TestSetupPricesFromSinglePrice(t *testing.T) {
+	request := &payment.SetupProductsReq{Name: "Pro", Price: 999}
+
+	prices, err := request.SetupPrices(true)
+	require.NoError(t, err)
+	require.Len(t, prices, 1)
+	assert.Equal(t, int64(999), prices[0].Amount)
+	assert.Equal(t, "usd", prices[0].Currency)
+	assert.Equal(t, "month", prices[0].Interval)
+
+	prices, err = request.SetupPrices(false)
+	require.NoError(t, err)
+	require.Len(t, prices, 1)
+	assert.False(t, prices[0].Recurring())
+}
+
+func TestSetupPricesRejectsInvalidPrices(t *testing.T) {
+	cases := map[string][]*payment.SetupPriceReq{
+		"negative amount":        {{Amount: -1, Interval: "month"}},
+		"unknown interval":       {{Amount: 999, Interval: "fortnight"}},
+		"interval too long":      {{Amount: 999, Interval: "month", IntervalCount: 37}},
+		"one-time with count":    {{Amount: 999, IntervalCount: 2}, {Amount: 999, Interval: "month"}},
+		"no recurring price":     {{Amount: 999}},
+		"duplicate lookup key":   {{Amount: 999, Interval: "month", LookupKey: "pro"}, {Amount: 9900, Interval: "year", LookupKey: "pro"}},
+		"duplicate derived keys": {{Amount: 999, Interval: "month"}, {Amount: 899, Interval: "month"}},
+	}
+
+	for name, prices := range cases {
+		t.Run(name, func(t *testing.T) {
+			request := &payment.SetupProductsReq{Name: "Pro", Prices: prices}
+
+			_, err := request.SetupPrices(true)
+			assert.ErrorIs(t, err, payment.ErrInvalidPrice)
+		})
+	}
+}
@@ -12,10 +12,52 @@ type PaymentProcessor interface {
 	SetupSubscription(ctx context.Context, request *SetupProductsReq) (*SetupProductsResp, error)
 	GetProducts(ctx context.Context) (*ProductListResponse, error)
 	CreateCustomer(ctx context.Context, userId uuid.UUID, email string) (string, error)
+	DeleteCustomer(ctx context.Context, customerId string) error
 	SaveCard(ctx context.Context, customerId string) (string, error)
 	CreatePaymentIntent(ctx context.Context, amount int64, customerId string) (*CreatePaymentIntentResponse, error)
 	PurchaseProduct(ctx context.Context, req *PurchaseProductRequest) (*StripePurchaseResponse, error)
 	SubscribeToProduct(ctx context.Context, req *SubscribeRequest) (*SubscribeResponse, error)
-	IsWebhookEventSupported(ctx context.Context, event *stripe.Event) bool
 	ProcessWebhookEvent(ctx context.Context, event *stripe.Event) (customerId string, error error)
+
+	// reads used by the sync to mirror stripe state into storage
+	GetCustomer(ctx context.Context, customerId string) (*stripe.Customer, error)
+	ListSubscriptions(ctx context.Context, customerId string, opts *ListOptions) ([]*stripe.Subscription, error)
+	GetSubscription(ctx context.Context, subscriptionId string) (*stripe.Subscription, error)
+	ListPaymentIntents(ctx context.Context, customerId string, opts *ListOptions) (intents []*stripe.PaymentIntent, nextCursor string, err error)
+
+	// subscription management, the returned subscription reflects the change
+	CancelSubscription(ctx context.Context, subscriptionId string, details *CancellationDetails) (*stripe.Subscription, error)
+	SetCancelAtPeriodEnd(ctx context.Context, subscriptionId string, cancel bool, details *CancellationDetails) (*stripe.Subscription, error)
+	GetInvoice(ctx context.Context, invoiceId string) (*stripe.Invoice, error)
+	RefundInvoice(ctx context.Context, invoiceId string, amount int64) (refunded int64, err error)
+	SetPauseCollection(ctx context.Context, subscriptionId string, pause *PauseCollection) (*stripe.Subscription, error)
+
+	// plan changes, swapping the price of a subscription item now or at the end of the period
+	GetProductPrice(ctx context.Context, productId string, selector PriceSelector) (*stripe.Price, error)
+	PreviewPlanChange(ctx context.Context, change *PlanChange) (*stripe.Invoice, error)
+	ChangePlan(ctx context.Context, change *PlanChange) (*stripe.Subscription, error)
+	SchedulePlanChange(ctx context.Context, change *PlanChange) (*stripe.SubscriptionSchedule, error)
+}
+
+/**
+* Pagination of the sync's list calls. Stripe lists newest first, so a listing cut short by MaxPages returns the
+* id of the last object as the cursor to continue from (starting_after) with the same CreatedGte.
+*
+* A nil *ListOptions lists everything.
+**/
+type ListOptions struct {
+	CreatedGte    int64  // only objects created at or after this unix time, 0 for all
+	StartingAfter string // continue after this object id
+	PageSize      int64  // objects per request, stripe allows up to 100
+	MaxPages      int    // requests per listing, 0 for no limit
+	ActiveOnly    bool   // subscriptions only, leave out canceled subscriptions
+}
+
+// most objects a listing returns before it is cut short, 0 for no limit
+func (o *ListOptions) MaxObjects() int {
+	if o == nil || o.MaxPages <= 0 || o.PageSize <= 0 {
+		return 0
+	}
+
+	return o.MaxPages * int(o.PageSize)
 }
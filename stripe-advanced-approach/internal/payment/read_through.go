@@ -0,0 +1,160 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
+	"github.com/stripe/stripe-go/v82"
+)
+
+/**
+* Read-through of the customer's cached stripe data.
+*
+* A popular customer's entry expiring must not send every concurrent request to stripe at once, so rebuilding an
+* entry is shared at two levels:
+*
+* - within the process concurrent reads of a customer join one in-flight rebuild (stripeDataFlights)
+* - across instances the rebuild is a regular sync, which runs under the customer's sync lock and coalesces
+*   concurrent requests (see sync_lock.go), reads coalesced into another instance's sync wait for its result
+*
+* Entries older than STRIPE_DATA_FRESH_SECONDS are stale. With STRIPE_DATA_STALE_WHILE_REVALIDATE (the default)
+* stale entries are served right away while one background rebuild refreshes them, otherwise the read waits for
+* the rebuild. Either way a stale entry is served when the rebuild fails, only reads without any cached copy fail
+* with ErrStripeUnavailable while stripe can't be reached.
+**/
+
+// returned when stripe can't be reached and there is no cached copy to serve instead
+var ErrStripeUnavailable = errors.New("stripe unavailable")
+
+func stripeDataFreshFor() time.Duration {
+	return time.Duration(util.GetEnvAsInt("STRIPE_DATA_FRESH_SECONDS", 300)) * time.Second
+}
+
+func staleWhileRevalidate() bool {
+	return util.GetEnv("STRIPE_DATA_STALE_WHILE_REVALIDATE", "true") == "true"
+}
+
+// how long a read waits for a rebuild running on another instance
+func stripeDataRebuildWait() time.Duration {
+	return time.Duration(util.GetEnvAsInt("STRIPE_DATA_REBUILD_WAIT_MS", 5000)) * time.Millisecond
+}
+
+const stripeDataRebuildPollInterval = 100 * time.Millisecond
+
+/**
+* Marks errors of calls to stripe that say nothing about the request itself (network failures, rate limits,
+* stripe's own outages) as ErrStripeUnavailable.
+**/
+func stripeCallErr(err error) error {
+	var stripeErr *stripe.Error
+
+	if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode != 0 && stripeErr.HTTPStatusCode < http.StatusInternalServerError && stripeErr.HTTPStatusCode != http.StatusTooManyRequests {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrStripeUnavailable, err)
+}
+
+func (d *StripeCacheData) isFresh(now time.Time) bool {
+	return now.Sub(time.UnixMicro(d.Version)) < stripeDataFreshFor()
+}
+
+/**
+* Rebuilds the customer's cached stripe data with a sync and returns it. When the sync was coalesced into one
+* running on another instance the entry appears once that finishes, so it is polled for a while.
+**/
+func (s *service) rebuildStripeData(ctx context.Context, customerId string) (*StripeCacheData, error) {
+	if err := s.SyncStripeDataToStorage(ctx, customerId); err != nil {
+		return nil, fmt.Errorf("failed to rebuild cached stripe data: %w", err)
+	}
+
+	key := s.keys.CustomerData(customerId)
+	deadline := time.Now().Add(stripeDataRebuildWait())
+
+	for {
+		data, err := s.getCachedStripeData(ctx, key)
+
+		if err != nil || data != nil {
+			return data, err
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("stripe data of customer %s not cached after its sync", customerId)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(stripeDataRebuildPollInterval):
+		}
+	}
+}
+
+// rebuild shared by every read of the customer in this process, it isn't canceled with the reader that started it
+func (s *service) sharedRebuild(ctx context.Context, customerId string) (*StripeCacheData, error) {
+	return s.stripeDataFlights.do(ctx, customerId, func() (*StripeCacheData, error) {
+		return s.rebuildStripeData(context.WithoutCancel(ctx), customerId)
+	})
+}
+
+func (s *service) revalidateInBackground(ctx context.Context, customerId string) {
+	go func() {
+		if _, err := s.sharedRebuild(context.WithoutCancel(ctx), customerId); err != nil {
+			fmt.Printf("\nError when revalidating stale stripe data of customer %s: %+v\n\n", customerId, err)
+		}
+	}()
+}
+
+/**
+* Minimal singleflight: concurrent calls with the same key share the result of the first one. Waiting callers
+* return early when their own context is done.
+**/
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	data *StripeCacheData
+	err  error
+}
+
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (*StripeCacheData, error)) (*StripeCacheData, error) {
+	g.mu.Lock()
+
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+
+	current, inFlight := g.flights[key]
+
+	if !inFlight {
+		current = &flight{done: make(chan struct{})}
+		g.flights[key] = current
+
+		go func() {
+			current.data, current.err = fn()
+
+			g.mu.Lock()
+			delete(g.flights, key)
+			g.mu.Unlock()
+
+			close(current.done)
+		}()
+	}
+
+	g.mu.Unlock()
+
+	select {
+	case <-current.done:
+		return current.data, current.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -2,10 +2,15 @@ package payment
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/database"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 type repository struct {
@@ -16,6 +21,11 @@ func NewRepository(db *sqlx.DB) *repository {
 	return &repository{db: db}
 }
 
+// queries join the transaction carried by the context, if any
+func (r *repository) conn(ctx context.Context) database.Executor {
+	return database.Conn(ctx, r.db)
+}
+
 func (r *repository) Create(ctx context.Context, userId uuid.UUID, paymentIntent *PaymentIntentRequest) error {
 
 	query := `
@@ -30,7 +40,7 @@ func (r *repository) Create(ctx context.Context, userId uuid.UUID, paymentIntent
 		) VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
 	`
 
-	_, err := r.db.ExecContext(ctx, query, userId, paymentIntent.CustomerID, paymentIntent.IntentID, paymentIntent.Amount, "pending")
+	_, err := r.conn(ctx).ExecContext(ctx, query, userId, paymentIntent.CustomerID, paymentIntent.IntentID, paymentIntent.Amount, "pending")
 
 	if err != nil {
 		return err
@@ -43,11 +53,25 @@ func (r *repository) GetPaymentByIntentID(ctx context.Context, intentID string)
 	var payment Payment
 
 	query := `
-		SELECT * FROM payments
+		SELECT
+			id,
+			user_id,
+			COALESCE(stripe_customer_id, '') AS stripe_customer_id,
+			stripe_payment_intent_id,
+			COALESCE(stripe_session_id, '') AS stripe_session_id,
+			amount,
+			COALESCE(currency, '') AS currency,
+			status,
+			COALESCE(payment_method_types, '') AS payment_method_types,
+			last_event_at,
+			created_at,
+			updated_at,
+			completed_at
+		FROM payments
 		WHERE stripe_payment_intent_id = $1
 	`
 
-	err := r.db.GetContext(ctx, &payment, query, intentID)
+	err := r.conn(ctx).GetContext(ctx, &payment, query, intentID)
 	if err != nil {
 		return nil, err
 	}
@@ -55,14 +79,18 @@ func (r *repository) GetPaymentByIntentID(ctx context.Context, intentID string)
 	return &payment, nil
 }
 
-func (r *repository) UpdateStatus(ctx context.Context, intentID string, status string) error {
+/**
+* Updates the status from stripe state as of eventAt, rows already reflecting newer state are left untouched.
+**/
+func (r *repository) UpdateStatus(ctx context.Context, intentID string, status string, eventAt time.Time) error {
 	query := `
 		UPDATE payments
-		SET status = $1, updated_at = NOW()
+		SET status = $1, last_event_at = $3, updated_at = NOW()
 		WHERE stripe_payment_intent_id = $2
+		AND (last_event_at IS NULL OR last_event_at <= $3)
 	`
 
-	_, err := r.db.ExecContext(ctx, query, status, intentID)
+	_, err := r.conn(ctx).ExecContext(ctx, query, status, intentID, eventAt)
 
 	if err != nil {
 		fmt.Printf("\nError when updating payment table status column: %+v\n\n", err)
@@ -72,6 +100,10 @@ func (r *repository) UpdateStatus(ctx context.Context, intentID string, status s
 	return nil
 }
 
+/**
+* Mirrors a payment intent. Stripe state older than what the row already reflects (payment.LastEventAt compared
+* to the stored last_event_at) is ignored, so a delayed event or stale sync can't regress the status.
+**/
 func (r *repository) UpsertPayment(ctx context.Context, paymentIntentID string, payment *Payment) error {
 	query := `
         INSERT INTO payments (
@@ -81,28 +113,39 @@ func (r *repository) UpsertPayment(ctx context.Context, paymentIntentID string,
             amount,
             status,
             currency,
+            last_event_at,
             created_at,
             updated_at
-        ) VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), NOW())
         ON CONFLICT (stripe_payment_intent_id) 
         DO UPDATE SET
             amount = EXCLUDED.amount,
             status = EXCLUDED.status,
             currency = EXCLUDED.currency,
+            last_event_at = EXCLUDED.last_event_at,
             updated_at = NOW()
+        WHERE payments.last_event_at IS NULL
+            OR EXCLUDED.last_event_at >= payments.last_event_at
         RETURNING id
     `
 
 	var id uuid.UUID
-	err := r.db.QueryRowContext(ctx, query,
+	err := r.conn(ctx).QueryRowContext(ctx, query,
 		payment.UserID,
 		payment.StripeCustomerID,
 		paymentIntentID,
 		payment.Amount,
 		payment.Status,
 		payment.Currency,
+		payment.LastEventAt,
 	).Scan(&id)
 
+	// row reflects newer stripe state
+	if err == sql.ErrNoRows {
+		fmt.Printf("\nSkipping stale update of payment %s\n\n", paymentIntentID)
+		return nil
+	}
+
 	if err != nil {
 		return fmt.Errorf("failed to upsert payment: %w", err)
 	}
@@ -110,6 +153,11 @@ func (r *repository) UpsertPayment(ctx context.Context, paymentIntentID string,
 	return nil
 }
 
+/**
+* Mirrors a subscription, with the same ordering guard on last_event_at as UpsertPayment. When the subscription
+* carries its items they replace the mirrored ones, so the upsert should run in a transaction to keep the row and
+* its items consistent.
+**/
 func (r *repository) UpsertSubscriptionRecord(ctx context.Context, sub *Subscription) error {
 	query := `
 		INSERT INTO subscriptions (
@@ -121,9 +169,21 @@ func (r *repository) UpsertSubscriptionRecord(ctx context.Context, sub *Subscrip
 			current_period_start,
 			current_period_end,
 			cancel_at_period_end,
+			canceled_at,
+			ended_at,
+			trial_start,
+			trial_end,
+			latest_invoice_id,
+			discount_ids,
+			cancellation_reason,
+			cancellation_feedback,
+			cancellation_comment,
+			pause_behavior,
+			pause_resumes_at,
+			last_event_at,
 			created_at,
 			updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW(), NOW())
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, NOW(), NOW())
 		ON CONFLICT (stripe_subscription_id)
 		DO UPDATE SET
 			stripe_price_id = EXCLUDED.stripe_price_id,
@@ -131,12 +191,31 @@ func (r *repository) UpsertSubscriptionRecord(ctx context.Context, sub *Subscrip
 			current_period_start = EXCLUDED.current_period_start,
 			current_period_end = EXCLUDED.current_period_end,
 			cancel_at_period_end = EXCLUDED.cancel_at_period_end,
+			canceled_at = EXCLUDED.canceled_at,
+			ended_at = EXCLUDED.ended_at,
+			trial_start = EXCLUDED.trial_start,
+			trial_end = EXCLUDED.trial_end,
+			latest_invoice_id = EXCLUDED.latest_invoice_id,
+			discount_ids = EXCLUDED.discount_ids,
+			cancellation_reason = EXCLUDED.cancellation_reason,
+			cancellation_feedback = EXCLUDED.cancellation_feedback,
+			cancellation_comment = EXCLUDED.cancellation_comment,
+			pause_behavior = EXCLUDED.pause_behavior,
+			pause_resumes_at = EXCLUDED.pause_resumes_at,
+			last_event_at = EXCLUDED.last_event_at,
 			updated_at = NOW()
+		WHERE subscriptions.last_event_at IS NULL
+			OR EXCLUDED.last_event_at >= subscriptions.last_event_at
 		RETURNING id
 	`
 
+	discountIDs := sub.DiscountIDs
+	if discountIDs == nil {
+		discountIDs = pq.StringArray{}
+	}
+
 	var id uuid.UUID
-	err := r.db.QueryRowContext(ctx, query,
+	err := r.conn(ctx).QueryRowContext(ctx, query,
 		sub.UserID,
 		sub.StripeCustomerID,
 		sub.StripeSubscriptionID,
@@ -145,26 +224,174 @@ func (r *repository) UpsertSubscriptionRecord(ctx context.Context, sub *Subscrip
 		sub.CurrentPeriodStart,
 		sub.CurrentPeriodEnd,
 		sub.CancelAtPeriodEnd,
+		sub.CanceledAt,
+		sub.EndedAt,
+		sub.TrialStart,
+		sub.TrialEnd,
+		sub.LatestInvoiceID,
+		discountIDs,
+		sub.CancellationReason,
+		sub.CancellationFeedback,
+		sub.CancellationComment,
+		sub.PauseBehavior,
+		sub.PauseResumesAt,
+		sub.LastEventAt,
 	).Scan(&id)
 
+	// row reflects newer stripe state
+	if err == sql.ErrNoRows {
+		fmt.Printf("\nSkipping stale update of subscription %s\n\n", sub.StripeSubscriptionID)
+		return nil
+	}
+
 	if err != nil {
 		return fmt.Errorf("failed to upsert subscription: %w", err)
 	}
 
+	// item state unknown (e.g. straight after creating the subscription), keep the mirrored items
+	if sub.Items == nil {
+		return nil
+	}
+
+	return r.replaceSubscriptionItems(ctx, sub.StripeSubscriptionID, sub.Items)
+}
+
+// upserts the given items of a subscription and removes the ones it no longer has
+func (r *repository) replaceSubscriptionItems(ctx context.Context, subID string, items []*SubscriptionItem) error {
+	itemIDs := pq.StringArray{}
+
+	query := `
+		INSERT INTO subscription_items (
+			stripe_subscription_item_id,
+			stripe_subscription_id,
+			stripe_price_id,
+			stripe_product_id,
+			quantity,
+			unit_amount,
+			currency,
+			recurring_interval,
+			current_period_start,
+			current_period_end,
+			created_at,
+			updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW(), NOW())
+		ON CONFLICT (stripe_subscription_item_id)
+		DO UPDATE SET
+			stripe_price_id = EXCLUDED.stripe_price_id,
+			stripe_product_id = EXCLUDED.stripe_product_id,
+			quantity = EXCLUDED.quantity,
+			unit_amount = EXCLUDED.unit_amount,
+			currency = EXCLUDED.currency,
+			recurring_interval = EXCLUDED.recurring_interval,
+			current_period_start = EXCLUDED.current_period_start,
+			current_period_end = EXCLUDED.current_period_end,
+			updated_at = NOW()
+	`
+
+	for _, item := range items {
+		_, err := r.conn(ctx).ExecContext(ctx, query,
+			item.StripeSubscriptionItemID,
+			subID,
+			item.StripePriceID,
+			item.StripeProductID,
+			item.Quantity,
+			item.UnitAmount,
+			item.Currency,
+			item.RecurringInterval,
+			item.CurrentPeriodStart,
+			item.CurrentPeriodEnd,
+		)
+
+		if err != nil {
+			return fmt.Errorf("failed to upsert subscription item %s: %w", item.StripeSubscriptionItemID, err)
+		}
+
+		itemIDs = append(itemIDs, item.StripeSubscriptionItemID)
+	}
+
+	_, err := r.conn(ctx).ExecContext(ctx, `
+		DELETE FROM subscription_items
+		WHERE stripe_subscription_id = $1 AND NOT (stripe_subscription_item_id = ANY($2))
+	`, subID, itemIDs)
+
+	if err != nil {
+		return fmt.Errorf("failed to remove subscription items: %w", err)
+	}
+
 	return nil
 }
 
+// subscription columns with defaults for rows written before they were mirrored
+const subscriptionColumns = `
+	id,
+	user_id,
+	COALESCE(stripe_customer_id, '') AS stripe_customer_id,
+	stripe_subscription_id,
+	COALESCE(stripe_price_id, '') AS stripe_price_id,
+	status,
+	COALESCE(current_period_start, 'epoch') AS current_period_start,
+	COALESCE(current_period_end, 'epoch') AS current_period_end,
+	COALESCE(cancel_at_period_end, FALSE) AS cancel_at_period_end,
+	canceled_at,
+	ended_at,
+	trial_start,
+	trial_end,
+	COALESCE(latest_invoice_id, '') AS latest_invoice_id,
+	discount_ids,
+	COALESCE(cancellation_reason, '') AS cancellation_reason,
+	COALESCE(cancellation_feedback, '') AS cancellation_feedback,
+	COALESCE(cancellation_comment, '') AS cancellation_comment,
+	COALESCE(pause_behavior, '') AS pause_behavior,
+	pause_resumes_at,
+	trial_ending_notice_at,
+	last_event_at,
+	created_at,
+	updated_at
+`
+
+/**
+* The user's current subscription (active or trialing) with its items, one still collecting payments over a paused
+* one.
+**/
 func (r *repository) GetActiveSubscription(ctx context.Context, userID uuid.UUID) (*Subscription, error) {
 	var subscription Subscription
 
 	query := `
-		SELECT * FROM subscriptions
-		WHERE user_id = $1 AND status = 'active'
-		ORDER BY created_at DESC
+		SELECT ` + subscriptionColumns + `
+		FROM subscriptions
+		WHERE user_id = $1 AND status IN ('active', 'trialing')
+		ORDER BY COALESCE(pause_behavior, '') <> '', created_at DESC
 		LIMIT 1
 	`
 
-	err := r.db.GetContext(ctx, &subscription, query, userID)
+	err := r.conn(ctx).GetContext(ctx, &subscription, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	subscription.Items, err = r.GetSubscriptionItems(ctx, subscription.StripeSubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &subscription, nil
+}
+
+func (r *repository) GetSubscriptionByStripeID(ctx context.Context, subID string) (*Subscription, error) {
+	var subscription Subscription
+
+	query := `
+		SELECT ` + subscriptionColumns + `
+		FROM subscriptions
+		WHERE stripe_subscription_id = $1
+	`
+
+	err := r.conn(ctx).GetContext(ctx, &subscription, query, subID)
+	if err != nil {
+		return nil, err
+	}
+
+	subscription.Items, err = r.GetSubscriptionItems(ctx, subID)
 	if err != nil {
 		return nil, err
 	}
@@ -172,14 +399,65 @@ func (r *repository) GetActiveSubscription(ctx context.Context, userID uuid.UUID
 	return &subscription, nil
 }
 
-func (r *repository) UpdateSubscriptionStatus(ctx context.Context, subID string, status string) error {
+func (r *repository) GetSubscriptionItems(ctx context.Context, subID string) ([]*SubscriptionItem, error) {
+	items := []*SubscriptionItem{}
+
+	query := `
+		SELECT
+			id,
+			stripe_subscription_item_id,
+			stripe_subscription_id,
+			stripe_price_id,
+			stripe_product_id,
+			quantity,
+			unit_amount,
+			currency,
+			recurring_interval,
+			COALESCE(current_period_start, 'epoch') AS current_period_start,
+			COALESCE(current_period_end, 'epoch') AS current_period_end,
+			created_at,
+			updated_at
+		FROM subscription_items
+		WHERE stripe_subscription_id = $1
+		ORDER BY created_at ASC, stripe_subscription_item_id ASC
+	`
+
+	err := r.conn(ctx).SelectContext(ctx, &items, query, subID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription items: %w", err)
+	}
+
+	return items, nil
+}
+
+// the customer's subscription rows without their items
+func (r *repository) ListSubscriptionsByCustomer(ctx context.Context, customerID string) ([]*Subscription, error) {
+	subscriptions := []*Subscription{}
+
+	query := `
+		SELECT ` + subscriptionColumns + `
+		FROM subscriptions
+		WHERE stripe_customer_id = $1
+		ORDER BY created_at ASC
+	`
+
+	err := r.conn(ctx).SelectContext(ctx, &subscriptions, query, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscriptions of customer: %w", err)
+	}
+
+	return subscriptions, nil
+}
+
+func (r *repository) UpdateSubscriptionStatus(ctx context.Context, subID string, status string, eventAt time.Time) error {
 	query := `
 		UPDATE subscriptions
-		SET status = $1, updated_at = NOW()
+		SET status = $1, last_event_at = $3, updated_at = NOW()
 		WHERE stripe_subscription_id = $2
+		AND (last_event_at IS NULL OR last_event_at <= $3)
 	`
 
-	_, err := r.db.ExecContext(ctx, query, status, subID)
+	_, err := r.conn(ctx).ExecContext(ctx, query, status, subID, eventAt)
 
 	if err != nil {
 		fmt.Printf("\nError when updating subscription status %+v\n\n", err)
@@ -189,6 +467,276 @@ func (r *repository) UpdateSubscriptionStatus(ctx context.Context, subID string,
 	return nil
 }
 
-func (r *repository) BeginTx(ctx context.Context) (*sqlx.Tx, error) {
-	return r.db.BeginTxx(ctx, nil)
+/**
+* Records stripe's notice that the subscription's trial ends without a payment method, nil clears it. The column is
+* kept by the mirror's upserts.
+**/
+func (r *repository) SetTrialEndingNotice(ctx context.Context, subID string, noticeAt *time.Time) error {
+	query := `
+		UPDATE subscriptions
+		SET trial_ending_notice_at = $1, updated_at = NOW()
+		WHERE stripe_subscription_id = $2
+	`
+
+	_, err := r.conn(ctx).ExecContext(ctx, query, noticeAt, subID)
+
+	if err != nil {
+		return fmt.Errorf("failed to set trial ending notice of subscription %s: %w", subID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetCustomerSyncState(ctx context.Context, customerID string) (*CustomerSyncState, error) {
+	var state CustomerSyncState
+
+	query := `SELECT * FROM customer_sync_state WHERE stripe_customer_id = $1`
+
+	err := r.conn(ctx).GetContext(ctx, &state, query, customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+func (r *repository) SaveCustomerSyncState(ctx context.Context, state *CustomerSyncState) error {
+	query := `
+		INSERT INTO customer_sync_state (
+			stripe_customer_id,
+			payments_created_gte,
+			pass_created_gte,
+			pass_cursor,
+			pass_newest_created,
+			last_full_sync_at,
+			updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		ON CONFLICT (stripe_customer_id)
+		DO UPDATE SET
+			payments_created_gte = EXCLUDED.payments_created_gte,
+			pass_created_gte = EXCLUDED.pass_created_gte,
+			pass_cursor = EXCLUDED.pass_cursor,
+			pass_newest_created = EXCLUDED.pass_newest_created,
+			last_full_sync_at = EXCLUDED.last_full_sync_at,
+			updated_at = NOW()
+	`
+
+	_, err := r.conn(ctx).ExecContext(ctx, query,
+		state.StripeCustomerID,
+		state.PaymentsCreatedGte,
+		state.PassCreatedGte,
+		state.PassCursor,
+		state.PassNewestCreated,
+		state.LastFullSyncAt,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to save customer sync state: %w", err)
+	}
+
+	return nil
+}
+
+/**
+* Stores a verified webhook event. Stripe retries deliveries, so an event that already exists is left untouched
+* and returned with inserted = false.
+**/
+func (r *repository) SaveWebhookEvent(ctx context.Context, event *WebhookEvent) (*WebhookEvent, bool, error) {
+	query := `
+		INSERT INTO webhook_events (
+			stripe_event_id,
+			event_type,
+			stripe_customer_id,
+			processed,
+			payload,
+			attempts,
+			created_at,
+			updated_at
+		) VALUES ($1, $2, $3, FALSE, $4, 0, NOW(), NOW())
+		ON CONFLICT (stripe_event_id) DO NOTHING
+		RETURNING *
+	`
+
+	var saved WebhookEvent
+	// jsonb has to be sent as text, lib/pq would encode a []byte as bytea
+	err := r.conn(ctx).GetContext(ctx, &saved, query, event.StripeEventID, event.EventType, event.CustomerID, string(event.Payload))
+
+	if err == nil {
+		return &saved, true, nil
+	}
+
+	if err != sql.ErrNoRows {
+		return nil, false, fmt.Errorf("failed to save webhook event: %w", err)
+	}
+
+	// conflict, event was delivered before
+	existing, err := r.GetWebhookEventByStripeID(ctx, event.StripeEventID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return existing, false, nil
+}
+
+func (r *repository) GetWebhookEventByStripeID(ctx context.Context, stripeEventID string) (*WebhookEvent, error) {
+	var event WebhookEvent
+
+	query := `
+		SELECT * FROM webhook_events
+		WHERE stripe_event_id = $1
+	`
+
+	err := r.conn(ctx).GetContext(ctx, &event, query, stripeEventID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+/**
+* Lists stored webhook events matching the replay filters, oldest first so they replay in delivery order.
+**/
+func (r *repository) ListWebhookEvents(ctx context.Context, filter *WebhookReplayRequest) ([]*WebhookEvent, error) {
+	var conditions []string
+	var args []interface{}
+
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.EventType != "" {
+		addCondition("event_type = $%d", filter.EventType)
+	}
+
+	if filter.CustomerID != "" {
+		addCondition("stripe_customer_id = $%d", filter.CustomerID)
+	}
+
+	if filter.From != nil {
+		addCondition("created_at >= $%d", *filter.From)
+	}
+
+	if filter.To != nil {
+		addCondition("created_at < $%d", *filter.To)
+	}
+
+	switch filter.State {
+	case "processed":
+		conditions = append(conditions, "processed = TRUE")
+	case "failed":
+		conditions = append(conditions, "processed = FALSE AND failed_at IS NOT NULL")
+	case "pending":
+		conditions = append(conditions, "processed = FALSE AND failed_at IS NULL")
+	}
+
+	query := `SELECT * FROM webhook_events`
+
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY created_at ASC LIMIT $%d", len(args))
+
+	var events []*WebhookEvent
+	err := r.conn(ctx).SelectContext(ctx, &events, query, args...)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook events: %w", err)
+	}
+
+	return events, nil
+}
+
+func (r *repository) MarkWebhookEventProcessed(ctx context.Context, stripeEventID string) error {
+	query := `
+		UPDATE webhook_events
+		SET processed = TRUE,
+			attempts = attempts + 1,
+			last_error = NULL,
+			processed_at = NOW(),
+			updated_at = NOW()
+		WHERE stripe_event_id = $1
+	`
+
+	_, err := r.conn(ctx).ExecContext(ctx, query, stripeEventID)
+
+	if err != nil {
+		fmt.Printf("\nError when marking webhook event as processed: %+v\n\n", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *repository) MarkWebhookEventFailed(ctx context.Context, stripeEventID string, processingErr string) error {
+	query := `
+		UPDATE webhook_events
+		SET attempts = attempts + 1,
+			last_error = $1,
+			failed_at = NOW(),
+			updated_at = NOW()
+		WHERE stripe_event_id = $2
+	`
+
+	_, err := r.conn(ctx).ExecContext(ctx, query, processingErr, stripeEventID)
+
+	if err != nil {
+		fmt.Printf("\nError when marking webhook event as failed: %+v\n\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// --- cache maintenance ---
+
+const cacheCustomerColumns = `
+	u.id,
+	u.stripe_customer_id,
+	EXISTS (SELECT 1 FROM subscriptions s WHERE s.stripe_customer_id = u.stripe_customer_id) AS has_subscriptions
+`
+
+/**
+* Users with a stripe customer ordered by id, the page after afterUserID (uuid.Nil for the first one).
+**/
+func (r *repository) ListCacheCustomers(ctx context.Context, afterUserID uuid.UUID, limit int) ([]*CacheCustomer, error) {
+	customers := []*CacheCustomer{}
+
+	query := `
+		SELECT ` + cacheCustomerColumns + `
+		FROM users u
+		WHERE u.stripe_customer_id IS NOT NULL AND u.id > $1
+		ORDER BY u.id ASC
+		LIMIT $2
+	`
+
+	err := r.conn(ctx).SelectContext(ctx, &customers, query, afterUserID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache customers: %w", err)
+	}
+
+	return customers, nil
+}
+
+// a random sample of users with a stripe customer
+func (r *repository) SampleCacheCustomers(ctx context.Context, limit int) ([]*CacheCustomer, error) {
+	customers := []*CacheCustomer{}
+
+	query := `
+		SELECT ` + cacheCustomerColumns + `
+		FROM users u
+		WHERE u.stripe_customer_id IS NOT NULL
+		ORDER BY random()
+		LIMIT $1
+	`
+
+	err := r.conn(ctx).SelectContext(ctx, &customers, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample cache customers: %w", err)
+	}
+
+	return customers, nil
 }
@@ -2,54 +2,132 @@ package payment
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"time"
 
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cachekey"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/codec"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/database"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
-	"github.com/darkphotonKN/stripe-advanced-approach/internal/model"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/invalidation"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/user"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
 	"github.com/google/uuid"
-	"github.com/jmoiron/sqlx"
-	redislib "github.com/redis/go-redis/v9"
 	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/customer"
-	"github.com/stripe/stripe-go/v82/paymentintent"
-	"github.com/stripe/stripe-go/v82/subscription"
 )
 
 type service struct {
 	userService      PaymentUserService
 	paymentProcessor PaymentProcessor
 	cacheClient      interfaces.Cache
+	keys             *cachekey.Schema
+	codec            codec.Codec
 	repo             Repository
+	unitOfWork       interfaces.UnitOfWork
+	webhookQueue     *WebhookQueue
+	invalidations    *invalidation.Bus
+	webhookHandlers  map[stripe.EventType]webhookEventHandler
+	lockSyncs        bool
+
+	// rebuilds of cached stripe data in flight, per customer
+	stripeDataFlights flightGroup
+	// requests of this process waiting for a customer's follow-up sync
+	syncFollowUps followUpGroup
 }
 
 type Repository interface {
 	Create(ctx context.Context, userId uuid.UUID, paymentIntent *PaymentIntentRequest) error
 	GetPaymentByIntentID(ctx context.Context, intentID string) (*Payment, error)
-	UpdateStatus(ctx context.Context, intentID string, status string) error
+	UpdateStatus(ctx context.Context, intentID string, status string, eventAt time.Time) error
 	UpsertPayment(ctx context.Context, paymentIntentID string, payment *Payment) error
 	UpsertSubscriptionRecord(ctx context.Context, sub *Subscription) error
 	GetActiveSubscription(ctx context.Context, userID uuid.UUID) (*Subscription, error)
-	UpdateSubscriptionStatus(ctx context.Context, subID string, status string) error
-	BeginTx(ctx context.Context) (*sqlx.Tx, error)
+	UpdateSubscriptionStatus(ctx context.Context, subID string, status string, eventAt time.Time) error
+	SetTrialEndingNotice(ctx context.Context, subID string, noticeAt *time.Time) error
+	GetSubscriptionByStripeID(ctx context.Context, subID string) (*Subscription, error)
+	ListSubscriptionsByCustomer(ctx context.Context, customerID string) ([]*Subscription, error)
+	GetCustomerSyncState(ctx context.Context, customerID string) (*CustomerSyncState, error)
+	SaveCustomerSyncState(ctx context.Context, state *CustomerSyncState) error
+	SaveWebhookEvent(ctx context.Context, event *WebhookEvent) (*WebhookEvent, bool, error)
+	GetWebhookEventByStripeID(ctx context.Context, stripeEventID string) (*WebhookEvent, error)
+	ListWebhookEvents(ctx context.Context, filter *WebhookReplayRequest) ([]*WebhookEvent, error)
+	MarkWebhookEventProcessed(ctx context.Context, stripeEventID string) error
+	MarkWebhookEventFailed(ctx context.Context, stripeEventID string, processingErr string) error
+	ListCacheCustomers(ctx context.Context, afterUserID uuid.UUID, limit int) ([]*CacheCustomer, error)
+	SampleCacheCustomers(ctx context.Context, limit int) ([]*CacheCustomer, error)
 }
 
+// returned when stripe redelivers an event that was already processed successfully
+var ErrWebhookEventAlreadyProcessed = errors.New("webhook event already processed")
+
+// returned when the user has no active or trialing subscription
+var ErrNoActiveSubscription = errors.New("no active subscription")
+
+// returned by dead-letter operations when webhooks are processed inline
+var ErrWebhookQueueDisabled = errors.New("webhook queue is not enabled")
+
+// returned for webhook replay filters that can't be applied
+var ErrInvalidReplayFilter = errors.New("invalid replay filter")
+
 type PaymentUserService interface {
 	UpdateStripeCustomer(ctx context.Context, userID uuid.UUID, stripeCustomerID string) error
 	GetByStripeCustomerID(ctx context.Context, stripeCustomerID string) (*user.User, error)
-	Update(ctx context.Context, userID uuid.UUID, user *user.User) error
+	UpdateSubscribed(ctx context.Context, userID uuid.UUID, subscribed bool) error
 	GetSubscriptionStatus(ctx context.Context, userID uuid.UUID) (bool, error)
+	GetStripeCustomer(ctx context.Context, userID uuid.UUID) (*string, error)
 }
 
-func NewService(repo Repository, userService PaymentUserService, paymentProcessor PaymentProcessor, cacheClient interfaces.Cache) *service {
-	return &service{
+func NewService(repo Repository, unitOfWork interfaces.UnitOfWork, userService PaymentUserService, paymentProcessor PaymentProcessor, cacheClient interfaces.Cache) *service {
+	s := &service{
 		repo:             repo,
+		unitOfWork:       unitOfWork,
 		userService:      userService,
 		paymentProcessor: paymentProcessor,
 		cacheClient:      cacheClient,
+		keys:             cachekey.FromEnv(),
+		codec:            codec.FromEnv(),
+		lockSyncs:        true,
+	}
+
+	s.webhookHandlers = s.newWebhookHandlers()
+
+	return s
+}
+
+/**
+* dependency injection for the webhook queue, which itself needs the finished payment service to process events
+**/
+func (s *service) SetWebhookQueue(webhookQueue *WebhookQueue) {
+	s.webhookQueue = webhookQueue
+}
+
+/**
+* optional, syncs of a customer are coalesced under a per-customer lock on the cache unless disabled
+**/
+func (s *service) SetSyncLocking(enabled bool) {
+	s.lockSyncs = enabled
+}
+
+/**
+* optional, announces rewritten customer keys so every instance drops its local copies of them
+**/
+func (s *service) SetInvalidationBus(invalidations *invalidation.Bus) {
+	s.invalidations = invalidations
+}
+
+// a lost announcement only leaves local copies stale until they expire, the write itself succeeded
+func (s *service) announceInvalidation(ctx context.Context, customerId string, keys ...string) {
+	if s.invalidations == nil {
+		return
+	}
+
+	if err := s.invalidations.Publish(ctx, customerId, keys...); err != nil {
+		fmt.Printf("\nError when announcing cache invalidation: %+v\n\n", err)
 	}
 }
 
@@ -64,7 +142,7 @@ func NewService(repo Repository, userService PaymentUserService, paymentProcesso
 *
 * The key-value cache structure will be as follows:
 
-Key: stripe:customer:{customerId}
+Key: stripe:customer:v{version}:{customerId}   // namespaced and versioned, see the cachekey package
 
 	Value: {
 	  subscriptionId: "sub_xyz",
@@ -81,81 +159,100 @@ Value: "cus_stripe123"        // Customer ID mapping
 *
 */
 func (s *service) SyncStripeDataToStorage(ctx context.Context, customerId string) error {
-	// get latest up-to-date data from stripe
-	customer, err := customer.Get(customerId, nil)
-
-	// --- Data Organization ---
+	return s.syncStripeDataToStorage(ctx, customerId, false)
+}
 
-	if err != nil {
-		fmt.Printf("\nFailed to get customer from stripe: %+v\n\n", err)
-		return fmt.Errorf("failed to get customer from stripe: %w", err)
+/**
+* forceFull lists everything of the customer from stripe even when an incremental pass is due, for callers that
+* can't tell which of the customer's objects are out of date.
+**/
+func (s *service) syncStripeDataToStorage(ctx context.Context, customerId string, forceFull bool) error {
+	if !s.lockSyncs {
+		return s.syncStripeData(ctx, customerId, forceFull)
 	}
 
-	stripeUpdateCusWithCusIdKey := s.cacheClient.GetCustomerDataFromCustomerIdKey(customerId)
+	// one sync per customer at a time, concurrent requests are coalesced into a follow-up run
+	return s.coalesceSync(ctx, customerId, forceFull)
+}
 
-	// -- subscriptions --
+func (s *service) syncStripeData(ctx context.Context, customerId string, forceFull bool) error {
+	plan, err := s.planStripeSync(ctx, customerId, forceFull)
 
-	params := &stripe.SubscriptionListParams{
-		Customer: stripe.String(customerId),
-		Status:   stripe.String("all"),
+	if err != nil {
+		return err
 	}
 
-	// expand the payment method to get card details
-	params.AddExpand("data.default_payment_method")
+	return s.applyStripeSync(ctx, plan)
+}
 
-	// get subscription data
-	subIter := subscription.List(params)
+// everything a sync writes for one customer, built from stripe before any storage is touched
+type stripeSyncPlan struct {
+	customerId    string
+	version       time.Time
+	userId        uuid.UUID
+	subscriptions []*Subscription
+	payments      []*Payment
+	syncState     *CustomerSyncState
+	cacheKey      string
+	cacheState    StripeCacheData
+	// full passes list every subscription, the cached ones stripe no longer lists are dropped
+	listedAllSubscriptions bool
+}
 
-	// subscriptions slice
-	subscriptions := []*stripe.Subscription{}
+/**
+* Fetches the latest state of a customer from stripe and organizes it into the rows and cache state the sync
+* writes, without touching storage.
+**/
+func (s *service) planStripeSync(ctx context.Context, customerId string, forceFull bool) (*stripeSyncPlan, error) {
+	// everything read below is at least as new as the start of the reads
+	readAt := time.Now().UTC()
+	version := stripeReadVersion(readAt)
 
-	// validates that customer has subscriptions
-	for subIter.Next() {
-		// get the subscription
-		sub := subIter.Subscription()
+	// get latest up-to-date data from stripe
+	customer, err := s.paymentProcessor.GetCustomer(ctx, customerId)
 
-		// Handle iteration error
-		if err := subIter.Err(); err != nil {
-			fmt.Printf("\nFailed to fetch subscriptions from Stripe: %+v\n\n", err)
-			return fmt.Errorf("failed to fetch subscriptions from Stripe: %w", err)
-		}
+	// --- Data Organization ---
 
-		subscriptions = append(subscriptions, sub)
+	if err != nil {
+		fmt.Printf("\nFailed to get customer from stripe: %+v\n\n", err)
+		return nil, fmt.Errorf("failed to get customer from stripe: %w", stripeCallErr(err))
 	}
 
-	// -- payments --
+	// -- sync progress --
 
-	payments := []*stripe.PaymentIntent{}
+	syncState, err := s.repo.GetCustomerSyncState(ctx, customerId)
 
-	paymentParams := &stripe.PaymentIntentListParams{
-		Customer: stripe.String(customerId),
+	// never synced before
+	if errors.Is(err, sql.ErrNoRows) {
+		syncState, err = nil, nil
 	}
 
-	// include payment method details
-	paymentParams.AddExpand("data.payment_method")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get customer sync state: %w", err)
+	}
 
-	paymentIter := paymentintent.List(paymentParams)
+	// incremental passes are merged into the cached state, without one everything has to be listed
+	cacheKey := s.keys.CustomerData(customerId)
+	cached := s.readCachedStripeData(ctx, cacheKey)
 
-	for paymentIter.Next() {
-		pi := paymentIter.PaymentIntent()
-		fmt.Printf("\npayment intent: %+v\n\n", pi)
+	pass := nextSyncPass(syncState, forceFull || cached == nil, readAt)
 
-		payments = append(payments, pi)
-	}
+	// -- subscriptions --
 
-	// --- DB Storage ---
-	// we do this first and roll back before even updating cache in case of error
+	subscriptions, err := s.paymentProcessor.ListSubscriptions(ctx, customerId, pass.subscriptionListOptions())
 
-	tx, err := s.repo.BeginTx(ctx)
 	if err != nil {
-		fmt.Printf("\nError when attempting to start transaction: %+v\n\n", err)
-		return fmt.Errorf("error when attempting to start transaction: %+v", err)
+		return nil, fmt.Errorf("failed to list subscriptions from stripe: %w", stripeCallErr(err))
 	}
 
-	// NOTE: safe to run even if commit was successful - in that case it will be a no-op
-	defer tx.Rollback()
+	// -- payments --
+
+	payments, cursor, err := s.paymentProcessor.ListPaymentIntents(ctx, customerId, pass.paymentListOptions())
 
-	// update application database for the respective tables
+	if err != nil {
+		fmt.Printf("\nFailed to fetch payment intents from Stripe: %+v\n\n", err)
+		return nil, fmt.Errorf("failed to fetch payment intents from Stripe: %w", stripeCallErr(err))
+	}
 
 	// -- user
 
@@ -164,54 +261,36 @@ func (s *service) SyncStripeDataToStorage(ctx context.Context, customerId string
 
 	if err != nil {
 		fmt.Printf("\nUnexpected error when trying to get userId from cache: %s\n\n", err)
-		return err
+		return nil, err
 	}
 
-	// if not availble, use direct db query
-	if err == redislib.Nil {
-		user, err := s.userService.GetByStripeCustomerID(ctx, customerId)
-
-		if err != nil {
-			fmt.Printf("unexpected error when trying to query for userId: %s\n", err)
-			return err
-		}
-
-		// update userId with this version
-		userId = user.ID
+	plan := &stripeSyncPlan{
+		customerId: customerId,
+		version:    version,
+		userId:     userId,
+		syncState:  pass.nextState(customerId, syncState, payments, cursor, readAt),
+		cacheKey:   cacheKey,
 	}
 
-	// -- subscription --
+	// --- DB Rows ---
 
 	for _, sub := range subscriptions {
-		err := s.repo.UpsertSubscriptionRecord(ctx, &Subscription{
-			UserID:               userId,
-			Status:               string(sub.Status),
-			StripeSubscriptionID: sub.ID,
-			StripeCustomerID:     customerId,
-		})
+		record := convertSubscriptionRecord(sub, userId, plan.version)
+		record.StripeCustomerID = customerId
 
-		if err != nil {
-			fmt.Printf("\nError when attempting to batch upsert subscriptions during sync: %+v\n\n", err)
-			return fmt.Errorf("error when attempting to batch upsert subscriptions during sync: %+v", err)
-		}
+		plan.subscriptions = append(plan.subscriptions, record)
 	}
 
-	// -- payments --
-
 	for _, payment := range payments {
-		err := s.repo.UpsertPayment(ctx, payment.ID, &Payment{
+		plan.payments = append(plan.payments, &Payment{
 			UserID:           userId,
 			StripeCustomerID: customerId,
 			StripeIntentID:   payment.ID,
 			Amount:           payment.Amount,
-			Status:           string(payment.Status),
+			Status:           paymentIntentStatus(payment),
 			Currency:         string(payment.Currency),
+			LastEventAt:      &plan.version,
 		})
-
-		if err != nil {
-			fmt.Printf("\nError when attempting to upsert payment during sync: %+v\n\n", err)
-			return err
-		}
 	}
 
 	// --- Caching ---
@@ -221,28 +300,19 @@ func (s *service) SyncStripeDataToStorage(ctx context.Context, customerId string
 	// -- subscriptions --
 
 	for index, sub := range subscriptions {
-		// extract payment method info safely
-		var pmInfo *PaymentMethodInfo
-
-		if len(subscriptions) > 0 {
-			sub := subscriptions[0]
-
-			if sub.DefaultPaymentMethod != nil && sub.DefaultPaymentMethod.Card != nil {
-				pmInfo = &PaymentMethodInfo{
-					Brand: string(sub.DefaultPaymentMethod.Card.Brand),
-					Last4: sub.DefaultPaymentMethod.Card.Last4,
-				}
-			}
-
-		}
-
 		// add to cache slice
 		subCache[index] = &StripeSubscriptionCache{
 			SubscriptionID:    sub.ID,
 			Status:            string(sub.Status),
-			PriceID:           sub.Items.Data[0].Price.ID,
+			PriceID:           subscriptionPriceID(sub),
 			CancelAtPeriodEnd: sub.CancelAtPeriodEnd,
-			PaymentMethod:     pmInfo,
+			TrialEnd:          currentTrialEnd(string(sub.Status), convertOptionalTime(sub.TrialEnd)),
+			PaymentMethod:     convertPaymentMethodInfo(sub.DefaultPaymentMethod),
+		}
+
+		if sub.PauseCollection != nil {
+			subCache[index].PauseBehavior = string(sub.PauseCollection.Behavior)
+			subCache[index].PauseResumesAt = convertOptionalTime(sub.PauseCollection.ResumesAt)
 		}
 	}
 
@@ -253,7 +323,7 @@ func (s *service) SyncStripeDataToStorage(ctx context.Context, customerId string
 	for index, payment := range payments {
 		paymentCache[index] = &StripePaymentsCache{
 			ID:     payment.ID,
-			Status: string(payment.Status),
+			Status: paymentIntentStatus(payment),
 		}
 	}
 
@@ -287,29 +357,87 @@ func (s *service) SyncStripeDataToStorage(ctx context.Context, customerId string
 		TaxExempt:            string(customer.TaxExempt),
 	}
 
+	// incremental passes only listed part of the customer's objects, the rest stays as cached
+	plan.listedAllSubscriptions = pass.full
+
 	// combine the two pieces of information into one cache state
-	cacheState := StripeCacheData{
+	plan.cacheState = StripeCacheData{
+		Version:       version.UnixMicro(),
 		CustomerData:  stripeCusData,
 		Subscriptions: subCache,
 		Payments:      paymentCache,
 	}
 
-	cacheStateJSON, err := json.Marshal(cacheState)
+	return plan, nil
+}
+
+// the customer's cached subscriptions, nil when there is no cached data or it can't be read
+func (s *service) readCachedStripeData(ctx context.Context, key string) *StripeCacheData {
+	data, err := s.getCachedStripeData(ctx, key, subscriptionFields...)
 
 	if err != nil {
-		fmt.Printf("\nFailed to marshal cacheState: %+v\n\n", err)
-		return fmt.Errorf("failed to marshal cacheState: %w", err)
+		fmt.Printf("\nError when reading cached stripe data, syncing everything: %+v\n\n", err)
+		return nil
 	}
 
-	// update redis
-	err = s.cacheClient.Set(ctx, stripeUpdateCusWithCusIdKey, cacheStateJSON, 0)
+	return data
+}
+
+/**
+* Writes a sync plan to the database and then the cache.
+**/
+func (s *service) applyStripeSync(ctx context.Context, plan *stripeSyncPlan) error {
+	// --- DB Storage ---
+	// we do this first and roll back before even updating cache in case of error
+
+	// update application database for the respective tables, all rows or none
+	err := s.unitOfWork.WithinTx(ctx, func(ctx context.Context) error {
+		// -- subscription --
+
+		for _, sub := range plan.subscriptions {
+			err := s.repo.UpsertSubscriptionRecord(ctx, sub)
+
+			if err != nil {
+				fmt.Printf("\nError when attempting to batch upsert subscriptions during sync: %+v\n\n", err)
+				return fmt.Errorf("error when attempting to batch upsert subscriptions during sync: %w", err)
+			}
+		}
+
+		// -- access, once no subscription grants it anymore --
+
+		ended := slices.ContainsFunc(plan.subscriptions, func(sub *Subscription) bool {
+			return subscriptionEnded(sub.Status)
+		})
+
+		if ended {
+			if err := s.unsubscribeIfAllEnded(ctx, plan.userId, plan.customerId); err != nil {
+				return err
+			}
+		}
+
+		// -- payments --
+
+		for _, payment := range plan.payments {
+			err := s.repo.UpsertPayment(ctx, payment.StripeIntentID, payment)
+
+			if err != nil {
+				fmt.Printf("\nError when attempting to upsert payment during sync: %+v\n\n", err)
+				return err
+			}
+		}
+
+		// -- sync progress, only moves along with the rows --
+
+		return s.repo.SaveCustomerSyncState(ctx, plan.syncState)
+	})
 
 	if err != nil {
-		fmt.Printf("\nFailed to sync and store stripe data into cache: %+v\n\n", err)
-		return fmt.Errorf("failed to sync and store stripe data into cache: %w", err)
+		return err
 	}
 
-	return nil
+	// --- Caching ---
+
+	return s.cacheStripeSync(ctx, plan)
 }
 
 /**
@@ -317,13 +445,14 @@ func (s *service) SyncStripeDataToStorage(ctx context.Context, customerId string
 **/
 func (s *service) AddCacheUserIdToCusId(ctx context.Context, userId uuid.UUID, customerId string) error {
 	fmt.Printf("\nupdating customerId to userId in cache..\ncustomerId key provided was :%s\nuserId value provided was: %s\n\n", customerId, userId)
-	key := s.cacheClient.GetUserIdFromCustomerIdKey(customerId)
-	err := s.cacheClient.Set(ctx, key, userId.String(), 0)
+	key := s.keys.CustomerIdToUserId(customerId)
+	err := s.cacheClient.Set(ctx, key, userId.String(), cachekey.MappingTTL())
 
 	if err != nil {
 		return fmt.Errorf("failed to cache userId to customerId mapping: %w", err)
 	}
 
+	s.announceInvalidation(ctx, customerId, key)
 	return nil
 }
 
@@ -331,13 +460,14 @@ func (s *service) AddCacheUserIdToCusId(ctx context.Context, userId uuid.UUID, c
 * adds/sets the mapping between customerId and userId in cache
 **/
 func (s *service) AddCacheCusIdToUserId(ctx context.Context, customerId string, userId uuid.UUID) error {
-	key := s.cacheClient.GetCustomerIdFromUserIdKey(userId.String())
-	err := s.cacheClient.Set(ctx, key, customerId, 0)
+	key := s.keys.UserIdToCustomerId(userId.String())
+	err := s.cacheClient.Set(ctx, key, customerId, cachekey.MappingTTL())
 
 	if err != nil {
 		return fmt.Errorf("failed to cache userId to customerId mapping: %w", err)
 	}
 
+	s.announceInvalidation(ctx, customerId, key)
 	return nil
 }
 
@@ -345,13 +475,27 @@ func (s *service) AddCacheCusIdToUserId(ctx context.Context, customerId string,
 * gets cached customerId with the userId
 **/
 func (s *service) GetCachedCusIdFromUserId(ctx context.Context, userId uuid.UUID) (string, error) {
-	key := s.cacheClient.GetCustomerIdFromUserIdKey(userId.String())
+	key := s.keys.UserIdToCustomerId(userId.String())
 	customerId, err := s.cacheClient.Get(ctx, key)
 
-	// doesn't exist in cache, error, cache is supposed to have a mapping from this point
+	// expired or never cached, rebuilt from the user's row
 	fmt.Printf("key: %s\n", key)
-	if err == redislib.Nil {
-		return "", fmt.Errorf("No customerId exists for this userId %s", userId)
+	if errors.Is(err, interfaces.ErrCacheMiss) {
+		storedCustomerId, err := s.userService.GetStripeCustomer(ctx, userId)
+
+		if err != nil {
+			return "", fmt.Errorf("failed to get customerId of user %s: %w", userId, err)
+		}
+
+		if storedCustomerId == nil {
+			return "", fmt.Errorf("No customerId exists for this userId %s", userId)
+		}
+
+		if err := s.AddCacheCusIdToUserId(ctx, *storedCustomerId, userId); err != nil {
+			fmt.Printf("\nError when caching customerId of user %s: %+v\n\n", userId, err)
+		}
+
+		return *storedCustomerId, nil
 	}
 
 	if err != nil {
@@ -365,61 +509,86 @@ func (s *service) GetCachedCusIdFromUserId(ctx context.Context, userId uuid.UUID
 
 /**
 * The get version of the payment cache sync method. Gets the latest up-to-date data from the cache if it exists,
-* otherwise calls the sync method to update the cache.
+* otherwise rebuilds it with a sync (see read_through.go).
 **/
 func (s *service) GetStripeData(ctx context.Context, customerId string) (*StripeCacheData, error) {
-	customerDataFromCustomerIDKey := s.cacheClient.GetCustomerDataFromCustomerIdKey(customerId)
-
-	// check if customer data already exists in the cache
-	dataJSON, err := s.cacheClient.Get(ctx, customerDataFromCustomerIDKey)
-
-	// if it doesn't we sync the data right there
-	if err == redislib.Nil {
-
-		fmt.Printf("Customer data doesn't exist in cache.\n")
+	return s.getStripeData(ctx, customerId)
+}
 
-		// sync from database
+// GetStripeData limited to fields of the cached data (see customer_cache.go), rebuilds still return everything
+func (s *service) getStripeData(ctx context.Context, customerId string, fields ...string) (*StripeCacheData, error) {
+	cached, err := s.getCachedStripeData(ctx, s.keys.CustomerData(customerId), fields...)
 
-		// log other exceptions
+	if err != nil {
 		log.Printf("error when attempting to get cache data for customerID %s\nerr was:\n%+v\n", customerId, err)
+		return nil, err
+	}
 
-		return s.GetStripeData(ctx, customerId)
+	if cached != nil && cached.isFresh(time.Now()) {
+		return cached, nil
+	}
 
+	if cached != nil && staleWhileRevalidate() {
+		s.revalidateInBackground(ctx, customerId)
+		return cached, nil
 	}
 
-	// data already exists, just unmarshal and return it
-	fmt.Printf("\ncache data before unmarshal: %+v\n\n", dataJSON)
+	// missing (expired, or cached under an older schema version) or stale, rebuild it right there
+	data, err := s.sharedRebuild(ctx, customerId)
 
-	var cacheData StripeCacheData
+	if err != nil && cached != nil {
+		fmt.Printf("\nError when refreshing stripe data of customer %s, serving the stale copy: %+v\n\n", customerId, err)
+		return cached, nil
+	}
 
-	err = json.Unmarshal([]byte(dataJSON), &cacheData)
 	if err != nil {
-		fmt.Printf("error when attempting to get unmarshal data for customerID %s\nerr was:\n%+v\n", customerId, err)
 		return nil, err
 	}
 
-	fmt.Printf("\ncache data after unmarshal: %+v\n\n", cacheData)
-	return &cacheData, nil
+	return data, nil
 }
 
 func (s *service) SetupProducts(ctx context.Context, request *SetupProductsReq) (*SetupProductsResp, error) {
 	return s.paymentProcessor.SetupProducts(ctx, request)
 }
 
+/**
+* Creates the stripe customer of a user and stores the mapping, joining the caller's transaction (e.g. signing up)
+* if there is one.
+**/
 func (s *service) CreateCustomer(ctx context.Context, userId uuid.UUID, email string) (string, error) {
-	// create customer on stripe and get customer id
-	customerId, err := s.paymentProcessor.CreateCustomer(ctx, userId, email)
+	var customerId string
 
-	if err != nil {
-		fmt.Printf("Error occured when attemtping to create customer on stripe, %s\n", err.Error())
-		return "", err
-	}
+	err := s.unitOfWork.WithinTx(ctx, func(ctx context.Context) error {
+		var err error
+
+		// create customer on stripe and get customer id
+		customerId, err = s.paymentProcessor.CreateCustomer(ctx, userId, email)
+
+		if err != nil {
+			fmt.Printf("Error occured when attemtping to create customer on stripe, %s\n", err.Error())
+			return err
+		}
+
+		// the customer can't be part of the transaction, delete it again when the user isn't stored after all
+		database.AfterRollback(ctx, func(ctx context.Context) {
+			if err := s.paymentProcessor.DeleteCustomer(ctx, customerId); err != nil {
+				fmt.Printf("\nError when deleting stripe customer %s of rolled back user %s: %+v\n\n", customerId, userId, err)
+			}
+		})
 
-	// update local user repo for mapping
-	err = s.userService.UpdateStripeCustomer(ctx, userId, customerId)
+		// update local user repo for mapping
+		err = s.userService.UpdateStripeCustomer(ctx, userId, customerId)
+
+		if err != nil {
+			fmt.Printf("Error occured when attempting to update stripe customerId to user repo in CreateCustomer method: %s\n", err.Error())
+			return err
+		}
+
+		return nil
+	})
 
 	if err != nil {
-		fmt.Printf("Error occured when attempting to update stripe customerId to user repo in CreateCustomer method: %s\n", err.Error())
 		return "", err
 	}
 
@@ -435,7 +604,39 @@ func (s *service) CreatePaymentIntent(ctx context.Context, amount int64, custome
 }
 
 func (s *service) GetProducts(ctx context.Context) (*ProductListResponse, error) {
-	return s.paymentProcessor.GetProducts(ctx)
+	key := s.keys.Products()
+
+	cachedProducts, err := s.cacheClient.Get(ctx, key)
+
+	if err == nil {
+		var products ProductListResponse
+
+		if err := codec.Decode([]byte(cachedProducts), &products); err == nil {
+			return &products, nil
+		}
+	}
+
+	if err != nil && !errors.Is(err, interfaces.ErrCacheMiss) {
+		fmt.Printf("\nError when reading cached products, reading from stripe: %+v\n\n", err)
+	}
+
+	products, err := s.paymentProcessor.GetProducts(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	productsData, err := codec.Encode(s.codec, 0, products)
+
+	if err == nil {
+		err = s.cacheClient.Set(ctx, key, productsData, cachekey.ProductsTTL())
+	}
+
+	if err != nil {
+		fmt.Printf("\nError when caching products: %+v\n\n", err)
+	}
+
+	return products, nil
 }
 
 func (s *service) PurchaseProduct(ctx context.Context, userId uuid.UUID, req *PurchaseProductRequest) (*PurchaseProductResponse, error) {
@@ -483,6 +684,12 @@ func (s *service) SetupSubscription(ctx context.Context, request *SetupProductsR
 * When subscription created → Store in DB as status: "incomplete" →  Wait for webhooks to update status to "active"
 **/
 func (s *service) SubscribeToProduct(ctx context.Context, userId uuid.UUID, req *SubscribeRequest) (*SubscribeResponse, error) {
+	if err := validateTrialDays(req.TrialDays); err != nil {
+		return nil, err
+	}
+
+	requestedAt := stripeRequestVersion(time.Now())
+
 	res, err := s.paymentProcessor.SubscribeToProduct(ctx, req)
 
 	if err != nil {
@@ -495,6 +702,8 @@ func (s *service) SubscribeToProduct(ctx context.Context, userId uuid.UUID, req
 		StripeCustomerID:     req.CustomerID,
 		StripeSubscriptionID: res.SubscriptionID,
 		Status:               res.Status,
+		TrialEnd:             res.TrialEnd,
+		LastEventAt:          &requestedAt,
 	})
 
 	if err != nil {
@@ -517,37 +726,44 @@ func (s *service) SubscribeToSite(ctx context.Context, userId uuid.UUID) (*Subsc
 
 	var ProSubscriptionProductID string = util.GetEnv("SUBSCRIPTION_PROD_ID", "")
 
-	// subscribe users to the pre-setup subscription pro product
-	_, err = s.SubscribeToProduct(ctx, userId, &SubscribeRequest{
-		CustomerID: customerID,
-		ProductID:  ProSubscriptionProductID, // subscription pro productID
-	})
+	// the subscription record and the user's subscribe status are stored together or not at all. the stripe
+	// subscription itself stays incomplete on failure and is mirrored by its webhooks like any other.
+	err = s.unitOfWork.WithinTx(ctx, func(ctx context.Context) error {
+		// subscribe users to the pre-setup subscription pro product
+		_, err := s.SubscribeToProduct(ctx, userId, &SubscribeRequest{
+			CustomerID: customerID,
+			ProductID:  ProSubscriptionProductID, // subscription pro productID
+		})
 
-	if err != nil {
-		fmt.Printf("\nError occured when attempting to subsribe to the site for pro plan: %s\n\n", err)
-		return nil, err
-	}
+		if err != nil {
+			fmt.Printf("\nError occured when attempting to subsribe to the site for pro plan: %s\n\n", err)
+			return err
+		}
+
+		// confirmed subscription, update user's subscribe status
+		err = s.userService.UpdateSubscribed(ctx, userId, true)
+
+		if err != nil {
+			fmt.Printf("Subscription update in DB failed, err: %s\n", err)
+			return err
+		}
 
-	// confirmed subscription, update user's subscribe status
-	err = s.userService.Update(ctx, userId, &user.User{
-		Subscribed: true,
+		return nil
 	})
 
-	// rollback subscription if DB fails
 	if err != nil {
-		fmt.Printf("Subscription update in DB failed, err: %s\n", err)
-		// TODO: add the rollback
+		return nil, err
 	}
 
 	return &SubscribeToSiteResponse{}, nil
 }
 
 func (s *service) GetCachedUserIdByCustomerId(ctx context.Context, customerID string) (uuid.UUID, error) {
-	key := s.cacheClient.GetUserIdFromCustomerIdKey(customerID)
+	key := s.keys.CustomerIdToUserId(customerID)
 	userIdStr, err := s.cacheClient.Get(ctx, key)
 
 	// key doesn't exist, acquire userId to fill in cache
-	if err == redislib.Nil {
+	if errors.Is(err, interfaces.ErrCacheMiss) {
 		user, err := s.userService.GetByStripeCustomerID(ctx, customerID)
 
 		if err != nil {
@@ -556,7 +772,7 @@ func (s *service) GetCachedUserIdByCustomerId(ctx context.Context, customerID st
 		}
 
 		// store in cache
-		s.cacheClient.Set(ctx, key, user.ID.String(), 0)
+		s.cacheClient.Set(ctx, key, user.ID.String(), cachekey.MappingTTL())
 
 		// return the id
 		return user.ID, nil
@@ -581,28 +797,220 @@ func (s *service) GetCachedUserIdByCustomerId(ctx context.Context, customerID st
 // --- Full Flow Methods ---
 
 /**
-* Recieves a payment processor event and parses the event
+* Recieves a payment processor event and applies it through the handler registered for its type (see
+* webhook_handlers.go). Falls back to a full sync of the event's customer when the targeted update fails, the
+* incremental pass a sync would otherwise run may not list the object the event is about.
+*
+* Events of connected accounts (delivered to the connect endpoint) are about the accounts' own customers, which
+* aren't mirrored here, so they are stored and acknowledged without being applied.
 **/
 func (s *service) ProcessWebhookEvent(ctx context.Context, event *stripe.Event) error {
+	if event.Account != "" {
+		fmt.Printf("Ignoring webhook event %s (%s) of connected account %s\n", event.ID, event.Type, event.Account)
+		return nil
+	}
+
+	handler, ok := s.webhookHandlers[event.Type]
+
+	// acknowledged but not acted upon, stripe would otherwise keep retrying it
+	if !ok {
+		fmt.Printf("Ignoring unsupported webhook event type: %s\n", event.Type)
+		return nil
+	}
+
+	handlerErr := handler(ctx, event)
+
+	if handlerErr == nil {
+		return nil
+	}
+
+	fmt.Printf("\nTargeted update for webhook event %s (%s) failed, falling back to full sync: %+v\n\n", event.ID, event.Type, handlerErr)
+
 	customerId, err := s.paymentProcessor.ProcessWebhookEvent(ctx, event)
 
 	if err != nil {
-		fmt.Printf("\npaymentProcessor method ProcessWebhookEvent could not process incoming event of %+v, err :%+v\n\n", event, err)
-		return err
+		fmt.Printf("\npaymentProcessor method ProcessWebhookEvent could not resolve a customer for event %s, err :%+v\n\n", event.ID, err)
+		return handlerErr
 	}
 
 	fmt.Printf("Service layer - customerId: %s\n", customerId)
 
-	s.SyncStripeDataToStorage(ctx, customerId)
+	return s.syncStripeDataToStorage(ctx, customerId, true)
+}
+
+/**
+* Entry point for verified webhook deliveries. The event is stored before any processing so that:
+*
+* - stripe's retries of an already processed event are short-circuited (ErrWebhookEventAlreadyProcessed)
+* - failures are recorded on the row for investigation, while stripe is still told to retry
+*
+* With the webhook queue enabled the stored event is only enqueued here and processed by the queue workers,
+* so stripe gets its acknowledgement without waiting on the sync.
+**/
+func (s *service) HandleWebhookEvent(ctx context.Context, event *stripe.Event, payload []byte) error {
+	stored, inserted, err := s.repo.SaveWebhookEvent(ctx, &WebhookEvent{
+		StripeEventID: event.ID,
+		EventType:     string(event.Type),
+		CustomerID:    webhookEventCustomerID(event),
+		Payload:       payload,
+	})
+
+	if err != nil {
+		fmt.Printf("\nError when storing webhook event %s: %+v\n\n", event.ID, err)
+		return err
+	}
 
-	return nil
+	if !inserted && stored.Processed {
+		fmt.Printf("\nWebhook event %s was already processed, skipping\n\n", event.ID)
+		return ErrWebhookEventAlreadyProcessed
+	}
+
+	if s.webhookQueue != nil {
+		return s.webhookQueue.Enqueue(ctx, event.ID)
+	}
+
+	return s.processAndRecordWebhookEvent(ctx, event)
+}
+
+/**
+* Processes an event previously stored by HandleWebhookEvent, used by the webhook queue workers.
+**/
+func (s *service) ProcessStoredWebhookEvent(ctx context.Context, stripeEventID string) error {
+	stored, err := s.repo.GetWebhookEventByStripeID(ctx, stripeEventID)
+	if err != nil {
+		return fmt.Errorf("failed to load stored webhook event %s: %w", stripeEventID, err)
+	}
+
+	// already handled by an earlier delivery or attempt
+	if stored.Processed {
+		return nil
+	}
+
+	var event stripe.Event
+	if err := json.Unmarshal(stored.Payload, &event); err != nil {
+		return fmt.Errorf("failed to decode stored webhook event %s: %w", stripeEventID, err)
+	}
+
+	return s.processAndRecordWebhookEvent(ctx, &event)
+}
+
+func (s *service) processAndRecordWebhookEvent(ctx context.Context, event *stripe.Event) error {
+	if err := s.ProcessWebhookEvent(ctx, event); err != nil {
+		if markErr := s.repo.MarkWebhookEventFailed(ctx, event.ID, err.Error()); markErr != nil {
+			fmt.Printf("\nError when recording failure of webhook event %s: %+v\n\n", event.ID, markErr)
+		}
+
+		return err
+	}
+
+	return s.repo.MarkWebhookEventProcessed(ctx, event.ID)
+}
+
+const (
+	defaultWebhookReplayLimit = 100
+	maxWebhookReplayLimit     = 1000
+)
+
+/**
+* Re-runs stored webhook events through ProcessWebhookEvent, e.g. after a fix to the sync logic. Events are
+* replayed regardless of their processed state unless filtered by it, and their processing state is updated.
+*
+* In dry run mode nothing is written, instead each event reports the rows and cache keys processing it would
+* change right now.
+**/
+func (s *service) ReplayWebhookEvents(ctx context.Context, request *WebhookReplayRequest) (*WebhookReplayResponse, error) {
+	switch request.State {
+	case "", "processed", "failed", "pending":
+	default:
+		return nil, fmt.Errorf("%w: unknown state %q, expected processed, failed or pending", ErrInvalidReplayFilter, request.State)
+	}
+
+	if request.Limit <= 0 {
+		request.Limit = defaultWebhookReplayLimit
+	}
+
+	if request.Limit > maxWebhookReplayLimit {
+		request.Limit = maxWebhookReplayLimit
+	}
+
+	storedEvents, err := s.repo.ListWebhookEvents(ctx, request)
+
+	if err != nil {
+		fmt.Printf("\nError when listing webhook events for replay: %+v\n\n", err)
+		return nil, err
+	}
+
+	res := &WebhookReplayResponse{
+		DryRun:  request.DryRun,
+		Matched: len(storedEvents),
+		Events:  make([]*WebhookReplayEvent, 0, len(storedEvents)),
+	}
+
+	for _, stored := range storedEvents {
+		result := &WebhookReplayEvent{
+			StripeEventID: stored.StripeEventID,
+			EventType:     stored.EventType,
+		}
+		res.Events = append(res.Events, result)
+
+		var event stripe.Event
+		if err := json.Unmarshal(stored.Payload, &event); err != nil {
+			result.Error = fmt.Sprintf("failed to decode stored payload: %s", err)
+			res.Failed++
+			continue
+		}
+
+		if stored.CustomerID != nil {
+			result.CustomerID = *stored.CustomerID
+		}
+
+		if !request.DryRun {
+			if err := s.processAndRecordWebhookEvent(ctx, &event); err != nil {
+				result.Error = err.Error()
+				res.Failed++
+				continue
+			}
+
+			res.Replayed++
+			continue
+		}
+
+		// dry run, process the event against recorders of storage writes
+		shadow, changes := s.dryRun()
+
+		if err := shadow.ProcessWebhookEvent(ctx, &event); err != nil {
+			result.Error = err.Error()
+			res.Failed++
+			continue
+		}
+
+		result.Changes = changes
+	}
+
+	return res, nil
+}
+
+func (s *service) ListWebhookDeadLetters(ctx context.Context, count int64) ([]WebhookDeadLetter, error) {
+	if s.webhookQueue == nil {
+		return nil, ErrWebhookQueueDisabled
+	}
+
+	return s.webhookQueue.ListDeadLetters(ctx, count)
+}
+
+func (s *service) RedriveWebhookDeadLetter(ctx context.Context, deadLetterID string) error {
+	if s.webhookQueue == nil {
+		return ErrWebhookQueueDisabled
+	}
+
+	return s.webhookQueue.Redrive(ctx, deadLetterID)
 }
 
 /**
 * for utilizing cache for checking the user's subscription status to the pro
 * plan of this site
 **/
-func (s *service) GetSubscriptionStatusCache(ctx context.Context, userId uuid.UUID) (*bool, error) {
+func (s *service) GetSubscriptionStatusCache(ctx context.Context, userId uuid.UUID) (*SubscriptionStatusResponse, error) {
 	// get customerId from cache
 	cusId, err := s.GetCachedCusIdFromUserId(ctx, userId)
 
@@ -611,36 +1019,274 @@ func (s *service) GetSubscriptionStatusCache(ctx context.Context, userId uuid.UU
 	}
 	fmt.Printf("\ncusId from cache: \n%+v\n\n", cusId)
 
-	// get subscription status
-	stripeCacheData, err := s.GetStripeData(ctx, cusId)
+	// get subscription status, the customer's profile and payments aren't needed for it
+	stripeCacheData, err := s.getStripeData(ctx, cusId, subscriptionFields...)
+
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Printf("\nstripeCachData when getting subscription status cache: \n%+v\n\n", stripeCacheData)
 
-	return nil, nil
+	if len(stripeCacheData.Subscriptions) == 0 {
+		return &SubscriptionStatusResponse{Status: "none"}, nil
+	}
+
+	// prefer a subscription that grants access over paused and older, ended ones
+	sub := stripeCacheData.Subscriptions[0]
+	for _, cachedSub := range stripeCacheData.Subscriptions {
+		if !subscriptionGrantsAccess(cachedSub.Status) {
+			continue
+		}
+
+		sub = cachedSub
+
+		if cachedSub.PauseBehavior == "" {
+			break
+		}
+	}
+
+	return subscriptionStatus(sub), nil
+}
+
+// the status of the user's current subscription
+func subscriptionStatus(sub *StripeSubscriptionCache) *SubscriptionStatusResponse {
+	if sub.PauseBehavior != "" {
+		return pausedSubscriptionStatus(sub.CancelAtPeriodEnd, sub.PauseResumesAt)
+	}
+
+	return &SubscriptionStatusResponse{
+		HasAccess:         subscriptionGrantsAccess(sub.Status),
+		Status:            sub.Status,
+		CancelAtPeriodEnd: sub.CancelAtPeriodEnd,
+		TrialEnd:          currentTrialEnd(sub.Status, sub.TrialEnd),
+	}
 }
 
 /**
 * retrieves the user's subscription status from cache or database depending on availability.
 **/
-func (s *service) GetSubscriptionStatus(ctx context.Context, userId uuid.UUID) (*bool, error) {
+func (s *service) GetSubscriptionStatus(ctx context.Context, userId uuid.UUID) (*SubscriptionStatusResponse, error) {
 	subStatusCache, err := s.GetSubscriptionStatusCache(ctx, userId)
 
-	if !*subStatusCache {
-		subStatus, err := s.userService.GetSubscriptionStatus(ctx, userId)
+	if err != nil || subStatusCache == nil {
+		fmt.Printf("\nfalling back to database for subscription status, cache err: %v\n\n", err)
+
+		subscribed, err := s.userService.GetSubscriptionStatus(ctx, userId)
 
 		if err != nil {
 			return nil, err
 		}
 
-		fmt.Printf("\nsubStatus when getting subscription status: \n%+v\n\n", subStatus)
-		return &subStatus, nil
+		fmt.Printf("\nsubStatus when getting subscription status: \n%+v\n\n", subscribed)
+
+		// users.subscribed doesn't know about pauses and trials, the mirrored subscription does
+		if subscribed {
+			current, err := s.repo.GetActiveSubscription(ctx, userId)
+
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return nil, fmt.Errorf("failed to get active subscription: %w", err)
+			}
+
+			if current != nil {
+				return subscriptionStatus(&StripeSubscriptionCache{
+					SubscriptionID:    current.StripeSubscriptionID,
+					Status:            current.Status,
+					PriceID:           current.StripePriceID,
+					CancelAtPeriodEnd: current.CancelAtPeriodEnd,
+					PauseBehavior:     current.PauseBehavior,
+					PauseResumesAt:    current.PauseResumesAt,
+					TrialEnd:          current.TrialEnd,
+				}), nil
+			}
+		}
+
+		status := "none"
+		if subscribed {
+			status = string(stripe.SubscriptionStatusActive)
+		}
+
+		return &SubscriptionStatusResponse{
+			HasAccess: subscribed,
+			Status:    status,
+		}, nil
+	}
+
+	return subStatusCache, nil
+}
+
+/**
+* The user's current subscription from the database mirror, kept up to date by syncs and webhooks.
+**/
+func (s *service) GetActiveSubscription(ctx context.Context, userId uuid.UUID) (*Subscription, error) {
+	subscription, err := s.repo.GetActiveSubscription(ctx, userId)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoActiveSubscription
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active subscription: %w", err)
+	}
+
+	return subscription, nil
+}
+
+// customer an event refers to, read from the event's object without requiring the event to be supported
+func webhookEventCustomerID(event *stripe.Event) *string {
+	var object struct {
+		Customer string `json:"customer"`
 	}
 
-	return subStatusCache, err
+	if event.Data == nil || json.Unmarshal(event.Data.Raw, &object) != nil || object.Customer == "" {
+		return nil
+	}
+
+	return &object.Customer
 }
 
 // Helper functions to convert Stripe types to our cache types
 
+/**
+* Mirror of a stripe subscription and its items, reflecting stripe's state as of seenAt.
+**/
+func convertSubscriptionRecord(sub *stripe.Subscription, userId uuid.UUID, seenAt time.Time) *Subscription {
+	record := &Subscription{
+		UserID:               userId,
+		StripeSubscriptionID: sub.ID,
+		Status:               string(sub.Status),
+		CancelAtPeriodEnd:    sub.CancelAtPeriodEnd,
+		CanceledAt:           convertOptionalTime(sub.CanceledAt),
+		EndedAt:              convertOptionalTime(sub.EndedAt),
+		TrialStart:           convertOptionalTime(sub.TrialStart),
+		TrialEnd:             convertOptionalTime(sub.TrialEnd),
+		DiscountIDs:          []string{},
+		LastEventAt:          &seenAt,
+		Items:                []*SubscriptionItem{},
+	}
+
+	if sub.Customer != nil {
+		record.StripeCustomerID = sub.Customer.ID
+	}
+
+	if sub.LatestInvoice != nil {
+		record.LatestInvoiceID = sub.LatestInvoice.ID
+	}
+
+	if sub.CancellationDetails != nil {
+		record.CancellationReason = string(sub.CancellationDetails.Reason)
+		record.CancellationFeedback = string(sub.CancellationDetails.Feedback)
+		record.CancellationComment = sub.CancellationDetails.Comment
+	}
+
+	if sub.PauseCollection != nil {
+		record.PauseBehavior = string(sub.PauseCollection.Behavior)
+		record.PauseResumesAt = convertOptionalTime(sub.PauseCollection.ResumesAt)
+	}
+
+	for _, discount := range sub.Discounts {
+		if discount != nil {
+			record.DiscountIDs = append(record.DiscountIDs, discount.ID)
+		}
+	}
+
+	if sub.Items == nil {
+		return record
+	}
+
+	for _, item := range sub.Items.Data {
+		mirrored := &SubscriptionItem{
+			StripeSubscriptionItemID: item.ID,
+			StripeSubscriptionID:     sub.ID,
+			Quantity:                 item.Quantity,
+			CurrentPeriodStart:       time.Unix(item.CurrentPeriodStart, 0),
+			CurrentPeriodEnd:         time.Unix(item.CurrentPeriodEnd, 0),
+		}
+
+		if item.Price != nil {
+			mirrored.StripePriceID = item.Price.ID
+			mirrored.UnitAmount = item.Price.UnitAmount
+			mirrored.Currency = string(item.Price.Currency)
+
+			if item.Price.Product != nil {
+				mirrored.StripeProductID = item.Price.Product.ID
+			}
+
+			if item.Price.Recurring != nil {
+				mirrored.RecurringInterval = string(item.Price.Recurring.Interval)
+			}
+		}
+
+		record.Items = append(record.Items, mirrored)
+	}
+
+	// billing periods live on the items since the 2025-03-31.basil api version, the first item is the main plan
+	if len(record.Items) > 0 {
+		record.StripePriceID = record.Items[0].StripePriceID
+		record.CurrentPeriodStart = record.Items[0].CurrentPeriodStart
+		record.CurrentPeriodEnd = record.Items[0].CurrentPeriodEnd
+	}
+
+	return record
+}
+
+// price of the subscription's main plan, the first item, empty for subscriptions without items
+func subscriptionPriceID(sub *stripe.Subscription) string {
+	if sub.Items == nil || len(sub.Items.Data) == 0 || sub.Items.Data[0].Price == nil {
+		return ""
+	}
+
+	return sub.Items.Data[0].Price.ID
+}
+
+// card details of an expanded payment method, nil when it wasn't expanded or isn't a card
+func convertPaymentMethodInfo(pm *stripe.PaymentMethod) *PaymentMethodInfo {
+	if pm == nil || pm.Card == nil {
+		return nil
+	}
+
+	return &PaymentMethodInfo{
+		Brand: string(pm.Card.Brand),
+		Last4: pm.Card.Last4,
+	}
+}
+
+/**
+* The status mirrored for a payment intent. Stripe leaves refunded intents succeeded and records refunds on the
+* charge, so an expanded latest charge with refunds turns the status into refunded or partially_refunded.
+**/
+func paymentIntentStatus(intent *stripe.PaymentIntent) string {
+	if status := chargeRefundStatus(intent.LatestCharge); status != "" {
+		return status
+	}
+
+	return string(intent.Status)
+}
+
+// refunded or partially_refunded for a charge with refunds, empty when nothing of it was refunded
+func chargeRefundStatus(charge *stripe.Charge) string {
+	switch {
+	case charge == nil:
+		return ""
+	case charge.Refunded:
+		return "refunded"
+	case charge.AmountRefunded > 0:
+		return "partially_refunded"
+	default:
+		return ""
+	}
+}
+
+// stripe uses 0 for timestamps that are not set
+func convertOptionalTime(unix int64) *time.Time {
+	if unix == 0 {
+		return nil
+	}
+
+	converted := time.Unix(unix, 0)
+	return &converted
+}
+
 func convertAddress(addr *stripe.Address) *CustomerAddress {
 	if addr == nil {
 		return nil
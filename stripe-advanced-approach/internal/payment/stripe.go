@@ -3,75 +3,66 @@ package payment
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"strconv"
 
 	"github.com/google/uuid"
 	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/customer"
-	"github.com/stripe/stripe-go/v82/paymentintent"
-	"github.com/stripe/stripe-go/v82/price"
-	"github.com/stripe/stripe-go/v82/product"
-	"github.com/stripe/stripe-go/v82/setupintent"
-	"github.com/stripe/stripe-go/v82/subscription"
 )
 
-type StripeProcessor struct{}
-
-func NewStripeProcessor() PaymentProcessor {
-	return &StripeProcessor{}
+type StripeProcessor struct {
+	client *stripe.Client
 }
 
 /**
-* Sets up custom products for purchase. This can be anything you wish to sell, and is a digital representation of the
-* item - which can be physical, digital, or even just a concept (donation, etc).
+* The processor only talks to stripe through the injected client, never through the package level
+* stripe.Key, so multiple accounts or a local stripe-mock can be used side by side.
 **/
-func (s *StripeProcessor) SetupProducts(ctx context.Context, request *SetupProductsReq) (*SetupProductsResp, error) {
-	// create product
-	prod, err := product.New(&stripe.ProductParams{
-		Name:        stripe.String(request.Name),
-		Description: stripe.String(request.Description),
-	})
-
-	if err != nil {
-		fmt.Printf("\nError when creating product on stripe: %+v\n\n", err)
-		return nil, err
+func NewStripeProcessor(client *stripe.Client) PaymentProcessor {
+	return &StripeProcessor{
+		client: client,
 	}
+}
 
-	// create STANDARD product / service
-	oneTimePrice, err := price.New(&stripe.PriceParams{
-		Currency: stripe.String("usd"),
-		Product:  stripe.String(prod.ID),
-		// NO Recurring parameter = one-time price!
-		UnitAmount: stripe.Int64(request.Price),
-	})
-
-	if err != nil {
-		fmt.Printf("\nError when creating subscription price for product on stripe: %+v\n\n", err)
-		return nil, err
+/**
+* Builds a stripe client for the given secret key. When baseURL is provided every backend (api, connect,
+* uploads) is pointed at it, e.g. http://localhost:12111 for stripe-mock.
+**/
+func NewStripeClient(secretKey string, baseURL string) *stripe.Client {
+	if baseURL == "" {
+		return stripe.NewClient(secretKey)
 	}
 
-	fmt.Printf("Created new product's price successfully. Response:%+v\n", oneTimePrice)
-
-	// set default price. NOT set by default.
-	product.Update(prod.ID, &stripe.ProductParams{
-		DefaultPrice: stripe.String(oneTimePrice.ID),
+	backends := stripe.NewBackendsWithConfig(&stripe.BackendConfig{
+		URL: stripe.String(baseURL),
 	})
 
-	return &SetupProductsResp{
-		PriceID: oneTimePrice.ID,
-	}, nil
+	return stripe.NewClient(secretKey, stripe.WithBackends(backends))
+}
+
+/**
+* Sets up custom products for purchase. This can be anything you wish to sell, and is a digital representation of the
+* item - which can be physical, digital, or even just a concept (donation, etc).
+**/
+func (s *StripeProcessor) SetupProducts(ctx context.Context, request *SetupProductsReq) (*SetupProductsResp, error) {
+	return s.setupProduct(ctx, request, false)
 }
 
 func (s *StripeProcessor) CreateCustomer(ctx context.Context, userId uuid.UUID, email string) (string, error) {
-	params := &stripe.CustomerParams{
+	params := &stripe.CustomerCreateParams{
 		Email: stripe.String(email),
 		Metadata: map[string]string{
 			"user_id": userId.String(),
 		},
 	}
 
+	// retries for the same user get the customer created first instead of another one
+	params.SetIdempotencyKey("create-customer-" + userId.String())
+
 	// create customer on Stripe
-	cust, err := customer.New(params)
+	cust, err := s.client.V1Customers.Create(ctx, params)
 	if err != nil {
 		return "", err
 	}
@@ -81,12 +72,17 @@ func (s *StripeProcessor) CreateCustomer(ctx context.Context, userId uuid.UUID,
 	return cust.ID, nil
 }
 
+func (s *StripeProcessor) DeleteCustomer(ctx context.Context, customerId string) error {
+	_, err := s.client.V1Customers.Delete(ctx, customerId, nil)
+	return err
+}
+
 /**
 * This method AUTHORIZES a card save for a customer by creating a permission token for the client
 * to then use the stripe sdk via elements to save the card.
 **/
 func (s *StripeProcessor) SaveCard(ctx context.Context, customerId string) (string, error) {
-	params := &stripe.SetupIntentParams{
+	params := &stripe.SetupIntentCreateParams{
 		Customer: stripe.String(customerId),
 		PaymentMethodTypes: stripe.StringSlice([]string{
 			"card",
@@ -96,7 +92,7 @@ func (s *StripeProcessor) SaveCard(ctx context.Context, customerId string) (stri
 	// - creates and sets up authorization for FUTURE card purchases.
 	// - generates client_secret, a permission token. NO card data is saved.
 	// - links to customer in stripe's system via customerId
-	si, err := setupintent.New(params)
+	si, err := s.client.V1SetupIntents.Create(ctx, params)
 	if err != nil {
 		fmt.Printf("Error when attempting to generate setup intent: %s\n", err.Error())
 		return "", err
@@ -113,7 +109,7 @@ func (s *StripeProcessor) SaveCard(ctx context.Context, customerId string) (stri
 **/
 func (s *StripeProcessor) CreatePaymentIntent(ctx context.Context, amount int64, customerId string) (*CreatePaymentIntentResponse, error) {
 
-	params := &stripe.PaymentIntentParams{
+	params := &stripe.PaymentIntentCreateParams{
 		Amount:   stripe.Int64(amount),
 		Currency: stripe.String("usd"),
 		Customer: stripe.String(customerId),
@@ -126,7 +122,7 @@ func (s *StripeProcessor) CreatePaymentIntent(ctx context.Context, amount int64,
 		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
 	}
 
-	intent, err := paymentintent.New(params)
+	intent, err := s.client.V1PaymentIntents.Create(ctx, params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create payment intent: %w", err)
 	}
@@ -143,44 +139,88 @@ func (s *StripeProcessor) CreatePaymentIntent(ctx context.Context, amount int64,
 * Creates a subscription item or service for recurring type payments.
 **/
 func (s *StripeProcessor) SetupSubscription(ctx context.Context, request *SetupProductsReq) (*SetupProductsResp, error) {
-	// create subscription
-	subscriptionProd, err := product.New(&stripe.ProductParams{
+	return s.setupProduct(ctx, request, true)
+}
+
+/**
+* Creates the product with all of its prices, the default one (see SetupProductsReq.SetupPrices) is set as the
+* product's default price.
+**/
+func (s *StripeProcessor) setupProduct(ctx context.Context, request *SetupProductsReq, recurring bool) (*SetupProductsResp, error) {
+	prices, err := request.SetupPrices(recurring)
+	if err != nil {
+		return nil, err
+	}
+
+	productParams := &stripe.ProductCreateParams{
 		Name:        stripe.String(request.Name),
 		Description: stripe.String(request.Description),
-	})
+	}
+
+	// the default free trial lives on the product, subscribing reads it back
+	if recurring && request.TrialDays > 0 {
+		productParams.AddMetadata(trialDaysMetadataKey, strconv.FormatInt(request.TrialDays, 10))
+	}
+
+	// create product
+	prod, err := s.client.V1Products.Create(ctx, productParams)
 
 	if err != nil {
 		fmt.Printf("\nError when creating product on stripe: %+v\n\n", err)
 		return nil, err
 	}
 
-	// create SUBSCRIPTION product / service
-	subscriptionPrice, err := price.New(&stripe.PriceParams{
-		Currency: stripe.String("usd"),
-		Product:  stripe.String(subscriptionProd.ID),
-		Recurring: &stripe.PriceRecurringParams{
-			Interval: stripe.String("month"),
-		},
-		UnitAmount: stripe.Int64(request.Price),
-	})
+	created := make([]*stripe.Price, 0, len(prices))
 
-	if err != nil {
-		fmt.Printf("\nError when creating subscription price for product on stripe: %+v\n\n", err)
-		return nil, err
+	for _, price := range prices {
+		priceParams := &stripe.PriceCreateParams{
+			Currency:   stripe.String(price.Currency),
+			Product:    stripe.String(prod.ID),
+			UnitAmount: stripe.Int64(price.Amount),
+			LookupKey:  stripe.String(price.LookupKeyFor(prod.ID)),
+		}
 
-	}
+		// NO Recurring parameter = one-time price!
+		if price.Recurring() {
+			priceParams.Recurring = &stripe.PriceCreateRecurringParams{
+				Interval:      stripe.String(price.Interval),
+				IntervalCount: stripe.Int64(price.IntervalCount),
+			}
+		}
+
+		createdPrice, err := s.client.V1Prices.Create(ctx, priceParams)
 
-	fmt.Printf("Created new subscription's price successfully. Response:%+v\n", subscriptionPrice)
+		if err != nil {
+			fmt.Printf("\nError when creating price %s for product on stripe: %+v\n\n", *priceParams.LookupKey, err)
+			return nil, err
+		}
+
+		fmt.Printf("Created new product's price successfully. Response:%+v\n", createdPrice)
+
+		created = append(created, createdPrice)
+	}
 
 	// set default price. NOT set by default.
-	product.Update(subscriptionProd.ID, &stripe.ProductParams{
-		DefaultPrice: stripe.String(subscriptionPrice.ID),
+	_, err = s.client.V1Products.Update(ctx, prod.ID, &stripe.ProductUpdateParams{
+		DefaultPrice: stripe.String(created[0].ID),
 	})
 
-	return &SetupProductsResp{
-		PriceID: subscriptionPrice.ID,
-	}, nil
+	if err != nil {
+		fmt.Printf("\nError when setting default price for product on stripe: %+v\n\n", err)
+		return nil, err
+	}
+
+	response := &SetupProductsResp{
+		ProductID: prod.ID,
+		PriceID:   created[0].ID,
+		Prices:    make([]PriceInfo, len(created)),
+	}
+
+	for index, price := range created {
+		response.Prices[index] = convertPriceInfo(price, created[0].ID)
+	}
 
+	return response, nil
 }
 
 /**
@@ -193,11 +233,16 @@ func (s *StripeProcessor) GetProducts(ctx context.Context) (*ProductListResponse
 	}
 	params.AddExpand("data.default_price")
 
-	iter := product.List(params)
+	prices, err := s.listActivePrices(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	var productList []ProductInfo
-	for iter.Next() {
-		prod := iter.Product()
+	for prod, err := range s.client.V1Products.List(ctx, params) {
+		if err != nil {
+			return nil, fmt.Errorf("error listing products: %w", err)
+		}
 
 		// skip products without a default price
 		if prod.DefaultPrice == nil {
@@ -208,6 +253,7 @@ func (s *StripeProcessor) GetProducts(ctx context.Context) (*ProductListResponse
 			ID:          prod.ID,
 			Name:        prod.Name,
 			Description: prod.Description,
+			TrialDays:   productTrialDays(prod),
 		}
 
 		// Get price information from the expanded default_price
@@ -223,16 +269,162 @@ func (s *StripeProcessor) GetProducts(ctx context.Context) (*ProductListResponse
 			}
 		}
 
+		productInfo.Prices = []PriceInfo{}
+		for _, price := range prices[prod.ID] {
+			productInfo.Prices = append(productInfo.Prices, convertPriceInfo(price, prod.DefaultPrice.ID))
+		}
+
+		// the default price first
+		slices.SortStableFunc(productInfo.Prices, func(a, b PriceInfo) int {
+			switch {
+			case a.Default == b.Default:
+				return 0
+			case a.Default:
+				return -1
+			default:
+				return 1
+			}
+		})
+
 		productList = append(productList, productInfo)
 	}
 
 	// fmt.Printf("\nproductList: %+v\n\n", productList)
 
-	if err := iter.Err(); err != nil {
-		return nil, fmt.Errorf("error listing products: %w", err)
+	return &ProductListResponse{Products: productList}, nil
+}
+
+// active prices of all products by product id, listed once instead of per product
+func (s *StripeProcessor) listActivePrices(ctx context.Context) (map[string][]*stripe.Price, error) {
+	prices := map[string][]*stripe.Price{}
+
+	for price, err := range s.client.V1Prices.List(ctx, &stripe.PriceListParams{Active: stripe.Bool(true)}) {
+		if err != nil {
+			return nil, fmt.Errorf("error listing prices: %w", err)
+		}
+
+		if price.Product == nil {
+			continue
+		}
+
+		prices[price.Product.ID] = append(prices[price.Product.ID], price)
 	}
 
-	return &ProductListResponse{Products: productList}, nil
+	return prices, nil
+}
+
+/**
+* Gets the latest customer object directly from stripe.
+**/
+func (s *StripeProcessor) GetCustomer(ctx context.Context, customerId string) (*stripe.Customer, error) {
+	return s.client.V1Customers.Retrieve(ctx, customerId, nil)
+}
+
+/**
+* Lists the subscriptions of a customer, regardless of status unless opts.ActiveOnly is set, with the default
+* payment method expanded so card details are available for caching.
+**/
+func (s *StripeProcessor) ListSubscriptions(ctx context.Context, customerId string, opts *ListOptions) ([]*stripe.Subscription, error) {
+	params := &stripe.SubscriptionListParams{
+		Customer: stripe.String(customerId),
+		Status:   stripe.String("all"),
+	}
+
+	if opts != nil {
+		if opts.ActiveOnly {
+			// stripe's default, everything but canceled subscriptions
+			params.Status = nil
+		}
+
+		if opts.PageSize > 0 {
+			params.Limit = stripe.Int64(opts.PageSize)
+		}
+	}
+
+	// expand the payment method to get card details
+	params.AddExpand("data.default_payment_method")
+
+	// subscriptions slice
+	subscriptions := []*stripe.Subscription{}
+
+	// get subscription data, validates that customer has subscriptions. the iterator pages through the results
+	for sub, err := range s.client.V1Subscriptions.List(ctx, params) {
+		// Handle iteration error
+		if err != nil {
+			fmt.Printf("\nFailed to fetch subscriptions from Stripe: %+v\n\n", err)
+			return nil, fmt.Errorf("failed to fetch subscriptions from Stripe: %w", err)
+		}
+
+		subscriptions = append(subscriptions, sub)
+	}
+
+	return subscriptions, nil
+}
+
+/**
+* Retrieves a single subscription, used for targeted updates from webhook events that only reference it.
+**/
+func (s *StripeProcessor) GetSubscription(ctx context.Context, subscriptionId string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionRetrieveParams{}
+	params.AddExpand("default_payment_method")
+
+	sub, err := s.client.V1Subscriptions.Retrieve(ctx, subscriptionId, params)
+
+	if err != nil {
+		fmt.Printf("\nFailed to fetch subscription %s from Stripe: %+v\n\n", subscriptionId, err)
+		return nil, fmt.Errorf("failed to fetch subscription from Stripe: %w", err)
+	}
+
+	return sub, nil
+}
+
+/**
+* Lists the payment intents of a customer, newest first, with the payment method expanded. When the listing is cut
+* short by opts.MaxPages the id of the last returned intent is the cursor to continue from.
+**/
+func (s *StripeProcessor) ListPaymentIntents(ctx context.Context, customerId string, opts *ListOptions) ([]*stripe.PaymentIntent, string, error) {
+	payments := []*stripe.PaymentIntent{}
+
+	paymentParams := &stripe.PaymentIntentListParams{
+		Customer: stripe.String(customerId),
+	}
+
+	if opts != nil {
+		if opts.CreatedGte > 0 {
+			paymentParams.CreatedRange = &stripe.RangeQueryParams{GreaterThanOrEqual: opts.CreatedGte}
+		}
+
+		if opts.StartingAfter != "" {
+			paymentParams.StartingAfter = stripe.String(opts.StartingAfter)
+		}
+
+		if opts.PageSize > 0 {
+			paymentParams.Limit = stripe.Int64(opts.PageSize)
+		}
+	}
+
+	// include payment method details and the latest charge, which carries the refunds
+	paymentParams.AddExpand("data.payment_method")
+	paymentParams.AddExpand("data.latest_charge")
+
+	maxObjects := opts.MaxObjects()
+
+	// the iterator requests the next page (starting_after the last intent) once a page is consumed
+	for pi, err := range s.client.V1PaymentIntents.List(ctx, paymentParams) {
+		if err != nil {
+			fmt.Printf("\nFailed to fetch payment intents from Stripe: %+v\n\n", err)
+			return nil, "", fmt.Errorf("failed to fetch payment intents from Stripe: %w", err)
+		}
+
+		payments = append(payments, pi)
+
+		// page limit reached, the rest is picked up by the next sync
+		if maxObjects > 0 && len(payments) >= maxObjects {
+			return payments, pi.ID, nil
+		}
+	}
+
+	return payments, "", nil
 }
 
 /**
@@ -240,7 +432,7 @@ func (s *StripeProcessor) GetProducts(ctx context.Context) (*ProductListResponse
 **/
 func (s *StripeProcessor) PurchaseProduct(ctx context.Context, req *PurchaseProductRequest) (*StripePurchaseResponse, error) {
 	// first, get the product to find its default price
-	productParams := &stripe.ProductParams{}
+	productParams := &stripe.ProductRetrieveParams{}
 
 	// we need to use AddExpand method on the the field we want to convert
 	// from an id to the object with DETAILED data object.
@@ -266,21 +458,26 @@ func (s *StripeProcessor) PurchaseProduct(ctx context.Context, req *PurchaseProd
 
 	productParams.AddExpand("default_price")
 
-	prod, err := product.Get(req.ProductID, productParams)
+	prod, err := s.client.V1Products.Retrieve(ctx, req.ProductID, productParams)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get product: %w", err)
 	}
 
-	if prod.DefaultPrice == nil {
-		return nil, fmt.Errorf("product has no default price")
+	price, err := s.selectPrice(ctx, prod, req.PriceSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	if price.Recurring != nil {
+		return nil, fmt.Errorf("%w: price %s is billed on a recurring basis, subscribe to it instead", ErrInvalidPrice, price.ID)
 	}
 
-	fmt.Printf("Product price amount: %d\n", prod.DefaultPrice.UnitAmount)
+	fmt.Printf("Product price amount: %d\n", price.UnitAmount)
 
 	// create payment intent with the product's price
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(prod.DefaultPrice.UnitAmount),
-		Currency: stripe.String("usd"),
+	params := &stripe.PaymentIntentCreateParams{
+		Amount:   stripe.Int64(price.UnitAmount),
+		Currency: stripe.String(string(price.Currency)),
 		Customer: stripe.String(req.CustomerID),
 
 		ConfirmationMethod: stripe.String("automatic"),
@@ -291,11 +488,11 @@ func (s *StripeProcessor) PurchaseProduct(ctx context.Context, req *PurchaseProd
 		// add metadata to track the product being purchased
 		Metadata: map[string]string{
 			"product_id": req.ProductID,
-			"price_id":   prod.DefaultPrice.ID,
+			"price_id":   price.ID,
 		},
 	}
 
-	intent, err := paymentintent.New(params)
+	intent, err := s.client.V1PaymentIntents.Create(ctx, params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create payment intent: %w", err)
 	}
@@ -303,7 +500,7 @@ func (s *StripeProcessor) PurchaseProduct(ctx context.Context, req *PurchaseProd
 	return &StripePurchaseResponse{
 		ClientSecret:    intent.ClientSecret,
 		PaymentIntentID: intent.ID,
-		Amount:          prod.DefaultPrice.UnitAmount,
+		Amount:          price.UnitAmount,
 	}, nil
 }
 
@@ -312,69 +509,97 @@ func (s *StripeProcessor) PurchaseProduct(ctx context.Context, req *PurchaseProd
 **/
 func (s *StripeProcessor) SubscribeToProduct(ctx context.Context, req *SubscribeRequest) (*SubscribeResponse, error) {
 	// get product with expanded default_price to check if it's a subscription
-	productParams := &stripe.ProductParams{}
+	productParams := &stripe.ProductRetrieveParams{}
 	productParams.AddExpand("default_price")
 
-	prod, err := product.Get(req.ProductID, productParams)
+	prod, err := s.client.V1Products.Retrieve(ctx, req.ProductID, productParams)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get product: %w", err)
 	}
 
-	if prod.DefaultPrice == nil {
-		return nil, fmt.Errorf("product has no default price")
+	price, err := s.selectPrice(ctx, prod, req.PriceSelector)
+	if err != nil {
+		return nil, err
 	}
 
-	if prod.DefaultPrice.Recurring == nil {
-		return nil, fmt.Errorf("product %s is not a subscription (no recurring price)", req.ProductID)
+	if price.Recurring == nil {
+		if req.IsDefault() {
+			return nil, fmt.Errorf("product %s is not a subscription (no recurring price)", req.ProductID)
+		}
+
+		return nil, fmt.Errorf("%w: price %s is a one-time price, purchase it instead", ErrInvalidPrice, price.ID)
 	}
 
 	// create subscription
-	subParams := &stripe.SubscriptionParams{
+	subParams := &stripe.SubscriptionCreateParams{
 		Customer: stripe.String(req.CustomerID),
-		Items: []*stripe.SubscriptionItemsParams{
+		Items: []*stripe.SubscriptionCreateItemParams{
 			{
-				Price: stripe.String(prod.DefaultPrice.ID),
+				Price: stripe.String(price.ID),
 			},
 		},
 		PaymentBehavior: stripe.String("default_incomplete"),
-		PaymentSettings: &stripe.SubscriptionPaymentSettingsParams{
+		PaymentSettings: &stripe.SubscriptionCreatePaymentSettingsParams{
 			SaveDefaultPaymentMethod: stripe.String("on_subscription"),
 		},
 	}
 
+	trialDays := productTrialDays(prod)
+	if req.TrialDays != nil {
+		trialDays = *req.TrialDays
+	}
+
+	// trials start without a card, the subscription cancels when it ends with none saved
+	if trialDays > 0 {
+		subParams.TrialPeriodDays = stripe.Int64(trialDays)
+		subParams.TrialSettings = &stripe.SubscriptionCreateTrialSettingsParams{
+			EndBehavior: &stripe.SubscriptionCreateTrialSettingsEndBehaviorParams{
+				MissingPaymentMethod: stripe.String(string(stripe.SubscriptionTrialSettingsEndBehaviorMissingPaymentMethodCancel)),
+			},
+		}
+	}
+
 	subParams.AddExpand("latest_invoice.confirmation_secret")
+	subParams.AddExpand("pending_setup_intent")
 
 	// create the subscription
-	sub, err := subscription.New(subParams)
+	sub, err := s.client.V1Subscriptions.Create(ctx, subParams)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create subscription: %w", err)
 	}
 
+	response := &SubscribeResponse{
+		SubscriptionID: sub.ID,
+		Status:         string(sub.Status),
+	}
+
 	// extract client secret from the invoice's confirmation_secret
-	var clientSecret string
 	if sub.LatestInvoice != nil && sub.LatestInvoice.ConfirmationSecret != nil {
 		// the ConfirmationSecret contains the client_secret
-		clientSecret = sub.LatestInvoice.ConfirmationSecret.ClientSecret
+		response.ClientSecret = sub.LatestInvoice.ConfirmationSecret.ClientSecret
+		response.ClientSecretType = clientSecretPaymentIntent
 	}
 
-	return &SubscribeResponse{
-		SubscriptionID: sub.ID,
-		ClientSecret:   clientSecret,
-		Status:         string(sub.Status),
-	}, nil
+	// trials invoice nothing up front, the card for after the trial is saved through the pending setup intent
+	if sub.PendingSetupIntent != nil {
+		response.ClientSecret = sub.PendingSetupIntent.ClientSecret
+		response.ClientSecretType = clientSecretSetupIntent
+	}
+
+	if sub.Status == stripe.SubscriptionStatusTrialing {
+		response.TrialEnd = convertOptionalTime(sub.TrialEnd)
+	}
+
+	return response, nil
 }
 
 /**
-* Checks webhook event, using it as an indicator that something has been triggered.
-* if you are on my team and I provide you this POC as guidance please be wary that the actual "sync" method comes after this processor
+* Resolves the customer a webhook event belongs to, used to fall back to a full sync of that customer.
+* Which events are handled, and how, is decided by the payment service's webhook handler registry.
 **/
 
 func (s *StripeProcessor) ProcessWebhookEvent(ctx context.Context, event *stripe.Event) (customerId string, error error) {
-	isEventSupported := s.IsWebhookEventSupported(ctx, event)
-
-	if !isEventSupported {
-		return "", fmt.Errorf("The event type that was resulted from the action was not allowed.")
-	}
+	fmt.Printf("Processing webhook event type: %s\n", event.Type)
 
 	customerId, err := s.ExtractCustomerIdFromWebhook(event)
 	fmt.Printf("customerId from webhook event: %s\n", customerId)
@@ -386,30 +611,6 @@ func (s *StripeProcessor) ProcessWebhookEvent(ctx context.Context, event *stripe
 	return customerId, nil
 }
 
-/**
-* Handles all webhook events specifically for stripe that this platform allows.
-**/
-
-func (s *StripeProcessor) IsWebhookEventSupported(ctx context.Context, event *stripe.Event) bool {
-	// store allowed / expected webhook events
-	expectedEvents := map[stripe.EventType]bool{
-		stripe.EventTypePaymentIntentSucceeded:      true,
-		stripe.EventTypePaymentIntentPaymentFailed:  true,
-		stripe.EventTypePaymentIntentCanceled:       true,
-		stripe.EventTypeCustomerSubscriptionCreated: true,
-	}
-
-	fmt.Printf("Processing webhook event type: %s\n", event.Type)
-
-	if !expectedEvents[event.Type] {
-		// not-allowed events
-		fmt.Printf("The event type that was resulted from the action was not allowed.")
-		return false
-	}
-
-	return true
-}
-
 /**
 * Extract stripe-specific customer id from event object.
 **/
@@ -434,5 +635,356 @@ func (s *StripeProcessor) ExtractCustomerIdFromWebhook(event interface{}) (strin
 		return customer, nil
 	}
 
+	// customer.* events carry the customer itself
+	if object, ok := eventData["object"].(string); ok && object == "customer" {
+		if id, ok := eventData["id"].(string); ok && id != "" {
+			return id, nil
+		}
+	}
+
 	return "", fmt.Errorf("no customer ID found in stripe event type: %s", stripeEvent.Type)
 }
+
+/**
+* Cancels a subscription right away. Stripe's own proration is left off, refunds of the unused period are made
+* separately through RefundInvoice.
+**/
+func (s *StripeProcessor) CancelSubscription(ctx context.Context, subscriptionId string, details *CancellationDetails) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionCancelParams{
+		Prorate: stripe.Bool(false),
+	}
+
+	if details != nil {
+		params.CancellationDetails = &stripe.SubscriptionCancelCancellationDetailsParams{
+			Feedback: optionalString(details.Feedback),
+			Comment:  optionalString(details.Comment),
+		}
+	}
+
+	params.AddExpand("default_payment_method")
+
+	sub, err := s.client.V1Subscriptions.Cancel(ctx, subscriptionId, params)
+
+	if err != nil {
+		fmt.Printf("\nFailed to cancel subscription %s on Stripe: %+v\n\n", subscriptionId, err)
+		return nil, fmt.Errorf("failed to cancel subscription on Stripe: %w", err)
+	}
+
+	return sub, nil
+}
+
+/**
+* Schedules the subscription to cancel at the end of its current period, or with cancel false takes a scheduled
+* cancellation back. The reason is only recorded when scheduling.
+**/
+func (s *StripeProcessor) SetCancelAtPeriodEnd(ctx context.Context, subscriptionId string, cancel bool, details *CancellationDetails) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionUpdateParams{
+		CancelAtPeriodEnd: stripe.Bool(cancel),
+	}
+
+	if cancel && details != nil {
+		params.CancellationDetails = &stripe.SubscriptionUpdateCancellationDetailsParams{
+			Feedback: optionalString(details.Feedback),
+			Comment:  optionalString(details.Comment),
+		}
+	}
+
+	params.AddExpand("default_payment_method")
+
+	sub, err := s.client.V1Subscriptions.Update(ctx, subscriptionId, params)
+
+	if err != nil {
+		fmt.Printf("\nFailed to update cancellation of subscription %s on Stripe: %+v\n\n", subscriptionId, err)
+		return nil, fmt.Errorf("failed to update subscription cancellation on Stripe: %w", err)
+	}
+
+	return sub, nil
+}
+
+/**
+* Pauses collecting payments for a subscription, or with a nil pause resumes it. The subscription stays active,
+* stripe keeps creating its invoices and handles them as pause.Behavior says.
+**/
+func (s *StripeProcessor) SetPauseCollection(ctx context.Context, subscriptionId string, pause *PauseCollection) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionUpdateParams{}
+
+	if pause != nil {
+		params.PauseCollection = &stripe.SubscriptionUpdatePauseCollectionParams{
+			Behavior: stripe.String(pause.Behavior),
+		}
+
+		if pause.ResumesAt > 0 {
+			params.PauseCollection.ResumesAt = stripe.Int64(pause.ResumesAt)
+		}
+	} else {
+		// an empty value unsets it
+		params.AddExtra("pause_collection", "")
+	}
+
+	params.AddExpand("default_payment_method")
+
+	sub, err := s.client.V1Subscriptions.Update(ctx, subscriptionId, params)
+
+	if err != nil {
+		fmt.Printf("\nFailed to update paused collection of subscription %s on Stripe: %+v\n\n", subscriptionId, err)
+		return nil, fmt.Errorf("failed to update subscription pause on Stripe: %w", err)
+	}
+
+	return sub, nil
+}
+
+/**
+* Refunds up to amount of what was paid for an invoice, returning the refunded amount. Invoices paid in several
+* payments are refunded from the first one only.
+**/
+func (s *StripeProcessor) RefundInvoice(ctx context.Context, invoiceId string, amount int64) (int64, error) {
+	params := &stripe.InvoiceRetrieveParams{}
+	params.AddExpand("payments")
+
+	invoice, err := s.client.V1Invoices.Retrieve(ctx, invoiceId, params)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get invoice %s: %w", invoiceId, err)
+	}
+
+	if invoice.Payments == nil {
+		return 0, nil
+	}
+
+	for _, payment := range invoice.Payments.Data {
+		if payment.Payment == nil || payment.Payment.PaymentIntent == nil || payment.AmountPaid <= 0 {
+			continue
+		}
+
+		params := &stripe.RefundCreateParams{
+			PaymentIntent: stripe.String(payment.Payment.PaymentIntent.ID),
+			Amount:        stripe.Int64(min(amount, payment.AmountPaid)),
+			Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+		}
+		// retries of a failed refund can't refund twice
+		params.SetIdempotencyKey(fmt.Sprintf("refund-invoice-%s-%d", invoiceId, amount))
+
+		refund, err := s.client.V1Refunds.Create(ctx, params)
+
+		if err != nil {
+			fmt.Printf("\nFailed to refund invoice %s on Stripe: %+v\n\n", invoiceId, err)
+			return 0, fmt.Errorf("failed to refund invoice on Stripe: %w", err)
+		}
+
+		return refund.Amount, nil
+	}
+
+	// nothing paid, e.g. covered by credit
+	return 0, nil
+}
+
+func (s *StripeProcessor) GetInvoice(ctx context.Context, invoiceId string) (*stripe.Invoice, error) {
+	invoice, err := s.client.V1Invoices.Retrieve(ctx, invoiceId, nil)
+
+	if err != nil {
+		fmt.Printf("\nFailed to fetch invoice %s from Stripe: %+v\n\n", invoiceId, err)
+		return nil, fmt.Errorf("failed to fetch invoice from Stripe: %w", err)
+	}
+
+	return invoice, nil
+}
+
+/**
+* The selected price of a product, what the product is subscribed or switched to.
+**/
+func (s *StripeProcessor) GetProductPrice(ctx context.Context, productId string, selector PriceSelector) (*stripe.Price, error) {
+	params := &stripe.ProductRetrieveParams{}
+	params.AddExpand("default_price")
+
+	prod, err := s.client.V1Products.Retrieve(ctx, productId, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get product: %w", err)
+	}
+
+	return s.selectPrice(ctx, prod, selector)
+}
+
+/**
+* The price of the product (with its default price expanded) the selector asks for. Other prices are looked up by
+* id, or in the price list by lookup key, inactive ones included so they can be told apart from unknown ones.
+**/
+func (s *StripeProcessor) selectPrice(ctx context.Context, prod *stripe.Product, selector PriceSelector) (*stripe.Price, error) {
+	if selector.IsDefault() {
+		return selector.Select(prod.ID, prod.DefaultPrice, nil)
+	}
+
+	var candidates []*stripe.Price
+
+	if selector.PriceID != "" {
+		price, err := s.client.V1Prices.Retrieve(ctx, selector.PriceID, nil)
+
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+			return nil, fmt.Errorf("%w: no price %s", ErrInvalidPrice, selector.PriceID)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to get price: %w", err)
+		}
+
+		candidates = append(candidates, price)
+	} else {
+		listParams := &stripe.PriceListParams{LookupKeys: stripe.StringSlice([]string{selector.LookupKey})}
+
+		for price, err := range s.client.V1Prices.List(ctx, listParams) {
+			if err != nil {
+				return nil, fmt.Errorf("error listing prices: %w", err)
+			}
+
+			candidates = append(candidates, price)
+		}
+	}
+
+	return selector.Select(prod.ID, prod.DefaultPrice, candidates)
+}
+
+/**
+* Previews the invoice a price change leads to: the one issued right away with always_invoice, otherwise the
+* upcoming renewal with the prorations added to it.
+**/
+func (s *StripeProcessor) PreviewPlanChange(ctx context.Context, change *PlanChange) (*stripe.Invoice, error) {
+	params := &stripe.InvoiceCreatePreviewParams{
+		Subscription: stripe.String(change.SubscriptionID),
+		SubscriptionDetails: &stripe.InvoiceCreatePreviewSubscriptionDetailsParams{
+			Items: []*stripe.InvoiceCreatePreviewSubscriptionDetailsItemParams{
+				{
+					ID:    stripe.String(change.ItemID),
+					Price: stripe.String(change.PriceID),
+				},
+			},
+			ProrationBehavior: stripe.String(change.ProrationBehavior),
+			ProrationDate:     stripe.Int64(change.ProrationDate),
+		},
+	}
+
+	invoice, err := s.client.V1Invoices.CreatePreview(ctx, params)
+
+	if err != nil {
+		fmt.Printf("\nFailed to preview plan change of subscription %s on Stripe: %+v\n\n", change.SubscriptionID, err)
+		return nil, fmt.Errorf("failed to preview plan change on Stripe: %w", err)
+	}
+
+	return invoice, nil
+}
+
+/**
+* Swaps the price of a subscription item right away. A schedule managing the subscription is released first, the
+* change replaces whatever it had planned.
+**/
+func (s *StripeProcessor) ChangePlan(ctx context.Context, change *PlanChange) (*stripe.Subscription, error) {
+	if change.ScheduleID != "" {
+		if _, err := s.client.V1SubscriptionSchedules.Release(ctx, change.ScheduleID, nil); err != nil {
+			return nil, fmt.Errorf("failed to release subscription schedule %s: %w", change.ScheduleID, err)
+		}
+	}
+
+	params := &stripe.SubscriptionUpdateParams{
+		Items: []*stripe.SubscriptionUpdateItemParams{
+			{
+				ID:    stripe.String(change.ItemID),
+				Price: stripe.String(change.PriceID),
+			},
+		},
+		ProrationBehavior: stripe.String(change.ProrationBehavior),
+		ProrationDate:     stripe.Int64(change.ProrationDate),
+	}
+
+	params.AddExpand("default_payment_method")
+
+	sub, err := s.client.V1Subscriptions.Update(ctx, change.SubscriptionID, params)
+
+	if err != nil {
+		fmt.Printf("\nFailed to change plan of subscription %s on Stripe: %+v\n\n", change.SubscriptionID, err)
+		return nil, fmt.Errorf("failed to change plan on Stripe: %w", err)
+	}
+
+	return sub, nil
+}
+
+/**
+* Swaps the price of a subscription item at the end of the current period through a subscription schedule. The
+* current phase runs until the period ends, the next one renews once at the new price and the schedule then releases
+* the subscription, which keeps renewing at that price. Phases an existing schedule had planned are replaced.
+**/
+func (s *StripeProcessor) SchedulePlanChange(ctx context.Context, change *PlanChange) (*stripe.SubscriptionSchedule, error) {
+	sub, err := s.client.V1Subscriptions.Retrieve(ctx, change.SubscriptionID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch subscription from Stripe: %w", err)
+	}
+
+	var schedule *stripe.SubscriptionSchedule
+
+	if change.ScheduleID != "" {
+		schedule, err = s.client.V1SubscriptionSchedules.Retrieve(ctx, change.ScheduleID, nil)
+	} else {
+		schedule, err = s.client.V1SubscriptionSchedules.Create(ctx, &stripe.SubscriptionScheduleCreateParams{
+			FromSubscription: stripe.String(change.SubscriptionID),
+		})
+	}
+
+	if err != nil {
+		fmt.Printf("\nFailed to get a schedule for subscription %s on Stripe: %+v\n\n", change.SubscriptionID, err)
+		return nil, fmt.Errorf("failed to get subscription schedule on Stripe: %w", err)
+	}
+
+	if schedule.CurrentPhase == nil || sub.Items == nil || len(sub.Items.Data) == 0 {
+		return nil, fmt.Errorf("subscription %s has no current phase to schedule from", change.SubscriptionID)
+	}
+
+	current := []*stripe.SubscriptionScheduleUpdatePhaseItemParams{}
+	next := []*stripe.SubscriptionScheduleUpdatePhaseItemParams{}
+
+	for _, item := range sub.Items.Data {
+		price := item.Price.ID
+
+		current = append(current, &stripe.SubscriptionScheduleUpdatePhaseItemParams{
+			Price:    stripe.String(price),
+			Quantity: stripe.Int64(item.Quantity),
+		})
+
+		if item.ID == change.ItemID {
+			price = change.PriceID
+		}
+
+		next = append(next, &stripe.SubscriptionScheduleUpdatePhaseItemParams{
+			Price:    stripe.String(price),
+			Quantity: stripe.Int64(item.Quantity),
+		})
+	}
+
+	schedule, err = s.client.V1SubscriptionSchedules.Update(ctx, schedule.ID, &stripe.SubscriptionScheduleUpdateParams{
+		EndBehavior:       stripe.String(string(stripe.SubscriptionScheduleEndBehaviorRelease)),
+		ProrationBehavior: stripe.String(string(stripe.SubscriptionSchedulePhaseProrationBehaviorNone)),
+		Phases: []*stripe.SubscriptionScheduleUpdatePhaseParams{
+			{
+				Items:     current,
+				StartDate: stripe.Int64(schedule.CurrentPhase.StartDate),
+				EndDate:   stripe.Int64(sub.Items.Data[0].CurrentPeriodEnd),
+			},
+			{
+				Items:      next,
+				Iterations: stripe.Int64(1),
+			},
+		},
+	})
+
+	if err != nil {
+		fmt.Printf("\nFailed to schedule plan change of subscription %s on Stripe: %+v\n\n", change.SubscriptionID, err)
+		return nil, fmt.Errorf("failed to schedule plan change on Stripe: %w", err)
+	}
+
+	return schedule, nil
+}
+
+// nil for empty strings, so they aren't sent
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+
+	return stripe.String(value)
+}
@@ -0,0 +1,228 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v82"
+)
+
+/**
+* Subscription cancellation.
+*
+* Users cancel a subscription either right away, optionally refunding the unused part of the current period, or at
+* the end of the period, which keeps their access until the renewal date and can be taken back until then. The
+* reason they give is stored on stripe's cancellation_details and mirrored with the subscription.
+*
+* Refunds are worked out before canceling from what the latest invoice actually collected (after discounts and
+* tax, nothing for trials) and made after it. A refund that fails doesn't undo the cancellation, the response
+* reports what is left to refund (RefundDue, RefundError) and retries of the same refund can't pay out twice.
+*
+* Stripe is changed first and the subscription it returns is mirrored the way its webhook would be (the row, the
+* cached field and users.subscribed), so the change shows before the webhooks arrive. Once stripe canceled, a
+* failure to mirror is only reported (MirrorError) and left to the webhook, the refund is still made.
+**/
+
+// returned when the subscription doesn't exist or belongs to another user
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// returned when canceling or resuming a subscription that already ended
+var ErrSubscriptionEnded = errors.New("subscription has already ended")
+
+// returned when resuming a subscription that isn't scheduled to cancel
+var ErrCancellationNotScheduled = errors.New("subscription is not scheduled to cancel")
+
+// returned for cancellation requests stripe wouldn't accept
+var ErrInvalidCancellation = errors.New("invalid cancellation")
+
+// the reasons stripe accepts as cancellation feedback
+var cancellationFeedback = []stripe.SubscriptionCancellationDetailsFeedback{
+	stripe.SubscriptionCancellationDetailsFeedbackCustomerService,
+	stripe.SubscriptionCancellationDetailsFeedbackLowQuality,
+	stripe.SubscriptionCancellationDetailsFeedbackMissingFeatures,
+	stripe.SubscriptionCancellationDetailsFeedbackOther,
+	stripe.SubscriptionCancellationDetailsFeedbackSwitchedService,
+	stripe.SubscriptionCancellationDetailsFeedbackTooComplex,
+	stripe.SubscriptionCancellationDetailsFeedbackTooExpensive,
+	stripe.SubscriptionCancellationDetailsFeedbackUnused,
+}
+
+/**
+* Cancels one of the user's subscriptions, now or at the end of its period (request.AtPeriodEnd).
+**/
+func (s *service) CancelSubscription(ctx context.Context, userId uuid.UUID, request *CancelSubscriptionRequest) (*SubscriptionCancellationResponse, error) {
+	if request.Reason != "" && !slices.Contains(cancellationFeedback, stripe.SubscriptionCancellationDetailsFeedback(request.Reason)) {
+		return nil, fmt.Errorf("%w: unknown reason %s", ErrInvalidCancellation, request.Reason)
+	}
+
+	if request.Refund && request.AtPeriodEnd {
+		return nil, fmt.Errorf("%w: only immediate cancellations are refunded", ErrInvalidCancellation)
+	}
+
+	record, err := s.ownedSubscription(ctx, userId, request.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	details := &CancellationDetails{Feedback: request.Reason, Comment: request.Comment}
+
+	// the returned subscription is at least as new as the start of the request
+	requestedAt := stripeRequestVersion(time.Now())
+
+	var refundDue int64
+
+	if request.Refund {
+		refundDue, err = s.unusedPeriodRefund(ctx, record, requestedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var sub *stripe.Subscription
+
+	if request.AtPeriodEnd {
+		sub, err = s.paymentProcessor.SetCancelAtPeriodEnd(ctx, request.SubscriptionID, true, details)
+	} else {
+		sub, err = s.paymentProcessor.CancelSubscription(ctx, request.SubscriptionID, details)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	response := subscriptionCancellationResponse(sub)
+
+	if err := s.applySubscription(ctx, sub, requestedAt); err != nil {
+		fmt.Printf("\nError when mirroring canceled subscription %s: %+v\n\n", sub.ID, err)
+		response.MirrorError = err.Error()
+	}
+
+	if refundDue <= 0 {
+		return response, nil
+	}
+
+	response.RefundedAmount, err = s.paymentProcessor.RefundInvoice(ctx, record.LatestInvoiceID, refundDue)
+
+	if err != nil {
+		fmt.Printf("\nError when refunding canceled subscription %s: %+v\n\n", sub.ID, err)
+		response.RefundDue = refundDue
+		response.RefundError = err.Error()
+	}
+
+	return response, nil
+}
+
+/**
+* Takes back a cancellation scheduled for the end of the period, the subscription renews again.
+**/
+func (s *service) ResumeSubscription(ctx context.Context, userId uuid.UUID, request *ResumeSubscriptionRequest) (*SubscriptionCancellationResponse, error) {
+	record, err := s.ownedSubscription(ctx, userId, request.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !record.CancelAtPeriodEnd {
+		return nil, ErrCancellationNotScheduled
+	}
+
+	requestedAt := stripeRequestVersion(time.Now())
+
+	sub, err := s.paymentProcessor.SetCancelAtPeriodEnd(ctx, request.SubscriptionID, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.applySubscription(ctx, sub, requestedAt); err != nil {
+		return nil, err
+	}
+
+	return subscriptionCancellationResponse(sub), nil
+}
+
+// the user's mirrored subscription, as long as it hasn't ended
+func (s *service) ownedSubscription(ctx context.Context, userId uuid.UUID, subscriptionId string) (*Subscription, error) {
+	record, err := s.repo.GetSubscriptionByStripeID(ctx, subscriptionId)
+
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && record.UserID != userId) {
+		return nil, ErrSubscriptionNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+
+	if subscriptionEnded(record.Status) {
+		return nil, ErrSubscriptionEnded
+	}
+
+	return record, nil
+}
+
+/**
+* The part of what the latest invoice collected for the current period that is unused after at, pro rata by time.
+* Trials weren't paid for.
+**/
+func (s *service) unusedPeriodRefund(ctx context.Context, record *Subscription, at time.Time) (int64, error) {
+	period := record.CurrentPeriodEnd.Sub(record.CurrentPeriodStart)
+	unused := record.CurrentPeriodEnd.Sub(at)
+
+	if record.Status == string(stripe.SubscriptionStatusTrialing) || record.LatestInvoiceID == "" || period <= 0 || unused <= 0 {
+		return 0, nil
+	}
+
+	invoice, err := s.paymentProcessor.GetInvoice(ctx, record.LatestInvoiceID)
+	if err != nil {
+		return 0, err
+	}
+
+	return invoice.AmountPaid * int64(unused/time.Second) / int64(period/time.Second), nil
+}
+
+/**
+* Clears users.subscribed once all of the customer's subscriptions ended. Runs after an ended subscription was
+* mirrored, in the same transaction. Subscriptions still waiting for their first payment keep the flag, it's set
+* when subscribing.
+**/
+func (s *service) unsubscribeIfAllEnded(ctx context.Context, userId uuid.UUID, customerId string) error {
+	subscriptions, err := s.repo.ListSubscriptionsByCustomer(ctx, customerId)
+	if err != nil {
+		return err
+	}
+
+	running := slices.ContainsFunc(subscriptions, func(sub *Subscription) bool {
+		return !subscriptionEnded(sub.Status)
+	})
+
+	if running {
+		return nil
+	}
+
+	return s.userService.UpdateSubscribed(ctx, userId, false)
+}
+
+// statuses stripe never moves a subscription out of
+func subscriptionEnded(status string) bool {
+	return status == string(stripe.SubscriptionStatusCanceled) || status == string(stripe.SubscriptionStatusIncompleteExpired)
+}
+
+func subscriptionCancellationResponse(sub *stripe.Subscription) *SubscriptionCancellationResponse {
+	response := &SubscriptionCancellationResponse{
+		SubscriptionID:    sub.ID,
+		Status:            string(sub.Status),
+		CancelAtPeriodEnd: sub.CancelAtPeriodEnd,
+	}
+
+	switch {
+	case sub.EndedAt > 0:
+		response.AccessEndsAt = convertOptionalTime(sub.EndedAt)
+	case sub.CancelAt > 0:
+		response.AccessEndsAt = convertOptionalTime(sub.CancelAt)
+	}
+
+	return response
+}
@@ -0,0 +1,122 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v82"
+)
+
+/**
+* Paused subscriptions.
+*
+* Users pause a subscription instead of canceling it, e.g. off season. Stripe pauses collecting its payments while
+* the subscription itself stays active: its invoices are still created and voided, kept as drafts or marked
+* uncollectible, as the pause's behavior says. A pause lasts until the subscription is unpaused, or until its
+* resume date when one is given, which stripe resumes on its own.
+*
+* Paused subscriptions grant no access (see GetSubscriptionStatus).
+**/
+
+// returned for pauses stripe wouldn't accept
+var ErrInvalidPause = errors.New("invalid pause")
+
+// returned when unpausing a subscription that isn't paused
+var ErrSubscriptionNotPaused = errors.New("subscription is not paused")
+
+// what stripe does with the invoices of a paused subscription
+var pauseBehaviors = []stripe.SubscriptionPauseCollectionBehavior{
+	stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft,
+	stripe.SubscriptionPauseCollectionBehaviorMarkUncollectible,
+	stripe.SubscriptionPauseCollectionBehaviorVoid,
+}
+
+/**
+* Pauses collection of one of the user's subscriptions. Pausing a paused subscription replaces its behavior and
+* resume date.
+**/
+func (s *service) PauseSubscription(ctx context.Context, userId uuid.UUID, request *PauseSubscriptionRequest) (*SubscriptionPauseResponse, error) {
+	if !slices.Contains(pauseBehaviors, stripe.SubscriptionPauseCollectionBehavior(request.Behavior)) {
+		return nil, fmt.Errorf("%w: unknown behavior %s", ErrInvalidPause, request.Behavior)
+	}
+
+	pause := &PauseCollection{Behavior: request.Behavior}
+
+	if request.ResumesAt != nil {
+		if !request.ResumesAt.After(time.Now()) {
+			return nil, fmt.Errorf("%w: the resume date has to be in the future", ErrInvalidPause)
+		}
+
+		pause.ResumesAt = request.ResumesAt.Unix()
+	}
+
+	record, err := s.ownedSubscription(ctx, userId, request.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// incomplete and unpaid subscriptions have nothing to pause yet
+	if record.Status != string(stripe.SubscriptionStatusActive) && record.Status != string(stripe.SubscriptionStatusTrialing) {
+		return nil, fmt.Errorf("%w: only active subscriptions are paused, this one is %s", ErrInvalidPause, record.Status)
+	}
+
+	return s.setPauseCollection(ctx, request.SubscriptionID, pause)
+}
+
+/**
+* Resumes collection of a paused subscription right away, it grants access again.
+**/
+func (s *service) UnpauseSubscription(ctx context.Context, userId uuid.UUID, request *UnpauseSubscriptionRequest) (*SubscriptionPauseResponse, error) {
+	record, err := s.ownedSubscription(ctx, userId, request.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.PauseBehavior == "" {
+		return nil, ErrSubscriptionNotPaused
+	}
+
+	return s.setPauseCollection(ctx, request.SubscriptionID, nil)
+}
+
+// changes the pause on stripe and mirrors the subscription it returns
+func (s *service) setPauseCollection(ctx context.Context, subscriptionId string, pause *PauseCollection) (*SubscriptionPauseResponse, error) {
+	// the returned subscription is at least as new as the start of the request
+	requestedAt := stripeRequestVersion(time.Now())
+
+	sub, err := s.paymentProcessor.SetPauseCollection(ctx, subscriptionId, pause)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.applySubscription(ctx, sub, requestedAt); err != nil {
+		return nil, err
+	}
+
+	response := &SubscriptionPauseResponse{
+		SubscriptionID: sub.ID,
+		Status:         string(sub.Status),
+		Paused:         sub.PauseCollection != nil,
+	}
+
+	if sub.PauseCollection != nil {
+		response.Behavior = string(sub.PauseCollection.Behavior)
+		response.ResumesAt = convertOptionalTime(sub.PauseCollection.ResumesAt)
+	}
+
+	return response, nil
+}
+
+// paused subscriptions grant no access until they resume
+func pausedSubscriptionStatus(cancelAtPeriodEnd bool, resumesAt *time.Time) *SubscriptionStatusResponse {
+	return &SubscriptionStatusResponse{
+		HasAccess:         false,
+		Status:            string(stripe.SubscriptionStatusPaused),
+		CancelAtPeriodEnd: cancelAtPeriodEnd,
+		ResumesAt:         resumesAt,
+	}
+}
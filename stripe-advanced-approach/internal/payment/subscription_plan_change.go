@@ -0,0 +1,262 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v82"
+)
+
+/**
+* Plan changes.
+*
+* Users move a subscription to another subscription product, or another price of one (e.g. yearly instead of
+* monthly billing), by swapping the price of its first item, the plan.
+* Stripe prorates the change by time: the unused part of the period at the old price is credited and the rest
+* charged at the new one, either added to the next renewal (create_prorations, the default), invoiced right away
+* (always_invoice) or left out (none).
+*
+* The preview returns the invoice the change leads to along with the proration date it was calculated for, passing
+* it back with the change prorates it exactly as previewed. Downgrades can instead be deferred to the end of the
+* period through a subscription schedule, nothing is prorated then and the subscription is mirrored once stripe
+* switches it.
+**/
+
+// returned for plan changes stripe wouldn't accept or that change nothing
+var ErrInvalidPlanChange = errors.New("invalid plan change")
+
+const (
+	prorationCreateProrations = "create_prorations"
+	prorationAlwaysInvoice    = "always_invoice"
+	prorationNone             = "none"
+)
+
+var prorationBehaviors = []string{prorationCreateProrations, prorationAlwaysInvoice, prorationNone}
+
+// a validated plan change and what it is compared with
+type plannedPlanChange struct {
+	change    *PlanChange
+	status    stripe.SubscriptionStatus // of the subscription before the change
+	current   *stripe.Price
+	target    *stripe.Price
+	downgrade bool
+	periodEnd time.Time
+}
+
+/**
+* Previews the invoice changing the plan leads to, nothing is changed.
+**/
+func (s *service) PreviewPlanChange(ctx context.Context, userId uuid.UUID, request *ChangePlanRequest) (*PlanChangePreview, error) {
+	plan, err := s.planChange(ctx, userId, request)
+	if err != nil {
+		return nil, err
+	}
+
+	invoice, err := s.paymentProcessor.PreviewPlanChange(ctx, plan.change)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &PlanChangePreview{
+		SubscriptionID:    plan.change.SubscriptionID,
+		CurrentPriceID:    plan.current.ID,
+		NewPriceID:        plan.target.ID,
+		Downgrade:         plan.downgrade,
+		ProrationBehavior: plan.change.ProrationBehavior,
+		ProrationDate:     plan.change.ProrationDate,
+		AmountDue:         invoice.AmountDue,
+		Currency:          string(invoice.Currency),
+		Lines:             []*PlanChangeLine{},
+	}
+
+	if plan.change.ProrationBehavior != prorationAlwaysInvoice {
+		preview.InvoiceAt = &plan.periodEnd
+	}
+
+	if invoice.Lines == nil {
+		return preview, nil
+	}
+
+	for _, line := range invoice.Lines.Data {
+		proration := line.Parent != nil && line.Parent.SubscriptionItemDetails != nil && line.Parent.SubscriptionItemDetails.Proration
+
+		if proration {
+			preview.ProrationAmount += line.Amount
+		}
+
+		preview.Lines = append(preview.Lines, &PlanChangeLine{
+			Description: line.Description,
+			Amount:      line.Amount,
+			Proration:   proration,
+		})
+	}
+
+	return preview, nil
+}
+
+/**
+* Moves the subscription to the requested product's price, now or for downgrades at the end of the period
+* (request.AtPeriodEnd).
+**/
+func (s *service) ChangePlan(ctx context.Context, userId uuid.UUID, request *ChangePlanRequest) (*PlanChangeResponse, error) {
+	plan, err := s.planChange(ctx, userId, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.AtPeriodEnd {
+		schedule, err := s.paymentProcessor.SchedulePlanChange(ctx, plan.change)
+		if err != nil {
+			return nil, err
+		}
+
+		// the subscription itself is unchanged until the schedule moves it to the next phase
+		return &PlanChangeResponse{
+			SubscriptionID:   plan.change.SubscriptionID,
+			Status:           string(plan.status),
+			PriceID:          plan.current.ID,
+			ScheduledPriceID: plan.target.ID,
+			ScheduleID:       schedule.ID,
+			ScheduleStatus:   string(schedule.Status),
+			EffectiveAt:      &plan.periodEnd,
+		}, nil
+	}
+
+	// the returned subscription is at least as new as the start of the request
+	requestedAt := stripeRequestVersion(time.Now())
+
+	sub, err := s.paymentProcessor.ChangePlan(ctx, plan.change)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.applySubscription(ctx, sub, requestedAt); err != nil {
+		return nil, err
+	}
+
+	return &PlanChangeResponse{
+		SubscriptionID: sub.ID,
+		Status:         string(sub.Status),
+		PriceID:        plan.target.ID,
+		EffectiveAt:    &requestedAt,
+	}, nil
+}
+
+/**
+* Checks the change against the subscription as stripe has it and resolves the prices it swaps.
+**/
+func (s *service) planChange(ctx context.Context, userId uuid.UUID, request *ChangePlanRequest) (*plannedPlanChange, error) {
+	behavior := request.ProrationBehavior
+	if behavior == "" {
+		behavior = prorationCreateProrations
+	}
+
+	if !slices.Contains(prorationBehaviors, behavior) {
+		return nil, fmt.Errorf("%w: unknown proration behavior %s", ErrInvalidPlanChange, behavior)
+	}
+
+	if _, err := s.ownedSubscription(ctx, userId, request.SubscriptionID); err != nil {
+		return nil, err
+	}
+
+	sub, err := s.paymentProcessor.GetSubscription(ctx, request.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if sub.Items == nil || len(sub.Items.Data) == 0 || sub.Items.Data[0].Price == nil {
+		return nil, fmt.Errorf("%w: subscription %s has no plan", ErrInvalidPlanChange, sub.ID)
+	}
+
+	// the first item is the plan
+	item := sub.Items.Data[0]
+
+	target, err := s.paymentProcessor.GetProductPrice(ctx, request.ProductID, request.PriceSelector)
+
+	if errors.Is(err, ErrInvalidPrice) {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPlanChange, err)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case target.Recurring == nil:
+		return nil, fmt.Errorf("%w: price %s of product %s is not a subscription price", ErrInvalidPlanChange, target.ID, request.ProductID)
+	case target.ID == item.Price.ID:
+		return nil, fmt.Errorf("%w: subscription is already on price %s of product %s", ErrInvalidPlanChange, target.ID, request.ProductID)
+	case target.Currency != item.Price.Currency:
+		return nil, fmt.Errorf("%w: product %s is billed in %s, the subscription in %s", ErrInvalidPlanChange, request.ProductID, target.Currency, item.Price.Currency)
+	}
+
+	plan := &plannedPlanChange{
+		change: &PlanChange{
+			SubscriptionID:    sub.ID,
+			ItemID:            item.ID,
+			PriceID:           target.ID,
+			ProrationBehavior: behavior,
+			ProrationDate:     request.ProrationDate,
+		},
+		status:    sub.Status,
+		current:   item.Price,
+		target:    target,
+		downgrade: isDowngrade(item.Price, target),
+		periodEnd: time.Unix(item.CurrentPeriodEnd, 0).UTC(),
+	}
+
+	if sub.Schedule != nil {
+		plan.change.ScheduleID = sub.Schedule.ID
+	}
+
+	if request.AtPeriodEnd {
+		if !plan.downgrade {
+			return nil, fmt.Errorf("%w: only downgrades are deferred to the end of the period", ErrInvalidPlanChange)
+		}
+
+		// nothing is left of the period to prorate
+		plan.change.ProrationBehavior = prorationNone
+		plan.change.ProrationDate = item.CurrentPeriodEnd
+
+		return plan, nil
+	}
+
+	if plan.change.ProrationDate == 0 {
+		plan.change.ProrationDate = time.Now().Unix()
+	}
+
+	if plan.change.ProrationDate < item.CurrentPeriodStart || plan.change.ProrationDate > item.CurrentPeriodEnd {
+		return nil, fmt.Errorf("%w: proration date is outside of the current period, preview the change again", ErrInvalidPlanChange)
+	}
+
+	return plan, nil
+}
+
+// whether target costs less than current over the same time, prices with different intervals are compared per day
+func isDowngrade(current *stripe.Price, target *stripe.Price) bool {
+	return target.UnitAmount*intervalDays(current.Recurring) < current.UnitAmount*intervalDays(target.Recurring)
+}
+
+// approximate length of a billing interval
+func intervalDays(recurring *stripe.PriceRecurring) int64 {
+	if recurring == nil {
+		return 1
+	}
+
+	count := max(recurring.IntervalCount, 1)
+
+	switch recurring.Interval {
+	case stripe.PriceRecurringIntervalWeek:
+		return 7 * count
+	case stripe.PriceRecurringIntervalMonth:
+		return 30 * count
+	case stripe.PriceRecurringIntervalYear:
+		return 365 * count
+	default:
+		return count
+	}
+}
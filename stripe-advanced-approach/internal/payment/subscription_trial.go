@@ -0,0 +1,74 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+/**
+* Free trials.
+*
+* Subscription products carry their default trial in the product's metadata (trial_days), set when the product is
+* set up, and subscribe requests may override it or turn it off. Trials start without a card: nothing is invoiced
+* up front, the subscription is trialing right away and grants access, and the client secret returned is the
+* subscription's pending setup intent through which the user can save a card for after the trial.
+*
+* Trials without a card saved when they end cancel the subscription. Stripe sends
+* customer.subscription.trial_will_end three days before that happens, which is recorded on the subscription row
+* when there is no card to charge (see handleTrialWillEnd).
+**/
+
+// returned for trial lengths stripe wouldn't accept
+var ErrInvalidTrial = errors.New("invalid trial")
+
+// product metadata holding the default trial of a subscription product
+const trialDaysMetadataKey = "trial_days"
+
+// longest trial stripe allows
+const maxTrialDays = 730
+
+// which intent the client secret of a new subscription confirms
+const (
+	clientSecretPaymentIntent = "payment_intent"
+	clientSecretSetupIntent   = "setup_intent"
+)
+
+func validateTrialDays(days *int64) error {
+	if days == nil {
+		return nil
+	}
+
+	if *days < 0 || *days > maxTrialDays {
+		return fmt.Errorf("%w: trials last from 0 to %d days, not %d", ErrInvalidTrial, maxTrialDays, *days)
+	}
+
+	return nil
+}
+
+// the product's default trial, 0 when it has none or it can't be read
+func productTrialDays(prod *stripe.Product) int64 {
+	days, err := strconv.ParseInt(prod.Metadata[trialDaysMetadataKey], 10, 64)
+	if err != nil || days < 0 {
+		return 0
+	}
+
+	return min(days, maxTrialDays)
+}
+
+// end of the subscription's trial while it is trialing, nil otherwise
+func currentTrialEnd(status string, trialEnd *time.Time) *time.Time {
+	if status != string(stripe.SubscriptionStatusTrialing) {
+		return nil
+	}
+
+	return trialEnd
+}
+
+// trialing subscriptions grant access like active ones, unless paused
+func subscriptionGrantsAccess(status string) bool {
+	return status == string(stripe.SubscriptionStatusActive) || status == string(stripe.SubscriptionStatusTrialing)
+}
@@ -0,0 +1,223 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/lock"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
+)
+
+/**
+* Sync coordination.
+*
+* Webhooks, signups and sign-ins all sync the same customer, often at the same time and from several instances.
+* Syncs of a customer run under a per-customer lock so they don't race on the rows and the cached data, and
+* requests arriving while a sync is running are coalesced:
+*
+* 1. the request marks the customer as pending and waits, the running sync owns the follow-up
+* 2. a sync clears the pending mark when it starts, its results cover every request made before
+* 3. after releasing the lock the sync checks the mark and runs once more if it was set in the meantime
+*
+* So any number of concurrent requests results in at most the running sync plus one follow-up. Waiting requests
+* get the result of the follow-up when it runs in this process, when it runs on another instance they poll the
+* lock and sync themselves once it is free. Requests for a full sync also set a second mark before the pending one,
+* the next sync to start takes it and lists everything.
+**/
+
+func syncLockTTL() time.Duration {
+	return time.Duration(util.GetEnvAsInt("STRIPE_SYNC_LOCK_TTL_SECONDS", 30)) * time.Second
+}
+
+// how long a request for a follow-up sync is kept, outlives a crashed holder's lock
+const syncPendingTTL = 5 * time.Minute
+
+// how often a coalesced request checks whether the lock was released without its follow-up running here
+const syncFollowUpPollInterval = 100 * time.Millisecond
+
+func (s *service) coalesceSync(ctx context.Context, customerId string, forceFull bool) error {
+	syncLock, acquired, err := lock.TryAcquire(ctx, s.cacheClient, s.keys.SyncLock(customerId), syncLockTTL())
+	if err != nil {
+		return err
+	}
+
+	if !acquired {
+		return s.awaitFollowUpSync(ctx, customerId, forceFull)
+	}
+
+	return s.syncWhileRequested(ctx, syncLock, customerId, forceFull)
+}
+
+// syncs under the held lock, then once more for every follow-up requested in the meantime
+func (s *service) syncWhileRequested(ctx context.Context, syncLock *lock.Lock, customerId string, forceFull bool) error {
+	lockKey := s.keys.SyncLock(customerId)
+	pendingKey := s.keys.SyncPending(customerId)
+
+	for {
+		if err := s.runLockedSync(ctx, syncLock, customerId, pendingKey, forceFull); err != nil {
+			return err
+		}
+
+		// follow-ups are only full when requested so
+		forceFull = false
+
+		// requested while syncing, run again with the newest state
+		_, err := s.cacheClient.Get(ctx, pendingKey)
+
+		if errors.Is(err, interfaces.ErrCacheMiss) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to check for follow-up sync requests: %w", err)
+		}
+
+		var acquired bool
+
+		syncLock, acquired, err = lock.TryAcquire(ctx, s.cacheClient, lockKey, syncLockTTL())
+		if err != nil {
+			return err
+		}
+
+		// our own request is covered, whoever took the lock owns the follow-up and its waiters
+		if !acquired {
+			return nil
+		}
+	}
+}
+
+/**
+* Requests a follow-up of the sync running elsewhere and waits for its result. The waiter is registered before the
+* pending mark is set, so the run clearing the mark is the one reporting to it.
+**/
+func (s *service) awaitFollowUpSync(ctx context.Context, customerId string, forceFull bool) error {
+	followUp := s.syncFollowUps.wait(customerId)
+
+	if forceFull {
+		if err := s.cacheClient.Set(ctx, s.keys.SyncFullPending(customerId), "1", syncPendingTTL); err != nil {
+			return fmt.Errorf("failed to request full follow-up sync: %w", err)
+		}
+	}
+
+	if err := s.cacheClient.Set(ctx, s.keys.SyncPending(customerId), "1", syncPendingTTL); err != nil {
+		return fmt.Errorf("failed to request follow-up sync: %w", err)
+	}
+
+	fmt.Printf("\nSync of customer %s already running, coalesced into its follow-up\n\n", customerId)
+
+	ticker := time.NewTicker(syncFollowUpPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-followUp.done:
+			return followUp.err
+		default:
+		}
+
+		// the running sync may have checked for requests just before this one was made, or run on another instance
+		syncLock, acquired, err := lock.TryAcquire(ctx, s.cacheClient, s.keys.SyncLock(customerId), syncLockTTL())
+		if err != nil {
+			return err
+		}
+
+		if acquired {
+			return s.syncWhileRequested(ctx, syncLock, customerId, forceFull)
+		}
+
+		select {
+		case <-followUp.done:
+			return followUp.err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *service) runLockedSync(ctx context.Context, syncLock *lock.Lock, customerId string, pendingKey string, forceFull bool) error {
+	leaseCtx, stop := syncLock.KeepAlive(ctx)
+
+	defer func() {
+		stop()
+
+		// released even when the caller gave up, otherwise the customer's syncs stall until the lock expires
+		if err := syncLock.Release(context.WithoutCancel(ctx)); err != nil {
+			fmt.Printf("\nError when releasing sync lock: %+v\n\n", err)
+		}
+	}()
+
+	// this run covers every request made so far
+	if err := s.cacheClient.Del(leaseCtx, pendingKey); err != nil {
+		return fmt.Errorf("failed to clear follow-up sync request: %w", err)
+	}
+
+	// taken after the pending mark, full requests made since stay for the follow-up they set the mark for
+	fullRequested, err := s.cacheClient.DelIfEqual(leaseCtx, s.keys.SyncFullPending(customerId), "1")
+	if err != nil {
+		return fmt.Errorf("failed to take full sync request: %w", err)
+	}
+
+	followUp := s.syncFollowUps.start(customerId)
+
+	err = s.syncStripeData(leaseCtx, customerId, forceFull || fullRequested)
+	followUp.finish(err)
+
+	return err
+}
+
+/**
+* Waiters of this process for the next sync of a customer. A run takes the waiters registered before it started
+* and reports its result to them.
+**/
+type followUpGroup struct {
+	mu      sync.Mutex
+	pending map[string]*followUp
+}
+
+type followUp struct {
+	done chan struct{}
+	err  error
+}
+
+func (g *followUpGroup) wait(customerId string) *followUp {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.pending == nil {
+		g.pending = map[string]*followUp{}
+	}
+
+	next, ok := g.pending[customerId]
+
+	if !ok {
+		next = &followUp{done: make(chan struct{})}
+		g.pending[customerId] = next
+	}
+
+	return next
+}
+
+// the waiters of the starting run, nil without any
+func (g *followUpGroup) start(customerId string) *followUp {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	next := g.pending[customerId]
+	delete(g.pending, customerId)
+
+	return next
+}
+
+func (f *followUp) finish(err error) {
+	if f == nil {
+		return
+	}
+
+	f.err = err
+	close(f.done)
+}
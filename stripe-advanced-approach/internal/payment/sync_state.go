@@ -0,0 +1,119 @@
+package payment
+
+import (
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
+	"github.com/stripe/stripe-go/v82"
+)
+
+/**
+* Incremental sync.
+*
+* Listing every subscription and payment intent of a customer on every sync is slow for customers with a long
+* history and eats into the stripe rate limit, so the sync keeps a high-water mark per customer (customer_sync_state):
+*
+* - incremental passes only list payment intents created at or after the mark and subscriptions that haven't ended.
+*   changes to older objects only reach storage through the targeted updates of their webhooks, which stripe may
+*   never deliver: those stay stale until the next full pass, which a webhook whose targeted update fails forces
+* - a full pass lists everything again every STRIPE_FULL_RESYNC_INTERVAL_HOURS to repair drift, and whenever the
+*   customer's cache entry is missing since it is rebuilt from the listing
+* - listings are paged by STRIPE_SYNC_PAGE_SIZE and cut short after STRIPE_SYNC_MAX_PAGES, the pass then stores its
+*   cursor and the next sync continues it before moving the mark
+**/
+
+func syncPageSize() int64 {
+	pageSize := util.GetEnvAsInt("STRIPE_SYNC_PAGE_SIZE", 100)
+
+	// stripe's maximum
+	return int64(min(max(pageSize, 1), 100))
+}
+
+func syncMaxPages() int {
+	return util.GetEnvAsInt("STRIPE_SYNC_MAX_PAGES", 10)
+}
+
+func fullResyncInterval() time.Duration {
+	return time.Duration(util.GetEnvAsInt("STRIPE_FULL_RESYNC_INTERVAL_HOURS", 24)) * time.Hour
+}
+
+// what one sync lists from stripe
+type syncPass struct {
+	full          bool
+	createdGte    int64
+	startingAfter string
+	newestCreated int64 // newest payment intent seen so far by a continued pass
+}
+
+/**
+* Continues an unfinished pass, unless it is incremental and a full one is forced, otherwise starts a full pass when
+* one is due (or forced) and an incremental one from the high-water mark if not.
+**/
+func nextSyncPass(state *CustomerSyncState, forceFull bool, now time.Time) syncPass {
+	unfinished := state != nil && state.PassCursor != nil && state.PassCreatedGte != nil
+
+	if unfinished && (!forceFull || *state.PassCreatedGte == 0) {
+		return syncPass{
+			full:          *state.PassCreatedGte == 0,
+			createdGte:    *state.PassCreatedGte,
+			startingAfter: *state.PassCursor,
+			newestCreated: state.PassNewestCreated,
+		}
+	}
+
+	if state == nil || forceFull || state.LastFullSyncAt == nil || now.Sub(*state.LastFullSyncAt) >= fullResyncInterval() {
+		return syncPass{full: true}
+	}
+
+	return syncPass{createdGte: state.PaymentsCreatedGte}
+}
+
+func (p syncPass) subscriptionListOptions() *ListOptions {
+	return &ListOptions{
+		PageSize:   syncPageSize(),
+		ActiveOnly: !p.full,
+	}
+}
+
+func (p syncPass) paymentListOptions() *ListOptions {
+	return &ListOptions{
+		CreatedGte:    p.createdGte,
+		StartingAfter: p.startingAfter,
+		PageSize:      syncPageSize(),
+		MaxPages:      syncMaxPages(),
+	}
+}
+
+/**
+* Sync state after the pass listed the given payment intents, cursor is set when the listing was cut short.
+**/
+func (p syncPass) nextState(customerId string, previous *CustomerSyncState, payments []*stripe.PaymentIntent, cursor string, finishedAt time.Time) *CustomerSyncState {
+	state := &CustomerSyncState{StripeCustomerID: customerId}
+
+	if previous != nil {
+		state.PaymentsCreatedGte = previous.PaymentsCreatedGte
+		state.LastFullSyncAt = previous.LastFullSyncAt
+	}
+
+	newestCreated := p.newestCreated
+	for _, payment := range payments {
+		newestCreated = max(newestCreated, payment.Created)
+	}
+
+	// unfinished, older payment intents of the pass are still missing so the mark stays
+	if cursor != "" {
+		state.PassCreatedGte = &p.createdGte
+		state.PassCursor = &cursor
+		state.PassNewestCreated = newestCreated
+
+		return state
+	}
+
+	state.PaymentsCreatedGte = max(state.PaymentsCreatedGte, newestCreated)
+
+	if p.full {
+		state.LastFullSyncAt = &finishedAt
+	}
+
+	return state
+}
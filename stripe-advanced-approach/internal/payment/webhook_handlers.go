@@ -0,0 +1,282 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+/**
+* Webhook handler registry.
+*
+* Every supported stripe.EventType maps to a handler that applies a targeted update from the event payload
+* (one payment row, one subscription row, the matching entry in the customer's cache) instead of re-reading the
+* whole customer from stripe. When a targeted update fails the service falls back to a full customer sync, and
+* event types without a handler, like every event of a connected account, are acknowledged and ignored.
+**/
+
+type webhookEventHandler func(ctx context.Context, event *stripe.Event) error
+
+func (s *service) newWebhookHandlers() map[stripe.EventType]webhookEventHandler {
+	return map[stripe.EventType]webhookEventHandler{
+		// -- payments --
+		stripe.EventTypePaymentIntentSucceeded:     handleEventObject(s.handlePaymentIntentEvent),
+		stripe.EventTypePaymentIntentPaymentFailed: handleEventObject(s.handlePaymentIntentEvent),
+		stripe.EventTypePaymentIntentCanceled:      handleEventObject(s.handlePaymentIntentEvent),
+		stripe.EventTypeChargeRefunded:             handleEventObject(s.handleChargeRefunded),
+
+		// -- subscriptions --
+		stripe.EventTypeCustomerSubscriptionCreated:      handleEventObject(s.handleSubscriptionEvent),
+		stripe.EventTypeCustomerSubscriptionUpdated:      handleEventObject(s.handleSubscriptionEvent),
+		stripe.EventTypeCustomerSubscriptionDeleted:      handleEventObject(s.handleSubscriptionEvent),
+		stripe.EventTypeCustomerSubscriptionTrialWillEnd: handleEventObject(s.handleTrialWillEnd),
+		stripe.EventTypeInvoicePaid:                      handleEventObject(s.handleInvoiceEvent),
+		stripe.EventTypeInvoicePaymentFailed:             handleEventObject(s.handleInvoiceEvent),
+
+		// -- catalog --
+		stripe.EventTypeProductCreated: s.handleCatalogEvent,
+		stripe.EventTypeProductUpdated: s.handleCatalogEvent,
+		stripe.EventTypeProductDeleted: s.handleCatalogEvent,
+		stripe.EventTypePriceCreated:   s.handleCatalogEvent,
+		stripe.EventTypePriceUpdated:   s.handleCatalogEvent,
+		stripe.EventTypePriceDeleted:   s.handleCatalogEvent,
+	}
+}
+
+// decodes the event's object into its stripe type before calling the typed handler
+func handleEventObject[T any](handler func(ctx context.Context, event *stripe.Event, object *T) error) webhookEventHandler {
+	return func(ctx context.Context, event *stripe.Event) error {
+		var object T
+
+		if event.Data == nil {
+			return fmt.Errorf("event %s has no data", event.ID)
+		}
+
+		if err := json.Unmarshal(event.Data.Raw, &object); err != nil {
+			return fmt.Errorf("failed to decode %s event object: %w", event.Type, err)
+		}
+
+		return handler(ctx, event, &object)
+	}
+}
+
+/**
+* Versions of mirrored stripe state.
+*
+* Rows and cached fields are only replaced by state of an equal or newer version. Events carry stripe's clock in
+* whole seconds while reads and requests are timed by ours, so versions of our own are kept to whole seconds too:
+*
+* - an event's object reflects stripe's state as of the event's creation
+* - a read may miss a change made later in the same second, whose event has to win the tie: it is versioned just
+*   before its second
+* - a request's response reflects our own change, which is newer than the events already applied before it: it is
+*   versioned at its second
+**/
+
+func webhookEventTime(event *stripe.Event) time.Time {
+	return time.Unix(event.Created, 0).UTC()
+}
+
+func stripeReadVersion(readAt time.Time) time.Time {
+	return readAt.UTC().Truncate(time.Second).Add(-time.Microsecond)
+}
+
+func stripeRequestVersion(requestedAt time.Time) time.Time {
+	return requestedAt.UTC().Truncate(time.Second)
+}
+
+// --- payments ---
+
+func (s *service) handlePaymentIntentEvent(ctx context.Context, event *stripe.Event, intent *stripe.PaymentIntent) error {
+	if intent.Customer == nil {
+		return fmt.Errorf("payment intent %s has no customer", intent.ID)
+	}
+
+	customerId := intent.Customer.ID
+	eventAt := webhookEventTime(event)
+
+	userId, err := s.GetCachedUserIdByCustomerId(ctx, customerId)
+	if err != nil {
+		return err
+	}
+
+	err = s.repo.UpsertPayment(ctx, intent.ID, &Payment{
+		UserID:           userId,
+		StripeCustomerID: customerId,
+		StripeIntentID:   intent.ID,
+		Amount:           intent.Amount,
+		Status:           paymentIntentStatus(intent),
+		Currency:         string(intent.Currency),
+		LastEventAt:      &eventAt,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return s.patchCachedStripeData(ctx, customerId, eventAt, paymentField(intent.ID), func(*StripeCacheData) interface{} {
+		return &StripePaymentsCache{ID: intent.ID, Status: paymentIntentStatus(intent)}
+	})
+}
+
+func (s *service) handleChargeRefunded(ctx context.Context, event *stripe.Event, charge *stripe.Charge) error {
+	// refunds of charges outside of payment intents are not tracked
+	if charge.PaymentIntent == nil {
+		return nil
+	}
+
+	status := chargeRefundStatus(charge)
+	if status == "" {
+		return nil
+	}
+
+	eventAt := webhookEventTime(event)
+
+	if err := s.repo.UpdateStatus(ctx, charge.PaymentIntent.ID, status, eventAt); err != nil {
+		return err
+	}
+
+	if charge.Customer == nil {
+		return nil
+	}
+
+	return s.patchCachedStripeData(ctx, charge.Customer.ID, eventAt, paymentField(charge.PaymentIntent.ID), func(*StripeCacheData) interface{} {
+		return &StripePaymentsCache{ID: charge.PaymentIntent.ID, Status: status}
+	})
+}
+
+// --- subscriptions ---
+
+func (s *service) handleSubscriptionEvent(ctx context.Context, event *stripe.Event, sub *stripe.Subscription) error {
+	return s.applySubscription(ctx, sub, webhookEventTime(event))
+}
+
+/**
+* Mirrors the subscription about to leave its trial. Those without a payment method to charge, neither their own
+* nor the customer's default for invoices, are canceled when the trial ends: the subscription row records the notice
+* (TrialEndingNoticeAt) so the user can be asked for a card before it happens. Later notices finding one clear it.
+**/
+func (s *service) handleTrialWillEnd(ctx context.Context, event *stripe.Event, sub *stripe.Subscription) error {
+	eventAt := webhookEventTime(event)
+
+	if err := s.applySubscription(ctx, sub, eventAt); err != nil {
+		return err
+	}
+
+	chargeable, err := s.hasDefaultPaymentMethod(ctx, sub)
+	if err != nil {
+		return err
+	}
+
+	var noticeAt *time.Time
+
+	if !chargeable {
+		fmt.Printf("\nTrial of subscription %s ends at %s without a payment method, it will be canceled\n\n", sub.ID, time.Unix(sub.TrialEnd, 0).UTC())
+		noticeAt = &eventAt
+	}
+
+	return s.repo.SetTrialEndingNotice(ctx, sub.ID, noticeAt)
+}
+
+// whether stripe has a payment method to charge the subscription's invoices with
+func (s *service) hasDefaultPaymentMethod(ctx context.Context, sub *stripe.Subscription) (bool, error) {
+	if sub.DefaultPaymentMethod != nil {
+		return true, nil
+	}
+
+	customer, err := s.paymentProcessor.GetCustomer(ctx, sub.Customer.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get customer of subscription %s: %w", sub.ID, err)
+	}
+
+	return customer.InvoiceSettings != nil && customer.InvoiceSettings.DefaultPaymentMethod != nil, nil
+}
+
+/**
+* Invoices only reference their subscription, whose new state (e.g. active after paying, past_due after a failed
+* renewal) is read from stripe for just that subscription.
+**/
+func (s *service) handleInvoiceEvent(ctx context.Context, event *stripe.Event, invoice *stripe.Invoice) error {
+	if invoice.Parent == nil || invoice.Parent.SubscriptionDetails == nil || invoice.Parent.SubscriptionDetails.Subscription == nil {
+		// one-off invoices, their payments arrive as payment intent events
+		return nil
+	}
+
+	// the subscription is read after the event was sent, so it is at least as new as the event
+	readAt := stripeReadVersion(time.Now())
+	if eventAt := webhookEventTime(event); eventAt.After(readAt) {
+		readAt = eventAt
+	}
+
+	sub, err := s.paymentProcessor.GetSubscription(ctx, invoice.Parent.SubscriptionDetails.Subscription.ID)
+	if err != nil {
+		return err
+	}
+
+	return s.applySubscription(ctx, sub, readAt)
+}
+
+// mirrors the subscription as of seenAt into the database and cache
+func (s *service) applySubscription(ctx context.Context, sub *stripe.Subscription, seenAt time.Time) error {
+	if sub.Customer == nil {
+		return fmt.Errorf("subscription %s has no customer", sub.ID)
+	}
+
+	customerId := sub.Customer.ID
+
+	userId, err := s.GetCachedUserIdByCustomerId(ctx, customerId)
+	if err != nil {
+		return err
+	}
+
+	record := convertSubscriptionRecord(sub, userId, seenAt)
+
+	// the row and its items are replaced together, with the user's access when the subscription ended
+	err = s.unitOfWork.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.UpsertSubscriptionRecord(ctx, record); err != nil {
+			return err
+		}
+
+		if subscriptionEnded(record.Status) {
+			return s.unsubscribeIfAllEnded(ctx, userId, customerId)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	pmInfo := convertPaymentMethodInfo(sub.DefaultPaymentMethod)
+
+	return s.patchCachedStripeData(ctx, customerId, seenAt, subscriptionField(sub.ID), func(current *StripeCacheData) interface{} {
+		// webhook payloads don't expand the payment method, keep this subscription's one from the last full sync
+		for _, cached := range current.Subscriptions {
+			if pmInfo == nil && cached.SubscriptionID == sub.ID {
+				pmInfo = cached.PaymentMethod
+			}
+		}
+
+		return &StripeSubscriptionCache{
+			SubscriptionID:    sub.ID,
+			Status:            string(sub.Status),
+			PriceID:           record.StripePriceID,
+			CancelAtPeriodEnd: sub.CancelAtPeriodEnd,
+			PauseBehavior:     record.PauseBehavior,
+			PauseResumesAt:    record.PauseResumesAt,
+			TrialEnd:          currentTrialEnd(record.Status, record.TrialEnd),
+			PaymentMethod:     pmInfo,
+		}
+	})
+}
+
+// --- catalog ---
+
+// products and prices are only cached as a whole, any change drops the cached list
+func (s *service) handleCatalogEvent(ctx context.Context, event *stripe.Event) error {
+	return s.cacheClient.Del(ctx, s.keys.Products())
+}
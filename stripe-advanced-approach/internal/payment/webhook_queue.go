@@ -0,0 +1,349 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cachekey"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
+)
+
+/**
+* Asynchronous webhook processing.
+*
+* The webhook handler only verifies, persists and acknowledges an event, then the stored event id is pushed onto
+* a redis stream. A pool of workers in a consumer group processes the events:
+*
+* - success            → ack
+* - failure            → ack and re-schedule with exponential backoff (sorted set, moved back when due)
+* - too many failures  → ack and move to the dead-letter stream, where it can be listed and re-driven
+*
+* Entries of crashed workers stay pending in the group and are reclaimed after WebhookQueueConfig.ClaimIdle.
+**/
+
+type WebhookQueueConfig struct {
+	Stream           string
+	Group            string
+	DeadLetterStream string
+	RetryKey         string
+	Workers          int
+	MaxAttempts      int
+	BaseBackoff      time.Duration
+	MaxBackoff       time.Duration
+	ClaimIdle        time.Duration
+	BlockTimeout     time.Duration
+	RetryPoll        time.Duration
+}
+
+// keys are namespaced per deployment like every other key, see the cachekey package
+func DefaultWebhookQueueConfig() WebhookQueueConfig {
+	keys := cachekey.FromEnv()
+
+	return WebhookQueueConfig{
+		Stream:           keys.WebhookStream(),
+		Group:            keys.WebhookGroup(),
+		DeadLetterStream: keys.WebhookDeadLetter(),
+		RetryKey:         keys.WebhookRetry(),
+		Workers:          util.GetEnvAsInt("WEBHOOK_WORKERS", 4),
+		MaxAttempts:      util.GetEnvAsInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		BaseBackoff:      time.Duration(util.GetEnvAsInt("WEBHOOK_BASE_BACKOFF_SECONDS", 2)) * time.Second,
+		MaxBackoff:       time.Duration(util.GetEnvAsInt("WEBHOOK_MAX_BACKOFF_SECONDS", 600)) * time.Second,
+		ClaimIdle:        time.Minute,
+		BlockTimeout:     5 * time.Second,
+		RetryPoll:        time.Second,
+	}
+}
+
+// processes a webhook event that has already been stored, implemented by the payment service
+type StoredWebhookEventProcessor interface {
+	ProcessStoredWebhookEvent(ctx context.Context, stripeEventID string) error
+}
+
+// dead-lettered event as exposed to admins
+type WebhookDeadLetter struct {
+	ID            string    `json:"id"`
+	StripeEventID string    `json:"stripe_event_id"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error"`
+	FailedAt      time.Time `json:"failed_at"`
+}
+
+type WebhookQueue struct {
+	queue     interfaces.Queue
+	processor StoredWebhookEventProcessor
+	config    WebhookQueueConfig
+	consumer  string
+}
+
+// queue message fields
+const (
+	webhookFieldEventID  = "event_id"
+	webhookFieldAttempt  = "attempt"
+	webhookFieldError    = "error"
+	webhookFieldFailedAt = "failed_at"
+)
+
+func NewWebhookQueue(queue interfaces.Queue, processor StoredWebhookEventProcessor, config WebhookQueueConfig) *WebhookQueue {
+	hostname, _ := os.Hostname()
+
+	return &WebhookQueue{
+		queue:     queue,
+		processor: processor,
+		config:    config,
+		consumer:  fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+	}
+}
+
+/**
+* Pushes a stored event onto the stream for the workers to pick up.
+**/
+func (q *WebhookQueue) Enqueue(ctx context.Context, stripeEventID string) error {
+	return q.publish(ctx, stripeEventID, 1)
+}
+
+/**
+* Starts the worker pool, the retry scheduler and the stale entry reclaimer. Runs until ctx is canceled.
+**/
+func (q *WebhookQueue) Run(ctx context.Context) error {
+	if err := q.queue.EnsureGroup(ctx, q.config.Stream, q.config.Group); err != nil {
+		return fmt.Errorf("failed to create webhook consumer group: %w", err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < q.config.Workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			q.work(ctx, fmt.Sprintf("%s-%d", q.consumer, worker))
+		}(i)
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		q.scheduleRetries(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		q.reclaimStale(ctx)
+	}()
+
+	fmt.Printf("Webhook queue started with %d workers on stream %s\n", q.config.Workers, q.config.Stream)
+
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (q *WebhookQueue) ListDeadLetters(ctx context.Context, count int64) ([]WebhookDeadLetter, error) {
+	messages, err := q.queue.Range(ctx, q.config.DeadLetterStream, count)
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters := make([]WebhookDeadLetter, 0, len(messages))
+	for _, message := range messages {
+		deadLetters = append(deadLetters, toWebhookDeadLetter(message))
+	}
+
+	return deadLetters, nil
+}
+
+/**
+* Moves a dead-lettered event back onto the stream with a fresh attempt budget.
+**/
+func (q *WebhookQueue) Redrive(ctx context.Context, deadLetterID string) error {
+	message, err := q.queue.GetMessage(ctx, q.config.DeadLetterStream, deadLetterID)
+	if err != nil {
+		return fmt.Errorf("dead letter %s not found: %w", deadLetterID, err)
+	}
+
+	if err := q.Enqueue(ctx, message.Values[webhookFieldEventID]); err != nil {
+		return err
+	}
+
+	return q.queue.Remove(ctx, q.config.DeadLetterStream, deadLetterID)
+}
+
+// --- workers ---
+
+func (q *WebhookQueue) work(ctx context.Context, consumer string) {
+	for ctx.Err() == nil {
+		messages, err := q.queue.Consume(ctx, q.config.Stream, q.config.Group, consumer, 1, q.config.BlockTimeout)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			fmt.Printf("\nError when reading webhook stream: %+v\n\n", err)
+			sleepCtx(ctx, time.Second)
+			continue
+		}
+
+		for _, message := range messages {
+			q.handle(ctx, message)
+		}
+	}
+}
+
+func (q *WebhookQueue) handle(ctx context.Context, message interfaces.QueueMessage) {
+	stripeEventID := message.Values[webhookFieldEventID]
+	attempt, _ := strconv.Atoi(message.Values[webhookFieldAttempt])
+
+	processErr := q.processor.ProcessStoredWebhookEvent(ctx, stripeEventID)
+
+	if processErr != nil {
+		fmt.Printf("\nWebhook event %s failed on attempt %d: %+v\n\n", stripeEventID, attempt, processErr)
+
+		if err := q.retryOrDeadLetter(ctx, stripeEventID, attempt, processErr); err != nil {
+			// leave the entry pending, it will be reclaimed and tried again
+			fmt.Printf("\nError when re-scheduling webhook event %s: %+v\n\n", stripeEventID, err)
+			return
+		}
+	}
+
+	if err := q.queue.Ack(ctx, q.config.Stream, q.config.Group, message.ID); err != nil {
+		fmt.Printf("\nError when acknowledging webhook stream entry %s: %+v\n\n", message.ID, err)
+	}
+}
+
+func (q *WebhookQueue) retryOrDeadLetter(ctx context.Context, stripeEventID string, attempt int, processErr error) error {
+	if attempt >= q.config.MaxAttempts {
+		_, err := q.queue.Publish(ctx, q.config.DeadLetterStream, map[string]string{
+			webhookFieldEventID:  stripeEventID,
+			webhookFieldAttempt:  strconv.Itoa(attempt),
+			webhookFieldError:    processErr.Error(),
+			webhookFieldFailedAt: time.Now().UTC().Format(time.RFC3339),
+		})
+
+		return err
+	}
+
+	retry, err := json.Marshal(map[string]string{
+		webhookFieldEventID: stripeEventID,
+		webhookFieldAttempt: strconv.Itoa(attempt + 1),
+	})
+	if err != nil {
+		return err
+	}
+
+	backoff := webhookBackoff(attempt, q.config.BaseBackoff, q.config.MaxBackoff)
+
+	return q.queue.ScheduleAt(ctx, q.config.RetryKey, string(retry), time.Now().Add(backoff))
+}
+
+// moves retries back onto the stream once their backoff has passed
+func (q *WebhookQueue) scheduleRetries(ctx context.Context) {
+	ticker := time.NewTicker(q.config.RetryPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		due, err := q.queue.PopDue(ctx, q.config.RetryKey, time.Now(), 100)
+		if err != nil {
+			fmt.Printf("\nError when reading due webhook retries: %+v\n\n", err)
+			continue
+		}
+
+		for _, member := range due {
+			var retry map[string]string
+			if err := json.Unmarshal([]byte(member), &retry); err != nil {
+				fmt.Printf("\nDropping malformed webhook retry %q: %+v\n\n", member, err)
+				continue
+			}
+
+			attempt, _ := strconv.Atoi(retry[webhookFieldAttempt])
+
+			if err := q.publish(ctx, retry[webhookFieldEventID], attempt); err != nil {
+				// put it back so it is not lost
+				fmt.Printf("\nError when re-publishing webhook retry: %+v\n\n", err)
+				q.queue.ScheduleAt(ctx, q.config.RetryKey, member, time.Now().Add(q.config.BaseBackoff))
+			}
+		}
+	}
+}
+
+// takes over entries left pending by workers that died mid-processing
+func (q *WebhookQueue) reclaimStale(ctx context.Context) {
+	ticker := time.NewTicker(q.config.ClaimIdle)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		messages, err := q.queue.ClaimStale(ctx, q.config.Stream, q.config.Group, q.consumer+"-reclaim", q.config.ClaimIdle, 10)
+		if err != nil {
+			fmt.Printf("\nError when reclaiming stale webhook entries: %+v\n\n", err)
+			continue
+		}
+
+		for _, message := range messages {
+			q.handle(ctx, message)
+		}
+	}
+}
+
+func (q *WebhookQueue) publish(ctx context.Context, stripeEventID string, attempt int) error {
+	_, err := q.queue.Publish(ctx, q.config.Stream, map[string]string{
+		webhookFieldEventID: stripeEventID,
+		webhookFieldAttempt: strconv.Itoa(attempt),
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to enqueue webhook event %s: %w", stripeEventID, err)
+	}
+
+	return nil
+}
+
+/**
+* Exponential backoff for the given (1-based) attempt: base, 2*base, 4*base ... capped at max.
+**/
+func webhookBackoff(attempt int, base time.Duration, max time.Duration) time.Duration {
+	backoff := base
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+
+		if backoff >= max {
+			return max
+		}
+	}
+
+	return backoff
+}
+
+func toWebhookDeadLetter(message interfaces.QueueMessage) WebhookDeadLetter {
+	attempts, _ := strconv.Atoi(message.Values[webhookFieldAttempt])
+	failedAt, _ := time.Parse(time.RFC3339, message.Values[webhookFieldFailedAt])
+
+	return WebhookDeadLetter{
+		ID:            message.ID,
+		StripeEventID: message.Values[webhookFieldEventID],
+		Attempts:      attempts,
+		LastError:     message.Values[webhookFieldError],
+		FailedAt:      failedAt,
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
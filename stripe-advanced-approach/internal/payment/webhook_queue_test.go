@@ -0,0 +1,110 @@
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyProcessor fails every event until it has been called failures times
+type flakyProcessor struct {
+	mu       sync.Mutex
+	failures int
+	calls    map[string]int
+}
+
+func (p *flakyProcessor) ProcessStoredWebhookEvent(ctx context.Context, stripeEventID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.calls[stripeEventID]++
+	if p.calls[stripeEventID] <= p.failures {
+		return errors.New("sync failed")
+	}
+
+	return nil
+}
+
+func (p *flakyProcessor) Calls(stripeEventID string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.calls[stripeEventID]
+}
+
+func fastWebhookQueueConfig() payment.WebhookQueueConfig {
+	config := payment.DefaultWebhookQueueConfig()
+	config.Workers = 2
+	config.MaxAttempts = 3
+	config.BaseBackoff = 5 * time.Millisecond
+	config.MaxBackoff = 20 * time.Millisecond
+	config.BlockTimeout = 20 * time.Millisecond
+	config.RetryPoll = 5 * time.Millisecond
+
+	return config
+}
+
+// TestWebhookQueueRetriesUntilSuccess checks failed events are retried with backoff and stop once processed
+func TestWebhookQueueRetriesUntilSuccess(t *testing.T) {
+	queue := testutil.NewFakeQueue()
+	processor := &flakyProcessor{failures: 2, calls: make(map[string]int)}
+	config := fastWebhookQueueConfig()
+
+	webhookQueue := payment.NewWebhookQueue(queue, processor, config)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go webhookQueue.Run(ctx)
+
+	require.NoError(t, webhookQueue.Enqueue(ctx, "evt_retry"))
+
+	require.Eventually(t, func() bool {
+		return processor.Calls("evt_retry") == 3
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// no further attempts after the successful one
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 3, processor.Calls("evt_retry"))
+	assert.Equal(t, 0, queue.Len(config.DeadLetterStream))
+}
+
+// TestWebhookQueueDeadLetterAndRedrive checks events that exhaust their attempts are dead-lettered and can be re-driven
+func TestWebhookQueueDeadLetterAndRedrive(t *testing.T) {
+	queue := testutil.NewFakeQueue()
+	processor := &flakyProcessor{failures: 3, calls: make(map[string]int)}
+	config := fastWebhookQueueConfig()
+
+	webhookQueue := payment.NewWebhookQueue(queue, processor, config)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go webhookQueue.Run(ctx)
+
+	require.NoError(t, webhookQueue.Enqueue(ctx, "evt_dead"))
+
+	require.Eventually(t, func() bool {
+		return queue.Len(config.DeadLetterStream) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	deadLetters, err := webhookQueue.ListDeadLetters(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 1)
+	assert.Equal(t, "evt_dead", deadLetters[0].StripeEventID)
+	assert.Equal(t, config.MaxAttempts, deadLetters[0].Attempts)
+	assert.Equal(t, "sync failed", deadLetters[0].LastError)
+
+	// the processor recovers, re-driving processes the event once more
+	require.NoError(t, webhookQueue.Redrive(ctx, deadLetters[0].ID))
+
+	require.Eventually(t, func() bool {
+		return processor.Calls("evt_dead") == 4
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, queue.Len(config.DeadLetterStream))
+}
@@ -0,0 +1,104 @@
+package payment
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+/**
+* Webhook signature verification.
+*
+* Each stripe webhook endpoint (the platform one and the one for connected accounts) has its own signing secrets.
+* Every endpoint accepts a comma separated list of active secrets so a secret can be rotated without downtime:
+*
+* 1. roll the secret in the stripe dashboard, stripe signs with both for a while
+* 2. add the new secret to the list, deploy
+* 3. remove the old secret once it has expired
+*
+* Which secret matched is counted per endpoint (expvar "stripe_webhook_signatures", e.g. "platform.secret_1"),
+* so it is visible when nothing is verified against the old secret anymore.
+**/
+
+type WebhookEndpoint string
+
+const (
+	WebhookEndpointPlatform WebhookEndpoint = "platform"
+	WebhookEndpointConnect  WebhookEndpoint = "connect"
+)
+
+// returned when none of the endpoint's secrets produced the signature
+var ErrWebhookSignatureInvalid = errors.New("webhook signature does not match any active secret")
+
+var webhookSignatureMetrics = expvar.NewMap("stripe_webhook_signatures")
+
+/**
+* Active signing secrets of an endpoint, in order of preference.
+*
+* - platform: STRIPE_WEBHOOK_SECRETS, falling back to the single STRIPE_WEBHOOK_SECRET
+* - connect:  STRIPE_CONNECT_WEBHOOK_SECRETS
+**/
+func webhookSecrets(endpoint WebhookEndpoint) []string {
+	var value string
+
+	switch endpoint {
+	case WebhookEndpointPlatform:
+		value = util.GetEnv("STRIPE_WEBHOOK_SECRETS", os.Getenv("STRIPE_WEBHOOK_SECRET"))
+	case WebhookEndpointConnect:
+		value = os.Getenv("STRIPE_CONNECT_WEBHOOK_SECRETS")
+	}
+
+	var secrets []string
+	for _, secret := range strings.Split(value, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return secrets
+}
+
+// how old a signature may be before it is rejected, guards against replayed deliveries
+func webhookTolerance() time.Duration {
+	seconds := util.GetEnvAsInt("STRIPE_WEBHOOK_TOLERANCE_SECONDS", int(webhook.DefaultTolerance/time.Second))
+	return time.Duration(seconds) * time.Second
+}
+
+/**
+* Verifies the payload against every active secret of the endpoint and constructs the event.
+**/
+func VerifyWebhookEvent(endpoint WebhookEndpoint, payload []byte, signature string) (stripe.Event, error) {
+	secrets := webhookSecrets(endpoint)
+
+	if len(secrets) == 0 {
+		webhookSignatureMetrics.Add(fmt.Sprintf("%s.unconfigured", endpoint), 1)
+		return stripe.Event{}, fmt.Errorf("no webhook secrets configured for the %s endpoint", endpoint)
+	}
+
+	options := webhook.ConstructEventOptions{Tolerance: webhookTolerance()}
+
+	for index, secret := range secrets {
+		event, err := webhook.ConstructEventWithOptions(payload, signature, secret, options)
+
+		if err == nil {
+			webhookSignatureMetrics.Add(fmt.Sprintf("%s.secret_%d", endpoint, index), 1)
+			return event, nil
+		}
+
+		// any other failure (too old, malformed header, api version) is the same for every secret
+		if !errors.Is(err, webhook.ErrNoValidSignature) {
+			webhookSignatureMetrics.Add(fmt.Sprintf("%s.rejected", endpoint), 1)
+			return stripe.Event{}, err
+		}
+	}
+
+	webhookSignatureMetrics.Add(fmt.Sprintf("%s.invalid", endpoint), 1)
+	return stripe.Event{}, ErrWebhookSignatureInvalid
+}
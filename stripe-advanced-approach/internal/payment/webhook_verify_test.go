@@ -0,0 +1,87 @@
+package payment_test
+
+import (
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+func signedTestEvent(t *testing.T, secret string, timestamp time.Time) ([]byte, string) {
+	t.Helper()
+
+	payload := []byte(fmt.Sprintf(`{"id":"evt_verify","object":"event","type":"payment_intent.succeeded","api_version":%q,"data":{"object":{}}}`, stripe.APIVersion))
+
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload:   payload,
+		Secret:    secret,
+		Timestamp: timestamp,
+	})
+
+	return signed.Payload, signed.Header
+}
+
+func signatureCount(key string) int64 {
+	metric := expvar.Get("stripe_webhook_signatures").(*expvar.Map).Get(key)
+	if metric == nil {
+		return 0
+	}
+
+	return metric.(*expvar.Int).Value()
+}
+
+// TestVerifyWebhookEventDuringRotation checks both the old and new secret verify while a rotation is in progress
+func TestVerifyWebhookEventDuringRotation(t *testing.T) {
+	t.Setenv("STRIPE_WEBHOOK_SECRETS", "whsec_new, whsec_old")
+
+	before := signatureCount("platform.secret_1")
+
+	payload, header := signedTestEvent(t, "whsec_old", time.Now())
+	event, err := payment.VerifyWebhookEvent(payment.WebhookEndpointPlatform, payload, header)
+	require.NoError(t, err)
+	assert.Equal(t, "evt_verify", event.ID)
+	assert.Equal(t, before+1, signatureCount("platform.secret_1"))
+
+	payload, header = signedTestEvent(t, "whsec_new", time.Now())
+	_, err = payment.VerifyWebhookEvent(payment.WebhookEndpointPlatform, payload, header)
+	require.NoError(t, err)
+
+	payload, header = signedTestEvent(t, "whsec_unknown", time.Now())
+	_, err = payment.VerifyWebhookEvent(payment.WebhookEndpointPlatform, payload, header)
+	assert.ErrorIs(t, err, payment.ErrWebhookSignatureInvalid)
+}
+
+// TestVerifyWebhookEventPerEndpoint checks secrets of one endpoint are not accepted by the other
+func TestVerifyWebhookEventPerEndpoint(t *testing.T) {
+	t.Setenv("STRIPE_WEBHOOK_SECRETS", "")
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "whsec_platform")
+	t.Setenv("STRIPE_CONNECT_WEBHOOK_SECRETS", "whsec_connect")
+
+	payload, header := signedTestEvent(t, "whsec_connect", time.Now())
+
+	_, err := payment.VerifyWebhookEvent(payment.WebhookEndpointConnect, payload, header)
+	require.NoError(t, err)
+
+	_, err = payment.VerifyWebhookEvent(payment.WebhookEndpointPlatform, payload, header)
+	assert.ErrorIs(t, err, payment.ErrWebhookSignatureInvalid)
+}
+
+// TestVerifyWebhookEventTolerance checks the configurable tolerance for signature age
+func TestVerifyWebhookEventTolerance(t *testing.T) {
+	t.Setenv("STRIPE_WEBHOOK_SECRETS", "whsec_tolerance")
+	t.Setenv("STRIPE_WEBHOOK_TOLERANCE_SECONDS", "60")
+
+	payload, header := signedTestEvent(t, "whsec_tolerance", time.Now().Add(-2*time.Minute))
+	_, err := payment.VerifyWebhookEvent(payment.WebhookEndpointPlatform, payload, header)
+	assert.ErrorIs(t, err, webhook.ErrTooOld)
+
+	t.Setenv("STRIPE_WEBHOOK_TOLERANCE_SECONDS", "600")
+	_, err = payment.VerifyWebhookEvent(payment.WebhookEndpointPlatform, payload, header)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,210 @@
+package pgnotify
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
+	"github.com/lib/pq"
+)
+
+/**
+* Customer change notifications from postgres.
+*
+* Triggers on users, subscriptions and payments NOTIFY a channel with the stripe customer id of rows changed outside
+* the application (migration 000015). The Listener hands each customer to its handler once the customer's
+* notifications settle for Debounce, so a bulk fix touching many rows is handled once. Failed handlers are retried
+* with exponential backoff up to MaxAttempts.
+*
+* The connection is re-established by lib/pq, waiting from MinReconnect doubling up to MaxReconnect between
+* attempts. Notifications sent while it is down are lost, that is counted and left to the consistency check.
+*
+* Counted in expvar "customer_change_notifications": received, handled, failed, dropped (out of attempts),
+* disconnects and reconnects.
+**/
+
+var metrics = expvar.NewMap("customer_change_notifications")
+
+// what a customer's change is handed to
+type Handler func(ctx context.Context, customerId string) error
+
+type ListenerConfig struct {
+	Channel      string
+	Debounce     time.Duration
+	MaxAttempts  int
+	MinReconnect time.Duration
+	MaxReconnect time.Duration
+	// lib/pq recommends pinging idle listeners to notice dead connections
+	PingInterval time.Duration
+}
+
+func DefaultListenerConfig() ListenerConfig {
+	return ListenerConfig{
+		Channel:      "customer_changed",
+		Debounce:     time.Duration(util.GetEnvAsInt("CUSTOMER_CHANGE_DEBOUNCE_MS", 500)) * time.Millisecond,
+		MaxAttempts:  util.GetEnvAsInt("CUSTOMER_CHANGE_MAX_ATTEMPTS", 5),
+		MinReconnect: time.Second,
+		MaxReconnect: time.Minute,
+		PingInterval: 90 * time.Second,
+	}
+}
+
+// the connection notifications arrive on, implemented by *pq.Listener
+type Connection interface {
+	Listen(channel string) error
+	NotificationChannel() <-chan *pq.Notification
+	Ping() error
+	Close() error
+}
+
+type Listener struct {
+	connect func() Connection
+	config  ListenerConfig
+	handler Handler
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer // customers waiting for their debounce window
+}
+
+func NewListener(dsn string, config ListenerConfig, handler Handler) *Listener {
+	return NewListenerOn(func() Connection {
+		return pq.NewListener(dsn, config.MinReconnect, config.MaxReconnect, func(event pq.ListenerEventType, err error) {
+			switch event {
+			case pq.ListenerEventDisconnected:
+				metrics.Add("disconnects", 1)
+				fmt.Printf("\nCustomer change listener disconnected, changes until it reconnects are missed: %+v\n\n", err)
+			case pq.ListenerEventReconnected:
+				metrics.Add("reconnects", 1)
+			case pq.ListenerEventConnectionAttemptFailed:
+				fmt.Printf("\nError when connecting the customer change listener: %+v\n\n", err)
+			}
+		})
+	}, config, handler)
+}
+
+// listener on connections made by connect, which reconnect on their own
+func NewListenerOn(connect func() Connection, config ListenerConfig, handler Handler) *Listener {
+	return &Listener{
+		connect: connect,
+		config:  config,
+		handler: handler,
+		pending: map[string]*time.Timer{},
+	}
+}
+
+/**
+* Listens until ctx is canceled. Only fails when the channel can't be listened on at all, connection losses are
+* reconnected.
+**/
+func (l *Listener) Run(ctx context.Context) error {
+	listener := l.connect()
+
+	// also unblocks Listen while it waits for a connection
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stop()
+
+	if err := listener.Listen(l.config.Channel); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		listener.Close()
+		return fmt.Errorf("failed to listen on %s: %w", l.config.Channel, err)
+	}
+
+	defer l.stopPending()
+
+	pings := time.NewTicker(l.config.PingInterval)
+	defer pings.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case notification, open := <-listener.NotificationChannel():
+			if !open {
+				return ctx.Err()
+			}
+
+			// sent after a reconnect
+			if notification == nil {
+				continue
+			}
+
+			metrics.Add("received", 1)
+			l.schedule(ctx, notification.Extra, l.config.Debounce, 1)
+
+		case <-pings.C:
+			go func() {
+				if err := listener.Ping(); err != nil {
+					fmt.Printf("\nError when pinging the customer change listener: %+v\n\n", err)
+				}
+			}()
+		}
+	}
+}
+
+// (re)starts the customer's wait, later notifications push it back
+func (l *Listener) schedule(ctx context.Context, customerId string, delay time.Duration, attempt int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if timer, exists := l.pending[customerId]; exists {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		l.mu.Lock()
+		if l.pending[customerId] == timer {
+			delete(l.pending, customerId)
+		}
+		l.mu.Unlock()
+
+		l.handle(ctx, customerId, attempt)
+	})
+
+	l.pending[customerId] = timer
+}
+
+func (l *Listener) handle(ctx context.Context, customerId string, attempt int) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	err := l.handler(ctx, customerId)
+
+	if err == nil {
+		metrics.Add("handled", 1)
+		return
+	}
+
+	metrics.Add("failed", 1)
+
+	if attempt >= l.config.MaxAttempts {
+		metrics.Add("dropped", 1)
+		fmt.Printf("\nError when handling change of customer %s, giving up after %d attempts: %+v\n\n", customerId, attempt, err)
+		return
+	}
+
+	backoff := l.config.Debounce << attempt
+	fmt.Printf("\nError when handling change of customer %s, retrying in %s: %+v\n\n", customerId, backoff, err)
+
+	l.schedule(ctx, customerId, backoff, attempt+1)
+}
+
+func (l *Listener) stopPending() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for customerId, timer := range l.pending {
+		timer.Stop()
+		delete(l.pending, customerId)
+	}
+}
@@ -0,0 +1,164 @@
+package pgnotify_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/pgnotify"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connection whose notifications are sent by the test
+type fakeConnection struct {
+	notifications chan *pq.Notification
+	pings         atomic.Int32
+	closeOnce     sync.Once
+}
+
+func newFakeConnection() *fakeConnection {
+	return &fakeConnection{notifications: make(chan *pq.Notification, 64)}
+}
+
+func (c *fakeConnection) Listen(channel string) error { return nil }
+
+func (c *fakeConnection) NotificationChannel() <-chan *pq.Notification { return c.notifications }
+
+func (c *fakeConnection) Ping() error {
+	c.pings.Add(1)
+	return nil
+}
+
+func (c *fakeConnection) Close() error {
+	c.closeOnce.Do(func() { close(c.notifications) })
+	return nil
+}
+
+func (c *fakeConnection) notify(customerId string) {
+	c.notifications <- &pq.Notification{Channel: "customer_changed", Extra: customerId}
+}
+
+// handler counting its calls per customer, failing the first failures of each
+type countingHandler struct {
+	mu       sync.Mutex
+	calls    map[string]int
+	failures int
+}
+
+func (h *countingHandler) handle(ctx context.Context, customerId string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.calls[customerId]++
+
+	if h.calls[customerId] <= h.failures {
+		return errors.New("sync failed")
+	}
+
+	return nil
+}
+
+func (h *countingHandler) count(customerId string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.calls[customerId]
+}
+
+func testConfig() pgnotify.ListenerConfig {
+	config := pgnotify.DefaultListenerConfig()
+	config.Debounce = 30 * time.Millisecond
+	config.MaxAttempts = 3
+	config.PingInterval = time.Hour
+
+	return config
+}
+
+// runListener runs a listener on conn until the test ends
+func runListener(t *testing.T, conn *fakeConnection, config pgnotify.ListenerConfig, handler pgnotify.Handler) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	listener := pgnotify.NewListenerOn(func() pgnotify.Connection { return conn }, config, handler)
+	go func() { done <- listener.Run(ctx) }()
+
+	t.Cleanup(func() {
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+	})
+}
+
+// TestListenerDebouncesCustomerChanges checks a burst of notifications of a customer is handled once
+func TestListenerDebouncesCustomerChanges(t *testing.T) {
+	conn := newFakeConnection()
+	handler := &countingHandler{calls: map[string]int{}}
+	runListener(t, conn, testConfig(), handler.handle)
+
+	for range 10 {
+		conn.notify("cus_bulk")
+	}
+	conn.notify("cus_other")
+
+	require.Eventually(t, func() bool {
+		return handler.count("cus_bulk") == 1 && handler.count("cus_other") == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// nothing is left waiting
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, handler.count("cus_bulk"))
+	assert.Equal(t, 1, handler.count("cus_other"))
+}
+
+// TestListenerRetriesFailedHandler checks failures are retried until the handler succeeds
+func TestListenerRetriesFailedHandler(t *testing.T) {
+	conn := newFakeConnection()
+	handler := &countingHandler{calls: map[string]int{}, failures: 2}
+	runListener(t, conn, testConfig(), handler.handle)
+
+	conn.notify("cus_flaky")
+
+	require.Eventually(t, func() bool {
+		return handler.count("cus_flaky") == 3
+	}, 2*time.Second, 5*time.Millisecond)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 3, handler.count("cus_flaky"), "no more attempts after a success")
+}
+
+// TestListenerGivesUpAfterMaxAttempts checks a handler that keeps failing is dropped after MaxAttempts
+func TestListenerGivesUpAfterMaxAttempts(t *testing.T) {
+	conn := newFakeConnection()
+	handler := &countingHandler{calls: map[string]int{}, failures: 100}
+	config := testConfig()
+	runListener(t, conn, config, handler.handle)
+
+	conn.notify("cus_broken")
+
+	require.Eventually(t, func() bool {
+		return handler.count("cus_broken") == config.MaxAttempts
+	}, 2*time.Second, 5*time.Millisecond)
+
+	// the last backoff would have been Debounce << MaxAttempts
+	time.Sleep(config.Debounce << (config.MaxAttempts + 1))
+	assert.Equal(t, config.MaxAttempts, handler.count("cus_broken"))
+}
+
+// TestListenerPingsIdleConnection checks the connection is pinged every PingInterval while nothing arrives
+func TestListenerPingsIdleConnection(t *testing.T) {
+	conn := newFakeConnection()
+	handler := &countingHandler{calls: map[string]int{}}
+	config := testConfig()
+	config.PingInterval = 10 * time.Millisecond
+	runListener(t, conn, config, handler.handle)
+
+	require.Eventually(t, func() bool {
+		return conn.pings.Load() >= 3
+	}, time.Second, 5*time.Millisecond)
+}
@@ -4,8 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cache"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/util"
 	redislib "github.com/redis/go-redis/v9"
 )
@@ -55,7 +60,13 @@ func (c *Client) Set(ctx context.Context, key string, value interface{}, expirat
 }
 
 func (c *Client) Get(ctx context.Context, key string) (string, error) {
-	return c.rdb.Get(ctx, key).Result()
+	value, err := c.rdb.Get(ctx, key).Result()
+
+	if err == redislib.Nil {
+		return "", interfaces.ErrCacheMiss
+	}
+
+	return value, err
 }
 
 func (c *Client) Del(ctx context.Context, keys ...string) error {
@@ -67,6 +78,351 @@ func (c *Client) SetNX(ctx context.Context, key string, value interface{}, expir
 	return result.Val(), result.Err()
 }
 
+// only replaces the stored value when its version is not newer, atomically. versions of values framed by the
+// codec package (format byte 1 or 2) follow as 16 hex digits, JSON values carry a top-level "version"
+var setIfNewerScript = redislib.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current then
+	local version
+	local format = string.byte(current, 1)
+	if format == 1 or format == 2 then
+		version = tonumber(string.sub(current, 2, 17), 16)
+	else
+		local ok, decoded = pcall(cjson.decode, current)
+		if ok and type(decoded) == 'table' then
+			version = tonumber(decoded['version'])
+		end
+	end
+	if version and version > tonumber(ARGV[2]) then
+		return 0
+	end
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+/**
+* Ordering guard for cached stripe state: value must be encoded by the codec package with version (keep it below
+* 2^53, lua numbers are doubles), it is only stored when the cached version is not newer.
+**/
+func (c *Client) SetIfNewer(ctx context.Context, key string, value []byte, version int64, expiration time.Duration) (bool, error) {
+	stored, err := setIfNewerScript.Run(ctx, c.rdb, []string{key}, value, version, expiration.Milliseconds()).Int()
+
+	if err != nil {
+		return false, err
+	}
+
+	return stored == 1, nil
+}
+
+/**
+* Hashes written a field at a time: the version of each field is kept next to it as "#v:{field}", deleted fields
+* keep theirs until a replacement of their pattern drops them, which leaves its version as "#floor:{pattern}" for
+* every field of the pattern without one. Versions must stay below 2^53 like for SetIfNewer.
+**/
+
+const hashVersionPrefix = "#v:"
+
+// ARGV: version, expiration, number of fields set, number of fields deleted, then field / value pairs, the fields
+// to delete and the patterns to replace
+var hSetIfNewerScript = redislib.NewScript(`
+local version = tonumber(ARGV[1])
+local sets = tonumber(ARGV[3])
+local deletesFrom = 5 + sets * 2
+local replaceFrom = deletesFrom + tonumber(ARGV[4])
+
+local function matches(field, pattern)
+	if string.sub(pattern, -1) == '*' then
+		return string.sub(field, 1, #pattern - 1) == string.sub(pattern, 1, -2)
+	end
+	return field == pattern
+end
+
+-- the version the field was written with, or the newest replacement of a pattern selecting it
+local function current(field)
+	local written = tonumber(redis.call('HGET', KEYS[1], '#v:' .. field))
+	if written then
+		return written
+	end
+	local floors = {'#floor:' .. field}
+	for j = 0, #field do
+		table.insert(floors, '#floor:' .. string.sub(field, 1, j) .. '*')
+	end
+	local floor
+	for _, value in ipairs(redis.call('HMGET', KEYS[1], unpack(floors))) do
+		if value and (not floor or tonumber(value) > floor) then
+			floor = tonumber(value)
+		end
+	end
+	return floor
+end
+
+local written = {}
+local listed = {}
+for i = 5, replaceFrom - 1 do
+	local deleting = i >= deletesFrom
+	if deleting or (i - 5) % 2 == 0 then
+		local field = ARGV[i]
+		listed[field] = true
+		local currentVersion = current(field)
+		if not currentVersion or currentVersion <= version then
+			if deleting then
+				redis.call('HDEL', KEYS[1], field)
+				redis.call('HSET', KEYS[1], '#v:' .. field, ARGV[1])
+			else
+				redis.call('HSET', KEYS[1], field, ARGV[i + 1], '#v:' .. field, ARGV[1])
+			end
+			table.insert(written, field)
+		end
+	end
+end
+
+if replaceFrom <= #ARGV then
+	local names = redis.call('HKEYS', KEYS[1])
+	local present = {}
+	for _, name in ipairs(names) do
+		present[name] = true
+	end
+	for _, name in ipairs(names) do
+		local versioned = string.sub(name, 1, 3) == '#v:'
+		local field = versioned and string.sub(name, 4) or name
+		local selected = false
+		if versioned or string.sub(name, 1, 1) ~= '#' then
+			for i = replaceFrom, #ARGV do
+				selected = selected or matches(field, ARGV[i])
+			end
+		end
+		local fieldVersion = tonumber(redis.call('HGET', KEYS[1], '#v:' .. field))
+		if selected and (not fieldVersion or fieldVersion <= version) then
+			if not versioned and not listed[field] then
+				-- not part of the replacement
+				redis.call('HDEL', KEYS[1], field, '#v:' .. field)
+				table.insert(written, field)
+			elseif versioned and not present[field] then
+				-- deleted, the floor keeps older writes out
+				redis.call('HDEL', KEYS[1], name)
+			end
+		end
+	end
+	for i = replaceFrom, #ARGV do
+		local floor = tonumber(redis.call('HGET', KEYS[1], '#floor:' .. ARGV[i]))
+		if not floor or floor < version then
+			redis.call('HSET', KEYS[1], '#floor:' .. ARGV[i], ARGV[1])
+		end
+	end
+end
+
+if (#written > 0 or replaceFrom <= #ARGV) and tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return written
+`)
+
+/**
+* Named fields are read with their versions by one HMGET, selections with patterns read the whole hash, which only
+* holds the live fields and their versions once full syncs replaced it.
+**/
+func (c *Client) HGet(ctx context.Context, key string, fields ...string) (map[string]interfaces.HashField, error) {
+	if len(fields) == 0 || slices.ContainsFunc(fields, func(field string) bool { return strings.HasSuffix(field, "*") }) {
+		return c.hGetAll(ctx, key, fields)
+	}
+
+	names := make([]string, 0, len(fields)*2)
+	for _, field := range fields {
+		names = append(names, field, hashVersionPrefix+field)
+	}
+
+	var exists *redislib.IntCmd
+	var values *redislib.SliceCmd
+
+	_, err := c.rdb.TxPipelined(ctx, func(pipe redislib.Pipeliner) error {
+		exists = pipe.Exists(ctx, key)
+		values = pipe.HMGet(ctx, key, names...)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if exists.Val() == 0 {
+		return nil, interfaces.ErrCacheMiss
+	}
+
+	hash := make(map[string]interfaces.HashField, len(fields))
+
+	for index, field := range fields {
+		value, found := values.Val()[index*2].(string)
+		if !found {
+			continue
+		}
+
+		version, err := parseHashVersion(key, field, values.Val()[index*2+1])
+		if err != nil {
+			return nil, err
+		}
+
+		hash[field] = interfaces.HashField{Value: value, Version: version}
+	}
+
+	return hash, nil
+}
+
+func (c *Client) hGetAll(ctx context.Context, key string, fields []string) (map[string]interfaces.HashField, error) {
+	all, err := c.rdb.HGetAll(ctx, key).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(all) == 0 {
+		return nil, interfaces.ErrCacheMiss
+	}
+
+	hash := map[string]interfaces.HashField{}
+
+	for field, value := range all {
+		if strings.HasPrefix(field, "#") || !cache.FieldSelected(field, fields) {
+			continue
+		}
+
+		version, err := parseHashVersion(key, field, all[hashVersionPrefix+field])
+		if err != nil {
+			return nil, err
+		}
+
+		hash[field] = interfaces.HashField{Value: value, Version: version}
+	}
+
+	return hash, nil
+}
+
+// fields written before versions were kept count as version 0
+func parseHashVersion(key string, field string, stored interface{}) (int64, error) {
+	encoded, ok := stored.(string)
+	if !ok || encoded == "" {
+		return 0, nil
+	}
+
+	version, err := strconv.ParseInt(encoded, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid version of field %s of %s: %w", field, key, err)
+	}
+
+	return version, nil
+}
+
+func (c *Client) HSetIfNewer(ctx context.Context, key string, fields map[string][]byte, version int64, expiration time.Duration) ([]string, error) {
+	return c.HReplaceIfNewer(ctx, key, fields, nil, version, expiration)
+}
+
+func (c *Client) HReplaceIfNewer(ctx context.Context, key string, fields map[string][]byte, replace []string, version int64, expiration time.Duration) ([]string, error) {
+	var sets, deletes []interface{}
+
+	for field, value := range fields {
+		if value == nil {
+			deletes = append(deletes, field)
+		} else {
+			sets = append(sets, field, value)
+		}
+	}
+
+	args := append([]interface{}{version, expiration.Milliseconds(), len(sets) / 2, len(deletes)}, sets...)
+	args = append(args, deletes...)
+
+	for _, pattern := range replace {
+		args = append(args, pattern)
+	}
+
+	return hSetIfNewerScript.Run(ctx, c.rdb, []string{key}, args...).StringSlice()
+}
+
+// only touches keys still holding the given value, e.g. a lock that wasn't taken over after its lease expired
+var expireIfEqualScript = redislib.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var delIfEqualScript = redislib.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// ExpireIfEqual renews the expiration of a key as long as it still holds value
+func (c *Client) ExpireIfEqual(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	renewed, err := expireIfEqualScript.Run(ctx, c.rdb, []string{key}, value, expiration.Milliseconds()).Int()
+
+	if err != nil {
+		return false, err
+	}
+
+	return renewed == 1, nil
+}
+
+// DelIfEqual deletes a key as long as it still holds value
+func (c *Client) DelIfEqual(ctx context.Context, key string, value string) (bool, error) {
+	deleted, err := delIfEqualScript.Run(ctx, c.rdb, []string{key}, value).Int()
+
+	if err != nil {
+		return false, err
+	}
+
+	return deleted == 1, nil
+}
+
+func (c *Client) Broadcast(ctx context.Context, channel string, message string) error {
+	return c.rdb.Publish(ctx, channel, message).Err()
+}
+
+/**
+* Forwards the payloads published on channel until ctx is done. The returned channel is closed when the connection
+* drops, as messages published meanwhile are lost the caller has to resubscribe and catch up.
+**/
+func (c *Client) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	pubsub := c.rdb.Subscribe(ctx, channel)
+
+	// wait for the subscription to be confirmed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", channel, err)
+	}
+
+	messages := make(chan string)
+
+	go func() {
+		defer close(messages)
+		defer pubsub.Close()
+
+		for {
+			// unlike pubsub.Channel() this reports dropped connections instead of silently reconnecting
+			message, err := pubsub.ReceiveMessage(ctx)
+
+			if err != nil {
+				if ctx.Err() == nil {
+					fmt.Printf("\nError when receiving from %s: %+v\n\n", channel, err)
+				}
+				return
+			}
+
+			select {
+			case messages <- message.Payload:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return messages, nil
+}
+
 func (c *Client) Pipeline() redislib.Pipeliner {
 	return c.rdb.Pipeline()
 }
@@ -109,39 +465,3 @@ func (c *Client) GetJSON(ctx context.Context, key string, dest interface{}) erro
 
 	return json.Unmarshal([]byte(jsonStr), dest)
 }
-
-/**
-* Helper methods to assist in maintaining the synchronization of keys
-*
-* There are 3 primary keys for mappings:
-*
-* -- Data --
-* - 1. stripe:customer:{customerId} → full customer stripe data
-*
-* -- Key Mappings --
-* - 2. stripe:customer:{customerId}:userid →  userId (customerId →  userId lookup)
-* - 3. stripe:customer:userid:{userId} →  customerId (userId →  customerId lookup)
-**/
-
-const (
-	cacheKeyCustomerData       = "stripe:customer:123"
-	cacheKeyCustomerIdToUserId = "stripe:customer:%s:userid"
-	cacheKeyUserIdToCustomerId = "stripe:customer:userid:%s"
-)
-
-func (c *Client) GetCustomerDataFromCustomerIdKey(customerId string) string {
-	key := fmt.Sprintf(cacheKeyCustomerData, customerId)
-	return key
-}
-
-// customer to userId
-func (c *Client) GetUserIdFromCustomerIdKey(customerId string) string {
-	key := fmt.Sprintf(cacheKeyCustomerIdToUserId, customerId)
-	return key
-}
-
-// userId to customerId
-func (c *Client) GetCustomerIdFromUserIdKey(userId string) string {
-	key := fmt.Sprintf(cacheKeyUserIdToCustomerId, userId)
-	return key
-}
@@ -0,0 +1,160 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+	redislib "github.com/redis/go-redis/v9"
+)
+
+/**
+* Redis Streams implementation of interfaces.Queue.
+*
+* - streams + consumer groups give at-least-once delivery, unacked entries stay pending until claimed
+* - delayed retries are kept in a sorted set scored by their due time and moved back onto the stream when due
+**/
+
+// atomically pops every member of a sorted set whose score is due
+var popDueScript = redislib.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+if #due > 0 then
+	redis.call('ZREM', KEYS[1], unpack(due))
+end
+return due
+`)
+
+func (c *Client) EnsureGroup(ctx context.Context, stream string, group string) error {
+	err := c.rdb.XGroupCreateMkStream(ctx, stream, group, "0").Err()
+
+	// group already exists
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+
+	return err
+}
+
+func (c *Client) Publish(ctx context.Context, stream string, values map[string]string) (string, error) {
+	fields := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		fields[key] = value
+	}
+
+	return c.rdb.XAdd(ctx, &redislib.XAddArgs{
+		Stream: stream,
+		Values: fields,
+	}).Result()
+}
+
+func (c *Client) Consume(ctx context.Context, stream string, group string, consumer string, count int64, block time.Duration) ([]interfaces.QueueMessage, error) {
+	streams, err := c.rdb.XReadGroup(ctx, &redislib.XReadGroupArgs{
+		Group:    group,
+		Consumer: consumer,
+		Streams:  []string{stream, ">"},
+		Count:    count,
+		Block:    block,
+	}).Result()
+
+	// nothing arrived within the block window
+	if err == redislib.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []interfaces.QueueMessage
+	for _, s := range streams {
+		messages = append(messages, toQueueMessages(s.Messages)...)
+	}
+
+	return messages, nil
+}
+
+func (c *Client) ClaimStale(ctx context.Context, stream string, group string, consumer string, minIdle time.Duration, count int64) ([]interfaces.QueueMessage, error) {
+	messages, _, err := c.rdb.XAutoClaim(ctx, &redislib.XAutoClaimArgs{
+		Stream:   stream,
+		Group:    group,
+		Consumer: consumer,
+		MinIdle:  minIdle,
+		Start:    "0-0",
+		Count:    count,
+	}).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return toQueueMessages(messages), nil
+}
+
+func (c *Client) Ack(ctx context.Context, stream string, group string, ids ...string) error {
+	return c.rdb.XAck(ctx, stream, group, ids...).Err()
+}
+
+func (c *Client) Range(ctx context.Context, stream string, count int64) ([]interfaces.QueueMessage, error) {
+	messages, err := c.rdb.XRangeN(ctx, stream, "-", "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return toQueueMessages(messages), nil
+}
+
+func (c *Client) GetMessage(ctx context.Context, stream string, id string) (*interfaces.QueueMessage, error) {
+	messages, err := c.rdb.XRangeN(ctx, stream, id, id, 1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(messages) == 0 {
+		return nil, redislib.Nil
+	}
+
+	message := toQueueMessages(messages)[0]
+	return &message, nil
+}
+
+func (c *Client) Remove(ctx context.Context, stream string, ids ...string) error {
+	return c.rdb.XDel(ctx, stream, ids...).Err()
+}
+
+func (c *Client) ScheduleAt(ctx context.Context, key string, member string, at time.Time) error {
+	return c.rdb.ZAdd(ctx, key, redislib.Z{
+		Score:  float64(at.UnixMilli()),
+		Member: member,
+	}).Err()
+}
+
+func (c *Client) PopDue(ctx context.Context, key string, now time.Time, count int64) ([]string, error) {
+	result, err := popDueScript.Run(ctx, c.rdb, []string{key}, strconv.FormatInt(now.UnixMilli(), 10), count).StringSlice()
+
+	if err == redislib.Nil {
+		return nil, nil
+	}
+
+	return result, err
+}
+
+func toQueueMessages(messages []redislib.XMessage) []interfaces.QueueMessage {
+	queueMessages := make([]interfaces.QueueMessage, 0, len(messages))
+
+	for _, message := range messages {
+		values := make(map[string]string, len(message.Values))
+		for key, value := range message.Values {
+			values[key] = fmt.Sprint(value)
+		}
+
+		queueMessages = append(queueMessages, interfaces.QueueMessage{
+			ID:     message.ID,
+			Values: values,
+		})
+	}
+
+	return queueMessages
+}
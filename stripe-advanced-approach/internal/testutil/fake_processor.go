@@ -0,0 +1,1464 @@
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+// FakeProcessor is an in-memory payment.PaymentProcessor that mimics the parts of stripe this platform uses.
+// It never touches the network, so payment flows can be exercised end to end in tests.
+//
+// Objects are created with stripe-like ids (prod_, price_, cus_, seti_, pi_, sub_) and every state change
+// records a synthetic stripe.Event that can be fed back through the webhook flow.
+type FakeProcessor struct {
+	mu  sync.Mutex
+	seq int
+
+	products       map[string]*stripe.Product
+	prices         map[string]*stripe.Price
+	customers      map[string]*stripe.Customer
+	setupIntents   map[string]*stripe.SetupIntent
+	paymentIntents map[string]*stripe.PaymentIntent
+	subscriptions  map[string]*stripe.Subscription
+	schedules      map[string]*stripe.SubscriptionSchedule
+
+	events []*stripe.Event
+
+	// reads of the customer object, each sync makes exactly one
+	customerReads int
+	// simulated outage, customer reads fail like stripe's own errors
+	unavailable bool
+	// refunds fail like stripe's own errors
+	refundsFailing bool
+}
+
+var _ payment.PaymentProcessor = (*FakeProcessor)(nil)
+
+func NewFakeProcessor() *FakeProcessor {
+	return &FakeProcessor{
+		products:       map[string]*stripe.Product{},
+		prices:         map[string]*stripe.Price{},
+		customers:      map[string]*stripe.Customer{},
+		setupIntents:   map[string]*stripe.SetupIntent{},
+		paymentIntents: map[string]*stripe.PaymentIntent{},
+		subscriptions:  map[string]*stripe.Subscription{},
+		schedules:      map[string]*stripe.SubscriptionSchedule{},
+	}
+}
+
+// --- payment.PaymentProcessor ---
+
+func (f *FakeProcessor) SetupProducts(ctx context.Context, request *payment.SetupProductsReq) (*payment.SetupProductsResp, error) {
+	return f.setupProduct(request, false)
+}
+
+func (f *FakeProcessor) SetupSubscription(ctx context.Context, request *payment.SetupProductsReq) (*payment.SetupProductsResp, error) {
+	return f.setupProduct(request, true)
+}
+
+func (f *FakeProcessor) GetProducts(ctx context.Context) (*payment.ProductListResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var productList []payment.ProductInfo
+	for _, id := range sortedKeys(f.products) {
+		prod := f.products[id]
+
+		if !prod.Active || prod.DefaultPrice == nil {
+			continue
+		}
+
+		productInfo := payment.ProductInfo{
+			ID:          prod.ID,
+			Name:        prod.Name,
+			Description: prod.Description,
+			PriceID:     prod.DefaultPrice.ID,
+			Price:       prod.DefaultPrice.UnitAmount,
+			Type:        "one-time",
+			TrialDays:   fakeTrialDays(prod),
+		}
+
+		if prod.DefaultPrice.Recurring != nil {
+			productInfo.Type = "subscription"
+		}
+
+		// the default price first, then the others in the order they were created
+		productInfo.Prices = []payment.PriceInfo{fakePriceInfo(prod.DefaultPrice, prod.DefaultPrice.ID)}
+		for _, priceId := range sortedKeys(f.prices) {
+			price := f.prices[priceId]
+
+			if price.Active && price.Product.ID == prod.ID && price.ID != prod.DefaultPrice.ID {
+				productInfo.Prices = append(productInfo.Prices, fakePriceInfo(price, prod.DefaultPrice.ID))
+			}
+		}
+
+		productList = append(productList, productInfo)
+	}
+
+	return &payment.ProductListResponse{Products: productList}, nil
+}
+
+func (f *FakeProcessor) CreateCustomer(ctx context.Context, userId uuid.UUID, email string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust := &stripe.Customer{
+		ID:       f.newID("cus"),
+		Object:   "customer",
+		Email:    email,
+		Created:  time.Now().Unix(),
+		Metadata: map[string]string{"user_id": userId.String()},
+	}
+	f.customers[cust.ID] = cust
+
+	if _, err := f.recordEvent(stripe.EventTypeCustomerCreated, cust); err != nil {
+		return "", err
+	}
+
+	return cust.ID, nil
+}
+
+func (f *FakeProcessor) DeleteCustomer(ctx context.Context, customerId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust, err := f.customer(customerId)
+	if err != nil {
+		return err
+	}
+
+	// stripe keeps answering for deleted customers, flagged as deleted
+	cust.Deleted = true
+
+	_, err = f.recordEvent(stripe.EventTypeCustomerDeleted, cust)
+	return err
+}
+
+func (f *FakeProcessor) SaveCard(ctx context.Context, customerId string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust, err := f.customer(customerId)
+	if err != nil {
+		return "", err
+	}
+
+	si := &stripe.SetupIntent{
+		ID:                 f.newID("seti"),
+		Object:             "setup_intent",
+		Customer:           &stripe.Customer{ID: cust.ID},
+		PaymentMethodTypes: []string{"card"},
+		Status:             stripe.SetupIntentStatusRequiresPaymentMethod,
+		Created:            time.Now().Unix(),
+	}
+	si.ClientSecret = si.ID + "_secret_fake"
+	f.setupIntents[si.ID] = si
+
+	return si.ClientSecret, nil
+}
+
+func (f *FakeProcessor) CreatePaymentIntent(ctx context.Context, amount int64, customerId string) (*payment.CreatePaymentIntentResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, err := f.newPaymentIntent(amount, customerId, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &payment.CreatePaymentIntentResponse{
+		PaymentIntentID: intent.ID,
+		ClientSecret:    intent.ClientSecret,
+	}, nil
+}
+
+func (f *FakeProcessor) PurchaseProduct(ctx context.Context, req *payment.PurchaseProductRequest) (*payment.StripePurchaseResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prod, ok := f.products[req.ProductID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get product: no such product: %s", req.ProductID)
+	}
+
+	price, err := f.selectPrice(prod, req.PriceSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	if price.Recurring != nil {
+		return nil, fmt.Errorf("%w: price %s is billed on a recurring basis, subscribe to it instead", payment.ErrInvalidPrice, price.ID)
+	}
+
+	intent, err := f.newPaymentIntent(price.UnitAmount, req.CustomerID, map[string]string{
+		"product_id": req.ProductID,
+		"price_id":   price.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &payment.StripePurchaseResponse{
+		ClientSecret:    intent.ClientSecret,
+		PaymentIntentID: intent.ID,
+		Amount:          intent.Amount,
+	}, nil
+}
+
+func (f *FakeProcessor) SubscribeToProduct(ctx context.Context, req *payment.SubscribeRequest) (*payment.SubscribeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prod, ok := f.products[req.ProductID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get product: no such product: %s", req.ProductID)
+	}
+
+	price, err := f.selectPrice(prod, req.PriceSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	if price.Recurring == nil {
+		if req.IsDefault() {
+			return nil, fmt.Errorf("product %s is not a subscription (no recurring price)", req.ProductID)
+		}
+
+		return nil, fmt.Errorf("%w: price %s is a one-time price, purchase it instead", payment.ErrInvalidPrice, price.ID)
+	}
+
+	cust, err := f.customer(req.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	periodEnd := now.AddDate(0, 1, 0)
+
+	sub := &stripe.Subscription{
+		ID:        f.newID("sub"),
+		Object:    "subscription",
+		Customer:  &stripe.Customer{ID: cust.ID},
+		Status:    stripe.SubscriptionStatusIncomplete,
+		Created:   now.Unix(),
+		StartDate: now.Unix(),
+		Currency:  price.Currency,
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{
+					ID:                 f.newID("si"),
+					Object:             "subscription_item",
+					Price:              price,
+					Quantity:           1,
+					Created:            now.Unix(),
+					CurrentPeriodStart: now.Unix(),
+					CurrentPeriodEnd:   periodEnd.Unix(),
+				},
+			},
+		},
+	}
+	sub.Items.Data[0].Subscription = sub.ID
+
+	trialDays := fakeTrialDays(prod)
+	if req.TrialDays != nil {
+		trialDays = *req.TrialDays
+	}
+
+	if trialDays > 0 {
+		return f.startTrial(sub, trialDays)
+	}
+
+	// the first invoice is paid through a payment intent, exactly like default_incomplete on stripe
+	intent, err := f.newPaymentIntent(price.UnitAmount, cust.ID, map[string]string{
+		"subscription_id": sub.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sub.LatestInvoice = &stripe.Invoice{
+		ID:     f.newID("in"),
+		Object: "invoice",
+		ConfirmationSecret: &stripe.InvoiceConfirmationSecret{
+			ClientSecret: intent.ClientSecret,
+			Type:         "payment_intent",
+		},
+	}
+
+	f.subscriptions[sub.ID] = sub
+
+	if _, err := f.recordEvent(stripe.EventTypeCustomerSubscriptionCreated, sub); err != nil {
+		return nil, err
+	}
+
+	return &payment.SubscribeResponse{
+		SubscriptionID:   sub.ID,
+		ClientSecret:     intent.ClientSecret,
+		ClientSecretType: "payment_intent",
+		Status:           string(sub.Status),
+	}, nil
+}
+
+func (f *FakeProcessor) ProcessWebhookEvent(ctx context.Context, event *stripe.Event) (customerId string, error error) {
+	var eventData map[string]interface{}
+	if err := json.Unmarshal(event.Data.Raw, &eventData); err != nil {
+		return "", err
+	}
+
+	if customer, ok := eventData["customer"].(string); ok && customer != "" {
+		return customer, nil
+	}
+
+	if object, ok := eventData["object"].(string); ok && object == "customer" {
+		if id, ok := eventData["id"].(string); ok && id != "" {
+			return id, nil
+		}
+	}
+
+	return "", fmt.Errorf("no customer ID found in stripe event type: %s", event.Type)
+}
+
+func (f *FakeProcessor) GetCustomer(ctx context.Context, customerId string) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.customerReads++
+
+	if f.unavailable {
+		return nil, &stripe.Error{HTTPStatusCode: http.StatusServiceUnavailable, Msg: "fake stripe outage"}
+	}
+
+	cust, err := f.customer(customerId)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *cust
+	return &copied, nil
+}
+
+func (f *FakeProcessor) ListSubscriptions(ctx context.Context, customerId string, opts *payment.ListOptions) ([]*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscriptions := []*stripe.Subscription{}
+	for _, id := range sortedKeys(f.subscriptions) {
+		sub := f.subscriptions[id]
+
+		if sub.Customer == nil || sub.Customer.ID != customerId {
+			continue
+		}
+
+		if opts != nil && opts.ActiveOnly && sub.Status == stripe.SubscriptionStatusCanceled {
+			continue
+		}
+
+		copied := *sub
+		subscriptions = append(subscriptions, &copied)
+	}
+
+	return subscriptions, nil
+}
+
+func (f *FakeProcessor) GetSubscription(ctx context.Context, subscriptionId string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, ok := f.subscriptions[subscriptionId]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", subscriptionId)
+	}
+
+	copied := *sub
+	return &copied, nil
+}
+
+// ListPaymentIntents lists newest first like stripe, ids are sequential so reversed id order is creation order
+func (f *FakeProcessor) ListPaymentIntents(ctx context.Context, customerId string, opts *payment.ListOptions) ([]*stripe.PaymentIntent, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ids := sortedKeys(f.paymentIntents)
+	slices.Reverse(ids)
+
+	// continue after the cursor
+	if opts != nil && opts.StartingAfter != "" {
+		index := slices.Index(ids, opts.StartingAfter)
+		if index < 0 {
+			return nil, "", fmt.Errorf("no such payment_intent: %s", opts.StartingAfter)
+		}
+
+		ids = ids[index+1:]
+	}
+
+	maxObjects := opts.MaxObjects()
+
+	payments := []*stripe.PaymentIntent{}
+	for _, id := range ids {
+		intent := f.paymentIntents[id]
+
+		if intent.Customer == nil || intent.Customer.ID != customerId {
+			continue
+		}
+
+		if opts != nil && intent.Created < opts.CreatedGte {
+			continue
+		}
+
+		copied := *intent
+		payments = append(payments, &copied)
+
+		if maxObjects > 0 && len(payments) >= maxObjects {
+			return payments, intent.ID, nil
+		}
+	}
+
+	return payments, "", nil
+}
+
+func (f *FakeProcessor) CancelSubscription(ctx context.Context, subscriptionId string, details *payment.CancellationDetails) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.activeSubscription(subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+
+	sub.Status = stripe.SubscriptionStatusCanceled
+	sub.CanceledAt = now
+	sub.EndedAt = now
+	sub.CancellationDetails = fakeCancellationDetails(details)
+
+	if _, err := f.recordEvent(stripe.EventTypeCustomerSubscriptionDeleted, sub); err != nil {
+		return nil, err
+	}
+
+	copied := *sub
+	return &copied, nil
+}
+
+func (f *FakeProcessor) SetCancelAtPeriodEnd(ctx context.Context, subscriptionId string, cancel bool, details *payment.CancellationDetails) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.activeSubscription(subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+
+	sub.CancelAtPeriodEnd = cancel
+	sub.CancelAt = 0
+	sub.CanceledAt = 0
+	sub.CancellationDetails = nil
+
+	if cancel {
+		sub.CancelAt = sub.Items.Data[0].CurrentPeriodEnd
+		sub.CanceledAt = time.Now().Unix()
+		sub.CancellationDetails = fakeCancellationDetails(details)
+	}
+
+	if _, err := f.recordEvent(stripe.EventTypeCustomerSubscriptionUpdated, sub); err != nil {
+		return nil, err
+	}
+
+	copied := *sub
+	return &copied, nil
+}
+
+func (f *FakeProcessor) SetPauseCollection(ctx context.Context, subscriptionId string, pause *payment.PauseCollection) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.activeSubscription(subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+
+	sub.PauseCollection = nil
+
+	if pause != nil {
+		sub.PauseCollection = &stripe.SubscriptionPauseCollection{
+			Behavior:  stripe.SubscriptionPauseCollectionBehavior(pause.Behavior),
+			ResumesAt: pause.ResumesAt,
+		}
+	}
+
+	if _, err := f.recordEvent(stripe.EventTypeCustomerSubscriptionUpdated, sub); err != nil {
+		return nil, err
+	}
+
+	copied := *sub
+	return &copied, nil
+}
+
+// GetInvoice returns the latest invoice of a subscription, paid by its succeeded payment intents
+func (f *FakeProcessor) GetInvoice(ctx context.Context, invoiceId string) (*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, sub := range f.subscriptions {
+		if sub.LatestInvoice == nil || sub.LatestInvoice.ID != invoiceId {
+			continue
+		}
+
+		invoice := &stripe.Invoice{ID: invoiceId, Object: "invoice", Customer: sub.Customer, Currency: sub.Currency}
+
+		for _, intent := range f.paymentIntents {
+			if intent.Metadata["subscription_id"] == sub.ID && intent.Status == stripe.PaymentIntentStatusSucceeded {
+				invoice.AmountPaid += intent.AmountReceived
+			}
+		}
+
+		invoice.AmountDue = invoice.AmountPaid
+		invoice.Status = stripe.InvoiceStatusPaid
+		return invoice, nil
+	}
+
+	return nil, fmt.Errorf("no such invoice: %s", invoiceId)
+}
+
+// RefundInvoice refunds the payment intent that paid the subscription's first invoice, the only invoices the fake pays
+func (f *FakeProcessor) RefundInvoice(ctx context.Context, invoiceId string, amount int64) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.refundsFailing {
+		return 0, &stripe.Error{HTTPStatusCode: http.StatusServiceUnavailable, Msg: "fake refund failure"}
+	}
+
+	for _, sub := range f.subscriptions {
+		if sub.LatestInvoice == nil || sub.LatestInvoice.ID != invoiceId {
+			continue
+		}
+
+		for _, id := range sortedKeys(f.paymentIntents) {
+			intent := f.paymentIntents[id]
+
+			if intent.Metadata["subscription_id"] != sub.ID || intent.Status != stripe.PaymentIntentStatusSucceeded {
+				continue
+			}
+
+			var refundedBefore int64
+			if intent.LatestCharge != nil {
+				refundedBefore = intent.LatestCharge.AmountRefunded
+			}
+
+			charge, _, err := f.refund(intent, amount)
+			if err != nil {
+				return 0, err
+			}
+
+			return charge.AmountRefunded - refundedBefore, nil
+		}
+	}
+
+	return 0, nil
+}
+
+func (f *FakeProcessor) GetProductPrice(ctx context.Context, productId string, selector payment.PriceSelector) (*stripe.Price, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prod, ok := f.products[productId]
+	if !ok {
+		return nil, fmt.Errorf("failed to get product: no such product: %s", productId)
+	}
+
+	price, err := f.selectPrice(prod, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *price
+	return &copied, nil
+}
+
+// PreviewPlanChange prorates by the second like stripe: the unused time at the old price is credited and charged
+// at the new one. Unless always_invoice, the lines come with the renewal at the new price.
+func (f *FakeProcessor) PreviewPlanChange(ctx context.Context, change *payment.PlanChange) (*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, item, target, err := f.planChangeItem(change)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []*stripe.InvoiceLineItem{}
+
+	if change.ProrationBehavior != "none" {
+		lines = append(lines, f.prorationLines(sub, item, target, change.ProrationDate)...)
+	}
+
+	if change.ProrationBehavior != "always_invoice" {
+		lines = append(lines, &stripe.InvoiceLineItem{
+			ID:          f.newID("il"),
+			Object:      "line_item",
+			Amount:      target.UnitAmount * item.Quantity,
+			Currency:    target.Currency,
+			Description: fmt.Sprintf("%d × %s", item.Quantity, f.priceName(target)),
+			Quantity:    item.Quantity,
+			Period:      &stripe.Period{Start: item.CurrentPeriodEnd, End: time.Unix(item.CurrentPeriodEnd, 0).AddDate(0, 1, 0).Unix()},
+			Parent:      fakeSubscriptionLineParent(sub, item, false),
+		})
+	}
+
+	var total int64
+	for _, line := range lines {
+		total += line.Amount
+	}
+
+	return &stripe.Invoice{
+		Object:    "invoice",
+		Customer:  sub.Customer,
+		Currency:  target.Currency,
+		Total:     total,
+		AmountDue: max(total, 0),
+		Lines:     &stripe.InvoiceLineItemList{Data: lines},
+	}, nil
+}
+
+// ChangePlan swaps the item's price, releasing the subscription's schedule first. Prorations aren't invoiced.
+func (f *FakeProcessor) ChangePlan(ctx context.Context, change *payment.PlanChange) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, item, target, err := f.planChangeItem(change)
+	if err != nil {
+		return nil, err
+	}
+
+	if schedule, ok := f.schedules[change.ScheduleID]; ok {
+		schedule.Status = stripe.SubscriptionScheduleStatusReleased
+		schedule.ReleasedAt = time.Now().Unix()
+		sub.Schedule = nil
+	}
+
+	item.Price = target
+
+	if _, err := f.recordEvent(stripe.EventTypeCustomerSubscriptionUpdated, sub); err != nil {
+		return nil, err
+	}
+
+	copied := *sub
+	return &copied, nil
+}
+
+// SchedulePlanChange plans the new price for the next period, see AdvanceSubscriptionSchedule.
+func (f *FakeProcessor) SchedulePlanChange(ctx context.Context, change *payment.PlanChange) (*stripe.SubscriptionSchedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, item, target, err := f.planChangeItem(change)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, exists := f.schedules[change.ScheduleID]
+
+	if !exists {
+		schedule = &stripe.SubscriptionSchedule{
+			ID:           f.newID("sub_sched"),
+			Object:       "subscription_schedule",
+			Created:      time.Now().Unix(),
+			Customer:     sub.Customer,
+			Subscription: &stripe.Subscription{ID: sub.ID},
+			Status:       stripe.SubscriptionScheduleStatusActive,
+			EndBehavior:  stripe.SubscriptionScheduleEndBehaviorRelease,
+		}
+
+		f.schedules[schedule.ID] = schedule
+		sub.Schedule = &stripe.SubscriptionSchedule{ID: schedule.ID}
+	}
+
+	schedule.CurrentPhase = &stripe.SubscriptionScheduleCurrentPhase{
+		StartDate: item.CurrentPeriodStart,
+		EndDate:   item.CurrentPeriodEnd,
+	}
+	schedule.Phases = []*stripe.SubscriptionSchedulePhase{
+		{
+			StartDate: item.CurrentPeriodStart,
+			EndDate:   item.CurrentPeriodEnd,
+			Items:     []*stripe.SubscriptionSchedulePhaseItem{{Price: item.Price, Quantity: item.Quantity}},
+		},
+		{
+			StartDate: item.CurrentPeriodEnd,
+			EndDate:   time.Unix(item.CurrentPeriodEnd, 0).AddDate(0, 1, 0).Unix(),
+			Items:     []*stripe.SubscriptionSchedulePhaseItem{{Price: target, Quantity: item.Quantity}},
+		},
+	}
+
+	eventType := stripe.EventTypeSubscriptionScheduleUpdated
+	if !exists {
+		eventType = stripe.EventTypeSubscriptionScheduleCreated
+	}
+
+	if _, err := f.recordEvent(eventType, schedule); err != nil {
+		return nil, err
+	}
+
+	copied := *schedule
+	return &copied, nil
+}
+
+// --- test controls ---
+
+// SucceedSetupIntent simulates the frontend saving a card. If the intent is the pending setup intent of a trialing
+// subscription, the card becomes its default payment method and is charged once the trial ends.
+func (f *FakeProcessor) SucceedSetupIntent(intentId string) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	si, ok := f.setupIntents[intentId]
+	if !ok {
+		return nil, fmt.Errorf("no such setup_intent: %s", intentId)
+	}
+
+	si.Status = stripe.SetupIntentStatusSucceeded
+	si.PaymentMethod = &stripe.PaymentMethod{
+		ID:     f.newID("pm"),
+		Object: "payment_method",
+		Type:   stripe.PaymentMethodTypeCard,
+		Card: &stripe.PaymentMethodCard{
+			Brand:    stripe.PaymentMethodCardBrandVisa,
+			Last4:    "4242",
+			ExpMonth: 12,
+			ExpYear:  int64(time.Now().Year() + 2),
+		},
+	}
+
+	if subId := si.Metadata["subscription_id"]; subId != "" {
+		if sub, ok := f.subscriptions[subId]; ok {
+			sub.DefaultPaymentMethod = si.PaymentMethod
+			sub.PendingSetupIntent = nil
+
+			if _, err := f.recordEvent(stripe.EventTypeCustomerSubscriptionUpdated, sub); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return f.recordEvent(stripe.EventTypeSetupIntentSucceeded, si)
+}
+
+// SetDefaultCard simulates the customer saving a card as the default for all their invoices, outside of any
+// subscription.
+func (f *FakeProcessor) SetDefaultCard(customerId string) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust, err := f.customer(customerId)
+	if err != nil {
+		return nil, err
+	}
+
+	cust.InvoiceSettings = &stripe.CustomerInvoiceSettings{
+		DefaultPaymentMethod: &stripe.PaymentMethod{ID: f.newID("pm"), Object: "payment_method", Type: stripe.PaymentMethodTypeCard},
+	}
+
+	return f.recordEvent(stripe.EventTypeCustomerUpdated, cust)
+}
+
+// TrialWillEnd simulates the notice stripe sends three days before the trial of a subscription ends.
+func (f *FakeProcessor) TrialWillEnd(subscriptionId string) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.trialingSubscription(subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.recordEvent(stripe.EventTypeCustomerSubscriptionTrialWillEnd, sub)
+}
+
+// EndTrial simulates the end of a subscription's trial: it becomes active with a card saved, otherwise it is
+// canceled as its trial settings say.
+func (f *FakeProcessor) EndTrial(subscriptionId string) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.trialingSubscription(subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	item := sub.Items.Data[0]
+
+	sub.TrialEnd = now.Unix()
+	sub.PendingSetupIntent = nil
+
+	cust, err := f.customer(sub.Customer.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if sub.DefaultPaymentMethod != nil || (cust.InvoiceSettings != nil && cust.InvoiceSettings.DefaultPaymentMethod != nil) {
+		sub.Status = stripe.SubscriptionStatusActive
+		item.CurrentPeriodStart = now.Unix()
+		item.CurrentPeriodEnd = now.AddDate(0, 1, 0).Unix()
+
+		return f.recordEvent(stripe.EventTypeCustomerSubscriptionUpdated, sub)
+	}
+
+	sub.Status = stripe.SubscriptionStatusCanceled
+	sub.CanceledAt = now.Unix()
+	sub.EndedAt = now.Unix()
+
+	return f.recordEvent(stripe.EventTypeCustomerSubscriptionDeleted, sub)
+}
+
+// SucceedPaymentIntent simulates the frontend confirming a payment. If the intent pays for a subscription's
+// first invoice, the subscription becomes active as well.
+func (f *FakeProcessor) SucceedPaymentIntent(intentId string) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.paymentIntents[intentId]
+	if !ok {
+		return nil, fmt.Errorf("no such payment_intent: %s", intentId)
+	}
+
+	intent.Status = stripe.PaymentIntentStatusSucceeded
+	intent.AmountReceived = intent.Amount
+
+	if subId := intent.Metadata["subscription_id"]; subId != "" {
+		if sub, ok := f.subscriptions[subId]; ok {
+			sub.Status = stripe.SubscriptionStatusActive
+
+			if _, err := f.recordEvent(stripe.EventTypeCustomerSubscriptionUpdated, sub); err != nil {
+				return nil, err
+			}
+
+			invoice := &stripe.Invoice{
+				ID:         f.newID("in"),
+				Object:     "invoice",
+				Customer:   sub.Customer,
+				Status:     stripe.InvoiceStatusPaid,
+				AmountDue:  intent.Amount,
+				AmountPaid: intent.Amount,
+				Currency:   intent.Currency,
+				Parent: &stripe.InvoiceParent{
+					Type: stripe.InvoiceParentTypeSubscriptionDetails,
+					SubscriptionDetails: &stripe.InvoiceParentSubscriptionDetails{
+						Subscription: &stripe.Subscription{ID: sub.ID},
+					},
+				},
+			}
+
+			if _, err := f.recordEvent(stripe.EventTypeInvoicePaid, invoice); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return f.recordEvent(stripe.EventTypePaymentIntentSucceeded, intent)
+}
+
+// AdvanceSubscriptionSchedule simulates the end of the period of a subscription with a scheduled plan change: the
+// next period starts at the scheduled price and the schedule releases the subscription.
+func (f *FakeProcessor) AdvanceSubscriptionSchedule(scheduleId string) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	schedule, ok := f.schedules[scheduleId]
+	if !ok || schedule.Status != stripe.SubscriptionScheduleStatusActive || len(schedule.Phases) < 2 {
+		return nil, fmt.Errorf("no active subscription_schedule with a next phase: %s", scheduleId)
+	}
+
+	sub, err := f.activeSubscription(schedule.Subscription.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	next := schedule.Phases[1]
+	item := sub.Items.Data[0]
+
+	item.Price = next.Items[0].Price
+	item.CurrentPeriodStart = next.StartDate
+	item.CurrentPeriodEnd = next.EndDate
+
+	schedule.Status = stripe.SubscriptionScheduleStatusReleased
+	schedule.ReleasedAt = time.Now().Unix()
+	schedule.ReleasedSubscription = &stripe.Subscription{ID: sub.ID}
+	schedule.CurrentPhase = nil
+	sub.Schedule = nil
+
+	return f.recordEvent(stripe.EventTypeCustomerSubscriptionUpdated, sub)
+}
+
+// SetUnavailable simulates a stripe outage until it is called with false.
+func (f *FakeProcessor) SetUnavailable(unavailable bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.unavailable = unavailable
+}
+
+// DeactivatePrice simulates archiving a price, it can no longer be bought or subscribed to.
+func (f *FakeProcessor) DeactivatePrice(priceId string) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	price, ok := f.prices[priceId]
+	if !ok {
+		return nil, fmt.Errorf("no such price: %s", priceId)
+	}
+
+	price.Active = false
+
+	return f.recordEvent(stripe.EventTypePriceUpdated, price)
+}
+
+// SetRefundsFailing makes refunds fail until it is called with false.
+func (f *FakeProcessor) SetRefundsFailing(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.refundsFailing = failing
+}
+
+// CustomerReads returns how often the customer object was read, i.e. how many syncs reached stripe.
+func (f *FakeProcessor) CustomerReads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.customerReads
+}
+
+// FailPaymentIntent simulates a declined card on confirmation.
+func (f *FakeProcessor) FailPaymentIntent(intentId string) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.paymentIntents[intentId]
+	if !ok {
+		return nil, fmt.Errorf("no such payment_intent: %s", intentId)
+	}
+
+	intent.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+	intent.LastPaymentError = &stripe.Error{
+		Code: stripe.ErrorCodeCardDeclined,
+		Msg:  "Your card was declined.",
+	}
+
+	return f.recordEvent(stripe.EventTypePaymentIntentPaymentFailed, intent)
+}
+
+// CancelPaymentIntent simulates the intent being canceled before completion.
+func (f *FakeProcessor) CancelPaymentIntent(intentId string) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.paymentIntents[intentId]
+	if !ok {
+		return nil, fmt.Errorf("no such payment_intent: %s", intentId)
+	}
+
+	intent.Status = stripe.PaymentIntentStatusCanceled
+	intent.CanceledAt = time.Now().Unix()
+
+	return f.recordEvent(stripe.EventTypePaymentIntentCanceled, intent)
+}
+
+// RefundPaymentIntent simulates a refund of a succeeded intent, a full refund when amount is 0.
+func (f *FakeProcessor) RefundPaymentIntent(intentId string, amount int64) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.paymentIntents[intentId]
+	if !ok {
+		return nil, fmt.Errorf("no such payment_intent: %s", intentId)
+	}
+
+	if intent.Status != stripe.PaymentIntentStatusSucceeded {
+		return nil, fmt.Errorf("payment_intent %s has not succeeded", intentId)
+	}
+
+	_, event, err := f.refund(intent, amount)
+	return event, err
+}
+
+// NewEvent builds a synthetic event of any type around the provided stripe object without changing fake state.
+func (f *FakeProcessor) NewEvent(eventType stripe.EventType, object interface{}) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.recordEvent(eventType, object)
+}
+
+// Events returns every event emitted so far, oldest first.
+func (f *FakeProcessor) Events() []*stripe.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*stripe.Event(nil), f.events...)
+}
+
+// LatestEvent returns the most recent event of the given type, or nil when none was emitted.
+func (f *FakeProcessor) LatestEvent(eventType stripe.EventType) *stripe.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := len(f.events) - 1; i >= 0; i-- {
+		if f.events[i].Type == eventType {
+			return f.events[i]
+		}
+	}
+
+	return nil
+}
+
+// SignEvent returns the raw payload and Stripe-Signature header for an event, signed with the given secret,
+// so it can be posted to the webhook handler.
+func (f *FakeProcessor) SignEvent(event *stripe.Event, secret string) ([]byte, string, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, "", err
+	}
+
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  secret,
+	})
+
+	return signed.Payload, signed.Header, nil
+}
+
+// --- internal helpers, callers must hold f.mu ---
+
+func (f *FakeProcessor) newID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake%08d", prefix, f.seq)
+}
+
+func (f *FakeProcessor) customer(customerId string) (*stripe.Customer, error) {
+	cust, ok := f.customers[customerId]
+	if !ok {
+		return nil, fmt.Errorf("no such customer: %s", customerId)
+	}
+
+	return cust, nil
+}
+
+func (f *FakeProcessor) setupProduct(request *payment.SetupProductsReq, recurring bool) (*payment.SetupProductsResp, error) {
+	prices, err := request.SetupPrices(recurring)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now().Unix()
+
+	prod := &stripe.Product{
+		ID:          f.newID("prod"),
+		Object:      "product",
+		Name:        request.Name,
+		Description: request.Description,
+		Active:      true,
+		Created:     now,
+		Metadata:    map[string]string{},
+	}
+
+	if recurring && request.TrialDays > 0 {
+		prod.Metadata["trial_days"] = strconv.FormatInt(request.TrialDays, 10)
+	}
+
+	response := &payment.SetupProductsResp{ProductID: prod.ID}
+
+	for _, requested := range prices {
+		lookupKey := requested.LookupKeyFor(prod.ID)
+
+		for _, existing := range f.prices {
+			if existing.Active && existing.LookupKey == lookupKey {
+				return nil, fmt.Errorf("a price with the lookup key %s already exists", lookupKey)
+			}
+		}
+
+		price := &stripe.Price{
+			ID:         f.newID("price"),
+			Object:     "price",
+			Active:     true,
+			Currency:   stripe.Currency(requested.Currency),
+			LookupKey:  lookupKey,
+			Product:    &stripe.Product{ID: prod.ID},
+			Type:       stripe.PriceTypeOneTime,
+			UnitAmount: requested.Amount,
+			Created:    now,
+		}
+
+		if requested.Recurring() {
+			price.Type = stripe.PriceTypeRecurring
+			price.Recurring = &stripe.PriceRecurring{
+				Interval:      stripe.PriceRecurringInterval(requested.Interval),
+				IntervalCount: requested.IntervalCount,
+			}
+		}
+
+		// the first price is the default one
+		if prod.DefaultPrice == nil {
+			prod.DefaultPrice = price
+		}
+
+		f.prices[price.ID] = price
+		response.Prices = append(response.Prices, fakePriceInfo(price, prod.DefaultPrice.ID))
+	}
+
+	f.products[prod.ID] = prod
+	response.PriceID = prod.DefaultPrice.ID
+
+	return response, nil
+}
+
+// the price of the product the selector asks for, looked up among the prices of every product like on stripe
+func (f *FakeProcessor) selectPrice(prod *stripe.Product, selector payment.PriceSelector) (*stripe.Price, error) {
+	candidates := make([]*stripe.Price, 0, len(f.prices))
+
+	for _, id := range sortedKeys(f.prices) {
+		candidates = append(candidates, f.prices[id])
+	}
+
+	return selector.Select(prod.ID, prod.DefaultPrice, candidates)
+}
+
+func (f *FakeProcessor) newPaymentIntent(amount int64, customerId string, metadata map[string]string) (*stripe.PaymentIntent, error) {
+	cust, err := f.customer(customerId)
+	if err != nil {
+		return nil, err
+	}
+
+	intent := &stripe.PaymentIntent{
+		ID:                 f.newID("pi"),
+		Object:             "payment_intent",
+		Amount:             amount,
+		Currency:           stripe.CurrencyUSD,
+		Customer:           &stripe.Customer{ID: cust.ID},
+		ConfirmationMethod: stripe.PaymentIntentConfirmationMethodAutomatic,
+		PaymentMethodTypes: []string{"card"},
+		Status:             stripe.PaymentIntentStatusRequiresPaymentMethod,
+		Metadata:           metadata,
+		Created:            time.Now().Unix(),
+	}
+	intent.ClientSecret = intent.ID + "_secret_fake"
+
+	f.paymentIntents[intent.ID] = intent
+
+	if _, err := f.recordEvent(stripe.EventTypePaymentIntentCreated, intent); err != nil {
+		return nil, err
+	}
+
+	return intent, nil
+}
+
+// starts the trial of a new subscription, nothing is invoiced until it ends and the card for after it is saved
+// through the pending setup intent
+func (f *FakeProcessor) startTrial(sub *stripe.Subscription, trialDays int64) (*payment.SubscribeResponse, error) {
+	trialEnd := time.Unix(sub.StartDate, 0).AddDate(0, 0, int(trialDays))
+
+	sub.Status = stripe.SubscriptionStatusTrialing
+	sub.TrialStart = sub.StartDate
+	sub.TrialEnd = trialEnd.Unix()
+	sub.TrialSettings = &stripe.SubscriptionTrialSettings{
+		EndBehavior: &stripe.SubscriptionTrialSettingsEndBehavior{
+			MissingPaymentMethod: stripe.SubscriptionTrialSettingsEndBehaviorMissingPaymentMethodCancel,
+		},
+	}
+	sub.Items.Data[0].CurrentPeriodEnd = trialEnd.Unix()
+
+	si := &stripe.SetupIntent{
+		ID:                 f.newID("seti"),
+		Object:             "setup_intent",
+		Customer:           sub.Customer,
+		PaymentMethodTypes: []string{"card"},
+		Status:             stripe.SetupIntentStatusRequiresPaymentMethod,
+		Usage:              stripe.SetupIntentUsageOffSession,
+		Metadata:           map[string]string{"subscription_id": sub.ID},
+		Created:            sub.Created,
+	}
+	si.ClientSecret = si.ID + "_secret_fake"
+	f.setupIntents[si.ID] = si
+
+	sub.PendingSetupIntent = si
+	f.subscriptions[sub.ID] = sub
+
+	if _, err := f.recordEvent(stripe.EventTypeCustomerSubscriptionCreated, sub); err != nil {
+		return nil, err
+	}
+
+	return &payment.SubscribeResponse{
+		SubscriptionID:   sub.ID,
+		ClientSecret:     si.ClientSecret,
+		ClientSecretType: "setup_intent",
+		Status:           string(sub.Status),
+		TrialEnd:         &trialEnd,
+	}, nil
+}
+
+func (f *FakeProcessor) trialingSubscription(subscriptionId string) (*stripe.Subscription, error) {
+	sub, ok := f.subscriptions[subscriptionId]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", subscriptionId)
+	}
+
+	if sub.Status != stripe.SubscriptionStatusTrialing {
+		return nil, fmt.Errorf("subscription %s is not trialing", subscriptionId)
+	}
+
+	return sub, nil
+}
+
+func (f *FakeProcessor) activeSubscription(subscriptionId string) (*stripe.Subscription, error) {
+	sub, ok := f.subscriptions[subscriptionId]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", subscriptionId)
+	}
+
+	if sub.Status == stripe.SubscriptionStatusCanceled {
+		return nil, fmt.Errorf("subscription %s is canceled", subscriptionId)
+	}
+
+	return sub, nil
+}
+
+/**
+* Refund of a succeeded intent, everything still refundable when amount is 0. Refunds add up on the intent's latest
+* charge, which is replaced rather than changed so intents handed out earlier keep what they saw.
+**/
+func (f *FakeProcessor) refund(intent *stripe.PaymentIntent, amount int64) (*stripe.Charge, *stripe.Event, error) {
+	charge := &stripe.Charge{
+		ID:             f.newID("ch"),
+		Object:         "charge",
+		Customer:       intent.Customer,
+		PaymentIntent:  &stripe.PaymentIntent{ID: intent.ID},
+		Amount:         intent.Amount,
+		AmountCaptured: intent.Amount,
+		Currency:       intent.Currency,
+		Paid:           true,
+		Captured:       true,
+		Status:         stripe.ChargeStatusSucceeded,
+	}
+
+	if intent.LatestCharge != nil {
+		copied := *intent.LatestCharge
+		charge = &copied
+	}
+
+	refundable := charge.Amount - charge.AmountRefunded
+	if refundable <= 0 {
+		return nil, nil, fmt.Errorf("charge %s is already fully refunded", charge.ID)
+	}
+
+	if amount <= 0 || amount > refundable {
+		amount = refundable
+	}
+
+	charge.AmountRefunded += amount
+	charge.Refunded = charge.AmountRefunded == charge.Amount
+	intent.LatestCharge = charge
+
+	event, err := f.recordEvent(stripe.EventTypeChargeRefunded, charge)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return charge, event, nil
+}
+
+// the subscription, its item and the price a plan change swaps in
+func (f *FakeProcessor) planChangeItem(change *payment.PlanChange) (*stripe.Subscription, *stripe.SubscriptionItem, *stripe.Price, error) {
+	sub, err := f.activeSubscription(change.SubscriptionID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	index := slices.IndexFunc(sub.Items.Data, func(item *stripe.SubscriptionItem) bool {
+		return item.ID == change.ItemID
+	})
+	if index < 0 {
+		return nil, nil, nil, fmt.Errorf("no such subscription_item: %s", change.ItemID)
+	}
+
+	target, ok := f.prices[change.PriceID]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("no such price: %s", change.PriceID)
+	}
+
+	return sub, sub.Items.Data[index], target, nil
+}
+
+// the credit for the unused time at the item's price and the charge for it at target's, from prorationDate
+func (f *FakeProcessor) prorationLines(sub *stripe.Subscription, item *stripe.SubscriptionItem, target *stripe.Price, prorationDate int64) []*stripe.InvoiceLineItem {
+	period := item.CurrentPeriodEnd - item.CurrentPeriodStart
+	unused := item.CurrentPeriodEnd - prorationDate
+
+	if period <= 0 || unused <= 0 {
+		return nil
+	}
+
+	since := time.Unix(prorationDate, 0).UTC().Format("02 Jan 2006")
+	remaining := &stripe.Period{Start: prorationDate, End: item.CurrentPeriodEnd}
+
+	return []*stripe.InvoiceLineItem{
+		{
+			ID:          f.newID("il"),
+			Object:      "line_item",
+			Amount:      -item.Price.UnitAmount * item.Quantity * unused / period,
+			Currency:    item.Price.Currency,
+			Description: fmt.Sprintf("Unused time on %s after %s", f.priceName(item.Price), since),
+			Quantity:    item.Quantity,
+			Period:      remaining,
+			Parent:      fakeSubscriptionLineParent(sub, item, true),
+		},
+		{
+			ID:          f.newID("il"),
+			Object:      "line_item",
+			Amount:      target.UnitAmount * item.Quantity * unused / period,
+			Currency:    target.Currency,
+			Description: fmt.Sprintf("Remaining time on %s after %s", f.priceName(target), since),
+			Quantity:    item.Quantity,
+			Period:      remaining,
+			Parent:      fakeSubscriptionLineParent(sub, item, true),
+		},
+	}
+}
+
+func (f *FakeProcessor) priceName(price *stripe.Price) string {
+	if price.Product != nil {
+		if prod, ok := f.products[price.Product.ID]; ok {
+			return prod.Name
+		}
+	}
+
+	return price.ID
+}
+
+// recordEvent snapshots the object into a stripe.Event the same way stripe serializes webhook payloads.
+func (f *FakeProcessor) recordEvent(eventType stripe.EventType, object interface{}) (*stripe.Event, error) {
+	raw, err := fakeEventObject(object)
+	if err != nil {
+		return nil, err
+	}
+
+	eventJSON, err := json.Marshal(map[string]interface{}{
+		"id":          f.newID("evt"),
+		"object":      "event",
+		"api_version": stripe.APIVersion,
+		"created":     time.Now().Unix(),
+		"livemode":    false,
+		"type":        eventType,
+		"data": map[string]interface{}{
+			"object": raw,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var event stripe.Event
+	if err := json.Unmarshal(eventJSON, &event); err != nil {
+		return nil, err
+	}
+
+	f.events = append(f.events, &event)
+
+	return &event, nil
+}
+
+// fakeEventObject serializes a stripe object and collapses top level references to their ids, since stripe
+// only sends expanded objects when they are explicitly requested.
+func fakeEventObject(object interface{}) (map[string]interface{}, error) {
+	objectJSON, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(objectJSON, &data); err != nil {
+		return nil, err
+	}
+
+	for _, key := range []string{"customer", "default_payment_method", "latest_charge", "latest_invoice", "payment_intent", "pending_setup_intent", "product", "schedule", "subscription"} {
+		if ref, ok := data[key].(map[string]interface{}); ok {
+			data[key] = ref["id"]
+		}
+	}
+
+	return data, nil
+}
+
+func fakePriceInfo(price *stripe.Price, defaultPriceId string) payment.PriceInfo {
+	info := payment.PriceInfo{
+		ID:        price.ID,
+		LookupKey: price.LookupKey,
+		Amount:    price.UnitAmount,
+		Currency:  string(price.Currency),
+		Type:      "one-time",
+		Default:   price.ID == defaultPriceId,
+	}
+
+	if price.Recurring != nil {
+		info.Type = "subscription"
+		info.Interval = string(price.Recurring.Interval)
+		info.IntervalCount = price.Recurring.IntervalCount
+	}
+
+	return info
+}
+
+// the product's default trial, stored in its metadata like on stripe
+func fakeTrialDays(prod *stripe.Product) int64 {
+	days, _ := strconv.ParseInt(prod.Metadata["trial_days"], 10, 64)
+	return max(days, 0)
+}
+
+func fakeCancellationDetails(details *payment.CancellationDetails) *stripe.SubscriptionCancellationDetails {
+	cancellation := &stripe.SubscriptionCancellationDetails{
+		Reason: stripe.SubscriptionCancellationDetailsReasonCancellationRequested,
+	}
+
+	if details != nil {
+		cancellation.Feedback = stripe.SubscriptionCancellationDetailsFeedback(details.Feedback)
+		cancellation.Comment = details.Comment
+	}
+
+	return cancellation
+}
+
+func fakeSubscriptionLineParent(sub *stripe.Subscription, item *stripe.SubscriptionItem, proration bool) *stripe.InvoiceLineItemParent {
+	return &stripe.InvoiceLineItemParent{
+		Type: stripe.InvoiceLineItemParentTypeSubscriptionItemDetails,
+		SubscriptionItemDetails: &stripe.InvoiceLineItemParentSubscriptionItemDetails{
+			Proration:        proration,
+			Subscription:     sub.ID,
+			SubscriptionItem: item.ID,
+		},
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,390 @@
+package testutil_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/testutil"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+// TestFakeProcessorSubscriptionEvents checks that a subscription paid through the fake emits events
+// that look like stripe's, down to customer references being plain ids
+func TestFakeProcessorSubscriptionEvents(t *testing.T) {
+	fake := testutil.NewFakeProcessor()
+	ctx := t.Context()
+
+	customerId, err := fake.CreateCustomer(ctx, uuid.New(), "fake@example.com")
+	require.NoError(t, err)
+
+	_, err = fake.SetupSubscription(ctx, &payment.SetupProductsReq{Name: "Pro", Price: 999})
+	require.NoError(t, err)
+
+	products, err := fake.GetProducts(ctx)
+	require.NoError(t, err)
+	require.Len(t, products.Products, 1)
+
+	sub, err := fake.SubscribeToProduct(ctx, &payment.SubscribeRequest{
+		ProductID:  products.Products[0].ID,
+		CustomerID: customerId,
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, sub.ClientSecret)
+
+	intents, _, err := fake.ListPaymentIntents(ctx, customerId, nil)
+	require.NoError(t, err)
+	require.Len(t, intents, 1)
+
+	event, err := fake.SucceedPaymentIntent(intents[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, stripe.EventTypePaymentIntentSucceeded, event.Type)
+
+	// the processor contract used by the service resolves the customer from the payload
+	eventCustomer, err := fake.ProcessWebhookEvent(ctx, event)
+	require.NoError(t, err)
+	assert.Equal(t, customerId, eventCustomer)
+
+	subs, err := fake.ListSubscriptions(ctx, customerId, nil)
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	assert.Equal(t, stripe.SubscriptionStatusActive, subs[0].Status)
+	assert.Equal(t, products.Products[0].PriceID, subs[0].Items.Data[0].Price.ID)
+
+	updated := fake.LatestEvent(stripe.EventTypeCustomerSubscriptionUpdated)
+	require.NotNil(t, updated)
+
+	var subFromEvent stripe.Subscription
+	require.NoError(t, json.Unmarshal(updated.Data.Raw, &subFromEvent))
+	assert.Equal(t, sub.SubscriptionID, subFromEvent.ID)
+	assert.Equal(t, customerId, subFromEvent.Customer.ID)
+}
+
+// TestFakeProcessorSignedEvents checks that signed payloads verify like real stripe deliveries
+func TestFakeProcessorSignedEvents(t *testing.T) {
+	fake := testutil.NewFakeProcessor()
+
+	customerId, err := fake.CreateCustomer(t.Context(), uuid.New(), "fake@example.com")
+	require.NoError(t, err)
+
+	intent, err := fake.CreatePaymentIntent(t.Context(), 500, customerId)
+	require.NoError(t, err)
+
+	event, err := fake.CancelPaymentIntent(intent.PaymentIntentID)
+	require.NoError(t, err)
+
+	payload, header, err := fake.SignEvent(event, "whsec_test")
+	require.NoError(t, err)
+
+	verified, err := webhook.ConstructEvent(payload, header, "whsec_test")
+	require.NoError(t, err)
+	assert.Equal(t, event.ID, verified.ID)
+	assert.Equal(t, stripe.EventTypePaymentIntentCanceled, verified.Type)
+
+	_, err = webhook.ConstructEvent(payload, header, "whsec_other")
+	assert.Error(t, err)
+}
+
+// TestFakeProcessorPaginatesPaymentIntents checks listings are newest first and resume from their cursor
+func TestFakeProcessorPaginatesPaymentIntents(t *testing.T) {
+	fake := testutil.NewFakeProcessor()
+	ctx := t.Context()
+
+	customerId, err := fake.CreateCustomer(ctx, uuid.New(), "fake@example.com")
+	require.NoError(t, err)
+
+	var created []string
+	for range 5 {
+		intent, err := fake.CreatePaymentIntent(ctx, 100, customerId)
+		require.NoError(t, err)
+		created = append(created, intent.PaymentIntentID)
+	}
+
+	opts := &payment.ListOptions{PageSize: 2, MaxPages: 1}
+
+	page, cursor, err := fake.ListPaymentIntents(ctx, customerId, opts)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	assert.Equal(t, created[4], page[0].ID, "newest first")
+	assert.Equal(t, page[1].ID, cursor)
+
+	opts.StartingAfter = cursor
+	page, cursor, err = fake.ListPaymentIntents(ctx, customerId, opts)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	assert.Equal(t, created[2], page[0].ID)
+
+	opts.StartingAfter = cursor
+	page, cursor, err = fake.ListPaymentIntents(ctx, customerId, opts)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, created[0], page[0].ID)
+	assert.Empty(t, cursor, "nothing left to list")
+}
+
+// TestFakeProcessorCancelsSubscriptions checks scheduled and immediate cancellations and invoice refunds
+func TestFakeProcessorCancelsSubscriptions(t *testing.T) {
+	fake := testutil.NewFakeProcessor()
+	ctx := t.Context()
+
+	customerId, err := fake.CreateCustomer(ctx, uuid.New(), "fake@example.com")
+	require.NoError(t, err)
+
+	_, err = fake.SetupSubscription(ctx, &payment.SetupProductsReq{Name: "Pro", Price: 999})
+	require.NoError(t, err)
+
+	products, err := fake.GetProducts(ctx)
+	require.NoError(t, err)
+
+	subscribed, err := fake.SubscribeToProduct(ctx, &payment.SubscribeRequest{ProductID: products.Products[0].ID, CustomerID: customerId})
+	require.NoError(t, err)
+
+	intents, _, err := fake.ListPaymentIntents(ctx, customerId, nil)
+	require.NoError(t, err)
+
+	_, err = fake.SucceedPaymentIntent(intents[0].ID)
+	require.NoError(t, err)
+
+	details := &payment.CancellationDetails{Feedback: "too_expensive", Comment: "cheaper elsewhere"}
+
+	sub, err := fake.SetCancelAtPeriodEnd(ctx, subscribed.SubscriptionID, true, details)
+	require.NoError(t, err)
+	assert.True(t, sub.CancelAtPeriodEnd)
+	assert.Equal(t, sub.Items.Data[0].CurrentPeriodEnd, sub.CancelAt)
+	assert.Equal(t, stripe.SubscriptionCancellationDetailsFeedbackTooExpensive, sub.CancellationDetails.Feedback)
+
+	sub, err = fake.SetCancelAtPeriodEnd(ctx, subscribed.SubscriptionID, false, nil)
+	require.NoError(t, err)
+	assert.False(t, sub.CancelAtPeriodEnd)
+	assert.Zero(t, sub.CancelAt)
+
+	sub, err = fake.CancelSubscription(ctx, subscribed.SubscriptionID, details)
+	require.NoError(t, err)
+	assert.Equal(t, stripe.SubscriptionStatusCanceled, sub.Status)
+	assert.NotNil(t, fake.LatestEvent(stripe.EventTypeCustomerSubscriptionDeleted))
+
+	_, err = fake.CancelSubscription(ctx, subscribed.SubscriptionID, nil)
+	assert.Error(t, err)
+
+	refunded, err := fake.RefundInvoice(ctx, sub.LatestInvoice.ID, 400)
+	require.NoError(t, err)
+	assert.Equal(t, int64(400), refunded)
+	assert.NotNil(t, fake.LatestEvent(stripe.EventTypeChargeRefunded))
+}
+
+// TestFakeProcessorChangesPlans checks proration previews, immediate price swaps and scheduled ones
+func TestFakeProcessorChangesPlans(t *testing.T) {
+	fake := testutil.NewFakeProcessor()
+	ctx := t.Context()
+
+	customerId, err := fake.CreateCustomer(ctx, uuid.New(), "fake@example.com")
+	require.NoError(t, err)
+
+	_, err = fake.SetupSubscription(ctx, &payment.SetupProductsReq{Name: "Pro", Price: 3000})
+	require.NoError(t, err)
+
+	_, err = fake.SetupSubscription(ctx, &payment.SetupProductsReq{Name: "Premium", Price: 6000})
+	require.NoError(t, err)
+
+	products, err := fake.GetProducts(ctx)
+	require.NoError(t, err)
+	require.Len(t, products.Products, 2)
+
+	subscribed, err := fake.SubscribeToProduct(ctx, &payment.SubscribeRequest{ProductID: products.Products[0].ID, CustomerID: customerId})
+	require.NoError(t, err)
+
+	sub, err := fake.GetSubscription(ctx, subscribed.SubscriptionID)
+	require.NoError(t, err)
+	item := sub.Items.Data[0]
+
+	premium, err := fake.GetProductPrice(ctx, products.Products[1].ID, payment.PriceSelector{})
+	require.NoError(t, err)
+
+	// halfway through the period
+	change := &payment.PlanChange{
+		SubscriptionID:    sub.ID,
+		ItemID:            item.ID,
+		PriceID:           premium.ID,
+		ProrationBehavior: "always_invoice",
+		ProrationDate:     item.CurrentPeriodStart + (item.CurrentPeriodEnd-item.CurrentPeriodStart)/2,
+	}
+
+	invoice, err := fake.PreviewPlanChange(ctx, change)
+	require.NoError(t, err)
+	require.Len(t, invoice.Lines.Data, 2)
+	assert.Equal(t, int64(-1500), invoice.Lines.Data[0].Amount)
+	assert.Equal(t, int64(3000), invoice.Lines.Data[1].Amount)
+	assert.Equal(t, int64(1500), invoice.AmountDue)
+
+	change.ProrationBehavior = "none"
+	invoice, err = fake.PreviewPlanChange(ctx, change)
+	require.NoError(t, err)
+	require.Len(t, invoice.Lines.Data, 1)
+	assert.Equal(t, int64(6000), invoice.AmountDue, "only the renewal at the new price")
+
+	schedule, err := fake.SchedulePlanChange(ctx, change)
+	require.NoError(t, err)
+	require.Len(t, schedule.Phases, 2)
+	assert.Equal(t, item.CurrentPeriodEnd, schedule.Phases[1].StartDate)
+
+	sub, err = fake.GetSubscription(ctx, sub.ID)
+	require.NoError(t, err)
+	require.NotNil(t, sub.Schedule)
+	assert.Equal(t, schedule.ID, sub.Schedule.ID)
+
+	_, err = fake.AdvanceSubscriptionSchedule(schedule.ID)
+	require.NoError(t, err)
+
+	sub, err = fake.GetSubscription(ctx, sub.ID)
+	require.NoError(t, err)
+	assert.Equal(t, premium.ID, sub.Items.Data[0].Price.ID)
+	assert.Nil(t, sub.Schedule, "released")
+
+	change.PriceID = products.Products[0].ID
+	_, err = fake.ChangePlan(ctx, change)
+	assert.Error(t, err, "a product id is not a price")
+}
+
+// TestFakeProcessorPausesCollection checks pausing and resuming collection of a subscription
+func TestFakeProcessorPausesCollection(t *testing.T) {
+	fake := testutil.NewFakeProcessor()
+	ctx := t.Context()
+
+	customerId, err := fake.CreateCustomer(ctx, uuid.New(), "fake@example.com")
+	require.NoError(t, err)
+
+	_, err = fake.SetupSubscription(ctx, &payment.SetupProductsReq{Name: "Pro", Price: 999})
+	require.NoError(t, err)
+
+	products, err := fake.GetProducts(ctx)
+	require.NoError(t, err)
+
+	subscribed, err := fake.SubscribeToProduct(ctx, &payment.SubscribeRequest{ProductID: products.Products[0].ID, CustomerID: customerId})
+	require.NoError(t, err)
+
+	resumesAt := time.Now().AddDate(0, 1, 0).Unix()
+
+	sub, err := fake.SetPauseCollection(ctx, subscribed.SubscriptionID, &payment.PauseCollection{Behavior: "keep_as_draft", ResumesAt: resumesAt})
+	require.NoError(t, err)
+	require.NotNil(t, sub.PauseCollection)
+	assert.Equal(t, stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft, sub.PauseCollection.Behavior)
+	assert.Equal(t, resumesAt, sub.PauseCollection.ResumesAt)
+
+	sub, err = fake.SetPauseCollection(ctx, subscribed.SubscriptionID, nil)
+	require.NoError(t, err)
+	assert.Nil(t, sub.PauseCollection)
+	assert.NotNil(t, fake.LatestEvent(stripe.EventTypeCustomerSubscriptionUpdated))
+}
+
+func TestFakeProcessorStartsTrials(t *testing.T) {
+	fake := testutil.NewFakeProcessor()
+	ctx := t.Context()
+
+	customerId, err := fake.CreateCustomer(ctx, uuid.New(), "fake@example.com")
+	require.NoError(t, err)
+
+	_, err = fake.SetupSubscription(ctx, &payment.SetupProductsReq{Name: "Pro", Price: 999, TrialDays: 7})
+	require.NoError(t, err)
+
+	products, err := fake.GetProducts(ctx)
+	require.NoError(t, err)
+	require.Len(t, products.Products, 1)
+	assert.Equal(t, int64(7), products.Products[0].TrialDays)
+
+	noTrial := int64(0)
+	charged, err := fake.SubscribeToProduct(ctx, &payment.SubscribeRequest{ProductID: products.Products[0].ID, CustomerID: customerId, TrialDays: &noTrial})
+	require.NoError(t, err)
+	assert.Equal(t, string(stripe.SubscriptionStatusIncomplete), charged.Status)
+	assert.Equal(t, "payment_intent", charged.ClientSecretType)
+	assert.Nil(t, charged.TrialEnd)
+
+	trial, err := fake.SubscribeToProduct(ctx, &payment.SubscribeRequest{ProductID: products.Products[0].ID, CustomerID: customerId})
+	require.NoError(t, err)
+	assert.Equal(t, string(stripe.SubscriptionStatusTrialing), trial.Status)
+	assert.Equal(t, "setup_intent", trial.ClientSecretType)
+	require.NotNil(t, trial.TrialEnd)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 7), *trial.TrialEnd, time.Minute)
+
+	event, err := fake.TrialWillEnd(trial.SubscriptionID)
+	require.NoError(t, err)
+	assert.Equal(t, stripe.EventTypeCustomerSubscriptionTrialWillEnd, event.Type)
+
+	// saving a card through the pending setup intent keeps the subscription once the trial ends
+	sub, err := fake.GetSubscription(ctx, trial.SubscriptionID)
+	require.NoError(t, err)
+	require.NotNil(t, sub.PendingSetupIntent)
+
+	_, err = fake.SucceedSetupIntent(sub.PendingSetupIntent.ID)
+	require.NoError(t, err)
+
+	_, err = fake.EndTrial(trial.SubscriptionID)
+	require.NoError(t, err)
+
+	sub, err = fake.GetSubscription(ctx, trial.SubscriptionID)
+	require.NoError(t, err)
+	assert.Equal(t, stripe.SubscriptionStatusActive, sub.Status)
+	require.NotNil(t, sub.DefaultPaymentMethod)
+
+	// without one it is canceled
+	shortTrial := int64(3)
+	unpaid, err := fake.SubscribeToProduct(ctx, &payment.SubscribeRequest{ProductID: products.Products[0].ID, CustomerID: customerId, TrialDays: &shortTrial})
+	require.NoError(t, err)
+
+	event, err = fake.EndTrial(unpaid.SubscriptionID)
+	require.NoError(t, err)
+	assert.Equal(t, stripe.EventTypeCustomerSubscriptionDeleted, event.Type)
+
+	sub, err = fake.GetSubscription(ctx, unpaid.SubscriptionID)
+	require.NoError(t, err)
+	assert.Equal(t, stripe.SubscriptionStatusCanceled, sub.Status)
+}
+
+func TestFakeProcessorListsEveryPrice(t *testing.T) {
+	fake := testutil.NewFakeProcessor()
+	ctx := t.Context()
+
+	setup, err := fake.SetupSubscription(ctx, &payment.SetupProductsReq{
+		Name: "Pro",
+		Prices: []*payment.SetupPriceReq{
+			{Amount: 19900},
+			{Amount: 999, Interval: "month", LookupKey: "pro_monthly"},
+			{Amount: 9900, Interval: "year"},
+			{Amount: 299, Interval: "week", IntervalCount: 2},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, setup.Prices, 4)
+	assert.Equal(t, setup.Prices[0].ID, setup.PriceID)
+	assert.Equal(t, "pro_monthly", setup.Prices[0].LookupKey)
+
+	products, err := fake.GetProducts(ctx)
+	require.NoError(t, err)
+	require.Len(t, products.Products, 1)
+
+	product := products.Products[0]
+	assert.Equal(t, "subscription", product.Type)
+	assert.Equal(t, int64(999), product.Price)
+	assert.Equal(t, setup.Prices, product.Prices)
+
+	lookupKeys := []string{}
+	for _, price := range product.Prices {
+		lookupKeys = append(lookupKeys, price.LookupKey)
+	}
+	assert.Equal(t, []string{"pro_monthly", setup.ProductID + "_usd_one_time", setup.ProductID + "_usd_year", setup.ProductID + "_usd_2_week"}, lookupKeys)
+
+	assert.True(t, product.Prices[0].Default)
+	assert.Equal(t, "one-time", product.Prices[1].Type)
+	assert.Equal(t, int64(2), product.Prices[3].IntervalCount)
+
+	// lookup keys are unique across products
+	_, err = fake.SetupSubscription(ctx, &payment.SetupProductsReq{
+		Name:   "Pro again",
+		Prices: []*payment.SetupPriceReq{{Amount: 999, Interval: "month", LookupKey: "pro_monthly"}},
+	})
+	assert.Error(t, err)
+}
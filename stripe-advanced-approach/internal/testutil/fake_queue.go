@@ -0,0 +1,249 @@
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
+)
+
+/**
+* In-memory implementation of interfaces.Queue for running the webhook queue without redis.
+*
+* Mirrors the stream semantics the workers rely on: every group reads each entry once, read entries stay pending
+* until acked, and pending entries can be claimed once they have been idle for long enough.
+**/
+type FakeQueue struct {
+	mu        sync.Mutex
+	nextID    int
+	streams   map[string][]interfaces.QueueMessage
+	groups    map[string]*fakeQueueGroup
+	scheduled map[string]map[string]time.Time
+}
+
+type fakeQueueGroup struct {
+	delivered map[string]bool
+	pending   map[string]time.Time
+}
+
+func NewFakeQueue() *FakeQueue {
+	return &FakeQueue{
+		streams:   make(map[string][]interfaces.QueueMessage),
+		groups:    make(map[string]*fakeQueueGroup),
+		scheduled: make(map[string]map[string]time.Time),
+	}
+}
+
+func (q *FakeQueue) EnsureGroup(ctx context.Context, stream string, group string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.group(stream, group)
+	return nil
+}
+
+func (q *FakeQueue) Publish(ctx context.Context, stream string, values map[string]string) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.nextID++
+	id := fmt.Sprintf("%d-0", q.nextID)
+
+	copied := make(map[string]string, len(values))
+	for key, value := range values {
+		copied[key] = value
+	}
+
+	q.streams[stream] = append(q.streams[stream], interfaces.QueueMessage{ID: id, Values: copied})
+	return id, nil
+}
+
+func (q *FakeQueue) Consume(ctx context.Context, stream string, group string, consumer string, count int64, block time.Duration) ([]interfaces.QueueMessage, error) {
+	deadline := time.Now().Add(block)
+
+	for {
+		if messages := q.read(stream, group, count); len(messages) > 0 {
+			return messages, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (q *FakeQueue) ClaimStale(ctx context.Context, stream string, group string, consumer string, minIdle time.Duration, count int64) ([]interfaces.QueueMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	g := q.group(stream, group)
+
+	var claimed []interfaces.QueueMessage
+	for _, message := range q.streams[stream] {
+		readAt, ok := g.pending[message.ID]
+		if !ok || time.Since(readAt) < minIdle {
+			continue
+		}
+
+		g.pending[message.ID] = time.Now()
+		claimed = append(claimed, message)
+
+		if int64(len(claimed)) >= count {
+			break
+		}
+	}
+
+	return claimed, nil
+}
+
+func (q *FakeQueue) Ack(ctx context.Context, stream string, group string, ids ...string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	g := q.group(stream, group)
+	for _, id := range ids {
+		delete(g.pending, id)
+	}
+
+	return nil
+}
+
+func (q *FakeQueue) Range(ctx context.Context, stream string, count int64) ([]interfaces.QueueMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages := q.streams[stream]
+	if int64(len(messages)) > count {
+		messages = messages[:count]
+	}
+
+	return append([]interfaces.QueueMessage(nil), messages...), nil
+}
+
+func (q *FakeQueue) GetMessage(ctx context.Context, stream string, id string) (*interfaces.QueueMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, message := range q.streams[stream] {
+		if message.ID == id {
+			return &message, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no entry %s in stream %s", id, stream)
+}
+
+func (q *FakeQueue) Remove(ctx context.Context, stream string, ids ...string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		removed[id] = true
+	}
+
+	kept := q.streams[stream][:0]
+	for _, message := range q.streams[stream] {
+		if !removed[message.ID] {
+			kept = append(kept, message)
+		}
+	}
+	q.streams[stream] = kept
+
+	return nil
+}
+
+func (q *FakeQueue) ScheduleAt(ctx context.Context, key string, member string, at time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.scheduled[key] == nil {
+		q.scheduled[key] = make(map[string]time.Time)
+	}
+	q.scheduled[key][member] = at
+
+	return nil
+}
+
+func (q *FakeQueue) PopDue(ctx context.Context, key string, now time.Time, count int64) ([]string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []string
+	for member, at := range q.scheduled[key] {
+		if !at.After(now) {
+			due = append(due, member)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return q.scheduled[key][due[i]].Before(q.scheduled[key][due[j]])
+	})
+
+	if int64(len(due)) > count {
+		due = due[:count]
+	}
+
+	for _, member := range due {
+		delete(q.scheduled[key], member)
+	}
+
+	return due, nil
+}
+
+// --- test inspection ---
+
+// Len returns the number of entries currently in a stream
+func (q *FakeQueue) Len(stream string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.streams[stream])
+}
+
+func (q *FakeQueue) read(stream string, group string, count int64) []interfaces.QueueMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	g := q.group(stream, group)
+
+	var read []interfaces.QueueMessage
+	for _, message := range q.streams[stream] {
+		if int64(len(read)) >= count {
+			break
+		}
+
+		if g.delivered[message.ID] {
+			continue
+		}
+
+		g.delivered[message.ID] = true
+		g.pending[message.ID] = time.Now()
+		read = append(read, message)
+	}
+
+	return read
+}
+
+// must be called with the lock held
+func (q *FakeQueue) group(stream string, group string) *fakeQueueGroup {
+	key := stream + "/" + group
+
+	if q.groups[key] == nil {
+		q.groups[key] = &fakeQueueGroup{
+			delivered: make(map[string]bool),
+			pending:   make(map[string]time.Time),
+		}
+	}
+
+	return q.groups[key]
+}
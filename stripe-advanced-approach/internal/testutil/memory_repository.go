@@ -0,0 +1,697 @@
+package testutil
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/user"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+/**
+* user.Repository and payment.Repository on a MemoryStore, following the SQL repositories: missing rows are
+* sql.ErrNoRows, unique columns are enforced and the last_event_at guards skip stale writes.
+**/
+
+var _ user.Repository = (*MemoryUserRepository)(nil)
+var _ payment.Repository = (*MemoryPaymentRepository)(nil)
+
+// postgres timestamps keep microseconds
+func storedTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	rounded := t.Round(time.Microsecond)
+	return &rounded
+}
+
+// the guard of the upserts, rows without a version take any write and versioned rows only newer or equal ones
+func acceptsEvent(stored *time.Time, eventAt *time.Time) bool {
+	if stored == nil {
+		return true
+	}
+
+	return eventAt != nil && !eventAt.Before(*stored)
+}
+
+// --- users ---
+
+type MemoryUserRepository struct {
+	store *MemoryStore
+}
+
+func NewMemoryUserRepository(store *MemoryStore) *MemoryUserRepository {
+	return &MemoryUserRepository{store: store}
+}
+
+func (r *MemoryUserRepository) Create(ctx context.Context, newUser *user.User) (*user.User, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for _, existing := range r.store.users {
+		if existing.Email == newUser.Email {
+			return nil, fmt.Errorf(`pq: duplicate key value violates unique constraint "users_email_key"`)
+		}
+	}
+
+	now := r.store.nextCreated()
+	created := &user.User{
+		ID:        uuid.New(),
+		Email:     newUser.Email,
+		Password:  newUser.Password,
+		Name:      newUser.Name,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	setRow(r.store, ctx, r.store.users, created.ID, created, false)
+
+	// the columns returned by the insert
+	return &user.User{ID: created.ID, Email: created.Email, Name: created.Name, CreatedAt: now, UpdatedAt: now}, nil
+}
+
+func (r *MemoryUserRepository) GetByID(ctx context.Context, id uuid.UUID) (*user.User, error) {
+	return r.find(func(u *user.User) bool { return u.ID == id })
+}
+
+func (r *MemoryUserRepository) GetByEmail(ctx context.Context, email string) (*user.User, error) {
+	return r.find(func(u *user.User) bool { return u.Email == email })
+}
+
+func (r *MemoryUserRepository) GetByStripeCustomerID(ctx context.Context, stripeCustomerID string) (*user.User, error) {
+	return r.find(func(u *user.User) bool { return u.StripeCustomerID != nil && *u.StripeCustomerID == stripeCustomerID })
+}
+
+func (r *MemoryUserRepository) List(ctx context.Context) ([]user.User, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	var users []user.User
+	for _, stored := range r.store.users {
+		users = append(users, *copyUser(stored))
+	}
+
+	slices.SortFunc(users, func(a, b user.User) int { return b.CreatedAt.Compare(a.CreatedAt) })
+
+	return users, nil
+}
+
+func (r *MemoryUserRepository) Update(ctx context.Context, updated *user.User) error {
+	return r.update(ctx, updated.ID, func(u *user.User) {
+		u.Name = updated.Name
+		u.Email = updated.Email
+		u.Subscribed = updated.Subscribed
+		updated.UpdatedAt = u.UpdatedAt
+	})
+}
+
+func (r *MemoryUserRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if _, exists := r.store.users[id]; exists {
+		setRow(r.store, ctx, r.store.users, id, nil, true)
+	}
+
+	return nil
+}
+
+func (r *MemoryUserRepository) UpdateStripeCustomer(ctx context.Context, userID uuid.UUID, stripeCustomerID string) error {
+	err := r.update(ctx, userID, func(u *user.User) { u.StripeCustomerID = &stripeCustomerID })
+
+	// an update without a row is a no-op
+	if err == sql.ErrNoRows {
+		return nil
+	}
+
+	return err
+}
+
+func (r *MemoryUserRepository) UpdateSubscribed(ctx context.Context, userID uuid.UUID, subscribed bool) error {
+	err := r.update(ctx, userID, func(u *user.User) { u.Subscribed = subscribed })
+
+	if err == sql.ErrNoRows {
+		return nil
+	}
+
+	return err
+}
+
+func (r *MemoryUserRepository) find(match func(u *user.User) bool) (*user.User, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for _, stored := range r.store.users {
+		if match(stored) {
+			return copyUser(stored), nil
+		}
+	}
+
+	return &user.User{}, sql.ErrNoRows
+}
+
+// replaces the user's row with a changed copy
+func (r *MemoryUserRepository) update(ctx context.Context, id uuid.UUID, change func(u *user.User)) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, exists := r.store.users[id]
+	if !exists {
+		return sql.ErrNoRows
+	}
+
+	updated := copyUser(stored)
+	updated.UpdatedAt = time.Now()
+	change(updated)
+
+	setRow(r.store, ctx, r.store.users, id, updated, false)
+	return nil
+}
+
+func copyUser(u *user.User) *user.User {
+	copied := *u
+
+	if u.StripeCustomerID != nil {
+		customerID := *u.StripeCustomerID
+		copied.StripeCustomerID = &customerID
+	}
+
+	return &copied
+}
+
+// --- payments ---
+
+type MemoryPaymentRepository struct {
+	store *MemoryStore
+}
+
+func NewMemoryPaymentRepository(store *MemoryStore) *MemoryPaymentRepository {
+	return &MemoryPaymentRepository{store: store}
+}
+
+func (r *MemoryPaymentRepository) Create(ctx context.Context, userId uuid.UUID, paymentIntent *payment.PaymentIntentRequest) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if _, exists := r.store.payments[paymentIntent.IntentID]; exists {
+		return fmt.Errorf(`pq: duplicate key value violates unique constraint "payments_stripe_payment_intent_id_key"`)
+	}
+
+	now := r.store.nextCreated()
+
+	setRow(r.store, ctx, r.store.payments, paymentIntent.IntentID, &payment.Payment{
+		ID:               uuid.New(),
+		UserID:           userId,
+		StripeCustomerID: paymentIntent.CustomerID,
+		StripeIntentID:   paymentIntent.IntentID,
+		Amount:           paymentIntent.Amount,
+		Currency:         "usd",
+		Status:           "pending",
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}, false)
+
+	return nil
+}
+
+func (r *MemoryPaymentRepository) GetPaymentByIntentID(ctx context.Context, intentID string) (*payment.Payment, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, exists := r.store.payments[intentID]
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	return copyPayment(stored), nil
+}
+
+func (r *MemoryPaymentRepository) UpdateStatus(ctx context.Context, intentID string, status string, eventAt time.Time) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, exists := r.store.payments[intentID]
+	if !exists || !acceptsEvent(stored.LastEventAt, storedTime(&eventAt)) {
+		return nil
+	}
+
+	updated := copyPayment(stored)
+	updated.Status = status
+	updated.LastEventAt = storedTime(&eventAt)
+	updated.UpdatedAt = time.Now()
+
+	setRow(r.store, ctx, r.store.payments, intentID, updated, false)
+	return nil
+}
+
+func (r *MemoryPaymentRepository) UpsertPayment(ctx context.Context, paymentIntentID string, mirrored *payment.Payment) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, exists := r.store.payments[paymentIntentID]
+
+	if !exists {
+		now := r.store.nextCreated()
+
+		setRow(r.store, ctx, r.store.payments, paymentIntentID, &payment.Payment{
+			ID:               uuid.New(),
+			UserID:           mirrored.UserID,
+			StripeCustomerID: mirrored.StripeCustomerID,
+			StripeIntentID:   paymentIntentID,
+			Amount:           mirrored.Amount,
+			Status:           mirrored.Status,
+			Currency:         mirrored.Currency,
+			LastEventAt:      storedTime(mirrored.LastEventAt),
+			CreatedAt:        now,
+			UpdatedAt:        now,
+		}, false)
+
+		return nil
+	}
+
+	// row reflects newer stripe state
+	if !acceptsEvent(stored.LastEventAt, storedTime(mirrored.LastEventAt)) {
+		return nil
+	}
+
+	updated := copyPayment(stored)
+	updated.Amount = mirrored.Amount
+	updated.Status = mirrored.Status
+	updated.Currency = mirrored.Currency
+	updated.LastEventAt = storedTime(mirrored.LastEventAt)
+	updated.UpdatedAt = time.Now()
+
+	setRow(r.store, ctx, r.store.payments, paymentIntentID, updated, false)
+	return nil
+}
+
+func (r *MemoryPaymentRepository) UpsertSubscriptionRecord(ctx context.Context, sub *payment.Subscription) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, exists := r.store.subscriptions[sub.StripeSubscriptionID]
+
+	// row reflects newer stripe state
+	if exists && !acceptsEvent(stored.LastEventAt, storedTime(sub.LastEventAt)) {
+		return nil
+	}
+
+	updated := copySubscription(sub)
+	updated.LastEventAt = storedTime(sub.LastEventAt)
+	updated.Items = nil
+	updated.UpdatedAt = time.Now()
+
+	if updated.DiscountIDs == nil {
+		updated.DiscountIDs = pq.StringArray{}
+	}
+
+	if exists {
+		// columns the upsert doesn't update
+		updated.ID = stored.ID
+		updated.UserID = stored.UserID
+		updated.StripeCustomerID = stored.StripeCustomerID
+		updated.TrialEndingNoticeAt = stored.TrialEndingNoticeAt
+		updated.CreatedAt = stored.CreatedAt
+	} else {
+		updated.ID = uuid.New()
+		updated.CreatedAt = r.store.nextCreated()
+	}
+
+	setRow(r.store, ctx, r.store.subscriptions, sub.StripeSubscriptionID, updated, false)
+
+	// item state unknown (e.g. straight after creating the subscription), keep the mirrored items
+	if sub.Items == nil {
+		return nil
+	}
+
+	items := make([]*payment.SubscriptionItem, 0, len(sub.Items))
+
+	for _, item := range sub.Items {
+		mirrored := *item
+		mirrored.StripeSubscriptionID = sub.StripeSubscriptionID
+		mirrored.ID = uuid.New()
+		mirrored.CreatedAt = r.store.nextCreated()
+
+		// keep the identity of items that were mirrored before
+		for _, existing := range r.store.subscriptionItems[sub.StripeSubscriptionID] {
+			if existing.StripeSubscriptionItemID == item.StripeSubscriptionItemID {
+				mirrored.ID = existing.ID
+				mirrored.CreatedAt = existing.CreatedAt
+			}
+		}
+
+		mirrored.UpdatedAt = time.Now()
+		items = append(items, &mirrored)
+	}
+
+	slices.SortStableFunc(items, func(a, b *payment.SubscriptionItem) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	setRow(r.store, ctx, r.store.subscriptionItems, sub.StripeSubscriptionID, items, false)
+	return nil
+}
+
+func (r *MemoryPaymentRepository) GetActiveSubscription(ctx context.Context, userID uuid.UUID) (*payment.Subscription, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	var current *payment.Subscription
+
+	for _, stored := range r.store.subscriptions {
+		if stored.UserID != userID || (stored.Status != "active" && stored.Status != "trialing") {
+			continue
+		}
+
+		// one still collecting payments over a paused one, then the newest
+		if current == nil || preferSubscription(stored, current) {
+			current = stored
+		}
+	}
+
+	if current == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return r.withItems(current), nil
+}
+
+func preferSubscription(candidate *payment.Subscription, current *payment.Subscription) bool {
+	candidatePaused, currentPaused := candidate.PauseBehavior != "", current.PauseBehavior != ""
+
+	if candidatePaused != currentPaused {
+		return !candidatePaused
+	}
+
+	return candidate.CreatedAt.After(current.CreatedAt)
+}
+
+func (r *MemoryPaymentRepository) GetSubscriptionByStripeID(ctx context.Context, subID string) (*payment.Subscription, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, exists := r.store.subscriptions[subID]
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	return r.withItems(stored), nil
+}
+
+func (r *MemoryPaymentRepository) ListSubscriptionsByCustomer(ctx context.Context, customerID string) ([]*payment.Subscription, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	subscriptions := []*payment.Subscription{}
+
+	for _, stored := range r.store.subscriptions {
+		if stored.StripeCustomerID == customerID {
+			subscriptions = append(subscriptions, copySubscription(stored))
+		}
+	}
+
+	slices.SortFunc(subscriptions, func(a, b *payment.Subscription) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	return subscriptions, nil
+}
+
+func (r *MemoryPaymentRepository) UpdateSubscriptionStatus(ctx context.Context, subID string, status string, eventAt time.Time) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, exists := r.store.subscriptions[subID]
+	if !exists || !acceptsEvent(stored.LastEventAt, storedTime(&eventAt)) {
+		return nil
+	}
+
+	updated := copySubscription(stored)
+	updated.Status = status
+	updated.LastEventAt = storedTime(&eventAt)
+	updated.UpdatedAt = time.Now()
+
+	setRow(r.store, ctx, r.store.subscriptions, subID, updated, false)
+	return nil
+}
+
+func (r *MemoryPaymentRepository) SetTrialEndingNotice(ctx context.Context, subID string, noticeAt *time.Time) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, exists := r.store.subscriptions[subID]
+	if !exists {
+		return nil
+	}
+
+	updated := copySubscription(stored)
+	updated.TrialEndingNoticeAt = storedTime(noticeAt)
+	updated.UpdatedAt = time.Now()
+
+	setRow(r.store, ctx, r.store.subscriptions, subID, updated, false)
+	return nil
+}
+
+func (r *MemoryPaymentRepository) GetCustomerSyncState(ctx context.Context, customerID string) (*payment.CustomerSyncState, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, exists := r.store.syncStates[customerID]
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	state := *stored
+	return &state, nil
+}
+
+func (r *MemoryPaymentRepository) SaveCustomerSyncState(ctx context.Context, state *payment.CustomerSyncState) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	saved := *state
+	saved.LastFullSyncAt = storedTime(state.LastFullSyncAt)
+	saved.UpdatedAt = time.Now()
+
+	setRow(r.store, ctx, r.store.syncStates, state.StripeCustomerID, &saved, false)
+	return nil
+}
+
+func (r *MemoryPaymentRepository) SaveWebhookEvent(ctx context.Context, event *payment.WebhookEvent) (*payment.WebhookEvent, bool, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	// conflict, event was delivered before
+	if existing, exists := r.store.webhookEvents[event.StripeEventID]; exists {
+		return copyWebhookEvent(existing), false, nil
+	}
+
+	now := r.store.nextCreated()
+	saved := &payment.WebhookEvent{
+		ID:            uuid.New(),
+		StripeEventID: event.StripeEventID,
+		EventType:     event.EventType,
+		CustomerID:    event.CustomerID,
+		Payload:       slices.Clone(event.Payload),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	setRow(r.store, ctx, r.store.webhookEvents, event.StripeEventID, saved, false)
+	return copyWebhookEvent(saved), true, nil
+}
+
+func (r *MemoryPaymentRepository) GetWebhookEventByStripeID(ctx context.Context, stripeEventID string) (*payment.WebhookEvent, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, exists := r.store.webhookEvents[stripeEventID]
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	return copyWebhookEvent(stored), nil
+}
+
+func (r *MemoryPaymentRepository) ListWebhookEvents(ctx context.Context, filter *payment.WebhookReplayRequest) ([]*payment.WebhookEvent, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	var events []*payment.WebhookEvent
+
+	for _, stored := range r.store.webhookEvents {
+		if webhookEventMatches(stored, filter) {
+			events = append(events, copyWebhookEvent(stored))
+		}
+	}
+
+	slices.SortFunc(events, func(a, b *payment.WebhookEvent) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+
+	return events, nil
+}
+
+func webhookEventMatches(event *payment.WebhookEvent, filter *payment.WebhookReplayRequest) bool {
+	if filter.EventType != "" && event.EventType != filter.EventType {
+		return false
+	}
+
+	if filter.CustomerID != "" && (event.CustomerID == nil || *event.CustomerID != filter.CustomerID) {
+		return false
+	}
+
+	if filter.From != nil && event.CreatedAt.Before(*filter.From) {
+		return false
+	}
+
+	if filter.To != nil && !event.CreatedAt.Before(*filter.To) {
+		return false
+	}
+
+	switch filter.State {
+	case "processed":
+		return event.Processed
+	case "failed":
+		return !event.Processed && event.FailedAt != nil
+	case "pending":
+		return !event.Processed && event.FailedAt == nil
+	}
+
+	return true
+}
+
+func (r *MemoryPaymentRepository) MarkWebhookEventProcessed(ctx context.Context, stripeEventID string) error {
+	return r.updateWebhookEvent(ctx, stripeEventID, func(event *payment.WebhookEvent) {
+		now := time.Now()
+
+		event.Processed = true
+		event.Attempts++
+		event.LastError = nil
+		event.ProcessedAt = &now
+	})
+}
+
+func (r *MemoryPaymentRepository) MarkWebhookEventFailed(ctx context.Context, stripeEventID string, processingErr string) error {
+	return r.updateWebhookEvent(ctx, stripeEventID, func(event *payment.WebhookEvent) {
+		now := time.Now()
+
+		event.Attempts++
+		event.LastError = &processingErr
+		event.FailedAt = &now
+	})
+}
+
+func (r *MemoryPaymentRepository) updateWebhookEvent(ctx context.Context, stripeEventID string, change func(event *payment.WebhookEvent)) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, exists := r.store.webhookEvents[stripeEventID]
+	if !exists {
+		return nil
+	}
+
+	updated := copyWebhookEvent(stored)
+	updated.UpdatedAt = time.Now()
+	change(updated)
+
+	setRow(r.store, ctx, r.store.webhookEvents, stripeEventID, updated, false)
+	return nil
+}
+
+func (r *MemoryPaymentRepository) ListCacheCustomers(ctx context.Context, afterUserID uuid.UUID, limit int) ([]*payment.CacheCustomer, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	customers := r.cacheCustomers(func(u *user.User) bool {
+		return strings.Compare(u.ID.String(), afterUserID.String()) > 0
+	})
+
+	slices.SortFunc(customers, func(a, b *payment.CacheCustomer) int {
+		return strings.Compare(a.UserID.String(), b.UserID.String())
+	})
+
+	if len(customers) > limit {
+		customers = customers[:limit]
+	}
+
+	return customers, nil
+}
+
+func (r *MemoryPaymentRepository) SampleCacheCustomers(ctx context.Context, limit int) ([]*payment.CacheCustomer, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	customers := r.cacheCustomers(func(u *user.User) bool { return true })
+
+	rand.Shuffle(len(customers), func(i, j int) { customers[i], customers[j] = customers[j], customers[i] })
+
+	if len(customers) > limit {
+		customers = customers[:limit]
+	}
+
+	return customers, nil
+}
+
+// users with a stripe customer, callers hold mu
+func (r *MemoryPaymentRepository) cacheCustomers(match func(u *user.User) bool) []*payment.CacheCustomer {
+	customers := []*payment.CacheCustomer{}
+
+	for _, stored := range r.store.users {
+		if stored.StripeCustomerID == nil || !match(stored) {
+			continue
+		}
+
+		customer := &payment.CacheCustomer{UserID: stored.ID, StripeCustomerID: *stored.StripeCustomerID}
+
+		for _, sub := range r.store.subscriptions {
+			if sub.StripeCustomerID == customer.StripeCustomerID {
+				customer.HasSubscriptions = true
+				break
+			}
+		}
+
+		customers = append(customers, customer)
+	}
+
+	return customers
+}
+
+// copy of a subscription row with its items, callers hold mu
+func (r *MemoryPaymentRepository) withItems(stored *payment.Subscription) *payment.Subscription {
+	subscription := copySubscription(stored)
+	subscription.Items = []*payment.SubscriptionItem{}
+
+	for _, item := range r.store.subscriptionItems[stored.StripeSubscriptionID] {
+		copied := *item
+		subscription.Items = append(subscription.Items, &copied)
+	}
+
+	return subscription
+}
+
+func copyPayment(p *payment.Payment) *payment.Payment {
+	copied := *p
+	return &copied
+}
+
+func copySubscription(sub *payment.Subscription) *payment.Subscription {
+	copied := *sub
+	copied.DiscountIDs = slices.Clone(sub.DiscountIDs)
+	copied.Items = nil
+
+	return &copied
+}
+
+func copyWebhookEvent(event *payment.WebhookEvent) *payment.WebhookEvent {
+	copied := *event
+	copied.Payload = slices.Clone(event.Payload)
+
+	return &copied
+}
@@ -0,0 +1,141 @@
+package testutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/database"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/user"
+	"github.com/google/uuid"
+)
+
+/**
+* In-memory tables behind the user and payment repositories, for running the services without postgres.
+*
+* Each table is a map keyed like its unique column. Rows are copied in and out so callers can't change stored
+* state by holding on to a row. Writes made in a transaction of the MemoryUnitOfWork are applied right away and
+* record how to undo them, a rollback undoes them in reverse order. Unlike postgres other callers see them before
+* the commit, which the flow tests don't depend on.
+**/
+type MemoryStore struct {
+	mu sync.Mutex
+
+	users             map[uuid.UUID]*user.User
+	payments          map[string]*payment.Payment      // by payment intent id
+	subscriptions     map[string]*payment.Subscription // by subscription id, without items
+	subscriptionItems map[string][]*payment.SubscriptionItem
+	syncStates        map[string]*payment.CustomerSyncState
+	webhookEvents     map[string]*payment.WebhookEvent
+
+	// created_at of the newest row, rows of the same instant are ordered by insertion
+	lastCreated time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:             map[uuid.UUID]*user.User{},
+		payments:          map[string]*payment.Payment{},
+		subscriptions:     map[string]*payment.Subscription{},
+		subscriptionItems: map[string][]*payment.SubscriptionItem{},
+		syncStates:        map[string]*payment.CustomerSyncState{},
+		webhookEvents:     map[string]*payment.WebhookEvent{},
+	}
+}
+
+type memoryTxKey struct{}
+
+// writes of a transaction, undone on rollback
+type memoryTx struct {
+	mu   sync.Mutex
+	undo []func()
+}
+
+// runs repository calls of the memory repositories in transactions carried by the context
+type MemoryUnitOfWork struct {
+	store *MemoryStore
+}
+
+func NewMemoryUnitOfWork(store *MemoryStore) *MemoryUnitOfWork {
+	return &MemoryUnitOfWork{store: store}
+}
+
+/**
+* Same contract as the sqlx unit of work: nested calls join, AfterCommit hooks run after the outermost call
+* succeeded and AfterRollback hooks after it failed.
+**/
+func (u *MemoryUnitOfWork) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(memoryTxKey{}).(*memoryTx); ok {
+		return fn(ctx)
+	}
+
+	tx := &memoryTx{}
+	txCtx, commit, rollback := database.BeginHooks(context.WithValue(ctx, memoryTxKey{}, tx))
+
+	if err := fn(txCtx); err != nil {
+		u.rollback(tx)
+		rollback(ctx)
+
+		return err
+	}
+
+	commit(ctx)
+	return nil
+}
+
+func (u *MemoryUnitOfWork) rollback(tx *memoryTx) {
+	u.store.mu.Lock()
+	defer u.store.mu.Unlock()
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+}
+
+// records how to undo a write made under mu, when it is part of a transaction
+func (s *MemoryStore) recordUndo(ctx context.Context, undo func()) {
+	tx, ok := ctx.Value(memoryTxKey{}).(*memoryTx)
+	if !ok {
+		return
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.undo = append(tx.undo, undo)
+}
+
+// the created_at of a new row, callers hold mu
+func (s *MemoryStore) nextCreated() time.Time {
+	created := time.Now()
+
+	if !created.After(s.lastCreated) {
+		created = s.lastCreated.Add(time.Microsecond)
+	}
+
+	s.lastCreated = created
+	return created
+}
+
+// writes row under key of table, or deletes it for a nil row, undone on rollback. callers hold mu
+func setRow[K comparable, V any](s *MemoryStore, ctx context.Context, table map[K]V, key K, row V, deleted bool) {
+	previous, existed := table[key]
+
+	if deleted {
+		delete(table, key)
+	} else {
+		table[key] = row
+	}
+
+	s.recordUndo(ctx, func() {
+		if existed {
+			table[key] = previous
+		} else {
+			delete(table, key)
+		}
+	})
+}
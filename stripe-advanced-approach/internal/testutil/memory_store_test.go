@@ -0,0 +1,66 @@
+package testutil_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/database"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/testutil"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMemoryUnitOfWorkRollsBack checks the in-memory unit of work keeps the contract of the sqlx one: a failure
+// undoes every write and drops the AfterCommit hooks, a success runs them once
+func TestMemoryUnitOfWorkRollsBack(t *testing.T) {
+	store := testutil.NewMemoryStore()
+	unitOfWork := testutil.NewMemoryUnitOfWork(store)
+	userRepo := testutil.NewMemoryUserRepository(store)
+	ctx := t.Context()
+
+	failure := errors.New("stripe unavailable")
+	hookRan := false
+	undone := false
+
+	err := unitOfWork.WithinTx(ctx, func(ctx context.Context) error {
+		created, err := userRepo.Create(ctx, &user.User{Email: "rollback@example.com", Password: "hashed", Name: "Rollback"})
+		require.NoError(t, err)
+		require.NoError(t, userRepo.UpdateStripeCustomer(ctx, created.ID, "cus_rolled_back"))
+
+		database.AfterCommit(ctx, func(ctx context.Context) { hookRan = true })
+		database.AfterRollback(ctx, func(ctx context.Context) { undone = true })
+
+		return failure
+	})
+
+	assert.ErrorIs(t, err, failure)
+	assert.True(t, undone, "rollback hooks undo side effects outside of the transaction")
+	assert.False(t, hookRan, "hooks must not run after a rollback")
+
+	_, err = userRepo.GetByEmail(ctx, "rollback@example.com")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	hookRuns := 0
+
+	err = unitOfWork.WithinTx(ctx, func(ctx context.Context) error {
+		return unitOfWork.WithinTx(ctx, func(ctx context.Context) error {
+			_, err := userRepo.Create(ctx, &user.User{Email: "rollback@example.com", Password: "hashed", Name: "Committed"})
+			if err != nil {
+				return err
+			}
+
+			database.AfterCommit(ctx, func(ctx context.Context) { hookRuns++ })
+			return nil
+		})
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, hookRuns)
+
+	committed, err := userRepo.GetByEmail(ctx, "rollback@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Committed", committed.Name)
+}
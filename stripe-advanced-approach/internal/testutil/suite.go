@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/cache"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/database"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/payment"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/redis"
 	"github.com/darkphotonKN/stripe-advanced-approach/internal/user"
@@ -27,23 +31,28 @@ type TestUser struct {
 // BaseSuite provides basic infrastructure for tests (DB, Redis, Stripe)
 // Use this when you only need basic infrastructure without service dependencies
 type BaseSuite struct {
-	Ctx         context.Context
-	DB          *sqlx.DB
-	RedisClient *redis.Client
-	CleanupFunc func()
-	TestUser    TestUser
+	Ctx          context.Context
+	DB           *sqlx.DB
+	RedisClient  *redis.Client
+	StripeClient *stripe.Client
+	CleanupFunc  func()
+	TestUser     TestUser
 }
 
 // FullSuite provides complete test environment with all services
 // Use this when you need services with proper dependency injection
 type FullSuite struct {
 	Ctx         context.Context
-	DB          *sqlx.DB
+	DB          *sqlx.DB // nil for in-memory fake suites
 	RedisClient *redis.Client
+	// what the services cache on, the redis client or an in-memory cache
+	Cache       interfaces.Cache
 	CleanupFunc func()
 
 	UserService    user.Service
 	PaymentService payment.Service
+	// the transactions the services and repositories run in
+	UnitOfWork interfaces.UnitOfWork
 
 	// Repositories
 	UserRepo    user.Repository
@@ -53,6 +62,9 @@ type FullSuite struct {
 	UserHandler    *user.Handler
 	PaymentHandler *payment.Handler
 
+	// in-memory stripe, only set by SetupFake
+	FakeProcessor *FakeProcessor
+
 	// Test Data
 	TestUser TestUser
 }
@@ -68,10 +80,11 @@ func SetupBase(t *testing.T) *BaseSuite {
 	}
 
 	// Setup Stripe
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	if stripe.Key == "" {
+	stripeKey := os.Getenv("STRIPE_SECRET_KEY")
+	if stripeKey == "" {
 		t.Skip("STRIPE_SECRET_KEY not set, skipping test")
 	}
+	stripeClient := payment.NewStripeClient(stripeKey, os.Getenv("STRIPE_API_BASE_URL"))
 
 	// Setup database connection
 	dbUser := os.Getenv("DB_USER")
@@ -110,11 +123,12 @@ func SetupBase(t *testing.T) *BaseSuite {
 	}
 
 	return &BaseSuite{
-		Ctx:         context.Background(),
-		DB:          db,
-		RedisClient: redisClient,
-		CleanupFunc: cleanupFunc,
-		TestUser:    testUser,
+		Ctx:          context.Background(),
+		DB:           db,
+		RedisClient:  redisClient,
+		StripeClient: stripeClient,
+		CleanupFunc:  cleanupFunc,
+		TestUser:     testUser,
 	}
 }
 
@@ -136,10 +150,11 @@ func SetupFull(t *testing.T) *FullSuite {
 	}
 
 	// Setup Stripe
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	if stripe.Key == "" {
+	stripeKey := os.Getenv("STRIPE_SECRET_KEY")
+	if stripeKey == "" {
 		t.Skip("STRIPE_SECRET_KEY not set, skipping test")
 	}
+	stripeClient := payment.NewStripeClient(stripeKey, os.Getenv("STRIPE_API_BASE_URL"))
 
 	// Setup database connection
 	dbUser := os.Getenv("DB_USER")
@@ -164,16 +179,17 @@ func SetupFull(t *testing.T) *FullSuite {
 	redisClient := redis.NewClient()
 
 	// Setup repositories
+	unitOfWork := database.NewUnitOfWork(db)
 	userRepo := user.NewRepository(db)
 	paymentRepo := payment.NewRepository(db)
 
 	// Setup services with proper dependency injection
 	// Step 1: Create user service first (without payment service)
-	userService := user.NewService(userRepo)
+	userService := user.NewService(userRepo, unitOfWork)
 
 	// Step 2: Create payment service (can accept user service)
-	stripeProcessor := payment.NewStripeProcessor()
-	paymentService := payment.NewService(paymentRepo, userService, stripeProcessor, redisClient)
+	stripeProcessor := payment.NewStripeProcessor(stripeClient)
+	paymentService := payment.NewService(paymentRepo, unitOfWork, userService, stripeProcessor, redisClient)
 
 	// Step 3: Inject payment service back into user service (resolves circular dependency)
 	userService.SetPaymentService(paymentService)
@@ -200,10 +216,12 @@ func SetupFull(t *testing.T) *FullSuite {
 		Ctx:         context.Background(),
 		DB:          db,
 		RedisClient: redisClient,
+		Cache:       redisClient,
 		CleanupFunc: cleanupFunc,
 
 		UserService:    userService,
 		PaymentService: paymentService,
+		UnitOfWork:     unitOfWork,
 
 		UserRepo:    userRepo,
 		PaymentRepo: paymentRepo,
@@ -222,3 +240,168 @@ func SetupFullWithUser(t *testing.T, customUser TestUser) *FullSuite {
 	return suite
 }
 
+// options of SetupFake
+type fakeConfig struct {
+	postgres     bool
+	redis        bool
+	webhookQueue bool
+	syncLock     bool
+}
+
+type FakeOption func(*fakeConfig)
+
+// WithPostgres stores rows in postgres instead of in memory, the test is skipped when it isn't reachable
+func WithPostgres() FakeOption {
+	return func(config *fakeConfig) { config.postgres = true }
+}
+
+// WithRedis caches on a real redis instead of in memory, the test is skipped when redis isn't reachable
+func WithRedis() FakeOption {
+	return func(config *fakeConfig) { config.redis = true }
+}
+
+// WithWebhookQueue processes webhooks through the webhook queue on an in-memory FakeQueue instead of inline
+func WithWebhookQueue() FakeOption {
+	return func(config *fakeConfig) { config.webhookQueue = true }
+}
+
+// WithoutSyncLock runs customer syncs directly instead of under the per-customer lock
+func WithoutSyncLock() FakeOption {
+	return func(config *fakeConfig) { config.syncLock = false }
+}
+
+// SetupFake creates a fully configured test environment backed by the in-memory FakeProcessor instead of stripe
+// Use this for flow tests (purchase, subscribe, webhooks) that should run without network access or stripe keys
+// Rows and the cache are kept in memory unless WithPostgres or WithRedis is passed
+func SetupFake(t *testing.T, options ...FakeOption) *FullSuite {
+	t.Helper()
+
+	config := fakeConfig{syncLock: true}
+	for _, option := range options {
+		option(&config)
+	}
+
+	// Load environment variables
+	if err := godotenv.Load("../../.env"); err != nil {
+		t.Log("No .env file found, using environment variables")
+	}
+
+	// Setup repositories, in memory unless postgres is asked for
+	var db *sqlx.DB
+	var unitOfWork interfaces.UnitOfWork
+	var userRepo user.Repository
+	var paymentRepo payment.Repository
+
+	if config.postgres {
+		dsn := fmt.Sprintf("postgresql://%s:%s@%s:%s/%s?sslmode=disable",
+			os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_NAME"))
+
+		var err error
+		db, err = sqlx.Open("postgres", dsn)
+		if err != nil {
+			t.Skipf("Database not available, skipping test: %v", err)
+		}
+
+		if err := db.Ping(); err != nil {
+			db.Close()
+			t.Skipf("Database not reachable, skipping test: %v", err)
+		}
+
+		unitOfWork = database.NewUnitOfWork(db)
+		userRepo = user.NewRepository(db)
+		paymentRepo = payment.NewRepository(db)
+	} else {
+		store := NewMemoryStore()
+
+		unitOfWork = NewMemoryUnitOfWork(store)
+		userRepo = NewMemoryUserRepository(store)
+		paymentRepo = NewMemoryPaymentRepository(store)
+	}
+
+	closeDB := func() {
+		if db != nil {
+			db.Close()
+		}
+	}
+
+	// Setup cache, the sync lock and the read-through rebuilds run on it as well
+	var redisClient *redis.Client
+	var cacheClient interfaces.Cache = cache.NewMemory(0)
+
+	if config.redis {
+		redisClient = redis.NewClient()
+
+		pingCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		if err := redisClient.Ping(pingCtx); err != nil {
+			closeDB()
+			t.Skipf("Redis not reachable, skipping test: %v", err)
+		}
+
+		cacheClient = redisClient
+	}
+
+	// Setup services, same wiring as SetupFull but with the fake processor
+	userService := user.NewService(userRepo, unitOfWork)
+	fakeProcessor := NewFakeProcessor()
+	paymentService := payment.NewService(paymentRepo, unitOfWork, userService, fakeProcessor, cacheClient)
+	paymentService.SetSyncLocking(config.syncLock)
+	userService.SetPaymentService(paymentService)
+
+	// Setup webhook queue workers, stopped by the cleanup
+	queueCtx, stopQueue := context.WithCancel(context.Background())
+
+	if config.webhookQueue {
+		queueConfig := payment.DefaultWebhookQueueConfig()
+		queueConfig.BlockTimeout = 20 * time.Millisecond
+		queueConfig.RetryPoll = 10 * time.Millisecond
+		queueConfig.BaseBackoff = 10 * time.Millisecond
+
+		webhookQueue := payment.NewWebhookQueue(NewFakeQueue(), paymentService, queueConfig)
+		paymentService.SetWebhookQueue(webhookQueue)
+
+		go webhookQueue.Run(queueCtx)
+	}
+
+	// Setup handlers
+	userHandler := user.NewHandler(userService)
+	paymentHandler := payment.NewHandler(paymentService)
+
+	// Create test user data
+	newUserId := uuid.New().String()[:8]
+	testUser := TestUser{
+		UserID:   uuid.New(),
+		Email:    fmt.Sprintf("test%s@example.com", newUserId),
+		Password: "testpass123",
+	}
+
+	// Cleanup function
+	cleanupFunc := func() {
+		stopQueue()
+		cacheClient.Close()
+		closeDB()
+	}
+
+	return &FullSuite{
+		Ctx:         context.Background(),
+		DB:          db,
+		RedisClient: redisClient,
+		Cache:       cacheClient,
+		CleanupFunc: cleanupFunc,
+
+		UserService:    userService,
+		PaymentService: paymentService,
+		UnitOfWork:     unitOfWork,
+
+		UserRepo:    userRepo,
+		PaymentRepo: paymentRepo,
+
+		UserHandler:    userHandler,
+		PaymentHandler: paymentHandler,
+
+		FakeProcessor: fakeProcessor,
+
+		TestUser: testUser,
+	}
+}
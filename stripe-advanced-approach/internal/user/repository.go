@@ -2,8 +2,8 @@ package user
 
 import (
 	"context"
-	"fmt"
 
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/database"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 )
@@ -16,17 +16,19 @@ func NewRepository(db *sqlx.DB) *repository {
 	return &repository{db: db}
 }
 
-func (r *repository) Create(ctx context.Context, user *User) (*User, error) {
-	fmt.Printf("repo create inc user: %+v\n", *user)
-	fmt.Printf("repo create inc user.email %s\n user.password %s \nuser.name: %+v\n", user.Email, user.Password, user.Name)
+// queries join the transaction carried by the context, if any
+func (r *repository) conn(ctx context.Context) database.Executor {
+	return database.Conn(ctx, r.db)
+}
 
+func (r *repository) Create(ctx context.Context, user *User) (*User, error) {
 	query := `
 		INSERT INTO users (email, password, name, created_at, updated_at)
 		VALUES ($1, $2, $3, NOW(), NOW())
 		RETURNING id, email, name, created_at, updated_at
 	`
 	var createdUser User
-	err := r.db.GetContext(ctx, &createdUser, query, user.Email, user.Password, user.Name)
+	err := r.conn(ctx).GetContext(ctx, &createdUser, query, user.Email, user.Password, user.Name)
 
 	if err != nil {
 		return nil, err
@@ -38,21 +40,21 @@ func (r *repository) Create(ctx context.Context, user *User) (*User, error) {
 func (r *repository) GetByID(ctx context.Context, id uuid.UUID) (*User, error) {
 	var user User
 	query := `SELECT * FROM users WHERE id = $1`
-	err := r.db.GetContext(ctx, &user, query, id)
+	err := r.conn(ctx).GetContext(ctx, &user, query, id)
 	return &user, err
 }
 
 func (r *repository) GetByEmail(ctx context.Context, email string) (*User, error) {
 	var user User
 	query := `SELECT * FROM users WHERE email = $1`
-	err := r.db.GetContext(ctx, &user, query, email)
+	err := r.conn(ctx).GetContext(ctx, &user, query, email)
 	return &user, err
 }
 
 func (r *repository) List(ctx context.Context) ([]User, error) {
 	var users []User
 	query := `SELECT * FROM users ORDER BY created_at DESC`
-	err := r.db.SelectContext(ctx, &users, query)
+	err := r.conn(ctx).SelectContext(ctx, &users, query)
 	return users, err
 }
 
@@ -63,12 +65,12 @@ func (r *repository) Update(ctx context.Context, user *User) error {
 		WHERE id = $4
 		RETURNING updated_at
 	`
-	return r.db.GetContext(ctx, user, query, user.Name, user.Email, user.Subscribed, user.ID)
+	return r.conn(ctx).GetContext(ctx, user, query, user.Name, user.Email, user.Subscribed, user.ID)
 }
 
 func (r *repository) Delete(ctx context.Context, id uuid.UUID) error {
 	query := `DELETE FROM users WHERE id = $1`
-	_, err := r.db.ExecContext(ctx, query, id)
+	_, err := r.conn(ctx).ExecContext(ctx, query, id)
 	return err
 }
 
@@ -78,13 +80,23 @@ func (r *repository) UpdateStripeCustomer(ctx context.Context, userID uuid.UUID,
 		SET stripe_customer_id = $1, updated_at = NOW()
 		WHERE id = $2
 	`
-	_, err := r.db.ExecContext(ctx, query, stripeCustomerID, userID)
+	_, err := r.conn(ctx).ExecContext(ctx, query, stripeCustomerID, userID)
+	return err
+}
+
+func (r *repository) UpdateSubscribed(ctx context.Context, userID uuid.UUID, subscribed bool) error {
+	query := `
+		UPDATE users
+		SET subscribed = $1, updated_at = NOW()
+		WHERE id = $2
+	`
+	_, err := r.conn(ctx).ExecContext(ctx, query, subscribed, userID)
 	return err
 }
 
 func (r *repository) GetByStripeCustomerID(ctx context.Context, stripeCustomerID string) (*User, error) {
 	var user User
 	query := `SELECT * FROM users WHERE stripe_customer_id = $1`
-	err := r.db.GetContext(ctx, &user, query, stripeCustomerID)
+	err := r.conn(ctx).GetContext(ctx, &user, query, stripeCustomerID)
 	return &user, err
 }
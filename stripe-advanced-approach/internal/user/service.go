@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/database"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/interfaces"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -18,10 +20,12 @@ type Repository interface {
 	Update(ctx context.Context, user *User) error
 	Delete(ctx context.Context, id uuid.UUID) error
 	UpdateStripeCustomer(ctx context.Context, userID uuid.UUID, stripeCustomerID string) error
+	UpdateSubscribed(ctx context.Context, userID uuid.UUID, subscribed bool) error
 }
 
 type service struct {
 	repo           Repository
+	unitOfWork     interfaces.UnitOfWork
 	paymentService UserPaymentService
 }
 
@@ -32,9 +36,10 @@ type UserPaymentService interface {
 	SyncStripeDataToStorage(ctx context.Context, customerId string) error
 }
 
-func NewService(repo Repository) *service {
+func NewService(repo Repository, unitOfWork interfaces.UnitOfWork) *service {
 	return &service{
-		repo: repo,
+		repo:       repo,
+		unitOfWork: unitOfWork,
 	}
 }
 
@@ -58,24 +63,26 @@ func (s *service) Create(ctx context.Context, user *User) error {
 
 	user.Password = string(hashedPassword)
 
-	createdUser, err := s.repo.Create(ctx, user)
+	// the user and its payment processor customer are created together, the customer is deleted again when the
+	// user can't be stored
+	return s.unitOfWork.WithinTx(ctx, func(ctx context.Context) error {
+		createdUser, err := s.repo.Create(ctx, user)
 
-	if err != nil {
-		fmt.Printf("could not create user, err:%s\n", err)
-		return err
-	}
+		if err != nil {
+			fmt.Printf("could not create user, err:%s\n", err)
+			return err
+		}
 
-	// create a payment processor user once user is created on platform
-	customerID, err := s.paymentService.CreateCustomer(ctx, createdUser.ID, user.Email)
+		// create a payment processor user once user is created on platform, which also syncs the cache once committed
+		_, err = s.paymentService.CreateCustomer(ctx, createdUser.ID, user.Email)
 
-	if err != nil {
-		fmt.Printf("could not create payment processor customer.\n")
-		return err
-	}
+		if err != nil {
+			fmt.Printf("could not create payment processor customer.\n")
+			return err
+		}
 
-	// sync to cache
-	go s.SyncCacheAndMappings(ctx, createdUser.ID, customerID)
-	return nil
+		return nil
+	})
 }
 
 func (s *service) GetByID(ctx context.Context, id uuid.UUID) (*User, error) {
@@ -181,12 +188,22 @@ func (s *service) UpdateStripeCustomer(ctx context.Context, userId uuid.UUID, cu
 		return err
 	}
 
-	// updates cache with customerId to userId mapping
-	go s.SyncCacheAndMappings(ctx, userId, customerId)
+	// updates cache with customerId to userId mapping, once the mapping is visible to the sync
+	database.AfterCommit(ctx, func(ctx context.Context) {
+		go s.SyncCacheAndMappings(ctx, userId, customerId)
+	})
 
 	return nil
 }
 
+func (s *service) UpdateSubscribed(ctx context.Context, userId uuid.UUID, subscribed bool) error {
+	if userId == uuid.Nil {
+		return errors.New("invalid user ID")
+	}
+
+	return s.repo.UpdateSubscribed(ctx, userId, subscribed)
+}
+
 func (s *service) GetStripeCustomer(ctx context.Context, userID uuid.UUID) (*string, error) {
 	if userID == uuid.Nil {
 		return nil, errors.New("invalid user ID")
@@ -0,0 +1,49 @@
+package user_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/testutil"
+	"github.com/darkphotonKN/stripe-advanced-approach/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// TestCreateRollbackDeletesCustomer checks a signup that isn't committed leaves no stripe customer behind
+func TestCreateRollbackDeletesCustomer(t *testing.T) {
+	suite := testutil.SetupFake(t)
+	defer suite.CleanupFunc()
+
+	failure := errors.New("storage unavailable")
+
+	err := suite.UnitOfWork.WithinTx(suite.Ctx, func(ctx context.Context) error {
+		err := suite.UserService.Create(ctx, &user.User{
+			Email:    suite.TestUser.Email,
+			Password: suite.TestUser.Password,
+			Name:     "Rolled Back User",
+		})
+		require.NoError(t, err)
+
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+
+	_, err = suite.UserService.GetByEmail(suite.Ctx, suite.TestUser.Email)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	created := suite.FakeProcessor.LatestEvent(stripe.EventTypeCustomerCreated)
+	require.NotNil(t, created)
+	deleted := suite.FakeProcessor.LatestEvent(stripe.EventTypeCustomerDeleted)
+	require.NotNil(t, deleted, "the customer of the rolled back user is deleted")
+
+	customerId := created.Data.Object["id"].(string)
+	assert.Equal(t, customerId, deleted.Data.Object["id"])
+
+	customer, err := suite.FakeProcessor.GetCustomer(suite.Ctx, customerId)
+	require.NoError(t, err)
+	assert.True(t, customer.Deleted)
+}
@@ -0,0 +1,6 @@
+ALTER TABLE webhook_events
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS failed_at,
+    DROP COLUMN IF EXISTS processed_at,
+    DROP COLUMN IF EXISTS last_error,
+    DROP COLUMN IF EXISTS attempts;
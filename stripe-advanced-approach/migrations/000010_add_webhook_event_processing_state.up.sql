@@ -0,0 +1,7 @@
+-- Track processing state of stored webhook events (idempotency + failure investigation)
+ALTER TABLE webhook_events
+    ADD COLUMN IF NOT EXISTS attempts INTEGER DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_error TEXT,
+    ADD COLUMN IF NOT EXISTS processed_at TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS failed_at TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT NOW();
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_webhook_events_stripe_customer_id;
+ALTER TABLE webhook_events DROP COLUMN IF EXISTS stripe_customer_id;
@@ -0,0 +1,8 @@
+-- Customer of a stored webhook event, for filtering replays
+ALTER TABLE webhook_events ADD COLUMN IF NOT EXISTS stripe_customer_id VARCHAR(255);
+
+UPDATE webhook_events
+SET stripe_customer_id = payload->'data'->'object'->>'customer'
+WHERE stripe_customer_id IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_webhook_events_stripe_customer_id ON webhook_events(stripe_customer_id);
@@ -0,0 +1,2 @@
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS last_event_at;
+ALTER TABLE payments DROP COLUMN IF EXISTS last_event_at;
@@ -0,0 +1,3 @@
+-- Time of the stripe state a mirrored row reflects, older state (delayed webhooks, stale syncs) is not applied
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS last_event_at TIMESTAMP;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS last_event_at TIMESTAMP;
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS subscription_items;
+
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS discount_ids;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS latest_invoice_id;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS trial_end;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS trial_start;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS ended_at;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS canceled_at;
@@ -0,0 +1,26 @@
+-- Remaining subscription state mirrored from stripe
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS canceled_at TIMESTAMP;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS ended_at TIMESTAMP;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS trial_start TIMESTAMP;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS trial_end TIMESTAMP;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS latest_invoice_id VARCHAR(255);
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS discount_ids TEXT[] NOT NULL DEFAULT '{}';
+
+-- Subscription items, one per price the subscription bills
+CREATE TABLE IF NOT EXISTS subscription_items (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    stripe_subscription_item_id VARCHAR(255) UNIQUE NOT NULL,
+    stripe_subscription_id VARCHAR(255) NOT NULL REFERENCES subscriptions(stripe_subscription_id) ON DELETE CASCADE,
+    stripe_price_id VARCHAR(255) NOT NULL,
+    stripe_product_id VARCHAR(255) NOT NULL,
+    quantity BIGINT NOT NULL DEFAULT 1,
+    unit_amount BIGINT NOT NULL DEFAULT 0,
+    currency VARCHAR(3) NOT NULL DEFAULT '',
+    recurring_interval VARCHAR(10) NOT NULL DEFAULT '',
+    current_period_start TIMESTAMP,
+    current_period_end TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscription_items_stripe_subscription_id ON subscription_items(stripe_subscription_id);
@@ -0,0 +1,10 @@
+-- Progress of the incremental stripe sync per customer
+CREATE TABLE IF NOT EXISTS customer_sync_state (
+    stripe_customer_id VARCHAR(255) PRIMARY KEY,
+    payments_created_gte BIGINT NOT NULL DEFAULT 0, -- high-water mark, payment intents created before it are synced
+    pass_created_gte BIGINT,                        -- set while a paginated pass is unfinished
+    pass_cursor VARCHAR(255),
+    pass_newest_created BIGINT NOT NULL DEFAULT 0,
+    last_full_sync_at TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT NOW()
+);
@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS payments_notify_customer_changed ON payments;
+DROP TRIGGER IF EXISTS subscriptions_notify_customer_changed ON subscriptions;
+DROP TRIGGER IF EXISTS users_notify_customer_changed ON users;
+DROP FUNCTION IF EXISTS notify_customer_changed();
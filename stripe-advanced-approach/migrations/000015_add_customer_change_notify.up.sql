@@ -0,0 +1,44 @@
+-- Announces rows changed outside the application (e.g. fixed by hand in SQL) on the customer_changed channel, with
+-- the stripe customer id as payload, so the API drops its cached copies. The application keeps the cache current
+-- for its own writes, its connections are recognized by their application_name (config.DatabaseApplicationName).
+CREATE OR REPLACE FUNCTION notify_customer_changed() RETURNS trigger AS $$
+DECLARE
+    old_customer TEXT;
+    new_customer TEXT;
+BEGIN
+    IF current_setting('application_name', true) = 'stripe-advanced-approach' THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP <> 'INSERT' THEN
+        old_customer := OLD.stripe_customer_id;
+    END IF;
+
+    IF TG_OP <> 'DELETE' THEN
+        new_customer := NEW.stripe_customer_id;
+    END IF;
+
+    -- notifications with the same payload are sent once per transaction
+    IF old_customer IS NOT NULL THEN
+        PERFORM pg_notify('customer_changed', old_customer);
+    END IF;
+
+    IF new_customer IS NOT NULL AND new_customer IS DISTINCT FROM old_customer THEN
+        PERFORM pg_notify('customer_changed', new_customer);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_notify_customer_changed
+    AFTER INSERT OR UPDATE OR DELETE ON users
+    FOR EACH ROW EXECUTE FUNCTION notify_customer_changed();
+
+CREATE TRIGGER subscriptions_notify_customer_changed
+    AFTER INSERT OR UPDATE OR DELETE ON subscriptions
+    FOR EACH ROW EXECUTE FUNCTION notify_customer_changed();
+
+CREATE TRIGGER payments_notify_customer_changed
+    AFTER INSERT OR UPDATE OR DELETE ON payments
+    FOR EACH ROW EXECUTE FUNCTION notify_customer_changed();
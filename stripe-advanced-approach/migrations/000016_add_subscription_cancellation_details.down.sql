@@ -0,0 +1,3 @@
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS cancellation_comment;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS cancellation_feedback;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS cancellation_reason;
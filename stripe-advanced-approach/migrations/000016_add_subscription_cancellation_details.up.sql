@@ -0,0 +1,4 @@
+-- Why a subscription was canceled, mirrored from the stripe subscription's cancellation_details
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS cancellation_reason VARCHAR(50);
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS cancellation_feedback VARCHAR(50);
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS cancellation_comment TEXT;
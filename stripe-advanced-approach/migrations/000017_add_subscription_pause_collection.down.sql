@@ -0,0 +1,2 @@
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS pause_resumes_at;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS pause_behavior;
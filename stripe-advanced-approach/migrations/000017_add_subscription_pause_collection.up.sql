@@ -0,0 +1,3 @@
+-- Paused collection of a subscription, mirrored from the stripe subscription's pause_collection
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS pause_behavior VARCHAR(50);
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS pause_resumes_at TIMESTAMP;
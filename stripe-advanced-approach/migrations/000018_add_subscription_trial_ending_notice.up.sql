@@ -0,0 +1,3 @@
+-- When stripe announced the end of a subscription's trial (customer.subscription.trial_will_end) without a payment
+-- method to charge after it, NULL otherwise
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS trial_ending_notice_at TIMESTAMP;